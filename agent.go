@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/yhat/workload-simulator/app"
+)
+
+// agent runs workers for a coordinating simulator until interrupted.
+func agent(args []string) {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	coordinator := fs.String("coordinator", "http://localhost:8080", "url of the simulator to register with")
+	addr := fs.String("addr", ":8081", "address to listen on")
+	url := fs.String("url", "", "url the coordinator reaches the agent at, http://<hostname><addr> if empty")
+	name := fs.String("name", "", "name of the agent, its url if empty")
+	maxWorkers := fs.Int("max-workers", 0, "most workers to run, unlimited if zero")
+	token := fs.String("token", os.Getenv("AGENT_TOKEN"), "agent_token of the coordinator, $AGENT_TOKEN if unset")
+	fs.Parse(args)
+
+	if *url == "" {
+		host, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if host == "" {
+			if host, err = os.Hostname(); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		}
+		*url = "http://" + net.JoinHostPort(host, port)
+	}
+
+	a, err := app.NewAgent(app.AgentConfig{
+		Coordinator: *coordinator,
+		URL:         *url,
+		Name:        *name,
+		MaxWorkers:  *maxWorkers,
+		Token:       *token,
+	})
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	go func() {
+		log.Printf("agent serving on %s\n", *addr)
+		if err := http.Serve(l, a); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}()
+	if err := a.Start(); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	if err := a.Close(); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,288 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	// poolIdle is how long a pool worker waits for a request before it
+	// exits, shrinking the pool.
+	poolIdle = time.Second
+
+	// ceilingLate is the share of a model's requests that have to be sent
+	// late, every worker being busy, for its ceiling to count as what
+	// limited the model's rate.
+	ceilingLate = 0.01
+)
+
+// pool sends one model's requests of an adaptive run. A dispatcher
+// schedules the model's arrivals and hands each to an idle worker, starting
+// a new one while the pool is below its ceiling. Workers that go idle for
+// poolIdle exit, so the pool holds about as many workers as the target's
+// latency needs to sustain the rate.
+type pool struct {
+	// w is the model's workload, which the pool's Stats are sent as and its
+	// workers copy.
+	w *Workload
+
+	max      int
+	schedule *arrivals
+	clock    Clock
+	stats    chan *Stat
+	killc    chan int
+
+	// seeds seeds the workers' random sources.
+	seeds *rand.Rand
+
+	// tickets hand arrivals to idle workers, which send results back.
+	tickets chan struct{}
+	results chan poolResult
+
+	// quit is closed when the dispatcher exits, stopping the workers.
+	quit chan struct{}
+}
+
+// poolResult is a worker's request, or its exit if exited is set.
+type poolResult struct {
+	exited bool
+	took   time.Duration
+	steps  []stepResult
+	err    error
+}
+
+// spawnPools starts a pool for each model of p's adaptive run, which sends
+// their Stats to stats and stops them when killc is closed. Like
+// spawnWorkers, all randomness is drawn from the run's seed.
+func spawnPools(p *plan, batchId string, clock Clock, stats chan *Stat, killc chan int, scale *rateScale, statsd *statsdClient, budgets *runBudgets) []<-chan struct{} {
+	spec := p.spec
+	rnd := rand.New(rand.NewSource(p.seed))
+	done := make([]<-chan struct{}, 0, len(spec.Models))
+	for idx, model := range spec.Models {
+		seeds := rand.New(rand.NewSource(rnd.Int63()))
+		w := &Workload{
+			dt:         500 * time.Millisecond,
+			batchId:    batchId,
+			workerId:   idx,
+			seed:       p.seed,
+			opsHost:    spec.Target.Host,
+			apiKey:     spec.Target.APIKey,
+			user:       spec.Target.User,
+			nrequests:  model.Requests,
+			modelId:    spec.ModelID(idx),
+			modelName:  model.Model,
+			modelInput: model.Input,
+			payloads:   model.Payloads,
+			steps:      newScenario(model),
+			clock:      clock,
+			statsd:     statsd,
+			budgets:    budgets.model(idx),
+		}
+		if w.nrequests == 0 {
+			// Unlimited, the stages end the run.
+			w.nrequests = math.MaxInt32
+		}
+		w.generated = hasPlaceholders(w.modelInput)
+		for _, p := range w.payloads {
+			w.generated = w.generated || hasPlaceholders(p)
+		}
+		schedule, err := newArrivals(spec.Run.Arrival, model.Rate, rand.New(rand.NewSource(seeds.Int63())), scale)
+		if err == nil && schedule == nil {
+			err = fmt.Errorf("no rate to sustain")
+		}
+		if err != nil {
+			log.Printf("model %s: %v, not sending requests", w.modelId, err)
+			continue
+		}
+		pl := &pool{
+			w:        w,
+			max:      spec.Run.Workers,
+			schedule: schedule,
+			clock:    clock,
+			stats:    stats,
+			killc:    killc,
+			seeds:    seeds,
+			tickets:  make(chan struct{}),
+			results:  make(chan poolResult, spec.Run.Workers),
+			quit:     make(chan struct{}),
+		}
+		d := make(chan struct{})
+		go func() {
+			defer close(d)
+			pl.dispatch()
+		}()
+		done = append(done, d)
+	}
+	return done
+}
+
+// dispatch sends the model's requests at its rate until they are all done
+// or the pool is killed, and reports them every dt.
+func (pl *pool) dispatch() {
+	defer close(pl.quit)
+	w := pl.w
+	sent, done, failed, late := 0, 0, 0, 0
+	latency := newHistogram()
+	steps := newStepCounts(len(w.steps))
+	size, busy, peak := 0, 0, 0
+	// taken is set once the due arrival's request is taken from the
+	// budgets, and behind while it waits for a worker.
+	taken, behind := false, false
+	last := pl.clock.Now()
+	next := last
+	ticker := pl.clock.NewTicker(w.dt)
+	defer ticker.Stop()
+
+	flush := func(final bool) {
+		now := pl.clock.Now()
+		pl.stats <- &Stat{
+			workload:   w,
+			nreqSent:   sent,
+			nreqDone:   done,
+			nreqFailed: failed,
+			latency:    latency,
+			steps:      steps,
+			dt:         now.Sub(last),
+			at:         now,
+			final:      final,
+			workers:    peak,
+			late:       late,
+		}
+		sent, done, failed, late = 0, 0, 0, 0
+		latency = newHistogram()
+		steps = newStepCounts(len(w.steps))
+		peak = size
+		last = now
+	}
+
+	// receive counts a worker's result or exit.
+	receive := func(r poolResult) {
+		if r.exited {
+			size--
+			return
+		}
+		recordSteps(steps, r.steps)
+		switch {
+		case r.err != nil:
+			log.Printf("Prediction error: %v\n", r.err)
+			failed++
+		default:
+			// Only successful requests count towards latency, as with
+			// fixed workers.
+			latency.record(r.took)
+			done++
+		}
+		busy--
+	}
+
+	n := 0
+	// dispatched counts the due arrival as sent and schedules the next.
+	dispatched := func() {
+		n, sent, busy = n+1, sent+1, busy+1
+		taken, behind = false, false
+		next = next.Add(pl.schedule.gap())
+	}
+
+	for n < w.nrequests || busy > 0 {
+		var wait <-chan time.Time
+		if n < w.nrequests {
+			if d := next.Sub(pl.clock.Now()); d > 0 {
+				wait = pl.clock.After(d)
+			} else {
+				if !taken {
+					if !takeAll(w.budgets) {
+						log.Printf("model %s: request budget spent after %d requests", w.modelId, n)
+						n = w.nrequests
+						continue
+					}
+					taken = true
+				}
+				if busy < size {
+					// An idle worker is waiting for a ticket.
+					select {
+					case pl.tickets <- struct{}{}:
+						dispatched()
+					case r := <-pl.results:
+						receive(r)
+					}
+					continue
+				}
+				if size < pl.max {
+					size++
+					if size > peak {
+						peak = size
+					}
+					go pl.work(pl.seeds.Int63())
+					dispatched()
+					continue
+				}
+				if !behind {
+					// Every worker is busy and the pool can't grow, so the
+					// arrival waits for one to finish.
+					behind = true
+					late++
+				}
+			}
+		}
+		select {
+		case <-ticker.C():
+			flush(false)
+		case <-pl.killc:
+			// Requests in flight still count, so that every request
+			// sent is done or failed.
+			for busy > 0 {
+				receive(<-pl.results)
+			}
+			flush(true)
+			log.Printf("model %s: SIGKILL good-bye!!!", w.modelId)
+			return
+		case r := <-pl.results:
+			receive(r)
+		case <-wait:
+		}
+	}
+	flush(true)
+	log.Printf("model %s: Done making %d requests with at most %d workers", w.modelId, w.nrequests, pl.max)
+}
+
+// work is a pool worker. It is started with a request to send, and sends
+// the next each time it is handed a ticket until it is idle for poolIdle.
+func (pl *pool) work(seed int64) {
+	w := *pl.w
+	w.rnd = rand.New(rand.NewSource(seed))
+	for {
+		start := pl.clock.Now()
+		status, results, err := w.send()
+		took := pl.clock.Now().Sub(start)
+		if w.statsd != nil {
+			code := ""
+			if err != nil {
+				code = "network"
+				if status != 0 {
+					code = strconv.Itoa(status)
+				}
+			}
+			w.statsd.request(&w, took, code)
+		}
+		select {
+		case pl.results <- poolResult{took: took, steps: results, err: err}:
+		case <-pl.quit:
+			return
+		}
+		select {
+		case <-pl.tickets:
+		case <-pl.clock.After(poolIdle):
+			select {
+			case pl.results <- poolResult{exited: true}:
+			case <-pl.quit:
+			}
+			return
+		case <-pl.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+func adaptiveSpec(host string, workers, requests int) string {
+	return `
+version: 1
+target: {host: "` + host + `", user: demo}
+run: {workers: ` + strconv.Itoa(workers) + `, adaptive: true, seed: 1}
+models:
+    - {model: m1, requests: ` + strconv.Itoa(requests) + `, rate: 50}
+`
+}
+
+func TestAdaptiveRun(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: 100 * time.Millisecond}},
+	})
+	app := newTestApp(t)
+
+	r := runSpec(t, app, adaptiveSpec(ts.URL, 20, 100))
+	m := r.summary.Models[0]
+	if m.Sent != 100 || m.Done != 100 {
+		t.Fatalf("expected 100 requests done, got %+v", m)
+	}
+	// 50 requests a second taking 100ms each keep about 5 in flight.
+	if m.Workers < 4 || m.Workers > 10 {
+		t.Errorf("expected the pool to grow to about 5 workers, got %d", m.Workers)
+	}
+	if m.CeilingLimited {
+		t.Errorf("expected the ceiling not to limit the rate, %d sent late", m.Late)
+	}
+	if m.Rate < 40 {
+		t.Errorf("expected about 50 requests a second, got %.1f", m.Rate)
+	}
+}
+
+func TestAdaptiveRunCeiling(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: 100 * time.Millisecond}},
+	})
+	app := newTestApp(t)
+
+	r := runSpec(t, app, adaptiveSpec(ts.URL, 2, 30))
+	m := r.summary.Models[0]
+	if m.Done != 30 || m.Workers != 2 {
+		t.Fatalf("expected 30 requests done by 2 workers, got %+v", m)
+	}
+	if !m.CeilingLimited || m.Late == 0 {
+		t.Errorf("expected the ceiling to limit the rate, got %+v", m)
+	}
+	if m.Rate > 25 {
+		t.Errorf("expected 2 workers to manage no more than 20 requests a second, got %.1f", m.Rate)
+	}
+
+	b, err := ioutil.ReadFile(reportPath(app.config.ReportDir, r.batchId))
+	if err != nil {
+		t.Fatalf("expected a report file: %v", err)
+	}
+	if !strings.Contains(string(b), "Worker pools") || !strings.Contains(string(b), "limited the rate") {
+		t.Error("expected the report to show the ceiling limited the rate")
+	}
+}
+
+func TestAdaptiveRunKilledCountsRequestsInFlight(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: 100 * time.Millisecond}},
+	})
+	app := newTestApp(t)
+	if w := do(app, "POST", "/workload", url.Values{"spec": {adaptiveSpec(ts.URL, 20, 100000)}}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	// 50 requests a second taking 100ms each keep several in flight.
+	waitFor(t, func() bool { return m.Stats()["m1"].Received >= 5 })
+	do(app, "POST", "/kill", nil)
+	waitRecorded(t, r)
+
+	s := r.summary.Models[0]
+	if s.Sent == 0 || s.Sent != s.Done+s.Failed {
+		t.Errorf("expected every request sent to be done or failed, got %+v", s)
+	}
+	if received := m.Stats()["m1"].Received; received != s.Sent {
+		t.Errorf("expected the %d requests sent to arrive, got %d", s.Sent, received)
+	}
+}
+
+func TestAdaptiveRunRejectsAgents(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	app.agents.register(agentRegistration{Name: "a1", URL: "http://agent"})
+
+	w := do(app, "POST", "/workload", url.Values{"spec": {adaptiveSpec(ts.URL, 2, 30)}})
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), errAdaptiveAgents.Error()) {
+		t.Errorf("expected the run to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,535 @@
+package app
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Timing of agents and their coordinator.
+const (
+	// agentHeartbeat is how often agents register again with their
+	// coordinator.
+	agentHeartbeat = 5 * time.Second
+
+	// agentExpiry is how long the coordinator keeps an agent it hasn't
+	// heard from.
+	agentExpiry = 3 * agentHeartbeat
+
+	// agentFlushInterval is how often agents send the Stats of a run.
+	agentFlushInterval = 250 * time.Millisecond
+
+	// agentTimeout is how long the coordinator waits for the Stats of an
+	// agent running a share of a run before giving up on it.
+	agentTimeout = 15 * time.Second
+
+	// agentStartDelay leaves the agents of a run time to be told when to
+	// start it, so they all start it at that instant.
+	agentStartDelay = time.Second
+
+	// agentStatsLag is how long the coordinator holds the intervals of a
+	// run for its agents' Stats, which are sent in batches.
+	agentStatsLag = time.Second
+
+	// agentClockSamples is how many times agents read the coordinator's
+	// clock when registering. The reading with the quickest round trip
+	// gives the offset between their clocks.
+	agentClockSamples = 5
+)
+
+// AgentConfig configures an agent generating load for a coordinator.
+type AgentConfig struct {
+	// Coordinator is the URL of the simulator the agent registers with.
+	Coordinator string
+
+	// URL the coordinator reaches the agent at.
+	URL string
+
+	// Name of the agent, its URL if empty.
+	Name string
+
+	// MaxWorkers is the most workers the agent runs, unlimited if zero.
+	MaxWorkers int
+
+	// Token is the secret shared with the coordinator, its agent_token.
+	Token string
+}
+
+// agentRegistration is what an agent registers with its coordinator.
+// ClockOffset is the coordinator's clock less the agent's, measured with
+// a round trip of RTT.
+type agentRegistration struct {
+	Name        string        `json:"name"`
+	URL         string        `json:"url"`
+	MaxWorkers  int           `json:"max_workers"`
+	ClockOffset time.Duration `json:"clock_offset"`
+	RTT         time.Duration `json:"rtt"`
+}
+
+// agentStart tells an agent to prepare to run workers FirstWorker to
+// FirstWorker+Workers-1 of a run. ClockOffset is the offset of the
+// agent's clock the coordinator goes by.
+type agentStart struct {
+	BatchId     string         `json:"batch_id"`
+	Name        string         `json:"name"`
+	Spec        *workload.Spec `json:"spec"`
+	Seed        int64          `json:"seed,string"`
+	FirstWorker int            `json:"first_worker"`
+	Workers     int            `json:"workers"`
+	ClockOffset time.Duration  `json:"clock_offset"`
+}
+
+// agentGo tells the agents prepared for a run to start it at StartAt on
+// the coordinator's clock. It is only sent once every agent is prepared,
+// so none starts before the others.
+type agentGo struct {
+	BatchId string    `json:"batch_id"`
+	StartAt time.Time `json:"start_at"`
+}
+
+// agentStats are Stats of a run an agent sends its coordinator. Done is
+// set on the last batch, once every worker of the agent has exited.
+type agentStats struct {
+	Agent   string     `json:"agent"`
+	BatchId string     `json:"batch_id"`
+	Stats   []wireStat `json:"stats"`
+	Done    bool       `json:"done"`
+}
+
+// wireStat is a Stat sent by an agent, stamped with the agent's clock.
+type wireStat struct {
+	WorkerId int           `json:"worker_id"`
+	ModelId  string        `json:"model_id"`
+	Sent     int           `json:"sent"`
+	Done     int           `json:"done"`
+	Failed   int           `json:"failed"`
+	Latency  *histogram    `json:"latency"`
+	Steps    []*stepCounts `json:"steps,omitempty"`
+	Joined   int           `json:"joined,omitempty"`
+	Left     int           `json:"left,omitempty"`
+	Dt       time.Duration `json:"dt"`
+	Time     time.Time     `json:"time"`
+	Final    bool          `json:"final"`
+}
+
+// Agent runs shares of runs split across agents by a coordinator. It
+// registers with the coordinator and sends it its workers' Stats.
+type Agent struct {
+	cfg    AgentConfig
+	clock  Clock
+	router *http.ServeMux
+
+	mu sync.Mutex
+	// killc stops the workers of the running share, nil when idle.
+	killc   chan int
+	batchId string
+	// goc receives the start of the prepared share, nil once started.
+	goc chan time.Time
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// NewAgent returns an agent for cfg. It serves the coordinator's requests
+// and registers once started.
+func NewAgent(cfg AgentConfig) (*Agent, error) {
+	if cfg.Coordinator == "" {
+		return nil, fmt.Errorf("agent: coordinator url is required")
+	}
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("agent: agent url is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("agent: token is required")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.URL
+	}
+	cfg.Coordinator = strings.TrimRight(cfg.Coordinator, "/")
+	a := &Agent{
+		cfg:    cfg,
+		clock:  WallClock,
+		router: http.NewServeMux(),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	a.router.HandleFunc("/agent/start", a.handleStart)
+	a.router.HandleFunc("/agent/go", a.handleGo)
+	a.router.HandleFunc("/agent/stop", a.handleStop)
+	return a, nil
+}
+
+func (a *Agent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.router.ServeHTTP(w, r)
+}
+
+// Start registers with the coordinator, and keeps registering again
+// every agentHeartbeat until the agent is closed.
+func (a *Agent) Start() error {
+	if err := a.register(); err != nil {
+		return err
+	}
+	ticker := a.clock.NewTicker(agentHeartbeat)
+	go func() {
+		defer close(a.done)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				if err := a.register(); err != nil {
+					log.Println(err)
+				}
+			case <-a.quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops the running share, if any, and leaves the coordinator.
+func (a *Agent) Close() error {
+	close(a.quit)
+	<-a.done
+	a.mu.Lock()
+	if a.killc != nil {
+		close(a.killc)
+		a.killc, a.goc = nil, nil
+	}
+	a.mu.Unlock()
+	req, err := http.NewRequest("DELETE", a.cfg.Coordinator+"/agents/"+a.cfg.Name, nil)
+	if err != nil {
+		return err
+	}
+	setAgentToken(req, a.cfg.Token)
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("agent: leaving coordinator: %v", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+var agentClient = &http.Client{Timeout: 5 * time.Second}
+
+func (a *Agent) register() error {
+	offset, rtt, err := a.clockOffset()
+	if err != nil {
+		return fmt.Errorf("agent: reading the clock of %s: %v", a.cfg.Coordinator, err)
+	}
+	reg := agentRegistration{
+		Name:        a.cfg.Name,
+		URL:         a.cfg.URL,
+		MaxWorkers:  a.cfg.MaxWorkers,
+		ClockOffset: offset,
+		RTT:         rtt,
+	}
+	if err := postJSON(a.cfg.Coordinator+"/agents", a.cfg.Token, reg); err != nil {
+		return fmt.Errorf("agent: registering with %s: %v", a.cfg.Coordinator, err)
+	}
+	return nil
+}
+
+// clockOffset measures the coordinator's clock less the agent's. The
+// coordinator read its clock halfway through the quickest of a few round
+// trips, give or take half of it.
+func (a *Agent) clockOffset() (offset, rtt time.Duration, err error) {
+	rtt = -1
+	for i := 0; i < agentClockSamples; i++ {
+		sent := a.clock.Now()
+		resp, err := agentClient.Get(a.cfg.Coordinator + "/agents/clock")
+		if err != nil {
+			return 0, 0, err
+		}
+		var c struct{ Time time.Time }
+		err = json.NewDecoder(resp.Body).Decode(&c)
+		resp.Body.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+		received := a.clock.Now()
+		if d := received.Sub(sent); rtt < 0 || d < rtt {
+			rtt = d
+			offset = c.Time.Sub(sent.Add(d / 2))
+		}
+	}
+	return offset, rtt, nil
+}
+
+// postJSON posts v with token and fails unless the answer is a 2xx.
+func postJSON(url, token string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setAgentToken(req, token)
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{code: resp.StatusCode, msg: strings.TrimSpace(string(msg))}
+	}
+	return nil
+}
+
+// setAgentToken authenticates req between an agent and its coordinator.
+func setAgentToken(req *http.Request, token string) {
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// hasAgentToken reports whether r carries token. An empty token matches
+// nothing.
+func hasAgentToken(r *http.Request, token string) bool {
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// statusError is a request answered with an error status.
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.msg)
+}
+
+// handleStart prepares the share of a run in the request, to be started
+// by handleGo.
+func (a *Agent) handleStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	if !hasAgentToken(r, a.cfg.Token) {
+		http.Error(w, "invalid agent token", http.StatusUnauthorized)
+		return
+	}
+	var s agentStart
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil || s.Spec == nil {
+		http.Error(w, fmt.Sprintf("could not parse start: %v", err), http.StatusBadRequest)
+		return
+	}
+	if problems := s.Spec.Validate(); problems != nil {
+		http.Error(w, problems.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Workers <= 0 || s.FirstWorker < 0 {
+		http.Error(w, fmt.Sprintf("invalid workers %d from %d", s.Workers, s.FirstWorker), http.StatusBadRequest)
+		return
+	}
+	if max := a.cfg.MaxWorkers; max > 0 && s.Workers > max {
+		http.Error(w, fmt.Sprintf("can't run more than %d workers, got %d", max, s.Workers), http.StatusBadRequest)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.killc != nil {
+		http.Error(w, errRunning.Error(), http.StatusConflict)
+		return
+	}
+	a.killc = make(chan int)
+	a.batchId = s.BatchId
+	a.goc = make(chan time.Time, 1)
+	go a.run(s, a.killc, a.goc)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleGo starts the prepared share of a run at the time in the request.
+func (a *Agent) handleGo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	if !hasAgentToken(r, a.cfg.Token) {
+		http.Error(w, "invalid agent token", http.StatusUnauthorized)
+		return
+	}
+	var g agentGo
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse go: %v", err), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.goc == nil || a.batchId != g.BatchId {
+		http.Error(w, "run "+g.BatchId+" is not prepared here", http.StatusGone)
+		return
+	}
+	a.goc <- g.StartAt
+	a.goc = nil
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleStop stops the share of the run in the batch_id form value.
+func (a *Agent) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	if !hasAgentToken(r, a.cfg.Token) {
+		http.Error(w, "invalid agent token", http.StatusUnauthorized)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.killc != nil && a.batchId == r.FormValue("batch_id") {
+		close(a.killc)
+		a.killc, a.goc = nil, nil
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// run waits for the start of the share s, runs its workers and sends
+// their Stats to the coordinator until they have all exited.
+func (a *Agent) run(s agentStart, killc chan int, goc chan time.Time) {
+	defer func() {
+		a.mu.Lock()
+		if a.killc == killc {
+			a.killc, a.goc = nil, nil
+		}
+		a.mu.Unlock()
+	}()
+
+	stats := make(chan *Stat)
+	var done []<-chan struct{}
+	if a.await(s, killc, goc) {
+		log.Printf("agent %s: starting workers %d to %d of run %s", a.cfg.Name, s.FirstWorker, s.FirstWorker+s.Workers-1, s.BatchId)
+		p := &plan{spec: s.Spec, seed: s.Seed, name: s.Name}
+		scale := newRateScale(1)
+		done = spawnWorkers(p, s.BatchId, s.FirstWorker, s.Workers, a.clock, stats, killc, scale, nil, nil)
+		if len(s.Spec.Stages) > 0 {
+			go func() {
+				if stepStages(a.clock, killc, scale, s.Spec.Stages) {
+					a.stop(killc)
+				}
+			}()
+		}
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		for _, d := range done {
+			<-d
+		}
+		close(finished)
+	}()
+	ticker := a.clock.NewTicker(agentFlushInterval)
+	defer ticker.Stop()
+	var batch []wireStat
+	for {
+		select {
+		case st := <-stats:
+			batch = append(batch, wireStat{
+				WorkerId: st.workload.workerId,
+				ModelId:  st.workload.modelId,
+				Sent:     st.nreqSent,
+				Done:     st.nreqDone,
+				Failed:   st.nreqFailed,
+				Latency:  st.latency,
+				Steps:    st.steps,
+				Joined:   st.joined,
+				Left:     st.left,
+				Dt:       st.dt,
+				Time:     st.at,
+				Final:    st.final,
+			})
+		case <-ticker.C():
+			// Unsent Stats are kept for the next try. Empty batches
+			// tell the coordinator the agent is still there.
+			if err := a.send(s.BatchId, batch, false); err == nil || isGone(err) {
+				batch = nil
+			} else {
+				log.Printf("agent %s: sending stats of run %s: %v", a.cfg.Name, s.BatchId, err)
+			}
+		case <-finished:
+			a.sendLast(s.BatchId, batch, ticker)
+			return
+		}
+	}
+}
+
+// await waits for the start of the share s. It returns false if the share
+// is stopped first, or never started.
+func (a *Agent) await(s agentStart, killc chan int, goc chan time.Time) bool {
+	select {
+	case startAt := <-goc:
+		// The start is on the coordinator's clock.
+		wait := startAt.Add(-s.ClockOffset).Sub(a.clock.Now())
+		if wait < 0 {
+			log.Printf("agent %s: starting run %s %v late", a.cfg.Name, s.BatchId, -wait)
+		}
+		select {
+		case <-a.clock.After(wait):
+			return true
+		case <-killc:
+			return false
+		}
+	case <-killc:
+		return false
+	case <-a.clock.After(agentTimeout):
+		log.Printf("agent %s: run %s was never started", a.cfg.Name, s.BatchId)
+		return false
+	}
+}
+
+// sendLast sends the last Stats of a share, trying again on every tick
+// until the coordinator would have given up on the agent.
+func (a *Agent) sendLast(batchId string, batch []wireStat, ticker Ticker) {
+	deadline := a.clock.Now().Add(agentTimeout)
+	for {
+		err := a.send(batchId, batch, true)
+		if err == nil || isGone(err) {
+			return
+		}
+		log.Printf("agent %s: sending the last stats of run %s: %v", a.cfg.Name, batchId, err)
+		if a.clock.Now().After(deadline) {
+			log.Printf("agent %s: giving up on sending the last stats of run %s", a.cfg.Name, batchId)
+			return
+		}
+		<-ticker.C()
+	}
+}
+
+func (a *Agent) send(batchId string, batch []wireStat, done bool) error {
+	if batch == nil {
+		batch = []wireStat{}
+	}
+	return postJSON(a.cfg.Coordinator+"/agents/stats", a.cfg.Token, agentStats{Agent: a.cfg.Name, BatchId: batchId, Stats: batch, Done: done})
+}
+
+// isGone reports whether the coordinator no longer takes the run's Stats,
+// because the run ended or gave up on the agent.
+func isGone(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && se.code == http.StatusGone
+}
+
+// stop stops the share with killc if it is still running.
+func (a *Agent) stop(killc chan int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.killc == killc {
+		close(a.killc)
+		a.killc, a.goc = nil, nil
+	}
+}
@@ -0,0 +1,377 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+// skewedClock is the wall clock off by offset.
+type skewedClock struct {
+	Clock
+	offset time.Duration
+}
+
+func (c skewedClock) Now() time.Time { return c.Clock.Now().Add(c.offset) }
+
+// testAgentToken is the token test coordinators share with their agents.
+const testAgentToken = "s3cret"
+
+// newTestCoordinator returns an app taking agents with testAgentToken,
+// and a server for them to reach it at.
+func newTestCoordinator(t *testing.T) (*App, *httptest.Server) {
+	app := newTestApp(t)
+	app.config.AgentToken = testAgentToken
+	coordinator := httptest.NewServer(app)
+	t.Cleanup(coordinator.Close)
+	return app, coordinator
+}
+
+// agentRequest is a request to an agent or coordinator with token.
+func agentRequest(method, path, body, token string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	setAgentToken(r, token)
+	return r
+}
+
+// newTestAgent serves an agent of coordinator on clock and starts it.
+func newTestAgent(t *testing.T, coordinator, name string, maxWorkers int, clock Clock) *Agent {
+	var a *Agent
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	a, err := NewAgent(AgentConfig{Coordinator: coordinator, URL: srv.URL, Name: name, MaxWorkers: maxWorkers, Token: testAgentToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.clock = clock
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestHistogramJSON(t *testing.T) {
+	h := newHistogram()
+	for _, d := range []time.Duration{3 * time.Millisecond, 40 * time.Millisecond, 2 * time.Second} {
+		h.record(d)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := newHistogram()
+	if err := json.Unmarshal(b, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.count() != 3 || got.mean() != h.mean() || got.quantile(0.5) != h.quantile(0.5) || got.max != h.max {
+		t.Errorf("expected %+v, got %+v", h, got)
+	}
+}
+
+func TestSplitWorkers(t *testing.T) {
+	agents := []agentInfo{{Name: "a"}, {Name: "b", MaxWorkers: 1}, {Name: "c"}}
+	shares, err := splitWorkers(6, agents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range shares {
+		got = append(got, fmt.Sprintf("%s:%d+%d", s.agent.Name, s.first, s.workers))
+	}
+	if expected := "a:0+3 b:3+1 c:4+2"; strings.Join(got, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(got, " "))
+	}
+	if shares, _ := splitWorkers(1, agents); len(shares) != 1 {
+		t.Errorf("expected agents without workers to be left out, got %+v", shares)
+	}
+	if _, err := splitWorkers(6, []agentInfo{{Name: "a", MaxWorkers: 2}, {Name: "b", MaxWorkers: 2}}); err == nil {
+		t.Error("expected an error for too few workers")
+	}
+}
+
+func TestDistributedRun(t *testing.T) {
+	_, ops := newMockOps(t, &mockops.Config{})
+	app, coordinator := newTestCoordinator(t)
+
+	for _, name := range []string{"a", "b", "c"} {
+		a := newTestAgent(t, coordinator.URL, name, 0, WallClock)
+		defer a.Close()
+	}
+	w := do(app, "GET", "/agents", nil)
+	var listed struct{ Agents []agentInfo }
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Agents) != 3 {
+		t.Fatalf("expected 3 agents, got %s", w.Body.String())
+	}
+
+	r := runSpec(t, app, `
+version: 1
+target: {host: "`+ops.URL+`", user: demo, apikey: key}
+run: {workers: 6}
+models:
+    - {model: m1, requests: 5}
+    - {model: m2, requests: 5}
+`)
+	if len(r.remote.shares) != 3 {
+		t.Errorf("expected the run split across 3 agents, got %+v", r.remote.shares)
+	}
+	runs := getRuns(t, app, "")
+	if s := runs[0].Summary; s == nil || s.Sent != 30 || s.Done != 30 || runs[0].Outcome != outcomeCompleted {
+		t.Errorf("expected the agents' 30 requests completed, got %+v %+v", runs[0].Outcome, s)
+	}
+	if len(reportFiles(t, app)) == 0 {
+		t.Error("expected a report of the run")
+	}
+	w = do(app, "GET", "/reports/"+r.batchId, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected a report, got %d", w.Code)
+	}
+}
+
+func TestDistributedRunKilled(t *testing.T) {
+	_, ops := newMockOps(t, &mockops.Config{})
+	app, coordinator := newTestCoordinator(t)
+	for _, name := range []string{"a", "b"} {
+		a := newTestAgent(t, coordinator.URL, name, 0, WallClock)
+		defer a.Close()
+	}
+
+	// The run lasts long enough that only the kill ends it.
+	w := do(app, "POST", "/workload", map[string][]string{"spec": {`
+version: 1
+target: {host: "` + ops.URL + `", user: demo, apikey: key}
+run: {workers: 2}
+models:
+    - {model: m1, requests: 100000, rate: 20}
+`}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	// Let the agents start.
+	time.Sleep(agentStartDelay + 500*time.Millisecond)
+	do(app, "POST", "/kill", nil)
+	waitRecorded(t, r)
+	if runs := getRuns(t, app, ""); runs[0].Outcome == outcomeRunning {
+		t.Errorf("expected the killed run to end, got %s", runs[0].Outcome)
+	}
+}
+
+func TestDistributedRunClockSkew(t *testing.T) {
+	_, ops := newMockOps(t, &mockops.Config{})
+	app, coordinator := newTestCoordinator(t)
+
+	// One agent's clock is an hour behind, the other's a minute ahead.
+	slow := newTestAgent(t, coordinator.URL, "slow", 0, skewedClock{WallClock, -time.Hour})
+	defer slow.Close()
+	fast := newTestAgent(t, coordinator.URL, "fast", 0, skewedClock{WallClock, time.Minute})
+	defer fast.Close()
+	offsets := make(map[string]time.Duration)
+	for _, a := range app.agents.live() {
+		offsets[a.Name] = a.ClockOffset
+	}
+	near := func(d, want time.Duration) bool { return d > want-time.Second && d < want+time.Second }
+	if !near(offsets["slow"], time.Hour) || !near(offsets["fast"], -time.Minute) {
+		t.Fatalf("expected offsets of 1h and -1m, got %v", offsets)
+	}
+
+	r := runSpec(t, app, `
+version: 1
+target: {host: "`+ops.URL+`", user: demo, apikey: key}
+run: {workers: 4}
+models:
+    - {model: m1, requests: 5, rate: 10}
+`)
+	if runs := getRuns(t, app, ""); runs[0].Summary == nil || runs[0].Summary.Done != 20 {
+		t.Fatalf("expected both agents' 20 requests, got %+v", runs[0].Summary)
+	}
+	// Points are on the coordinator's clock, from when the agents started
+	// together to when the run ended.
+	ended := app.clock.Now()
+	if len(r.points) == 0 {
+		t.Fatal("expected points")
+	}
+	for _, p := range r.points {
+		if p.Time.Before(r.started) || p.Time.After(ended) {
+			t.Errorf("expected points between %v and %v, got one at %v", r.started, ended, p.Time)
+		}
+	}
+}
+
+func TestAgentStartsOnGo(t *testing.T) {
+	_, coordinator := newTestCoordinator(t)
+	a := newTestAgent(t, coordinator.URL, "a", 0, WallClock)
+	defer a.Close()
+
+	post := func(path, body string) int {
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, agentRequest("POST", path, body, testAgentToken))
+		return w.Code
+	}
+	start := `{"batch_id": "b", "spec": {"version": 1, "target": {"host": "http://127.0.0.1:1", "user": "demo"}, "run": {"workers": 1}, "models": [{"model": "m1", "requests": 1}]}, "workers": 1}`
+	if code := post("/agent/start", start); code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	if code := post("/agent/go", `{"batch_id": "other"}`); code != http.StatusGone {
+		t.Errorf("expected 410 for a run not prepared, got %d", code)
+	}
+	// A prepared run holds the agent until it is started or stopped.
+	if code := post("/agent/start", start); code != http.StatusConflict {
+		t.Errorf("expected 409 while prepared, got %d", code)
+	}
+	if code := post("/agent/go", `{"batch_id": "b"}`); code != http.StatusOK {
+		t.Errorf("expected 200, got %d", code)
+	}
+	if code := post("/agent/go", `{"batch_id": "b"}`); code != http.StatusGone {
+		t.Errorf("expected 410 once started, got %d", code)
+	}
+}
+
+func TestAgentRejectsStart(t *testing.T) {
+	app, coordinator := newTestCoordinator(t)
+	a := newTestAgent(t, coordinator.URL, "small", 1, WallClock)
+	defer a.Close()
+
+	// The coordinator doesn't give the agent more than it takes.
+	w := do(app, "POST", "/workload", map[string][]string{"spec": {`
+version: 1
+target: {host: "http://127.0.0.1:1", user: demo, apikey: key}
+run: {workers: 2}
+models:
+    - {model: m1, requests: 1}
+`}})
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "more than 1 workers") {
+		t.Errorf("expected the run to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Nor does the agent.
+	w = httptest.NewRecorder()
+	start := `{"batch_id": "b", "spec": {"version": 1, "target": {"host": "http://127.0.0.1:1", "user": "demo"}, "run": {"workers": 2}, "models": [{"model": "m1", "requests": 1}]}, "workers": 2}`
+	a.ServeHTTP(w, agentRequest("POST", "/agent/start", start, testAgentToken))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "more than 1 workers") {
+		t.Errorf("expected the agent to refuse 2 workers, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Stats of runs the coordinator doesn't know are gone.
+	w = httptest.NewRecorder()
+	app.ServeHTTP(w, agentRequest("POST", "/agents/stats", `{"agent": "small", "batch_id": "b"}`, testAgentToken))
+	if w.Code != http.StatusGone {
+		t.Errorf("expected 410, got %d", w.Code)
+	}
+}
+
+func TestAgentToken(t *testing.T) {
+	app, coordinator := newTestCoordinator(t)
+	a := newTestAgent(t, coordinator.URL, "a", 0, WallClock)
+	defer a.Close()
+
+	start := `{"batch_id": "b", "spec": {"version": 1, "target": {"host": "http://127.0.0.1:1", "user": "demo", "apikey": "key"}, "run": {"workers": 1}, "models": [{"model": "m1", "requests": 1}]}, "workers": 1}`
+	reg := `{"name": "b", "url": "http://127.0.0.1:1"}`
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		path    string
+		body    string
+	}{
+		{"register", app, "POST", "/agents", reg},
+		{"deregister", app, "DELETE", "/agents/a", ""},
+		{"stats", app, "POST", "/agents/stats", `{"agent": "a", "batch_id": "b"}`},
+		{"start", a, "POST", "/agent/start", start},
+		{"go", a, "POST", "/agent/go", `{"batch_id": "b"}`},
+		{"stop", a, "POST", "/agent/stop?batch_id=b", ""},
+	}
+	for _, tt := range tests {
+		for _, token := range []string{"", "wrong"} {
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, agentRequest(tt.method, tt.path, tt.body, token))
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("%s with token %q: expected 401, got %d", tt.name, token, w.Code)
+			}
+		}
+	}
+	if agents := app.agents.live(); len(agents) != 1 || agents[0].Name != "a" {
+		t.Errorf("expected only the agent with the token, got %+v", agents)
+	}
+	a.mu.Lock()
+	if a.killc != nil {
+		t.Error("expected the agent not to take a start without the token")
+	}
+	a.mu.Unlock()
+
+	// Agents can't join a coordinator without a token of its own.
+	open := newTestApp(t)
+	w := httptest.NewRecorder()
+	open.ServeHTTP(w, agentRequest("POST", "/agents", reg, ""))
+	if w.Code != http.StatusForbidden || len(open.agents.live()) != 0 {
+		t.Errorf("expected registration to be refused, got %d", w.Code)
+	}
+	if _, err := NewAgent(AgentConfig{Coordinator: coordinator.URL, URL: "http://127.0.0.1:1"}); err == nil {
+		t.Error("expected an agent without a token to be refused")
+	}
+}
+
+func TestSlowAgentDoesNotHoldUpTheServer(t *testing.T) {
+	_, ops := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	started, release, stopped := make(chan struct{}), make(chan struct{}), make(chan struct{}, 1)
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/agent/start":
+			close(started)
+			<-release
+		case "/agent/stop":
+			stopped <- struct{}{}
+		}
+	}))
+	defer agent.Close()
+	app.agents.register(agentRegistration{Name: "slow", URL: agent.URL})
+
+	spec := map[string][]string{"spec": {`
+version: 1
+target: {host: "` + ops.URL + `", user: demo, apikey: key}
+run: {workers: 2}
+models:
+    - {model: m1, requests: 10}
+`}}
+	res := make(chan int, 1)
+	go func() { res <- do(app, "POST", "/workload", spec).Code }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the agent was never asked to start the run")
+	}
+
+	// While the agent takes its time, the run is reserved but the server
+	// still answers, and stopping the run gives the slot back.
+	if w := do(app, "POST", "/workload", spec); !strings.Contains(w.Body.String(), errRunning.Error()) {
+		t.Errorf("expected a second run to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+	do(app, "POST", "/kill", nil)
+	close(release)
+	if code := <-res; code == http.StatusOK {
+		t.Error("expected the run stopped while it started to fail")
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the agent to be told to stop its share")
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.killc != nil || app.run != nil {
+		t.Error("expected no run left behind")
+	}
+}
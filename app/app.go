@@ -7,19 +7,30 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"text/template"
 
 	"github.com/gorilla/handlers"
+	"github.com/yhat/workload-simulator/workload"
+	"golang.org/x/net/websocket"
 )
 
 // Configuration for web app.
 type AppConfig struct {
 	// Web stuff
-	Host      string
-	Port      int
-	PublicDir string
-	ViewsDir  string
-	ReportDir string
+	Host        string
+	Port        int
+	PublicDir   string
+	ViewsDir    string
+	ReportDir   string
+	ReportSinks []SinkConfig
+	SessionDir  string
+
+	// Scrape has the servers scraped during runs.
+	Scrape ScrapeConfig
+
+	// AgentToken authenticates agents and the simulator to each other.
+	AgentToken string
 
 	// Settings for worker concurrency and display settings for dials.
 	MaxDial        int
@@ -43,11 +54,53 @@ type App struct {
 	// http router
 	router http.Handler
 
-	// report file handle
-	reportfile *os.File
+	// library of named workloads, nil if no workload directory is
+	// configured.
+	library *workload.Library
+
+	// mu guards the state of the running workload below.
+	mu sync.Mutex
+
+	// sinks the running workload's stats are written to.
+	sinks []Sink
+
+	// killc is closed to stop the workers of the running workload, nil
+	// when nothing is running.
+	killc chan int
+
+	// run is the running or last run workload.
+	run *run
+
+	// history of runs, nil if it couldn't be opened.
+	history *history
+
+	// clock is the source of time for workers and handlers.
+	clock Clock
+
+	// exporters push the StatsMonitor's Reports elsewhere.
+	exporters []*exporter
+
+	// hub streams the StatsMonitor's Reports to subscribers.
+	hub *statsHub
+
+	// statsd receives every request's outcome, nil if not configured.
+	statsd *statsdClient
+
+	// live polls the Ops instance watched in live mode.
+	live *liveMonitor
+
+	// agents registered to run the workers of runs.
+	agents *agentRegistry
+
+	// search is the running capacity search, if any, and searches every
+	// search since the app started by id.
+	search   *search
+	searches map[string]*search
+
+	// scheduler starts runs of library workloads on their schedules.
+	scheduler *scheduler
 
 	// channels for workers and statMonitor
-	Killc   chan int
 	Reportc chan *Report
 	Statc   chan *Stat
 }
@@ -65,20 +118,87 @@ func New(config *Config) (*App, error) {
 	// create a new app config from config yaml and a new App.
 	// OpsConfig can be nil on start since it is specified by the UI.
 	appCfg := AppConfig{
-		Host:      config.Web.Hostname,
-		Port:      config.Web.HttpPort,
-		PublicDir: config.Web.PublicDir,
-		ViewsDir:  config.Web.ViewsDir,
-		ReportDir: config.Web.ReportDir,
+		Host:        config.Web.Hostname,
+		Port:        config.Web.HttpPort,
+		PublicDir:   config.Web.PublicDir,
+		ViewsDir:    config.Web.ViewsDir,
+		ReportDir:   config.Web.ReportDir,
+		ReportSinks: config.Web.ReportSinks,
+		SessionDir:  config.Web.SessionDir,
+		Scrape:      config.Scrape,
+		AgentToken:  config.AgentToken,
 
 		MaxDial:    config.Settings.MaxDial,
 		MaxWorkers: config.Settings.MaxWorkers,
 	}
 
+	if len(appCfg.ReportSinks) == 0 {
+		appCfg.ReportSinks = defaultSinks
+	}
+	for _, c := range appCfg.ReportSinks {
+		if err := c.check(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := appCfg.Scrape.check(); err != nil {
+		return nil, err
+	}
+
+	if appCfg.SessionDir == "" {
+		appCfg.SessionDir = filepath.Join(appCfg.ReportDir, "sessions")
+	}
+
 	app := App{
 		config:    &appCfg,
 		templates: make(map[string]*template.Template),
+		clock:     WallClock,
 	}
+	app.hub = newStatsHub(app.clock)
+	app.live = newLiveMonitor(app.clock, config.Live)
+	app.agents = newAgentRegistry(app.clock)
+	for _, c := range config.Exporters {
+		e, err := newExporter(app.clock, c)
+		if err != nil {
+			app.Close()
+			return nil, err
+		}
+		app.exporters = append(app.exporters, e)
+	}
+	if config.Statsd != nil {
+		c, err := newStatsd(*config.Statsd)
+		if err != nil {
+			app.Close()
+			return nil, err
+		}
+		app.statsd = c
+	}
+	if config.Web.WorkloadDir != "" {
+		app.library = workload.NewLibrary(config.Web.WorkloadDir)
+	}
+
+	historyDB := config.Web.HistoryDB
+	if historyDB == "" && appCfg.ReportDir != "" {
+		historyDB = filepath.Join(appCfg.ReportDir, "history.db")
+	}
+	if historyDB != "" {
+		h, err := openHistory(historyDB)
+		if err != nil {
+			// Runs still work, they just aren't recorded.
+			log.Printf("run history disabled: %v", err)
+		} else {
+			app.history = h
+		}
+	}
+
+	var saved []*schedule
+	if app.history != nil {
+		var err error
+		if saved, err = app.history.schedules(); err != nil {
+			log.Printf("not firing saved schedules: %v", err)
+		}
+	}
+	app.scheduler = newScheduler(app.clock, app.startScheduled, saved)
 
 	// Register handlers with ServeMux.
 	r := http.NewServeMux()
@@ -98,6 +218,10 @@ func New(config *Config) (*App, error) {
 
 	r.HandleFunc("/", app.handleRoot)
 	r.HandleFunc("/workload", app.handleWorkload)
+	r.HandleFunc("/workload/validate", app.handleValidate)
+	r.HandleFunc("/workload/load", app.handleLoad)
+	r.HandleFunc("/workloads", app.handleLibrary)
+	r.HandleFunc("/workloads/", app.handleLibraryWorkload)
 	r.HandleFunc("/ping", app.handlePing)
 	r.HandleFunc("/unload", app.handleUnload)
 	r.HandleFunc("/pause", app.handlePause)
@@ -107,15 +231,73 @@ func New(config *Config) (*App, error) {
 	r.HandleFunc("/live/stats", app.handleLiveStats)
 	r.HandleFunc("/sql", app.handleSql)
 	r.HandleFunc("/save", app.handleSave)
+	r.HandleFunc("/sessions", app.handleSessions)
+	r.HandleFunc("/sessions/", app.handleSession)
 	r.HandleFunc("/kill", app.handleKill)
+	r.HandleFunc("/runs", app.handleRuns)
+	r.HandleFunc("/runs/", app.handleRun)
+	r.HandleFunc("/reports/", app.handleReport)
+	r.HandleFunc("/compare", app.handleCompare)
+	r.HandleFunc("/baselines", app.handleBaselines)
+	r.HandleFunc("/baselines/", app.handleBaseline)
+	r.HandleFunc("/search", app.handleSearch)
+	r.HandleFunc("/searches", app.handleSearches)
+	r.HandleFunc("/searches/", app.handleSearchResult)
+	r.HandleFunc("/agents", app.handleAgents)
+	r.HandleFunc("/agents/", app.handleAgent)
+	r.HandleFunc("/schedules", app.handleSchedules)
+	r.HandleFunc("/schedules/", app.handleSchedule)
 
-	// Add router to app.
+	// Add router to app. The stats streams bypass the request log, its
+	// writer can't flush and they would only be logged once they end.
 	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
-	app.router = loggedRouter
+	top := http.NewServeMux()
+	top.Handle("/", loggedRouter)
+	top.HandleFunc("/stats/stream", app.handleStatsStream)
+	// Agents post their stats several times a second, and read the clock
+	// several times whenever they register.
+	top.HandleFunc("/agents/stats", app.handleAgentStats)
+	top.HandleFunc("/agents/clock", app.handleAgentClock)
+	// Without a handshake the socket takes any origin, like the
+	// stream, so scripts can connect.
+	top.Handle("/stats/ws", websocket.Server{Handler: app.handleStatsSocket})
+	app.router = top
 
 	return &app, nil
 }
 
+// StatsTaps returns the channels to tap the StatsMonitor's Reports into
+// for the stats stream and the configured exporters.
+func (app *App) StatsTaps() []chan<- *Report {
+	taps := []chan<- *Report{app.hub.reports}
+	for _, e := range app.exporters {
+		taps = append(taps, e.reports)
+	}
+	return taps
+}
+
+// Close releases the app's resources. It doesn't stop a running workload.
+func (app *App) Close() error {
+	if app.scheduler != nil {
+		app.scheduler.stop()
+		app.scheduler = nil
+	}
+	if app.live != nil {
+		app.live.stop()
+	}
+	for _, e := range app.exporters {
+		e.stop()
+	}
+	app.exporters = nil
+	if app.statsd != nil {
+		app.statsd.Close()
+	}
+	if app.history != nil {
+		return app.history.Close()
+	}
+	return nil
+}
+
 func (app *App) compileTemplates(viewsDir string) error {
 	templatesListing, err := ioutil.ReadDir(viewsDir)
 	if err != nil {
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Arrival processes a worker can use to pace its requests.
+const (
+	// arrivalNone sends requests back to back as fast as the target allows.
+	arrivalNone = ""
+	// arrivalConstant spaces requests evenly at the target rate.
+	arrivalConstant = workload.ArrivalConstant
+	// arrivalPoisson draws exponentially distributed gaps averaging the
+	// target rate.
+	arrivalPoisson = workload.ArrivalPoisson
+)
+
+// rateScale multiplies the rate of every paced worker in a run. Stages
+// change it while workers read it.
+type rateScale struct {
+	bits uint64
+}
+
+func newRateScale(f float64) *rateScale {
+	s := &rateScale{}
+	s.Store(f)
+	return s
+}
+
+func (s *rateScale) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.bits))
+}
+
+func (s *rateScale) Store(f float64) {
+	atomic.StoreUint64(&s.bits, math.Float64bits(f))
+}
+
+// arrivals schedules request start times for a single worker.
+type arrivals struct {
+	process string
+	rate    float64
+	rnd     *rand.Rand
+
+	// scale, if set, multiplies rate.
+	scale *rateScale
+}
+
+// newArrivals returns a schedule for process at rate requests per second, or
+// nil if requests should not be paced.
+func newArrivals(process string, rate float64, rnd *rand.Rand, scale *rateScale) (*arrivals, error) {
+	switch process {
+	case arrivalNone:
+		if rate > 0 {
+			process = arrivalConstant
+		}
+	case arrivalConstant, arrivalPoisson:
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q", process)
+	}
+	if rate < 0 {
+		return nil, fmt.Errorf("rate can't be negative")
+	}
+	if process == arrivalNone || rate == 0 {
+		return nil, nil
+	}
+	return &arrivals{process: process, rate: rate, rnd: rnd, scale: scale}, nil
+}
+
+// gap returns the time between the previous arrival and the next one.
+func (a *arrivals) gap() time.Duration {
+	rate := a.rate
+	if a.scale != nil {
+		rate *= a.scale.Load()
+	}
+	mean := float64(time.Second) / rate
+	if a.process == arrivalPoisson {
+		return time.Duration(a.rnd.ExpFloat64() * mean)
+	}
+	return time.Duration(mean)
+}
@@ -0,0 +1,39 @@
+package app
+
+import "time"
+
+// Clock is the source of time for the app. Workers, the StatsMonitor and
+// handlers all read time through a Clock so tests and replays can drive
+// them deterministically.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the subset of time.Ticker used by the app.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WallClock is a Clock backed by the time package.
+var WallClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+
+func (t realTicker) Stop() { t.t.Stop() }
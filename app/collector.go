@@ -0,0 +1,350 @@
+package app
+
+import (
+	"sort"
+	"time"
+)
+
+// collector keeps the complete statistics of one run. Workers of the run
+// send their Stats to it, and it passes them on to the StatsMonitor that
+// feeds the UI. Unlike the monitor's reports, nothing the collector sees is
+// dropped, so it can account for every request of the run.
+type collector struct {
+	clock    Clock
+	interval time.Duration
+
+	// lag is how long intervals are held for Stats that arrive late, the
+	// ones of agents. Stats are counted in the interval they were
+	// collected in if it is still held, and in the oldest one otherwise.
+	lag time.Duration
+
+	// stats receives the workers' Stats. It is closed by finish.
+	stats chan *Stat
+
+	// forward, if set, receives every Stat after it is counted.
+	forward chan<- *Stat
+
+	// onPoints, if set, is called with the points of each interval.
+	onPoints func([]point)
+
+	// totals and the current interval's counts by model id, and the
+	// ended intervals still held.
+	totals map[string]*modelCounts
+	window map[string]*modelCounts
+	last   time.Time
+	held   []*interval
+
+	done chan struct{}
+}
+
+// modelCounts are the requests made to one model of a run.
+type modelCounts struct {
+	id      string
+	name    string
+	sent    int
+	done    int
+	failed  int
+	latency *histogram
+
+	// workers is the largest pool and late the requests sent late by the
+	// model's pool in adaptive runs.
+	workers int
+	late    int
+
+	// steps are the counts of each step of a scenario, and stepModels
+	// the steps' models.
+	steps      []*stepCounts
+	stepModels []string
+
+	// users is how many of the model's virtual users are active, and
+	// peakUsers the most that were.
+	users     int
+	peakUsers int
+}
+
+func newModelCounts(id, name string) *modelCounts {
+	return &modelCounts{id: id, name: name, latency: newHistogram()}
+}
+
+func (m *modelCounts) add(s *Stat) {
+	m.sent += s.nreqSent
+	m.done += s.nreqDone
+	m.failed += s.nreqFailed
+	m.latency.merge(s.latency)
+	if s.workers > m.workers {
+		m.workers = s.workers
+	}
+	m.late += s.late
+	m.users += s.joined - s.left
+	if m.users > m.peakUsers {
+		m.peakUsers = m.users
+	}
+	m.steps = mergeSteps(m.steps, s.steps)
+	if m.stepModels == nil && len(s.steps) > 0 {
+		m.stepModels = s.workload.stepModels()
+	}
+}
+
+// interval is the counts of an ended interval of a run by model id, and
+// the virtual users active at its end.
+type interval struct {
+	start, end time.Time
+	counts     map[string]*modelCounts
+	users      map[string]int
+}
+
+// point is a model's statistics over one interval of a run.
+type point struct {
+	Time    time.Time `json:"time"`
+	ModelID string    `json:"model_id"`
+	Sent    int       `json:"sent"`
+	Done    int       `json:"done"`
+	Failed  int       `json:"failed"`
+
+	// Rate of requests done in requests per second.
+	Rate float64 `json:"rate"`
+
+	// Latency quantiles in seconds.
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+
+	// Users is how many virtual users were active at the end of the
+	// interval, and Iterations the requests, or scenarios, they finished
+	// over it.
+	Users      int `json:"users,omitempty"`
+	Iterations int `json:"iterations,omitempty"`
+}
+
+// modelSummary is a model's statistics over a whole run.
+type modelSummary struct {
+	ID        string         `json:"id"`
+	Model     string         `json:"model"`
+	Sent      int            `json:"sent"`
+	Done      int            `json:"done"`
+	Failed    int            `json:"failed"`
+	ErrorRate float64        `json:"error_rate"`
+	Rate      float64        `json:"rate"`
+	Latency   latencySummary `json:"latency"`
+
+	// Workers is the largest the model's pool grew in an adaptive run,
+	// and Late the requests it sent late because every worker was busy.
+	// CeilingLimited is set if the workers ceiling held back the rate.
+	Workers        int  `json:"workers,omitempty"`
+	Late           int  `json:"late,omitempty"`
+	CeilingLimited bool `json:"ceiling_limited,omitempty"`
+
+	// Knee and Saturation are where the model's latency rose sharply and
+	// its throughput stopped scaling with the offered load, if the run's
+	// load varied enough to find them.
+	Knee       *loadMark `json:"knee,omitempty"`
+	Saturation *loadMark `json:"saturation,omitempty"`
+
+	// Steps are the statistics of each step of a scenario. The model's
+	// latency is then end to end, of the scenarios whose every step
+	// succeeded.
+	Steps []stepSummary `json:"steps,omitempty"`
+
+	// Users is the most virtual users of the model active at once, and
+	// IterationRate the requests, or scenarios, they finished per second.
+	Users         int     `json:"users,omitempty"`
+	IterationRate float64 `json:"iteration_rate,omitempty"`
+}
+
+// runSummary is the statistics of a whole run, in total and by model.
+type runSummary struct {
+	Duration  float64        `json:"duration"`
+	Sent      int            `json:"sent"`
+	Done      int            `json:"done"`
+	Failed    int            `json:"failed"`
+	ErrorRate float64        `json:"error_rate"`
+	Rate      float64        `json:"rate"`
+	Latency   latencySummary `json:"latency"`
+	Models    []modelSummary `json:"models"`
+
+	// StopReason is why the run stopped, one of the stop constants.
+	StopReason string `json:"stop_reason,omitempty"`
+
+	// latencies are the models' whole latency distributions by model id,
+	// kept in the history to merge them later.
+	latencies map[string]*histogram
+}
+
+// newCollector starts collecting the Stats of a run, summing them into
+// points every interval of clock, lag after the interval ends.
+func newCollector(clock Clock, interval, lag time.Duration, forward chan<- *Stat, onPoints func([]point)) *collector {
+	c := &collector{
+		clock:    clock,
+		interval: interval,
+		lag:      lag,
+		stats:    make(chan *Stat),
+		forward:  forward,
+		onPoints: onPoints,
+		totals:   make(map[string]*modelCounts),
+		window:   make(map[string]*modelCounts),
+		last:     clock.Now(),
+		done:     make(chan struct{}),
+	}
+	go c.loop()
+	return c
+}
+
+func (c *collector) loop() {
+	defer close(c.done)
+	ticker := c.clock.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case s, ok := <-c.stats:
+			if !ok {
+				c.flush(c.clock.Now())
+				for _, iv := range c.held {
+					c.emit(iv)
+				}
+				return
+			}
+			c.add(s)
+			if c.forward != nil {
+				c.forward <- s
+			}
+		case now := <-ticker.C():
+			c.flush(now)
+		}
+	}
+}
+
+func (c *collector) add(s *Stat) {
+	id, name := s.workload.modelId, s.workload.modelName
+	if _, ok := c.totals[id]; !ok {
+		c.totals[id] = newModelCounts(id, name)
+	}
+	c.totals[id].add(s)
+	window := c.window
+	if c.lag > 0 && !s.at.IsZero() && s.at.Before(c.last) {
+		for _, iv := range c.held {
+			if s.at.Before(iv.end) {
+				window = iv.counts
+				break
+			}
+		}
+	}
+	if _, ok := window[id]; !ok {
+		window[id] = newModelCounts(id, name)
+	}
+	window[id].add(s)
+}
+
+// flush ends the current interval at now, and turns the intervals that
+// ended lag before now into points.
+func (c *collector) flush(now time.Time) {
+	users := make(map[string]int)
+	for id, m := range c.totals {
+		if m.peakUsers > 0 {
+			users[id] = m.users
+		}
+	}
+	c.held = append(c.held, &interval{start: c.last, end: now, counts: c.window, users: users})
+	c.window = make(map[string]*modelCounts)
+	c.last = now
+	for len(c.held) > 0 && !c.held[0].end.After(now.Add(-c.lag)) {
+		c.emit(c.held[0])
+		c.held = c.held[1:]
+	}
+}
+
+// emit turns the counts of iv into points. Models with virtual users get a
+// point even if they sent nothing over iv, as when every user was thinking.
+func (c *collector) emit(iv *interval) {
+	for id := range iv.users {
+		if _, ok := iv.counts[id]; !ok {
+			iv.counts[id] = newModelCounts(id, "")
+		}
+	}
+	if len(iv.counts) == 0 {
+		return
+	}
+	dt := iv.end.Sub(iv.start).Seconds()
+	points := make([]point, 0, len(iv.counts))
+	for _, id := range sortedModelIds(iv.counts) {
+		m := iv.counts[id]
+		p := point{
+			Time:    iv.end,
+			ModelID: id,
+			Sent:    m.sent,
+			Done:    m.done,
+			Failed:  m.failed,
+			P50:     m.latency.quantile(0.50).Seconds(),
+			P95:     m.latency.quantile(0.95).Seconds(),
+			P99:     m.latency.quantile(0.99).Seconds(),
+			Users:   iv.users[id],
+		}
+		if _, ok := iv.users[id]; ok {
+			p.Iterations = m.done + m.failed
+		}
+		if dt > 0 {
+			p.Rate = float64(m.done) / dt
+		}
+		points = append(points, p)
+	}
+	if c.onPoints != nil {
+		c.onPoints(points)
+	}
+}
+
+// finish waits for the last Stats, which must all have been sent, and
+// summarizes the run as having lasted d.
+func (c *collector) finish(d time.Duration) *runSummary {
+	close(c.stats)
+	<-c.done
+
+	total := newModelCounts("", "")
+	s := &runSummary{Duration: d.Seconds(), Models: []modelSummary{}, latencies: make(map[string]*histogram)}
+	for _, id := range sortedModelIds(c.totals) {
+		m := c.totals[id]
+		s.Models = append(s.Models, m.summary(d))
+		s.latencies[id] = m.latency
+		total.sent += m.sent
+		total.done += m.done
+		total.failed += m.failed
+		total.latency.merge(m.latency)
+	}
+	ts := total.summary(d)
+	s.Sent, s.Done, s.Failed = ts.Sent, ts.Done, ts.Failed
+	s.ErrorRate, s.Rate, s.Latency = ts.ErrorRate, ts.Rate, ts.Latency
+	return s
+}
+
+func (m *modelCounts) summary(d time.Duration) modelSummary {
+	s := modelSummary{
+		ID:      m.id,
+		Model:   m.name,
+		Sent:    m.sent,
+		Done:    m.done,
+		Failed:  m.failed,
+		Latency: m.latency.summary(),
+		Workers: m.workers,
+		Late:    m.late,
+		Steps:   summarizeSteps(m.steps, m.stepModels),
+		Users:   m.peakUsers,
+	}
+	s.CeilingLimited = m.late > 0 && float64(m.late) >= ceilingLate*float64(m.sent)
+	if n := m.done + m.failed; n > 0 {
+		s.ErrorRate = float64(m.failed) / float64(n)
+	}
+	if d > 0 {
+		s.Rate = float64(m.done) / d.Seconds()
+		if m.peakUsers > 0 {
+			s.IterationRate = float64(m.done+m.failed) / d.Seconds()
+		}
+	}
+	return s
+}
+
+func sortedModelIds(m map[string]*modelCounts) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func latencies(ds ...time.Duration) *histogram {
+	h := newHistogram()
+	for _, d := range ds {
+		h.record(d)
+	}
+	return h
+}
+
+func TestCollectorPointsAndSummary(t *testing.T) {
+	clock := newFakeClock()
+	forward := make(chan *Stat, 10)
+	points := make(chan []point, 10)
+	c := newCollector(clock, time.Second, 0, forward, func(ps []point) { points <- ps })
+
+	w1 := &Workload{modelId: "0", modelName: "m1"}
+	w2 := &Workload{modelId: "1", modelName: "m2"}
+	c.stats <- &Stat{workload: w1, nreqSent: 4, nreqDone: 3, nreqFailed: 1,
+		latency: latencies(10*time.Millisecond, 20*time.Millisecond, 30*time.Millisecond)}
+	c.stats <- &Stat{workload: w2, nreqSent: 2, nreqDone: 2, latency: latencies(time.Second, time.Second)}
+	waitFor(t, func() bool { return len(forward) == 2 })
+
+	clock.Advance(time.Second)
+	ps := <-points
+	if len(ps) != 2 || ps[0].ModelID != "0" || ps[0].Done != 3 || ps[0].Failed != 1 || ps[0].Rate != 3 {
+		t.Errorf("unexpected first interval %+v", ps)
+	}
+
+	// Quiet intervals produce no points.
+	clock.Advance(time.Second)
+	c.stats <- &Stat{workload: w1, nreqSent: 1, nreqDone: 1, latency: latencies(40 * time.Millisecond), final: true}
+	clock.Advance(time.Second)
+	if ps := <-points; len(ps) != 1 || ps[0].Done != 1 {
+		t.Errorf("expected one point for the last stat, got %+v", ps)
+	}
+
+	s := c.finish(5 * time.Second)
+	if s.Sent != 7 || s.Done != 6 || s.Failed != 1 || s.Rate != 6.0/5 {
+		t.Errorf("unexpected totals %+v", s)
+	}
+	m1 := s.Models[0]
+	want := modelSummary{ID: "0", Model: "m1", Sent: 5, Done: 4, Failed: 1, ErrorRate: 0.2, Rate: 0.8}
+	got := m1
+	got.Latency = latencySummary{}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if m1.Latency.Max != 0.04 || m1.Latency.Mean != 0.025 {
+		t.Errorf("unexpected latency %+v", m1.Latency)
+	}
+	if s.Latency.Max != 1 {
+		t.Errorf("expected the run's latency to include every model, got %+v", s.Latency)
+	}
+}
+
+func TestCollectorLag(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	var points [][]point
+	c := &collector{
+		lag:      2 * time.Second,
+		totals:   make(map[string]*modelCounts),
+		window:   make(map[string]*modelCounts),
+		last:     t0,
+		onPoints: func(ps []point) { points = append(points, ps) },
+	}
+	w := &Workload{modelId: "0", modelName: "m1"}
+	stat := func(done int, at time.Duration) *Stat {
+		return &Stat{workload: w, nreqSent: done, nreqDone: done, latency: latencies(time.Millisecond), at: t0.Add(at)}
+	}
+
+	c.add(stat(1, 500*time.Millisecond))
+	c.flush(t0.Add(time.Second))
+	c.flush(t0.Add(2 * time.Second))
+	if len(points) != 0 {
+		t.Fatalf("expected the intervals to be held, got %+v", points)
+	}
+
+	// Stats that arrive late count in the interval they were collected in.
+	c.add(stat(2, 1500*time.Millisecond))
+	c.add(stat(4, 200*time.Millisecond))
+	c.flush(t0.Add(3 * time.Second))
+	if len(points) != 1 || !points[0][0].Time.Equal(t0.Add(time.Second)) || points[0][0].Done != 5 {
+		t.Fatalf("expected 5 requests in the first interval, got %+v", points)
+	}
+	c.flush(t0.Add(4 * time.Second))
+	if len(points) != 2 || !points[1][0].Time.Equal(t0.Add(2*time.Second)) || points[1][0].Done != 2 {
+		t.Errorf("expected 2 requests in the second interval, got %+v", points)
+	}
+
+	// Stats later than every held interval count in the oldest.
+	c.add(stat(8, 0))
+	c.flush(t0.Add(5 * time.Second))
+	if len(points) != 3 || !points[2][0].Time.Equal(t0.Add(3*time.Second)) || points[2][0].Done != 8 {
+		t.Errorf("expected 8 requests in the oldest held interval, got %+v", points)
+	}
+}
+
+func TestCollectorPointsWhileUsersThink(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	var points [][]point
+	c := &collector{
+		totals:   make(map[string]*modelCounts),
+		window:   make(map[string]*modelCounts),
+		last:     t0,
+		onPoints: func(ps []point) { points = append(points, ps) },
+	}
+	w := &Workload{modelId: "0", modelName: "m1"}
+	c.add(&Stat{workload: w, nreqSent: 3, nreqDone: 2, nreqFailed: 1, latency: latencies(time.Millisecond), joined: 2})
+	c.flush(t0.Add(time.Second))
+	if len(points) != 1 || points[0][0].Users != 2 || points[0][0].Iterations != 3 {
+		t.Fatalf("expected 3 iterations of 2 users, got %+v", points)
+	}
+
+	// Every user thinking sends nothing, the users are still active.
+	c.flush(t0.Add(2 * time.Second))
+	if len(points) != 2 || len(points[1]) != 1 {
+		t.Fatalf("expected a point for the quiet interval, got %+v", points)
+	}
+	if p := points[1][0]; p.ModelID != "0" || !p.Time.Equal(t0.Add(2*time.Second)) || p.Users != 2 || p.Sent != 0 || p.Iterations != 0 {
+		t.Errorf("expected 2 users finishing nothing, got %+v", p)
+	}
+}
@@ -0,0 +1,311 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// tolerances are how much worse than its baseline a run may be before it
+// counts as a regression.
+type tolerances struct {
+	// Throughput is the largest relative drop in requests per second.
+	Throughput float64 `json:"throughput"`
+
+	// Latency is the largest relative increase of a latency percentile.
+	Latency float64 `json:"latency"`
+
+	// ErrorRate is the largest absolute increase of the error rate.
+	ErrorRate float64 `json:"error_rate"`
+
+	// Alpha is the significance level changes are tested at.
+	Alpha float64 `json:"alpha"`
+}
+
+var defaultTolerances = tolerances{
+	Throughput: 0.05,
+	Latency:    0.10,
+	ErrorRate:  0.01,
+	Alpha:      0.05,
+}
+
+// comparison compares runs to a baseline run model by model.
+type comparison struct {
+	Baseline   string          `json:"baseline"`
+	Tolerances tolerances      `json:"tolerances"`
+	Runs       []runComparison `json:"runs"`
+
+	// Regression is set if any run regressed.
+	Regression bool `json:"regression"`
+}
+
+type runComparison struct {
+	BatchId    string            `json:"batch_id"`
+	Name       string            `json:"name"`
+	Regression bool              `json:"regression"`
+	Models     []modelComparison `json:"models"`
+}
+
+type modelComparison struct {
+	Model      string             `json:"model"`
+	Regression bool               `json:"regression"`
+	Metrics    []metricComparison `json:"metrics"`
+
+	// Note says why a model wasn't compared.
+	Note string `json:"note,omitempty"`
+}
+
+// metricComparison is the change of one metric from the baseline.
+// Throughput and latency changes are relative, error rate changes absolute.
+type metricComparison struct {
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline"`
+	Value    float64 `json:"value"`
+	Change   float64 `json:"change"`
+
+	// PValue of the change, nil if there weren't enough samples to test
+	// it.
+	PValue      *float64 `json:"p_value,omitempty"`
+	Significant bool     `json:"significant"`
+
+	// Regression is set if the change is worse than the tolerance and
+	// significant, or couldn't be tested.
+	Regression bool `json:"regression"`
+}
+
+// runData is a finished run's summary and per second samples by model
+// name.
+type runData struct {
+	record *runRecord
+	models map[string]*modelData
+}
+
+type modelData struct {
+	summary modelSummary
+
+	// latency is the distribution of every window of the model, nil if
+	// one of them was recorded without it. With several windows, latency
+	// is only compared if it is set.
+	latency *histogram
+	windows int
+
+	// per second samples.
+	rates         []float64
+	p50, p95, p99 []float64
+}
+
+// compareRuns compares each of the runs to the baseline run.
+func (app *App) compareRuns(baseline string, runs []string, tol tolerances) (*comparison, error) {
+	base, err := app.loadRunData(baseline)
+	if err != nil {
+		return nil, err
+	}
+	c := &comparison{Baseline: baseline, Tolerances: tol, Runs: []runComparison{}}
+	for _, id := range runs {
+		d, err := app.loadRunData(id)
+		if err != nil {
+			return nil, err
+		}
+		rc := compareRun(base, d, tol)
+		c.Regression = c.Regression || rc.Regression
+		c.Runs = append(c.Runs, rc)
+	}
+	return c, nil
+}
+
+func (app *App) loadRunData(batchId string) (*runData, error) {
+	rec, err := app.history.run(batchId)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("no run %s", batchId)
+	}
+	if rec.Summary == nil {
+		return nil, fmt.Errorf("run %s has not finished", batchId)
+	}
+	points, err := app.history.points(batchId, "")
+	if err != nil {
+		return nil, err
+	}
+
+	latencies, err := app.history.latencies(batchId)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &runData{record: rec, models: make(map[string]*modelData)}
+	names := make(map[string]string)
+	for _, m := range rec.Summary.Models {
+		names[m.ID] = m.Model
+		md, ok := d.models[m.Model]
+		if !ok {
+			md = &modelData{summary: m, latency: newHistogram()}
+			d.models[m.Model] = md
+		} else {
+			// Windows of the same model are compared as one.
+			md.summary = mergeModelSummaries(md.summary, m)
+		}
+		md.windows++
+		if h := latencies[m.ID]; h != nil && md.latency != nil {
+			md.latency.merge(h)
+		} else {
+			md.latency = nil
+		}
+	}
+	for _, md := range d.models {
+		if md.windows > 1 && md.latency != nil {
+			md.summary.Latency = md.latency.summary()
+		}
+	}
+
+	// Sum the rates of a model's windows in each interval.
+	rates := make(map[string]map[time.Time]float64)
+	for _, p := range points {
+		name, ok := names[p.ModelID]
+		if !ok {
+			continue
+		}
+		if rates[name] == nil {
+			rates[name] = make(map[time.Time]float64)
+		}
+		rates[name][p.Time] += p.Rate
+		if p.Done > 0 {
+			md := d.models[name]
+			md.p50 = append(md.p50, p.P50)
+			md.p95 = append(md.p95, p.P95)
+			md.p99 = append(md.p99, p.P99)
+		}
+	}
+	for name, byTime := range rates {
+		times := make([]time.Time, 0, len(byTime))
+		for t := range byTime {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for _, t := range times {
+			d.models[name].rates = append(d.models[name].rates, byTime[t])
+		}
+	}
+	return d, nil
+}
+
+// latencyMerged reports whether the model's latency describes all of its
+// windows.
+func (md *modelData) latencyMerged() bool {
+	return md.windows == 1 || md.latency != nil
+}
+
+// mergeModelSummaries combines the summaries of two windows of a model,
+// but for their latency, which is merged from their distributions.
+func mergeModelSummaries(a, b modelSummary) modelSummary {
+	m := modelSummary{
+		ID:     a.ID,
+		Model:  a.Model,
+		Sent:   a.Sent + b.Sent,
+		Done:   a.Done + b.Done,
+		Failed: a.Failed + b.Failed,
+		Rate:   a.Rate + b.Rate,
+	}
+	if n := m.Done + m.Failed; n > 0 {
+		m.ErrorRate = float64(m.Failed) / float64(n)
+	}
+	return m
+}
+
+func compareRun(base, d *runData, tol tolerances) runComparison {
+	rc := runComparison{BatchId: d.record.BatchId, Name: d.record.Name, Models: []modelComparison{}}
+	names := make(map[string]bool)
+	for name := range base.models {
+		names[name] = true
+	}
+	for name := range d.models {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		b, v := base.models[name], d.models[name]
+		mc := modelComparison{Model: name, Metrics: []metricComparison{}}
+		switch {
+		case b == nil:
+			mc.Note = "not in baseline"
+		case v == nil:
+			mc.Note = "not in run"
+		default:
+			if !b.latencyMerged() || !v.latencyMerged() {
+				mc.Note = "latency not compared, the model's windows were recorded without their distributions"
+			}
+			mc.Metrics = compareModel(b, v, tol)
+			for _, m := range mc.Metrics {
+				mc.Regression = mc.Regression || m.Regression
+			}
+		}
+		rc.Regression = rc.Regression || mc.Regression
+		rc.Models = append(rc.Models, mc)
+	}
+	return rc
+}
+
+func compareModel(b, v *modelData, tol tolerances) []metricComparison {
+	bs, vs := b.summary, v.summary
+
+	rate := relative("rate", bs.Rate, vs.Rate)
+	rate.test(welchTest(b.rates, v.rates))
+	rate.judge(-rate.Change > tol.Throughput, tol.Alpha)
+
+	metrics := []metricComparison{rate}
+	latencies := []struct {
+		name     string
+		b, v     float64
+		bsamples []float64
+		vsamples []float64
+	}{
+		{"p50", bs.Latency.P50, vs.Latency.P50, b.p50, v.p50},
+		{"p95", bs.Latency.P95, vs.Latency.P95, b.p95, v.p95},
+		{"p99", bs.Latency.P99, vs.Latency.P99, b.p99, v.p99},
+	}
+	if !b.latencyMerged() || !v.latencyMerged() {
+		latencies = nil
+	}
+	for _, l := range latencies {
+		m := relative(l.name, l.b, l.v)
+		m.test(welchTest(l.bsamples, l.vsamples))
+		m.judge(m.Change > tol.Latency, tol.Alpha)
+		metrics = append(metrics, m)
+	}
+
+	errs := metricComparison{
+		Metric:   "error_rate",
+		Baseline: bs.ErrorRate,
+		Value:    vs.ErrorRate,
+		Change:   vs.ErrorRate - bs.ErrorRate,
+	}
+	errs.test(proportionTest(bs.Failed, bs.Done+bs.Failed, vs.Failed, vs.Done+vs.Failed))
+	errs.judge(errs.Change > tol.ErrorRate, tol.Alpha)
+	return append(metrics, errs)
+}
+
+// relative compares a metric by its relative change.
+func relative(metric string, b, v float64) metricComparison {
+	m := metricComparison{Metric: metric, Baseline: b, Value: v}
+	if b != 0 {
+		m.Change = (v - b) / b
+	}
+	return m
+}
+
+func (m *metricComparison) test(p float64, ok bool) {
+	if ok {
+		m.PValue = &p
+	}
+}
+
+func (m *metricComparison) judge(beyond bool, alpha float64) {
+	m.Significant = m.PValue != nil && *m.PValue < alpha
+	m.Regression = beyond && (m.Significant || m.PValue == nil)
+}
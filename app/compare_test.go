@@ -0,0 +1,210 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// recordRun records a finished run of model m1 in the history with 30
+// seconds of points around the given rate and p99 latency, and failed of
+// every 1000 requests failing.
+func recordRun(t *testing.T, app *App, batchId, name string, rate, p99 float64, failed int) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	spec := &workload.Spec{Metadata: workload.Metadata{Name: name}, Models: []workload.Model{{ID: "a", Model: "m1"}}}
+	if err := app.history.start(&runRecord{BatchId: batchId, Name: name, Started: start, Spec: spec}); err != nil {
+		t.Fatal(err)
+	}
+	var points []point
+	for i := 0; i < 30; i++ {
+		jitter := float64(i%5-2) / 100
+		points = append(points, point{
+			Time:    start.Add(time.Duration(i+1) * time.Second),
+			ModelID: "a",
+			Done:    int(rate),
+			Rate:    rate * (1 + jitter),
+			P50:     p99 / 4 * (1 + jitter),
+			P95:     p99 / 2 * (1 + jitter),
+			P99:     p99 * (1 + jitter),
+		})
+	}
+	if err := app.history.addPoints(batchId, points); err != nil {
+		t.Fatal(err)
+	}
+	m := modelSummary{
+		ID: "a", Model: "m1", Done: 1000 - failed, Failed: failed,
+		ErrorRate: float64(failed) / 1000, Rate: rate,
+		Latency: latencySummary{P50: p99 / 4, P95: p99 / 2, P99: p99},
+	}
+	s := &runSummary{Duration: 30, Done: m.Done, Failed: m.Failed, Rate: rate, Models: []modelSummary{m}}
+	if err := app.history.finish(batchId, start.Add(30*time.Second), outcomeCompleted, s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getComparison(t *testing.T, app *App, query string) *comparison {
+	w := do(app, "GET", "/compare?"+query, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+	}
+	var c comparison
+	if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func metric(t *testing.T, c *comparison, run int, name string) metricComparison {
+	for _, m := range c.Runs[run].Models[0].Metrics {
+		if m.Metric == name {
+			return m
+		}
+	}
+	t.Fatalf("no metric %s in %+v", name, c.Runs[run])
+	return metricComparison{}
+}
+
+func TestCompareRuns(t *testing.T) {
+	app := newTestApp(t)
+	recordRun(t, app, "base", "nightly", 100, 0.200, 1)
+	recordRun(t, app, "same", "nightly", 100, 0.200, 2)
+	recordRun(t, app, "slow", "nightly", 100, 0.300, 1)
+	recordRun(t, app, "drop", "nightly", 80, 0.200, 1)
+	recordRun(t, app, "errs", "nightly", 100, 0.200, 50)
+
+	c := getComparison(t, app, "runs=base,same,slow,drop,errs")
+	if c.Baseline != "base" || len(c.Runs) != 4 || !c.Regression {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+	regressions := map[string]string{"same": "", "slow": "p99", "drop": "rate", "errs": "error_rate"}
+	for i, r := range c.Runs {
+		want := regressions[r.BatchId]
+		if r.Regression != (want != "") {
+			t.Errorf("%s: expected regression %q, got %+v", r.BatchId, want, r)
+		}
+		for _, m := range r.Models[0].Metrics {
+			if m.Regression && m.Metric != want && !(want == "p99" && (m.Metric == "p50" || m.Metric == "p95")) {
+				t.Errorf("%s: unexpected regression of %s", r.BatchId, m.Metric)
+			}
+		}
+		if want != "" {
+			if m := metric(t, c, i, want); !m.Regression || !m.Significant || m.PValue == nil {
+				t.Errorf("%s: expected a significant regression of %s, got %+v", r.BatchId, want, m)
+			}
+		}
+	}
+	if m := metric(t, c, 1, "p99"); m.Change < 0.49 || m.Change > 0.51 {
+		t.Errorf("expected p99 to be 50%% slower, got %+v", m)
+	}
+
+	// Looser tolerances let the slower run pass.
+	if c := getComparison(t, app, "runs=base,slow&latency=0.6"); c.Regression {
+		t.Errorf("expected no regression with 60%% latency tolerance, got %+v", c.Runs)
+	}
+	if w := do(app, "GET", "/compare?runs=base,slow&latency=x", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad tolerance to fail, got %d", w.Code)
+	}
+	for _, alpha := range []string{"0", "1", "1.5"} {
+		if w := do(app, "GET", "/compare?runs=base,slow&alpha="+alpha, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected alpha %s to fail, got %d", alpha, w.Code)
+		}
+	}
+	if w := do(app, "GET", "/compare?runs=base,nope", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown run to fail, got %d", w.Code)
+	}
+	if w := do(app, "GET", "/compare?runs=base", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected a single run without a baseline to fail, got %d", w.Code)
+	}
+}
+
+func TestCompareToPinnedBaseline(t *testing.T) {
+	app := newTestApp(t)
+	recordRun(t, app, "base", "nightly", 100, 0.200, 1)
+	recordRun(t, app, "slow", "nightly", 100, 0.300, 1)
+
+	if w := do(app, "PUT", "/baselines/nightly", url.Values{"batch_id": {"nope"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected pinning an unknown run to fail, got %d", w.Code)
+	}
+	if w := do(app, "PUT", "/baselines/nightly", url.Values{"batch_id": {"base"}}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	w := do(app, "GET", "/baselines", nil)
+	var resp struct{ Baselines []baseline }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Baselines) != 1 || resp.Baselines[0].BatchId != "base" {
+		t.Errorf("expected the pinned baseline, got %+v", resp.Baselines)
+	}
+
+	// A single run is compared to the baseline pinned under its name.
+	c := getComparison(t, app, "runs=slow")
+	if c.Baseline != "base" || len(c.Runs) != 1 || !c.Regression {
+		t.Errorf("expected slow to regress from the pinned baseline, got %+v", c)
+	}
+	if c := getComparison(t, app, "runs=base,slow&baseline=nightly"); len(c.Runs) != 2 || c.Runs[0].Regression {
+		t.Errorf("expected both runs compared to the baseline, got %+v", c)
+	}
+
+	if w := do(app, "DELETE", "/baselines/nightly", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if w := do(app, "DELETE", "/baselines/nightly", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+	if w := do(app, "GET", "/compare?runs=slow", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected no baseline after unpinning, got %d", w.Code)
+	}
+}
+
+func TestCompareMergesWindowLatencies(t *testing.T) {
+	app := newTestApp(t)
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	spec := &workload.Spec{Models: []workload.Model{{ID: "a", Model: "m1"}, {ID: "b", Model: "m1"}}}
+	fast, slow := newHistogram(), newHistogram()
+	for i := 0; i < 900; i++ {
+		fast.record(10 * time.Millisecond)
+	}
+	for i := 0; i < 100; i++ {
+		slow.record(time.Second)
+	}
+	for _, kept := range []map[string]*histogram{{"a": fast, "b": slow}, {"a": fast}} {
+		batchId := fmt.Sprintf("windows-%d", len(kept))
+		if err := app.history.start(&runRecord{BatchId: batchId, Started: start, Spec: spec}); err != nil {
+			t.Fatal(err)
+		}
+		s := &runSummary{Duration: 10, Done: 1000, Models: []modelSummary{
+			{ID: "a", Model: "m1", Done: 900, Latency: fast.summary()},
+			{ID: "b", Model: "m1", Done: 100, Latency: slow.summary()},
+		}, latencies: kept}
+		if err := app.history.finish(batchId, start.Add(10*time.Second), outcomeCompleted, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := app.loadRunData("windows-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slow window's requests are the slowest 10% of the model's.
+	m := d.models["m1"]
+	if l := m.summary.Latency; !m.latencyMerged() || m.summary.Done != 1000 || l.P50 > 0.011 || l.P95 < 0.99 || l.P99 < 0.99 {
+		t.Errorf("expected the latency of both windows, got %+v", m.summary)
+	}
+
+	c := getComparison(t, app, "runs=windows-2,windows-1")
+	mc := c.Runs[0].Models[0]
+	for _, metric := range mc.Metrics {
+		if metric.Metric == "p99" {
+			t.Errorf("expected no latency compared without both windows' distributions, got %+v", metric)
+		}
+	}
+	if mc.Note == "" || len(mc.Metrics) != 2 {
+		t.Errorf("expected the rate and error rate compared with a note, got %+v", mc)
+	}
+}
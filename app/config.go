@@ -14,12 +14,43 @@ type Config struct {
 		PublicDir string `yaml:"public_dir,omitempty"`
 		ViewsDir  string `yaml:"views_dir,omitempty"`
 		ReportDir string `yaml:"report_dir,omitempty"`
+
+		// ReportSinks are the files each run's stats are written to in
+		// report_dir, a CSV file if empty.
+		ReportSinks []SinkConfig `yaml:"report_sinks,omitempty"`
+
+		// WorkloadDir holds the workload library, disabled if empty.
+		WorkloadDir string `yaml:"workload_dir,omitempty"`
+
+		// SessionDir holds saved sessions, report_dir/sessions if empty.
+		SessionDir string `yaml:"session_dir,omitempty"`
+
+		// HistoryDB is the SQLite database of past runs,
+		// report_dir/history.db if empty.
+		HistoryDB string `yaml:"history_db,omitempty"`
 	}
 
 	Settings struct {
 		MaxDial    int `yaml:"max_dial,omitempty"`
 		MaxWorkers int `yaml:"max_workers,omitempty"`
 	}
+
+	// Exporters push the live statistics to time series databases.
+	Exporters []ExporterConfig `yaml:"exporters,omitempty"`
+
+	// Statsd, if set, is sent every request the workers make.
+	Statsd *StatsdConfig `yaml:"statsd,omitempty"`
+
+	// Scrape has the Prometheus endpoints of the target's servers
+	// scraped during runs.
+	Scrape ScrapeConfig `yaml:"scrape,omitempty"`
+
+	// Live configures polling the Ops instance watched in live mode.
+	Live LiveConfig `yaml:"live,omitempty"`
+
+	// AgentToken is the secret shared with the agents runs are split
+	// across. Agents can't register unless it is set.
+	AgentToken string `yaml:"agent_token,omitempty"`
 }
 
 // ReadConfig reads in a YAML config file for the Workload simulator app.
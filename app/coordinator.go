@@ -0,0 +1,397 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentInfo is an agent registered with the coordinator. ClockOffset is
+// the coordinator's clock less the agent's.
+type agentInfo struct {
+	Name        string        `json:"name"`
+	URL         string        `json:"url"`
+	MaxWorkers  int           `json:"max_workers"`
+	ClockOffset time.Duration `json:"clock_offset"`
+	RTT         time.Duration `json:"rtt"`
+	Seen        time.Time     `json:"seen"`
+}
+
+// agentRegistry keeps the agents that registered in the last agentExpiry.
+type agentRegistry struct {
+	clock Clock
+
+	mu     sync.Mutex
+	agents map[string]*agentInfo
+}
+
+func newAgentRegistry(clock Clock) *agentRegistry {
+	return &agentRegistry{clock: clock, agents: make(map[string]*agentInfo)}
+}
+
+func (r *agentRegistry) register(reg agentRegistration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.agents[reg.Name]; !ok {
+		log.Printf("agent %s registered from %s, clock offset %v (rtt %v)", reg.Name, reg.URL, reg.ClockOffset, reg.RTT)
+	}
+	r.agents[reg.Name] = &agentInfo{
+		Name:        reg.Name,
+		URL:         strings.TrimRight(reg.URL, "/"),
+		MaxWorkers:  reg.MaxWorkers,
+		ClockOffset: reg.ClockOffset,
+		RTT:         reg.RTT,
+		Seen:        r.clock.Now(),
+	}
+}
+
+// remove forgets an agent. It reports whether it was registered.
+func (r *agentRegistry) remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.agents[name]
+	delete(r.agents, name)
+	return ok
+}
+
+// live returns the agents heard from in the last agentExpiry by name,
+// forgetting the others.
+func (r *agentRegistry) live() []agentInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	agents := []agentInfo{}
+	for name, a := range r.agents {
+		if now.Sub(a.Seen) > agentExpiry {
+			log.Printf("agent %s expired", name)
+			delete(r.agents, name)
+			continue
+		}
+		agents = append(agents, *a)
+	}
+	sort.Slice(agents, func(i, j int) bool { return agents[i].Name < agents[j].Name })
+	return agents
+}
+
+// agentShare is the workers of a run an agent runs.
+type agentShare struct {
+	agent   agentInfo
+	first   int
+	workers int
+}
+
+// splitWorkers shares out n workers between agents as evenly as their
+// limits allow. It fails if they can't run them all.
+func splitWorkers(n int, agents []agentInfo) ([]agentShare, error) {
+	counts := make([]int, len(agents))
+	left := n
+	for left > 0 {
+		gave := false
+		for i, a := range agents {
+			if left == 0 {
+				break
+			}
+			if a.MaxWorkers > 0 && counts[i] >= a.MaxWorkers {
+				continue
+			}
+			counts[i]++
+			left--
+			gave = true
+		}
+		if !gave {
+			return nil, fmt.Errorf("the %d agents can't run more than %d workers, got %d", len(agents), n-left, n)
+		}
+	}
+	var shares []agentShare
+	first := 0
+	for i, a := range agents {
+		if counts[i] == 0 {
+			continue
+		}
+		shares = append(shares, agentShare{agent: a, first: first, workers: counts[i]})
+		first += counts[i]
+	}
+	return shares, nil
+}
+
+// remoteRun is a run split across agents. The agents' Stats go into the
+// run's collector as if its workers ran here, their times moved to the
+// coordinator's clock.
+type remoteRun struct {
+	shares []agentShare
+
+	// startAt is when every agent starts its share.
+	startAt time.Time
+
+	// offsets of the agents' clocks the run goes by.
+	offsets map[string]time.Duration
+
+	mu sync.Mutex
+	// heard is when each agent still running its share was last heard
+	// from.
+	heard map[string]time.Time
+	// closed is set once the run no longer takes Stats.
+	closed bool
+	// workers stand in for the agents' workers in the Stats.
+	workers map[int]*Workload
+
+	// done is closed when every agent is done or given up on.
+	done chan struct{}
+}
+
+// startRemote starts the shares of a run on the agents. Every agent
+// prepares its share first, then they are all told to start at the same
+// instant a moment from then. If an agent fails to, the others are
+// stopped. It talks to the agents, so the caller must not hold app.mu.
+func (app *App) startRemote(p *plan, batchId string, agents []agentInfo) (*remoteRun, error) {
+	shares, err := splitWorkers(p.spec.Run.Workers, agents)
+	if err != nil {
+		return nil, err
+	}
+	// The spec has the target's api key, which only goes to agents that
+	// registered with the token.
+	token := app.config.AgentToken
+	m := &remoteRun{
+		shares:  shares,
+		offsets: make(map[string]time.Duration),
+		heard:   make(map[string]time.Time),
+		workers: make(map[int]*Workload),
+		done:    make(chan struct{}),
+	}
+	for i, s := range shares {
+		start := agentStart{
+			BatchId:     batchId,
+			Name:        p.name,
+			Spec:        p.spec,
+			Seed:        p.seed,
+			FirstWorker: s.first,
+			Workers:     s.workers,
+			ClockOffset: s.agent.ClockOffset,
+		}
+		if err := postJSON(s.agent.URL+"/agent/start", token, start); err != nil {
+			stopShares(shares[:i], batchId, token)
+			return nil, fmt.Errorf("agent %s: %v", s.agent.Name, err)
+		}
+		m.offsets[s.agent.Name] = s.agent.ClockOffset
+	}
+
+	m.startAt = app.clock.Now().Add(agentStartDelay)
+	for _, s := range shares {
+		if err := postJSON(s.agent.URL+"/agent/go", token, agentGo{BatchId: batchId, StartAt: m.startAt}); err != nil {
+			stopShares(shares, batchId, token)
+			return nil, fmt.Errorf("agent %s: %v", s.agent.Name, err)
+		}
+		m.heard[s.agent.Name] = app.clock.Now()
+	}
+	log.Printf("run %s: split %d workers across %d agents, starting at %v", batchId, p.spec.Run.Workers, len(shares), m.startAt)
+	return m, nil
+}
+
+// stopShares asks the agents to stop their shares of a run.
+func stopShares(shares []agentShare, batchId, token string) {
+	for _, s := range shares {
+		u := s.agent.URL + "/agent/stop?" + url.Values{"batch_id": {batchId}}.Encode()
+		if err := postJSON(u, token, nil); err != nil {
+			log.Printf("agent %s: stopping run %s: %v", s.agent.Name, batchId, err)
+		}
+	}
+}
+
+// add passes an agent's Stats on to stats. It returns false if the run
+// no longer takes them.
+func (m *remoteRun) add(r *run, batch agentStats, now time.Time, stats chan<- *Stat) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.heard[batch.Agent]; !ok || m.closed {
+		return false
+	}
+	offset := m.offsets[batch.Agent]
+	for _, ws := range batch.Stats {
+		latency := ws.Latency
+		if latency == nil {
+			latency = newHistogram()
+		}
+		stats <- &Stat{
+			workload:   m.worker(r, ws),
+			nreqSent:   ws.Sent,
+			nreqDone:   ws.Done,
+			nreqFailed: ws.Failed,
+			latency:    latency,
+			steps:      ws.Steps,
+			joined:     ws.Joined,
+			left:       ws.Left,
+			dt:         ws.Dt,
+			at:         ws.Time.Add(offset),
+			final:      ws.Final,
+		}
+	}
+	m.heard[batch.Agent] = now
+	if batch.Done {
+		m.leave(batch.Agent)
+	}
+	return true
+}
+
+// worker returns the stand in for an agent's worker. m.mu must be held.
+func (m *remoteRun) worker(r *run, ws wireStat) *Workload {
+	if w, ok := m.workers[ws.WorkerId]; ok {
+		return w
+	}
+	spec := r.plan.spec
+	w := &Workload{
+		batchId:  r.batchId,
+		workerId: ws.WorkerId,
+		seed:     r.plan.seed,
+		opsHost:  spec.Target.Host,
+		user:     spec.Target.User,
+		modelId:  ws.ModelId,
+	}
+	for i, model := range spec.Models {
+		if spec.ModelID(i) == ws.ModelId {
+			w.modelName = model.Model
+			w.steps = newScenario(model)
+		}
+	}
+	m.workers[ws.WorkerId] = w
+	return w
+}
+
+// leave marks an agent as done with its share. m.mu must be held.
+func (m *remoteRun) leave(agent string) {
+	if _, ok := m.heard[agent]; !ok {
+		return
+	}
+	delete(m.heard, agent)
+	if len(m.heard) == 0 {
+		close(m.done)
+	}
+}
+
+// waitRemote waits for the agents of the run r to finish their shares, or
+// to be given up on, and records the run.
+func (app *App) waitRemote(r *run, ticker Ticker) {
+	defer ticker.Stop()
+	killc := r.killc
+	for {
+		select {
+		case <-killc:
+			stopShares(r.remote.shares, r.batchId, app.config.AgentToken)
+			killc = nil
+		case <-ticker.C():
+			now := app.clock.Now()
+			r.remote.mu.Lock()
+			for agent, heard := range r.remote.heard {
+				if now.Sub(heard) > agentTimeout {
+					log.Printf("run %s: giving up on agent %s, not heard from since %v", r.batchId, agent, heard)
+					r.remote.leave(agent)
+				}
+			}
+			r.remote.mu.Unlock()
+		case <-r.remote.done:
+			r.remote.mu.Lock()
+			r.remote.closed = true
+			r.remote.mu.Unlock()
+			app.finishRun(r)
+			return
+		}
+	}
+}
+
+// handleAgents lists the live agents on GET and registers an agent on
+// POST.
+func (app *App) handleAgents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"agents": app.agents.live()})
+	case "POST":
+		if !app.checkAgentToken(w, r) {
+			return
+		}
+		var reg agentRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse registration: %v", err), http.StatusBadRequest)
+			return
+		}
+		if reg.Name == "" || reg.URL == "" {
+			http.Error(w, "name and url are required", http.StatusBadRequest)
+			return
+		}
+		if u, err := url.Parse(reg.URL); err != nil || u.Host == "" {
+			http.Error(w, fmt.Sprintf("invalid url %q", reg.URL), http.StatusBadRequest)
+			return
+		}
+		app.agents.register(reg)
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "I only respond to GETs and POSTs.", http.StatusNotImplemented)
+	}
+}
+
+// checkAgentToken answers r with an error unless it has the agents'
+// token, and reports whether it did.
+func (app *App) checkAgentToken(w http.ResponseWriter, r *http.Request) bool {
+	if app.config.AgentToken == "" {
+		http.Error(w, "agents are disabled, agent_token is not set", http.StatusForbidden)
+		return false
+	}
+	if !hasAgentToken(r, app.config.AgentToken) {
+		http.Error(w, "invalid agent token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// handleAgent removes the agent at /agents/{name} on DELETE.
+func (app *App) handleAgent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "I only respond to DELETEs.", http.StatusNotImplemented)
+		return
+	}
+	if !app.checkAgentToken(w, r) {
+		return
+	}
+	if !app.agents.remove(strings.TrimPrefix(r.URL.Path, "/agents/")) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleAgentClock answers with the coordinator's clock, for agents to
+// measure the offset of theirs.
+func (app *App) handleAgentClock(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"time": app.clock.Now()})
+}
+
+// handleAgentStats takes the Stats agents send of their shares of the
+// running run. Stats of other runs are answered with 410 Gone, so the
+// agent drops them.
+func (app *App) handleAgentStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	if !app.checkAgentToken(w, r) {
+		return
+	}
+	var batch agentStats
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, fmt.Sprintf("could not parse stats: %v", err), http.StatusBadRequest)
+		return
+	}
+	app.mu.Lock()
+	run := app.run
+	app.mu.Unlock()
+	if run == nil || run.remote == nil || run.batchId != batch.BatchId ||
+		!run.remote.add(run, batch, app.clock.Now(), run.collector.stats) {
+		http.Error(w, "run "+batch.BatchId+" is not running here", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
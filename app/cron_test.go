@@ -0,0 +1,53 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, expr := range []string{
+		"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "* * * foo *", "@often",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("expected %q to be refused", expr)
+		}
+	}
+	for _, expr := range []string{"* * * * *", "*/15 9-17 * * mon-fri", "0 0 1,15 jan,jul 7", "5/20 * * * *", "@daily"} {
+		if _, err := parseCron(expr); err != nil {
+			t.Errorf("%q: %v", expr, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Monday.
+	t0 := time.Date(2015, 6, 1, 12, 0, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2015, 6, 1, 12, 1, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2015, 6, 1, 12, 15, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2015, 6, 1, 12, 5, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2015, 6, 2, 2, 30, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2015, 6, 6, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2015, 6, 7, 9, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)},
+		// With both day fields set, either one matches.
+		{"0 0 15 * fri", time.Date(2015, 6, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2016, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 feb *", time.Time{}},
+	}
+	for _, test := range tests {
+		c, err := parseCron(test.expr)
+		if err != nil {
+			t.Fatalf("%q: %v", test.expr, err)
+		}
+		if got := c.next(t0); !got.Equal(test.next) {
+			t.Errorf("%q: expected next %v, got %v", test.expr, test.next, got)
+		}
+	}
+}
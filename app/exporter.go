@@ -0,0 +1,367 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Exporter protocols.
+const (
+	ProtocolInfluxHTTP = "influx-http"
+	ProtocolInfluxUDP  = "influx-udp"
+	ProtocolGraphite   = "graphite"
+)
+
+// Tags an exporter can put on its metrics.
+const (
+	TagBatchId    = "batch_id"
+	TagModel      = "model"
+	TagModelId    = "model_id"
+	TagTargetHost = "target_host"
+	TagTargetUser = "target_user"
+)
+
+// ExporterConfig configures an exporter pushing the StatsMonitor's
+// statistics to a time series database.
+type ExporterConfig struct {
+	// Protocol is "influx-http" (InfluxDB line protocol POSTed to
+	// Address, a write URL like http://localhost:8086/write?db=sim),
+	// "influx-udp" (line protocol sent to the UDP host:port Address) or
+	// "graphite" (plaintext with tags over TCP to host:port Address).
+	Protocol string `yaml:"protocol"`
+	Address  string `yaml:"address"`
+
+	// Measurement is the InfluxDB measurement, or the Graphite metric
+	// prefix. Defaults to workload_simulator.
+	Measurement string `yaml:"measurement,omitempty"`
+
+	// Tags picked from batch_id, model, model_id, target_host and
+	// target_user. Defaults to batch_id, model and target_host.
+	Tags []string `yaml:"tags,omitempty"`
+
+	// StaticTags are added to every metric.
+	StaticTags map[string]string `yaml:"static_tags,omitempty"`
+
+	// Interval between samples of the statistics. Defaults to 10s.
+	Interval workload.Duration `yaml:"interval,omitempty"`
+
+	// BatchSize is the most lines sent at once, 1000 by default.
+	BatchSize int `yaml:"batch_size,omitempty"`
+
+	// BufferSize is the most lines kept while the endpoint is down, the
+	// oldest are dropped beyond it. 100000 by default.
+	BufferSize int `yaml:"buffer_size,omitempty"`
+}
+
+// exporter samples the StatsMonitor's Reports every interval and pushes
+// them in batches. Lines it can't send are kept and sent with the next
+// batch.
+type exporter struct {
+	cfg   ExporterConfig
+	clock Clock
+	send  func(lines []string) error
+
+	// reports is tapped into the StatsMonitor.
+	reports chan *Report
+	latest  *Report
+	last    *Report
+
+	buf     []string
+	dropped int
+
+	// graphite connection, redialed after errors.
+	conn net.Conn
+
+	ticker Ticker
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newExporter checks cfg and starts an exporter sampling on clock.
+func newExporter(clock Clock, cfg ExporterConfig) (*exporter, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("exporter %s: address is required", cfg.Protocol)
+	}
+	if cfg.Measurement == "" {
+		cfg.Measurement = "workload_simulator"
+	}
+	if cfg.Tags == nil {
+		cfg.Tags = []string{TagBatchId, TagModel, TagTargetHost}
+	}
+	for _, t := range cfg.Tags {
+		switch t {
+		case TagBatchId, TagModel, TagModelId, TagTargetHost, TagTargetUser:
+		default:
+			return nil, fmt.Errorf("exporter %s: unknown tag %q", cfg.Protocol, t)
+		}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = workload.Duration(10 * time.Second)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 100000
+	}
+
+	e := &exporter{
+		cfg:     cfg,
+		clock:   clock,
+		reports: make(chan *Report, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	switch cfg.Protocol {
+	case ProtocolInfluxHTTP:
+		e.send = e.sendHTTP
+	case ProtocolInfluxUDP:
+		e.send = e.sendUDP
+	case ProtocolGraphite:
+		e.send = e.sendGraphite
+	default:
+		return nil, fmt.Errorf("unknown exporter protocol %q", cfg.Protocol)
+	}
+	e.ticker = clock.NewTicker(time.Duration(cfg.Interval))
+	go e.loop()
+	return e, nil
+}
+
+func (e *exporter) loop() {
+	defer close(e.done)
+	defer e.ticker.Stop()
+	for {
+		select {
+		case r := <-e.reports:
+			e.latest = r
+		case now := <-e.ticker.C():
+			e.sample(now)
+			e.flush()
+		case <-e.quit:
+			e.flush()
+			if e.conn != nil {
+				e.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+// stop sends what it can and stops the exporter.
+func (e *exporter) stop() {
+	close(e.quit)
+	<-e.done
+}
+
+// sample turns the latest Report into lines. Reports are only exported
+// while a run makes progress, so an idle simulator doesn't repeat the last
+// run's numbers forever.
+func (e *exporter) sample(now time.Time) {
+	r := e.latest
+	if r == nil || r.batchId == "" || !progressed(e.last, r) {
+		return
+	}
+	e.last = r
+	var lines []string
+	for _, id := range sortedMetricIds(r.metrics) {
+		m := r.metrics[id]
+		tags := e.tags(r, id)
+		fields := [][2]string{
+			{"requests_sent", strconv.Itoa(m.reqSent)},
+			{"requests_done", strconv.Itoa(m.reqComplete)},
+			{"requests_per_second", strconv.Itoa(m.reqPerSec)},
+		}
+		if e.cfg.Protocol == ProtocolGraphite {
+			lines = append(lines, graphiteLines(e.cfg.Measurement, tags, fields, now)...)
+		} else {
+			lines = append(lines, influxLine(e.cfg.Measurement, tags, fields, now))
+		}
+	}
+	e.buf = append(e.buf, lines...)
+	if over := len(e.buf) - e.cfg.BufferSize; over > 0 {
+		if e.dropped == 0 {
+			log.Printf("exporter %s: buffer full, dropping the oldest metrics", e.cfg.Address)
+		}
+		e.dropped += over
+		e.buf = e.buf[over:]
+	}
+}
+
+// progressed reports whether r shows progress since the last exported
+// Report: more requests, or different rates.
+func progressed(last, r *Report) bool {
+	if last == nil || last.batchId != r.batchId || last.requestSent != r.requestSent || last.requestDone != r.requestDone {
+		return true
+	}
+	for id, m := range r.metrics {
+		if m.reqPerSec != 0 || last.metrics[id].reqPerSec != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// flush sends the buffered lines in batches, keeping them from the first
+// batch that fails.
+func (e *exporter) flush() {
+	for len(e.buf) > 0 {
+		n := e.cfg.BatchSize
+		if n > len(e.buf) {
+			n = len(e.buf)
+		}
+		if err := e.send(e.buf[:n]); err != nil {
+			log.Printf("exporter %s: %v, keeping %d lines", e.cfg.Address, err, len(e.buf))
+			return
+		}
+		e.buf = e.buf[n:]
+		if e.dropped > 0 {
+			log.Printf("exporter %s: sending again, %d lines were dropped", e.cfg.Address, e.dropped)
+			e.dropped = 0
+		}
+	}
+}
+
+func (e *exporter) tags(r *Report, modelId string) [][2]string {
+	var tags [][2]string
+	for _, t := range e.cfg.Tags {
+		var v string
+		switch t {
+		case TagBatchId:
+			v = r.batchId
+		case TagModel:
+			v = r.modelNames[modelId]
+		case TagModelId:
+			v = modelId
+		case TagTargetHost:
+			v = r.opsHost
+		case TagTargetUser:
+			v = r.user
+		}
+		if v != "" {
+			tags = append(tags, [2]string{t, v})
+		}
+	}
+	for k, v := range e.cfg.StaticTags {
+		tags = append(tags, [2]string{k, v})
+	}
+	// Both protocols are most efficient with tags in key order.
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+	return tags
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+var influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// influxLine formats a point in InfluxDB line protocol with integer fields
+// and a nanosecond timestamp.
+func influxLine(measurement string, tags, fields [][2]string, t time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	for _, tag := range tags {
+		fmt.Fprintf(&b, ",%s=%s", influxTagEscaper.Replace(tag[0]), influxTagEscaper.Replace(tag[1]))
+	}
+	for i, f := range fields {
+		sep := ","
+		if i == 0 {
+			sep = " "
+		}
+		fmt.Fprintf(&b, "%s%s=%si", sep, influxTagEscaper.Replace(f[0]), f[1])
+	}
+	fmt.Fprintf(&b, " %d", t.UnixNano())
+	return b.String()
+}
+
+// graphiteTagEscaper replaces the characters Graphite doesn't allow in
+// tags.
+var graphiteTagEscaper = strings.NewReplacer(";", "_", "!", "_", "^", "_", "=", "_", " ", "_", "~", "_")
+
+// graphiteLines formats a point as Graphite plaintext lines, one per field,
+// with tags and a timestamp in seconds.
+func graphiteLines(prefix string, tags, fields [][2]string, t time.Time) []string {
+	var suffix strings.Builder
+	for _, tag := range tags {
+		fmt.Fprintf(&suffix, ";%s=%s", graphiteTagEscaper.Replace(tag[0]), graphiteTagEscaper.Replace(tag[1]))
+	}
+	lines := make([]string, 0, len(fields))
+	for _, f := range fields {
+		lines = append(lines, fmt.Sprintf("%s.%s%s %s %d", prefix, f[0], suffix.String(), f[1], t.Unix()))
+	}
+	return lines
+}
+
+var exporterClient = &http.Client{Timeout: 5 * time.Second}
+
+func (e *exporter) sendHTTP(lines []string) error {
+	body := strings.Join(lines, "\n") + "\n"
+	resp, err := exporterClient.Post(e.cfg.Address, "text/plain; charset=utf-8", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("influx returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// maxDatagram keeps UDP packets within a typical MTU.
+const maxDatagram = 1400
+
+func (e *exporter) sendUDP(lines []string) error {
+	conn, err := net.Dial("udp", e.cfg.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet bytes.Buffer
+	for _, l := range lines {
+		if packet.Len() > 0 && packet.Len()+len(l)+1 > maxDatagram {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		packet.WriteString(l)
+		packet.WriteByte('\n')
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+func (e *exporter) sendGraphite(lines []string) error {
+	if e.conn == nil {
+		conn, err := net.DialTimeout("tcp", e.cfg.Address, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+	e.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := e.conn.Write([]byte(strings.Join(lines, "\n") + "\n")); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+	return nil
+}
+
+func sortedMetricIds(m map[string]Metric) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func testReport(sent int) *Report {
+	return &Report{
+		batchId:     "b1",
+		opsHost:     "http://ops",
+		user:        "demo",
+		requestSent: sent,
+		requestDone: sent,
+		metrics:     map[string]Metric{"0": {reqSent: sent, reqComplete: sent, reqPerSec: 3}},
+		modelNames:  map[string]string{"0": "rent viz,1"},
+	}
+}
+
+// tapReport hands r to the exporter and waits until its loop has taken it.
+func tapReport(t *testing.T, e *exporter, r *Report) {
+	e.reports <- r
+	deadline := time.Now().Add(5 * time.Second)
+	for len(e.reports) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the exporter")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInfluxLine(t *testing.T) {
+	tags := [][2]string{{"host", "a b"}, {"model", "x,y=z"}}
+	fields := [][2]string{{"sent", "10"}, {"done", "9"}}
+	got := influxLine("sim ops", tags, fields, time.Unix(1433160000, 5))
+	want := `sim\ ops,host=a\ b,model=x\,y\=z sent=10i,done=9i 1433160000000000005`
+	if got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	lines := graphiteLines("sim", tags, fields, time.Unix(1433160000, 5))
+	if len(lines) != 2 || lines[0] != "sim.sent;host=a_b;model=x,y_z 10 1433160000" {
+		t.Errorf("unexpected graphite lines %q", lines)
+	}
+}
+
+func TestExporterConfig(t *testing.T) {
+	bad := []ExporterConfig{
+		{Protocol: "carbon", Address: "localhost:2003"},
+		{Protocol: ProtocolGraphite},
+		{Protocol: ProtocolGraphite, Address: "localhost:2003", Tags: []string{"color"}},
+	}
+	for _, c := range bad {
+		if _, err := newExporter(newFakeClock(), c); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+	cfg := &Config{Exporters: bad[:1]}
+	if _, err := New(cfg); err == nil {
+		t.Error("expected New to reject a bad exporter")
+	}
+}
+
+func TestExporterInfluxHTTPBuffersWhileDown(t *testing.T) {
+	var mu sync.Mutex
+	up := false
+	bodies := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !up {
+			http.Error(w, "database not found", http.StatusNotFound)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	clock := newFakeClock()
+	e, err := newExporter(clock, ExporterConfig{
+		Protocol:   ProtocolInfluxHTTP,
+		Address:    ts.URL + "/write?db=sim",
+		StaticTags: map[string]string{"env": "ci"},
+		Interval:   workload.Duration(time.Second),
+		BatchSize:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+
+	tapReport(t, e, testReport(10))
+	clock.Advance(time.Second)
+	tapReport(t, e, testReport(20))
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	clock.Advance(time.Second)
+
+	// Both samples arrive, one batch each, oldest first.
+	for _, sent := range []string{"requests_sent=10i", "requests_sent=20i"} {
+		select {
+		case b := <-bodies:
+			if !strings.HasPrefix(b, `workload_simulator,batch_id=b1,env=ci,model=rent\ viz\,1,target_host=http://ops `) ||
+				!strings.Contains(b, sent) {
+				t.Errorf("expected a line with %s, got %q", sent, b)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for influx writes")
+		}
+	}
+
+	// Nothing is exported while the run stands still.
+	idle := testReport(20)
+	idle.metrics["0"] = Metric{reqSent: 20, reqComplete: 20}
+	tapReport(t, e, idle)
+	clock.Advance(time.Second)
+	tapReport(t, e, idle)
+	clock.Advance(time.Second)
+	tapReport(t, e, idle)
+	select {
+	case b := <-bodies:
+		if !strings.Contains(b, "requests_per_second=0i") {
+			t.Errorf("expected the run to stop once, got %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the last write")
+	}
+	select {
+	case b := <-bodies:
+		t.Errorf("expected no writes while idle, got %q", b)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestExporterInfluxUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	clock := newFakeClock()
+	e, err := newExporter(clock, ExporterConfig{
+		Protocol: ProtocolInfluxUDP,
+		Address:  pc.LocalAddr().String(),
+		Tags:     []string{TagModelId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+	tapReport(t, e, testReport(10))
+	clock.Advance(10 * time.Second)
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "workload_simulator,model_id=0 requests_sent=10i,requests_done=10i,requests_per_second=3i"
+	if got := string(buf[:n]); !strings.HasPrefix(got, want) {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestExporterGraphite(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sc := bufio.NewScanner(conn)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+	}()
+
+	clock := newFakeClock()
+	e, err := newExporter(clock, ExporterConfig{
+		Protocol:    ProtocolGraphite,
+		Address:     l.Addr().String(),
+		Measurement: "sim",
+		Tags:        []string{TagModel, TagTargetUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.stop()
+	tapReport(t, e, testReport(10))
+	clock.Advance(10 * time.Second)
+
+	ts := clock.Now().Unix()
+	for _, want := range []string{"sim.requests_sent", "sim.requests_done", "sim.requests_per_second"} {
+		select {
+		case line := <-lines:
+			if !strings.HasPrefix(line, want+";model=rent_viz,1;target_user=demo ") || !strings.HasSuffix(line, " "+strconv.FormatInt(ts, 10)) {
+				t.Errorf("expected %s, got %q", want, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for graphite lines")
+		}
+	}
+}
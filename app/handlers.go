@@ -1,14 +1,18 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/yhat/workload-simulator/workload"
 )
 
 // handleRoot renders the home page or redirects if ping timeout is
@@ -32,154 +36,299 @@ func (app *App) handleRoot(w http.ResponseWriter, r *http.Request) {
 	app.Render("index", w, r, data)
 }
 
-// structs to parse workload JSON.
-type modelData struct {
-	Query string
-	QPS   string
-}
+// handleWorkload sends workload to worker goroutines. The workload is
+// either the UI's workload and settings form values or a workload file in
+// the spec form value.
+func (app *App) handleWorkload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
 
-type queryData struct {
-	Model string
-	Input map[string]interface{}
-}
+	// Decode json-encoded form values and refuse to start anything if
+	// a single window is invalid.
+	p, problems := app.parseForm(r)
+	if problems == nil && p.spec.Search != nil {
+		problems = workload.Problems{{Field: "search", Message: "searches are started with /search"}}
+	}
+	if problems != nil {
+		writeWorkloadError(w, problems)
+		return
+	}
+	app.mu.Lock()
+	searching := app.search != nil
+	app.mu.Unlock()
+	if searching {
+		writeWorkloadError(w, workload.Problems{{Field: "workload", Message: "a search is running"}})
+		return
+	}
 
-type settings struct {
-	OpsHost    string `json:"ops_host"`
-	ApiKey     string `json:"ops_apikey"`
-	User       string `json:"ops_user"`
-	MaxDialVal int    `json:"dial_max_value"`
-	Workers    string `json:"workers"`
+	batchId, err := app.startRun(p)
+	if err != nil {
+		writeWorkloadError(w, workload.Problems{{Field: "workload", Message: err.Error()}})
+		return
+	}
+
+	data := map[string]interface{}{
+		"batch_id": batchId,
+		"seed":     strconv.FormatInt(p.seed, 10),
+	}
+	b, err := formatJSONresp(true, data)
+	if err != nil {
+		http.Error(w, "failed to marshal data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-type modelInput struct {
-	// model name
-	name string
+// parseForm reads a workload from the library by its name form value, from
+// a spec form value, or from the UI's workload and settings form values.
+func (app *App) parseForm(r *http.Request) (*plan, workload.Problems) {
+	if name := r.FormValue("name"); name != "" {
+		return app.parseNamed(name, r.FormValue("version"))
+	}
+	if spec := r.FormValue("spec"); spec != "" {
+		return app.parseSpec(spec)
+	}
+	return app.parseWorkload(r.FormValue("workload"), r.FormValue("settings"))
+}
 
-	// input data
-	input map[string]interface{}
+// handleValidate checks a workload without running it and lists every
+// problem found.
+func (app *App) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	_, problems := app.parseForm(r)
+	if problems == nil {
+		problems = workload.Problems{}
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"valid":    len(problems) == 0,
+		"problems": problems,
+	})
+	if err != nil {
+		http.Error(w, "failed to marshal data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
 
-	// queries per second
-	qps int
+// handleLoad converts a workload file in any supported format and version
+// to the UI's workload and settings.
+func (app *App) handleLoad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	spec, err := workload.Parse([]byte(r.FormValue("spec")))
+	if err != nil {
+		problems, ok := err.(workload.Problems)
+		if !ok {
+			problems = workload.Problems{{Field: "spec", Message: err.Error()}}
+		}
+		writeWorkloadError(w, problems)
+		return
+	}
+	wl, settings, warnings := spec.Legacy()
+	b, err := json.Marshal(map[string]interface{}{
+		"workload": wl,
+		"settings": settings,
+		"warnings": warnings,
+	})
+	if err != nil {
+		http.Error(w, "failed to marshal data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
 }
 
-// handleWorkload sends workload to worker goroutines.
-func (app *App) handleWorkload(w http.ResponseWriter, r *http.Request) {
+// handleLibrary lists the workload library on GET and adds a workload to
+// it on POST.
+func (app *App) handleLibrary(w http.ResponseWriter, r *http.Request) {
+	if app.library == nil {
+		http.Error(w, "no workload library configured", http.StatusNotFound)
+		return
+	}
 	switch r.Method {
-	case "POST":
-		// Decode json-encoded form values
-		wl := r.FormValue("workload")
-		s := r.FormValue("settings")
-
-		work := make(map[string]modelData)
-		err := json.Unmarshal([]byte(wl), &work)
+	case "GET":
+		entries, err := app.library.List()
 		if err != nil {
-			fmt.Printf("error parsing workload form: %v\n", err)
+			log.Println(err)
+			http.Error(w, "failed to list workloads", http.StatusInternalServerError)
 			return
 		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"workloads": entries})
+	case "POST":
+		name := r.FormValue("name")
+		spec, ok := parseLibrarySpec(w, r)
+		if !ok {
+			return
+		}
+		if err := app.library.Create(name, spec); err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"name": name, "version": 1})
+	default:
+		http.Error(w, "I only respond to GETs and POSTs.", http.StatusNotImplemented)
+	}
+}
 
-		settings := &settings{}
-		err = json.Unmarshal([]byte(s), settings)
+// handleLibraryWorkload serves a single workload of the library at
+// /workloads/{name}: GET reads it, PUT saves a new version and DELETE
+// removes it. /workloads/{name}/versions lists its versions.
+//
+// GET takes an optional version and a format of "json" (the default),
+// "yaml" or "legacy", the UI's workload and settings.
+func (app *App) handleLibraryWorkload(w http.ResponseWriter, r *http.Request) {
+	if app.library == nil {
+		http.Error(w, "no workload library configured", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/workloads/")
+	if strings.HasSuffix(name, "/versions") {
+		if r.Method != "GET" {
+			http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+			return
+		}
+		versions, err := app.library.Versions(strings.TrimSuffix(name, "/versions"))
 		if err != nil {
-			fmt.Printf("error parsing form settings: %v\n", err)
+			writeLibraryError(w, err)
+			return
 		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"versions": versions})
+		return
+	}
 
-		// This builds a map that maps a model prediction window to a model
-		// input for Ops.
-		wrk := make(map[string]*modelInput)
-		for k, v := range work {
-			q := queryData{}
-			err = json.Unmarshal([]byte(v.Query), &q)
-			if err != nil {
-				fmt.Printf("error parsing workload form: %v\n", err)
-				data := make(map[string]interface{})
-				b, err := formatJSONresp(false, data)
-				if err != nil {
-					http.Error(w, "failed to parse workload data", http.StatusInternalServerError)
-
-					return
-				}
-				w.Header().Set("Content-Type", "application/json")
-				w.Write(b)
-			}
-
-			modelName := q.Model
-			input := q.Input
-
-			iqps, err := strconv.Atoi(v.QPS)
-			if err != nil {
-				fmt.Println("could not parse qps into int:")
+	switch r.Method {
+	case "GET":
+		version := 0
+		if v := r.FormValue("version"); v != "" {
+			var err error
+			if version, err = strconv.Atoi(v); err != nil {
+				http.Error(w, fmt.Sprintf("invalid version %q", v), http.StatusBadRequest)
 				return
 			}
-			// create model input for each window.
-			modelInput := &modelInput{
-				name:  modelName,
-				input: input,
-				qps:   iqps,
-			}
-			wrk[k] = modelInput
-
 		}
-
-		// Open file for csv output on a per workload basis.
-		// The pause button event should close this file.
-		batchId, err := uuid()
-		if err != nil {
-			log.Printf("error generating uuid: %v", err)
-		}
-
-		filename := app.config.ReportDir + "/" + "workload_data_" + batchId
-		outfile, err := os.Create(filename)
+		spec, version, err := app.library.GetVersion(name, version)
 		if err != nil {
-			log.Printf("failed to create report file: %v", err)
+			writeLibraryError(w, err)
+			return
 		}
-		app.reportfile = outfile
-
-		if err = WriteHeader(outfile); err != nil {
-			log.Printf("failed to write csv header: %v", err)
+		switch r.FormValue("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"name":    name,
+				"version": version,
+				"spec":    spec,
+			})
+		case "yaml":
+			b, err := workload.Marshal(spec, "yaml")
+			if err != nil {
+				http.Error(w, "failed to marshal workload", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "text/yaml")
+			w.Write(b)
+		case "legacy":
+			wl, settings, warnings := spec.Legacy()
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"name":     name,
+				"version":  version,
+				"workload": wl,
+				"settings": settings,
+				"warnings": warnings,
+			})
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %q", r.FormValue("format")), http.StatusBadRequest)
 		}
-
-		// Spawn goroutines and randomly assign work
-		n := len(wrk)
-		if n == 0 {
-			http.Error(w, "no work to be done", http.StatusInternalServerError)
+	case "PUT":
+		spec, ok := parseLibrarySpec(w, r)
+		if !ok {
 			return
 		}
-		nw, err := strconv.Atoi(settings.Workers)
+		version, err := app.library.Update(name, spec)
 		if err != nil {
-			http.Error(w, "error parsing worker count", http.StatusInternalServerError)
+			writeLibraryError(w, err)
 			return
 		}
-		app.config.currentWorkers = nw
-
-		for i := 0; i < nw; i++ {
-			// Choose a model from the workload at random.
-			modelId := strconv.Itoa(rand.Intn(n))
-			model := wrk[modelId]
-			work := &Workload{
-				dt:         500 * time.Millisecond,
-				batchId:    batchId,
-				workerId:   i,
-				opsHost:    settings.OpsHost,
-				apiKey:     settings.ApiKey,
-				user:       settings.User,
-				nrequests:  model.qps,
-				modelId:    modelId,
-				modelName:  model.name,
-				modelInput: model.input,
-			}
-			Worker(app.Statc, app.Killc, work)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "version": version})
+	case "DELETE":
+		if err := app.library.Delete(name); err != nil {
+			writeLibraryError(w, err)
+			return
 		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
 	default:
-		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		http.Error(w, "I only respond to GETs, PUTs and DELETEs.", http.StatusNotImplemented)
 	}
+}
 
-	data := make(map[string]interface{})
-	b, err := formatJSONresp(true, data)
+// parseLibrarySpec reads the spec form value of a workload being saved to
+// the library. Workloads with problems are refused.
+func parseLibrarySpec(w http.ResponseWriter, r *http.Request) (*workload.Spec, bool) {
+	spec, err := workload.Parse([]byte(r.FormValue("spec")))
+	if err != nil {
+		problems, ok := err.(workload.Problems)
+		if !ok {
+			problems = workload.Problems{{Field: "spec", Message: err.Error()}}
+		}
+		writeWorkloadError(w, problems)
+		return nil, false
+	}
+	if problems := spec.Validate(); problems != nil {
+		writeWorkloadError(w, problems)
+		return nil, false
+	}
+	return spec, true
+}
+
+// writeLibraryError responds with the status matching an error reading or
+// writing a saved workload or session.
+func writeLibraryError(w http.ResponseWriter, err error) {
+	switch err {
+	case workload.ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case workload.ErrExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
 	if err != nil {
 		http.Error(w, "failed to marshal data", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeWorkloadError tells the UI a workload was not started and why.
+func writeWorkloadError(w http.ResponseWriter, problems workload.Problems) {
+	msg := problems.Error()
+	log.Printf("refusing workload: %s", msg)
+	data := map[string]interface{}{
+		"error":    map[string]interface{}{"message": msg},
+		"problems": problems,
+	}
+	b, err := formatJSONresp(false, data)
+	if err != nil {
+		http.Error(w, "failed to parse workload data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
 	w.Write(b)
 }
 
@@ -204,18 +353,11 @@ func (app *App) handleUnload(w http.ResponseWriter, r *http.Request) {
 
 // handlePause kills the worker goroutines.
 func (app *App) handlePause(w http.ResponseWriter, r *http.Request) {
-	nw := app.config.currentWorkers
-	for i := 0; i < nw; i++ {
-		app.Killc <- 1
-	}
-	// avoid trying to close a nil file handler
-	if app.reportfile != nil {
-		err := app.reportfile.Close()
-		if err != nil {
-			log.Printf("failed to close report file: %v", err)
-		}
-		app.reportfile = nil
-	}
+	app.mu.Lock()
+	app.stopWorkers(outcomeStopped, stopPaused)
+	closeSinks(app.sinks)
+	app.sinks = nil
+	app.mu.Unlock()
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
@@ -242,34 +384,24 @@ func (app *App) handleStats(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// iterate over models and map modelId to requests per second.
-		ts := time.Now()
-		records := make([]*CsvMetric, 0)
 		for k, v := range r {
 			stats[k] = int(v)
-			csv := &CsvMetric{
-				ts:           ts,
-				batchId:      statReport.batchId,
-				opsHost:      statReport.opsHost,
-				opsUser:      statReport.user,
-				opsModelName: statReport.modelName,
-				nWorkers:     app.config.currentWorkers,
-				reqSent:      statReport.requestSent,
-				reqComplete:  statReport.requestDone,
-				reqPerSec:    v,
-			}
-			records = append(records, csv)
 		}
 		for k, v := range rd {
 			rdone[k] = v
 		}
 		data["stats"] = stats
 		data["rdone"] = rdone
-		if app.reportfile != nil {
-			if err := WriteCsv(app.reportfile, records); err != nil {
-				log.Printf("failed to write csv stats in /stats handler: %v", err)
+		app.mu.Lock()
+		if run := app.run; run != nil && run.batchId == statReport.batchId {
+			run.mu.Lock()
+			if len(run.knees) > 0 {
+				data["knees"] = run.knees
 			}
+			run.mu.Unlock()
 		}
-	case <-time.After(time.Second):
+		app.mu.Unlock()
+	case <-app.clock.After(time.Second):
 		data["running"] = false
 	}
 
@@ -287,14 +419,33 @@ func (app *App) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// handleLive handles the live server request
+// handleLive renders the live mode page.
 func (app *App) handleLive(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	data := map[string]interface{}{
+		"Live":       true,
+		"Redirected": false,
+		"MaxDial":    app.config.MaxDial,
+		"Host":       app.config.OpsHost,
+		"ApiKey":     app.config.OpsApiKey,
+		"User":       app.config.OpsUser,
+		"Workers":    app.config.MaxWorkers,
+	}
+	app.Render("index", w, r, data)
 }
 
-// handleLive handles the live server request
+// handleLiveStats returns the time series of the Ops instance in the
+// settings form value, polling it from now on if it wasn't already.
 func (app *App) handleLiveStats(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	var t liveTarget
+	if err := json.Unmarshal([]byte(r.FormValue("settings")), &t); err != nil {
+		writeJSON(w, http.StatusBadRequest, newLiveStats(nil, fmt.Errorf("could not parse settings: %v", err)))
+		return
+	}
+	writeJSON(w, http.StatusOK, newLiveStats(app.live.watch(t)))
 }
 
 // handleSql sql connection
@@ -303,17 +454,398 @@ func (app *App) handleSql(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("OK"))
 }
 
-// handleSave saves the workloads being run
+// handleSave saves the UI's workload and settings form values as a
+// session under the name form value. Saving again under the same name
+// replaces the session.
 func (app *App) handleSave(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	s, err := app.saveSession(r.FormValue("name"), r.FormValue("workload"), r.FormValue("settings"))
+	if err != nil {
+		log.Printf("failed to save session: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": s.Name, "saved": s.Saved})
+}
+
+// handleSessions lists the saved sessions.
+func (app *App) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	infos, err := app.listSessions()
+	if err != nil {
+		log.Printf("failed to list sessions: %v", err)
+		http.Error(w, "failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": infos})
+}
+
+// handleSession restores the session at /sessions/{name} on GET and
+// deletes it on DELETE.
+func (app *App) handleSession(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	switch r.Method {
+	case "GET":
+		s, err := app.loadSession(name)
+		if err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case "DELETE":
+		if err := app.deleteSession(name); err != nil {
+			writeLibraryError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "I only respond to GETs and DELETEs.", http.StatusNotImplemented)
+	}
+}
+
+// handleRuns lists past runs, most recent first. Runs can be selected by
+// start time with from and to, as dates or RFC 3339 times, and by host,
+// model, tag and outcome. limit caps the number of runs, 100 by default.
+func (app *App) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "no run history configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	f, err := parseRunFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	runs, err := app.history.runs(f)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to query runs", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"runs": runs})
+}
+
+// handleRun serves a past run with its workload and summary at
+// /runs/{batchId}, and its time series at /runs/{batchId}/series,
+// optionally of one model.
+func (app *App) handleRun(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "no run history configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	batchId := strings.TrimPrefix(r.URL.Path, "/runs/")
+	series := strings.HasSuffix(batchId, "/series")
+	batchId = strings.TrimSuffix(batchId, "/series")
+
+	rec, err := app.history.run(batchId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read run", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !series {
+		// Runs recorded before keys were left out of the history have
+		// theirs stored.
+		rec.Spec = withoutAPIKey(rec.Spec)
+		writeJSON(w, http.StatusOK, rec)
+		return
+	}
+	points, err := app.history.points(batchId, r.FormValue("model"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read run", http.StatusInternalServerError)
+		return
+	}
+	server, err := app.history.serverPoints(batchId)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read run", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"batch_id": batchId, "points": points, "server": server})
+}
+
+// handleReport serves the HTML report of the run at /reports/{batchId}.
+// Runs in the history without a report file, such as runs from before
+// reports were written, get one rendered on the fly.
+func (app *App) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	batchId := strings.TrimPrefix(r.URL.Path, "/reports/")
+	if batchId == "" || strings.ContainsAny(batchId, `/\`) || strings.HasPrefix(batchId, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	if app.config.ReportDir != "" {
+		f, err := os.Open(reportPath(app.config.ReportDir, batchId))
+		if err == nil {
+			defer f.Close()
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.Copy(w, f)
+			return
+		}
+	}
+	if app.history == nil {
+		http.NotFound(w, r)
+		return
+	}
+	rec, err := app.history.run(batchId)
+	if err == nil && (rec == nil || rec.Summary == nil) {
+		http.NotFound(w, r)
+		return
+	}
+	var points []point
+	var server []serverPoint
+	if err == nil {
+		points, err = app.history.points(batchId, "")
+	}
+	if err == nil {
+		server, err = app.history.serverPoints(batchId)
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read run", http.StatusInternalServerError)
+		return
+	}
+	var buf bytes.Buffer
+	if err := app.renderReport(&buf, rec, points, server); err != nil {
+		log.Println(err)
+		http.Error(w, "failed to render report", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// handleCompare compares runs model by model and flags regressions. The
+// runs form value lists batch ids separated by commas. Runs are compared to
+// the run pinned as the baseline form value, or to the first run listed.
+// A single run without a baseline is compared to the baseline pinned under
+// its workload's name. The tolerances throughput, latency and error_rate
+// and the significance level alpha override the defaults.
+func (app *App) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "no run history configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	var runs []string
+	for _, id := range strings.Split(r.FormValue("runs"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			runs = append(runs, id)
+		}
+	}
+	tol, err := parseTolerances(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := r.FormValue("baseline")
+	if name == "" && len(runs) == 1 {
+		rec, err := app.history.run(runs[0])
+		if err != nil || rec == nil {
+			http.Error(w, fmt.Sprintf("no run %s", runs[0]), http.StatusNotFound)
+			return
+		}
+		name = rec.Name
+	}
+	var base string
+	if name != "" {
+		if base, err = app.history.baseline(name); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to read baseline", http.StatusInternalServerError)
+			return
+		}
+		if base == "" {
+			http.Error(w, fmt.Sprintf("no baseline pinned as %q", name), http.StatusNotFound)
+			return
+		}
+	} else if len(runs) >= 2 {
+		base, runs = runs[0], runs[1:]
+	}
+	if base == "" || len(runs) == 0 {
+		http.Error(w, "compare needs two runs, or runs and a baseline", http.StatusBadRequest)
+		return
+	}
+
+	c, err := app.compareRuns(base, runs, tol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func parseTolerances(r *http.Request) (tolerances, error) {
+	tol := defaultTolerances
+	fields := []struct {
+		name string
+		v    *float64
+	}{
+		{"throughput", &tol.Throughput},
+		{"latency", &tol.Latency},
+		{"error_rate", &tol.ErrorRate},
+		{"alpha", &tol.Alpha},
+	}
+	for _, f := range fields {
+		if v := r.FormValue(f.name); v != "" {
+			x, err := strconv.ParseFloat(v, 64)
+			if err != nil || x < 0 {
+				return tol, fmt.Errorf("invalid %s %q", f.name, v)
+			}
+			*f.v = x
+		}
+	}
+	if tol.Alpha <= 0 || tol.Alpha >= 1 {
+		return tol, fmt.Errorf("invalid alpha %q, expected a significance level between 0 and 1", r.FormValue("alpha"))
+	}
+	return tol, nil
+}
+
+// handleBaselines lists the pinned baselines.
+func (app *App) handleBaselines(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "no run history configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	baselines, err := app.history.baselines()
+	if err != nil {
+		log.Println(err)
+		http.Error(w, "failed to read baselines", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"baselines": baselines})
+}
+
+// handleBaseline pins the run in the batch_id form value as the baseline
+// at /baselines/{name} on PUT or POST, and unpins it on DELETE.
+func (app *App) handleBaseline(w http.ResponseWriter, r *http.Request) {
+	if app.history == nil {
+		http.Error(w, "no run history configured", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/baselines/")
+	if name == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "PUT", "POST":
+		batchId := r.FormValue("batch_id")
+		rec, err := app.history.run(batchId)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "failed to read run", http.StatusInternalServerError)
+			return
+		}
+		if rec == nil || rec.Summary == nil {
+			http.Error(w, fmt.Sprintf("no finished run %q", batchId), http.StatusBadRequest)
+			return
+		}
+		if err := app.history.pin(name, batchId, app.clock.Now()); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to pin baseline", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "batch_id": batchId})
+	case "DELETE":
+		ok, err := app.history.unpin(name)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, "failed to remove baseline", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	default:
+		http.Error(w, "I only respond to PUTs, POSTs and DELETEs.", http.StatusNotImplemented)
+	}
+}
+
+func parseRunFilter(r *http.Request) (runFilter, error) {
+	f := runFilter{
+		Host:    r.FormValue("host"),
+		Model:   r.FormValue("model"),
+		Tag:     r.FormValue("tag"),
+		Outcome: r.FormValue("outcome"),
+		Limit:   100,
+	}
+	var err error
+	if v := r.FormValue("from"); v != "" {
+		if f.From, err = parseTimeOrDate(v, false); err != nil {
+			return f, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if f.To, err = parseTimeOrDate(v, true); err != nil {
+			return f, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return f, nil
+}
+
+// parseTimeOrDate parses an RFC 3339 time or a date. A date is its start,
+// or the start of the next day if end is set so the date is included.
+func parseTimeOrDate(v string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return t, fmt.Errorf("%q is not a date or RFC 3339 time", v)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
 }
 
 // handleKill kills all worker goroutines
 func (app *App) handleKill(w http.ResponseWriter, r *http.Request) {
-	nw := app.config.currentWorkers
-	for i := 0; i < nw; i++ {
-		app.Killc <- 1
-	}
+	app.mu.Lock()
+	app.stopSearch()
+	app.stopWorkers(outcomeStopped, stopKilled)
+	closeSinks(app.sinks)
+	app.sinks = nil
+	app.mu.Unlock()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
 }
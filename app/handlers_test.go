@@ -0,0 +1,517 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func newTestApp(t *testing.T) *App {
+	cfg := &Config{}
+	cfg.Web.ViewsDir = "views"
+	cfg.Web.ReportDir = t.TempDir()
+	cfg.Settings.MaxDial = 20
+	cfg.Settings.MaxWorkers = 30
+	app, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Reportc = make(chan *Report)
+	app.Statc = StatsMonitor(WallClock, app.Reportc, 10*time.Millisecond, app.StatsTaps()...)
+	t.Cleanup(func() {
+		app.mu.Lock()
+		app.stopWorkers(outcomeStopped, stopKilled)
+		r := app.run
+		app.mu.Unlock()
+		if r != nil {
+			waitRecorded(t, r)
+		}
+		app.Close()
+	})
+	return app
+}
+
+func workloadForm(workload, settings string) url.Values {
+	return url.Values{"workload": {workload}, "settings": {settings}}
+}
+
+func testSettings(host, workers string) string {
+	b, _ := json.Marshal(map[string]interface{}{
+		"ops_host":       host,
+		"ops_apikey":     "abc123",
+		"ops_user":       "demo",
+		"dial_max_value": 20,
+		"workers":        workers,
+	})
+	return string(b)
+}
+
+func do(app *App, method, path string, form url.Values) *httptest.ResponseRecorder {
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+	r := httptest.NewRequest(method, path, body)
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, r)
+	return w
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &data); err != nil {
+		t.Fatalf("response is not json: %v: %s", err, w.Body.String())
+	}
+	return data
+}
+
+func running(app *App) bool {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return app.killc != nil
+}
+
+func waitFinished(t *testing.T, app *App) {
+	deadline := time.Now().Add(5 * time.Second)
+	for running(app) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for workload to finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func waitRecorded(t *testing.T, r *run) {
+	select {
+	case <-r.recorded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for run to be recorded")
+	}
+}
+
+func reportFiles(t *testing.T, app *App) []string {
+	files, err := filepath.Glob(filepath.Join(app.config.ReportDir, "workload_data_*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+const twoWindows = `{
+	"0": {"query": "{\"model\":\"m1\", \"input\":{\"x\":1}}", "qps": "5"},
+	"3": {"query": "{\"model\":\"m2\", \"input\":{\"x\":2}}", "qps": "5"}
+}`
+
+func TestHandleWorkloadRunsAllWindows(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{Users: map[string]string{"demo": "abc123"}})
+	app := newTestApp(t)
+
+	w := do(app, "POST", "/workload", workloadForm(twoWindows, testSettings(ts.URL, "8")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if data := decodeJSON(t, w); data["running"] != true {
+		t.Fatalf("expected running workload, got %v", data)
+	}
+	waitFinished(t, app)
+
+	// Every worker makes its window's qps worth of requests, and window
+	// ids need not be contiguous.
+	stats := m.Stats()
+	received := stats["m1"].Received + stats["m2"].Received
+	if received != 8*5 {
+		t.Errorf("expected 40 requests, got %d", received)
+	}
+	if stats["m1"].Served+stats["m2"].Served != received {
+		t.Errorf("expected every request to be served, got %+v", stats)
+	}
+
+	files := reportFiles(t, app)
+	if len(files) != 1 {
+		t.Fatalf("expected one report file, got %v", files)
+	}
+	b, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "timestamp,batch_id,") {
+		t.Errorf("expected report to start with csv header, got %q", b)
+	}
+}
+
+func TestHandleWorkloadRejectsBadPayloads(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	good := testSettings(ts.URL, "2")
+
+	tests := []struct {
+		name     string
+		workload string
+		settings string
+	}{
+		{"invalid workload json", `{"0": `, good},
+		{"invalid settings json", twoWindows, `{"workers": `},
+		{"invalid query json", `{"0": {"query": "{model: m1}", "qps": "5"}}`, good},
+		{"non integer qps", `{"0": {"query": "{\"model\":\"m1\"}", "qps": "lots"}}`, good},
+		{"empty workload", `{}`, good},
+		{"non integer workers", twoWindows, testSettings(ts.URL, "two")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			w := do(app, "POST", "/workload", workloadForm(tt.workload, tt.settings))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400, got %d", w.Code)
+			}
+			data := decodeJSON(t, w)
+			if data["running"] != false {
+				t.Errorf("expected running to be false, got %v", data["running"])
+			}
+			if _, ok := data["error"].(map[string]interface{}); !ok {
+				t.Errorf("expected an error message, got %v", data)
+			}
+			if running(app) {
+				t.Error("expected no workload to be running")
+			}
+			if files := reportFiles(t, app); len(files) != 0 {
+				t.Errorf("expected no report file, got %v", files)
+			}
+		})
+	}
+}
+
+func TestHandleWorkloadOnlyAcceptsPost(t *testing.T) {
+	app := newTestApp(t)
+	if w := do(app, "GET", "/workload", nil); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected 501, got %d", w.Code)
+	}
+}
+
+func TestHandleWorkloadRejectsConcurrentRuns(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: time.Millisecond}},
+	})
+	app := newTestApp(t)
+	form := workloadForm(`{"0": {"query": "{\"model\":\"m1\"}", "qps": "100000"}}`, testSettings(ts.URL, "2"))
+
+	if w := do(app, "POST", "/workload", form); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	w := do(app, "POST", "/workload", form)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected second workload to be rejected, got %d", w.Code)
+	}
+	if files := reportFiles(t, app); len(files) != 1 {
+		t.Errorf("expected one report file, got %v", files)
+	}
+}
+
+func TestHandlePauseStopsWorkers(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: time.Millisecond}},
+	})
+	app := newTestApp(t)
+	form := workloadForm(`{"0": {"query": "{\"model\":\"m1\"}", "qps": "100000"}}`, testSettings(ts.URL, "4"))
+	if w := do(app, "POST", "/workload", form); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	waitFor(t, func() bool { return m.Stats()["m1"].Received > 0 })
+
+	if w := do(app, "POST", "/pause", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	app.mu.Lock()
+	if app.sinks != nil {
+		t.Error("expected report sinks to be closed")
+	}
+	app.mu.Unlock()
+
+	// The run is recorded once every worker has exited, so the mock has
+	// seen all the requests it will ever see from it.
+	waitRecorded(t, r)
+	if received := m.Stats()["m1"].Received; received != r.summary.Sent {
+		t.Errorf("expected the mock to receive the %d requests sent before pause, got %d", r.summary.Sent, received)
+	}
+
+	// A new workload can start once paused.
+	if w := do(app, "POST", "/workload", form); w.Code != http.StatusOK {
+		t.Errorf("expected workload to start after pause, got %d", w.Code)
+	}
+}
+
+func TestHandleKillClosesSinks(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	form := workloadForm(`{"0": {"query": "{\"model\":\"m1\"}", "qps": "100000"}}`, testSettings(ts.URL, "2"))
+	if w := do(app, "POST", "/workload", form); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w := do(app, "POST", "/kill", nil); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	app.mu.Lock()
+	if app.sinks != nil {
+		t.Error("expected report sinks to be closed")
+	}
+	app.mu.Unlock()
+}
+
+func TestHandlePauseAndKillWithoutWorkload(t *testing.T) {
+	app := newTestApp(t)
+	done := make(chan struct{})
+	go func() {
+		// Pausing twice and killing with nothing running must not block.
+		do(app, "POST", "/pause", nil)
+		do(app, "POST", "/pause", nil)
+		do(app, "POST", "/kill", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pause blocked with no workload running")
+	}
+}
+
+func TestHandlePauseAfterWorkloadFinished(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	if w := do(app, "POST", "/workload", workloadForm(twoWindows, testSettings(ts.URL, "2"))); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	waitFinished(t, app)
+
+	done := make(chan struct{})
+	go func() {
+		do(app, "POST", "/pause", nil)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pause blocked after workers finished")
+	}
+}
+
+func TestHandleStatsReportsRates(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: time.Millisecond}},
+	})
+	app := newTestApp(t)
+	form := workloadForm(twoWindows, testSettings(ts.URL, "4"))
+	form.Set("workload", strings.Replace(twoWindows, `"5"`, `"100000"`, -1))
+	if w := do(app, "POST", "/workload", form); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	// Workers report every 500ms, so poll until rates show up.
+	deadline := time.Now().Add(5 * time.Second)
+	var data map[string]interface{}
+	for {
+		w := do(app, "GET", "/stats", nil)
+		data = decodeJSON(t, w)
+		if stats, ok := data["stats"].(map[string]interface{}); ok && len(stats) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for stats, last response %v", data)
+		}
+	}
+	if data["running"] != true {
+		t.Errorf("expected running, got %v", data["running"])
+	}
+}
+
+// recordingTarget is an Ops stand-in that remembers every request body.
+type recordingTarget struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (rt *recordingTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := ioutil.ReadAll(r.Body)
+	rt.mu.Lock()
+	rt.bodies = append(rt.bodies, r.URL.Path+" "+string(b))
+	rt.mu.Unlock()
+	w.Write([]byte(`{"result": {}}`))
+}
+
+func (rt *recordingTarget) sorted() []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	out := append([]string(nil), rt.bodies...)
+	sort.Strings(out)
+	return out
+}
+
+func TestHandleWorkloadSeedIsReproducible(t *testing.T) {
+	workload := `{
+		"0": {"query": "{\"model\":\"m1\", \"input\":{\"id\":\"@\"}}", "qps": "3"},
+		"1": {"query": "{\"model\":\"m2\", \"input\":{\"name\":\"^\"}}", "qps": "3"},
+		"2": {"query": "{\"model\":\"m3\", \"input\":{\"x\":1}}", "qps": "3"}
+	}`
+	run := func(seed string) ([]string, map[string]interface{}) {
+		rt := &recordingTarget{}
+		ts := httptest.NewServer(rt)
+		defer ts.Close()
+		app := newTestApp(t)
+		var s map[string]interface{}
+		json.Unmarshal([]byte(testSettings(ts.URL, "12")), &s)
+		s["seed"] = seed
+		b, _ := json.Marshal(s)
+		w := do(app, "POST", "/workload", workloadForm(workload, string(b)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		waitFinished(t, app)
+		return rt.sorted(), decodeJSON(t, w)
+	}
+
+	first, data := run("42")
+	if data["seed"] != "42" {
+		t.Errorf("expected seed 42 in response, got %v", data["seed"])
+	}
+	second, _ := run("42")
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected identical requests for the same seed\nfirst:  %v\nsecond: %v", first, second)
+	}
+	other, _ := run("43")
+	if reflect.DeepEqual(first, other) {
+		t.Error("expected different requests for a different seed")
+	}
+
+	// A run without a seed gets one it can be replayed with.
+	_, data = run("")
+	if _, err := strconv.ParseInt(data["seed"].(string), 10, 64); err != nil {
+		t.Errorf("expected a generated seed, got %v", data["seed"])
+	}
+}
+
+func TestHandleWorkloadRejectsBadRandomSettings(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	for _, extra := range []map[string]interface{}{
+		{"seed": "abc"},
+		{"arrival": "bursty"},
+	} {
+		var s map[string]interface{}
+		json.Unmarshal([]byte(testSettings(ts.URL, "2")), &s)
+		for k, v := range extra {
+			s[k] = v
+		}
+		b, _ := json.Marshal(s)
+		app := newTestApp(t)
+		if w := do(app, "POST", "/workload", workloadForm(twoWindows, string(b))); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d", extra, w.Code)
+		}
+	}
+	app := newTestApp(t)
+	bad := `{"0": {"query": "{\"model\":\"m1\"}", "qps": "5", "rate": "-1"}}`
+	if w := do(app, "POST", "/workload", workloadForm(bad, testSettings(ts.URL, "2"))); w.Code != http.StatusBadRequest {
+		t.Errorf("negative rate: expected 400, got %d", w.Code)
+	}
+}
+
+func TestWorkloadLibrary(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	app.library = workload.NewLibrary(t.TempDir())
+
+	spec := func(requests int) string {
+		return `
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+run: {workers: 2}
+models:
+    - {model: m1, requests: ` + strconv.Itoa(requests) + `}
+`
+	}
+
+	w := do(app, "POST", "/workloads", url.Values{"name": {"steady"}, "spec": {spec(3)}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(app, "POST", "/workloads", url.Values{"name": {"steady"}, "spec": {spec(3)}}); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 creating a workload twice, got %d", w.Code)
+	}
+	if w := do(app, "POST", "/workloads", url.Values{"name": {"bad"}, "spec": {"version: 1"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid workload, got %d", w.Code)
+	}
+
+	w = do(app, "PUT", "/workloads/steady", url.Values{"spec": {spec(4)}})
+	if data := decodeJSON(t, w); data["version"] != 2.0 {
+		t.Errorf("expected version 2, got %v", data)
+	}
+
+	w = do(app, "GET", "/workloads", nil)
+	var list struct{ Workloads []workload.Entry }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Workloads) != 1 || list.Workloads[0].Name != "steady" || list.Workloads[0].Version != 2 {
+		t.Errorf("unexpected library listing %+v", list.Workloads)
+	}
+
+	w = do(app, "GET", "/workloads/steady?version=1", nil)
+	var got struct {
+		Version int
+		Spec    workload.Spec
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 1 || got.Spec.Models[0].Requests != 3 {
+		t.Errorf("expected version 1 with 3 requests, got %+v", got)
+	}
+	if w := do(app, "GET", "/workloads/steady?format=legacy", nil); !strings.Contains(w.Body.String(), `"qps":"4"`) {
+		t.Errorf("expected the UI's workload format, got %s", w.Body.String())
+	}
+	if w := do(app, "GET", "/workloads/steady/versions", nil); !strings.Contains(w.Body.String(), `"version":2`) {
+		t.Errorf("expected versions to be listed, got %s", w.Body.String())
+	}
+
+	// Runs start from the library by name.
+	w = do(app, "POST", "/workload", url.Values{"name": {"steady"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	waitFinished(t, app)
+	if got := m.Stats()["m1"].Received; got != 2*4 {
+		t.Errorf("expected the latest version's 8 requests, got %d", got)
+	}
+	if w := do(app, "POST", "/workload", url.Values{"name": {"missing"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 running a missing workload, got %d", w.Code)
+	}
+
+	if w := do(app, "DELETE", "/workloads/steady", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if w := do(app, "GET", "/workloads/steady", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestWorkloadLibraryNotConfigured(t *testing.T) {
+	app := newTestApp(t)
+	if w := do(app, "GET", "/workloads", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// histogramGrowth is the ratio between the bounds of consecutive histogram
+// buckets, so quantiles are within 0.5% of the recorded value.
+const histogramGrowth = 1.01
+
+var logGrowth = math.Log(histogramGrowth)
+
+// histogram records a distribution of latencies in logarithmic buckets
+// starting at 1µs. Its size depends on the spread of the latencies, not
+// their number, so a run's whole distribution can be kept.
+type histogram struct {
+	buckets map[int]int
+	n       int
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+func newHistogram() *histogram {
+	return &histogram{buckets: make(map[int]int)}
+}
+
+func bucketOf(d time.Duration) int {
+	if d < time.Microsecond {
+		return 0
+	}
+	return int(math.Log(float64(d)/float64(time.Microsecond))/logGrowth) + 1
+}
+
+// bucketValue returns the geometric middle of bucket i.
+func bucketValue(i int) time.Duration {
+	if i == 0 {
+		return 0
+	}
+	lower := float64(time.Microsecond) * math.Pow(histogramGrowth, float64(i-1))
+	return time.Duration(lower * math.Sqrt(histogramGrowth))
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	if h.n == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	h.buckets[bucketOf(d)]++
+	h.n++
+	h.sum += d
+}
+
+// merge adds the latencies recorded in o to h.
+func (h *histogram) merge(o *histogram) {
+	if o == nil || o.n == 0 {
+		return
+	}
+	if h.n == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	for b, c := range o.buckets {
+		h.buckets[b] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+}
+
+func (h *histogram) count() int { return h.n }
+
+func (h *histogram) mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
+
+// quantile returns the latency at or below which a fraction q of the
+// recorded latencies fall.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.min
+	}
+	if q >= 1 {
+		return h.max
+	}
+	keys := make([]int, 0, len(h.buckets))
+	for b := range h.buckets {
+		keys = append(keys, b)
+	}
+	sort.Ints(keys)
+
+	rank := int(math.Ceil(q * float64(h.n)))
+	seen := 0
+	for _, b := range keys {
+		seen += h.buckets[b]
+		if seen >= rank {
+			v := bucketValue(b)
+			// The bucket's middle can lie outside what was recorded.
+			if v < h.min {
+				v = h.min
+			}
+			if v > h.max {
+				v = h.max
+			}
+			return v
+		}
+	}
+	return h.max
+}
+
+// histogramJSON is a histogram as agents send it to their coordinator,
+// with durations in nanoseconds.
+type histogramJSON struct {
+	Buckets map[int]int   `json:"buckets"`
+	N       int           `json:"n"`
+	Sum     time.Duration `json:"sum"`
+	Min     time.Duration `json:"min"`
+	Max     time.Duration `json:"max"`
+}
+
+func (h *histogram) MarshalJSON() ([]byte, error) {
+	return json.Marshal(histogramJSON{Buckets: h.buckets, N: h.n, Sum: h.sum, Min: h.min, Max: h.max})
+}
+
+func (h *histogram) UnmarshalJSON(b []byte) error {
+	var j histogramJSON
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Buckets == nil {
+		j.Buckets = make(map[int]int)
+	}
+	*h = histogram{buckets: j.Buckets, n: j.N, sum: j.Sum, min: j.Min, max: j.Max}
+	return nil
+}
+
+// latencySummary is a histogram's distribution in seconds.
+type latencySummary struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+}
+
+func (h *histogram) summary() latencySummary {
+	return latencySummary{
+		Mean: h.mean().Seconds(),
+		P50:  h.quantile(0.50).Seconds(),
+		P90:  h.quantile(0.90).Seconds(),
+		P95:  h.quantile(0.95).Seconds(),
+		P99:  h.quantile(0.99).Seconds(),
+		Max:  h.max.Seconds(),
+	}
+}
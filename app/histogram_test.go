@@ -0,0 +1,68 @@
+package app
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := newHistogram()
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 500 * time.Millisecond},
+		{0.9, 900 * time.Millisecond},
+		{0.99, 990 * time.Millisecond},
+		{0, time.Millisecond},
+		{1, time.Second},
+	}
+	for _, tt := range tests {
+		got := h.quantile(tt.q)
+		if math.Abs(float64(got-tt.want)) > 0.01*float64(tt.want) {
+			t.Errorf("q%v: expected about %v, got %v", tt.q, tt.want, got)
+		}
+	}
+	if h.count() != 1000 || h.mean() != 500500*time.Microsecond {
+		t.Errorf("expected 1000 latencies averaging 500.5ms, got %d averaging %v", h.count(), h.mean())
+	}
+
+	// Merging splits recorded separately gives the same distribution.
+	a, b := newHistogram(), newHistogram()
+	for i := 1; i <= 1000; i++ {
+		if i%3 == 0 {
+			a.record(time.Duration(i) * time.Millisecond)
+		} else {
+			b.record(time.Duration(i) * time.Millisecond)
+		}
+	}
+	a.merge(b)
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		if a.quantile(q) != h.quantile(q) {
+			t.Errorf("q%v: merged histogram gives %v, expected %v", q, a.quantile(q), h.quantile(q))
+		}
+	}
+	if a.min != h.min || a.max != h.max || a.sum != h.sum {
+		t.Error("merged histogram has different min, max or sum")
+	}
+}
+
+func TestHistogramEmptyAndTiny(t *testing.T) {
+	h := newHistogram()
+	if h.quantile(0.5) != 0 || h.mean() != 0 {
+		t.Error("expected an empty histogram to report zero")
+	}
+	h.merge(nil)
+	h.record(300 * time.Nanosecond)
+	if got := h.quantile(0.99); got != 300*time.Nanosecond {
+		t.Errorf("expected quantiles to stay within the recorded range, got %v", got)
+	}
+	h.record(-time.Second)
+	if h.min != 0 || h.quantile(0) != 0 {
+		t.Errorf("expected negative latencies to count as 0, got min %v", h.min)
+	}
+}
@@ -0,0 +1,614 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// history stores every run's metadata, summary and time series in a SQLite
+// database.
+type history struct {
+	db *sql.DB
+}
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	batch_id    TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	started_at  TEXT NOT NULL,
+	ended_at    TEXT,
+	outcome     TEXT NOT NULL,
+	target_host TEXT NOT NULL,
+	target_user TEXT NOT NULL,
+	workers     INTEGER NOT NULL,
+	seed        INTEGER NOT NULL,
+	spec        TEXT NOT NULL,
+	summary     TEXT
+);
+CREATE INDEX IF NOT EXISTS runs_started_at ON runs (started_at);
+CREATE INDEX IF NOT EXISTS runs_target_host ON runs (target_host);
+
+CREATE TABLE IF NOT EXISTS run_tags (
+	batch_id TEXT NOT NULL,
+	tag      TEXT NOT NULL,
+	PRIMARY KEY (batch_id, tag)
+);
+CREATE INDEX IF NOT EXISTS run_tags_tag ON run_tags (tag);
+
+CREATE TABLE IF NOT EXISTS run_models (
+	batch_id   TEXT NOT NULL,
+	model_id   TEXT NOT NULL,
+	model_name TEXT NOT NULL,
+	sent       INTEGER NOT NULL DEFAULT 0,
+	done       INTEGER NOT NULL DEFAULT 0,
+	failed     INTEGER NOT NULL DEFAULT 0,
+	error_rate REAL NOT NULL DEFAULT 0,
+	rate       REAL NOT NULL DEFAULT 0,
+	mean       REAL NOT NULL DEFAULT 0,
+	p50        REAL NOT NULL DEFAULT 0,
+	p90        REAL NOT NULL DEFAULT 0,
+	p95        REAL NOT NULL DEFAULT 0,
+	p99        REAL NOT NULL DEFAULT 0,
+	max        REAL NOT NULL DEFAULT 0,
+	latency    TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (batch_id, model_id)
+);
+CREATE INDEX IF NOT EXISTS run_models_model_name ON run_models (model_name);
+
+CREATE TABLE IF NOT EXISTS run_points (
+	batch_id   TEXT NOT NULL,
+	ts         TEXT NOT NULL,
+	model_id   TEXT NOT NULL,
+	sent       INTEGER NOT NULL,
+	done       INTEGER NOT NULL,
+	failed     INTEGER NOT NULL,
+	rate       REAL NOT NULL,
+	p50        REAL NOT NULL,
+	p95        REAL NOT NULL,
+	p99        REAL NOT NULL,
+	users      INTEGER NOT NULL DEFAULT 0,
+	iterations INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS run_points_batch_id ON run_points (batch_id, ts);
+
+CREATE TABLE IF NOT EXISTS run_server_points (
+	batch_id TEXT NOT NULL,
+	ts       TEXT NOT NULL,
+	target   TEXT NOT NULL,
+	series   TEXT NOT NULL,
+	value    REAL NOT NULL
+);
+CREATE INDEX IF NOT EXISTS run_server_points_batch_id ON run_server_points (batch_id, ts);
+
+CREATE TABLE IF NOT EXISTS baselines (
+	name      TEXT PRIMARY KEY,
+	batch_id  TEXT NOT NULL,
+	pinned_at TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	name       TEXT PRIMARY KEY,
+	workload   TEXT NOT NULL,
+	version    INTEGER NOT NULL,
+	cron       TEXT NOT NULL,
+	overlap    TEXT NOT NULL,
+	created_at TEXT NOT NULL
+);
+`
+
+// Outcomes of a run.
+const (
+	outcomeRunning   = "running"
+	outcomeCompleted = "completed"
+	outcomeStopped   = "stopped"
+
+	// Runs still running when the simulator last exited.
+	outcomeAborted = "aborted"
+)
+
+// timeFormat is a fixed width UTC time, so times sort as text.
+const timeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// runRecord is a run as stored in the history.
+type runRecord struct {
+	BatchId    string     `json:"batch_id"`
+	Name       string     `json:"name"`
+	Started    time.Time  `json:"started"`
+	Ended      *time.Time `json:"ended,omitempty"`
+	Outcome    string     `json:"outcome"`
+	TargetHost string     `json:"target_host"`
+	TargetUser string     `json:"target_user"`
+	Workers    int        `json:"workers"`
+	Seed       int64      `json:"seed,string"`
+	Tags       []string   `json:"tags"`
+	Models     []string   `json:"models"`
+
+	Spec    *workload.Spec `json:"spec,omitempty"`
+	Summary *runSummary    `json:"summary,omitempty"`
+}
+
+// historyMigrations add the columns the schema gained to histories created
+// before. They fail with a duplicate column once applied, which is ignored.
+var historyMigrations = []string{
+	`ALTER TABLE run_points ADD COLUMN users INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE run_points ADD COLUMN iterations INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE run_models ADD COLUMN latency TEXT NOT NULL DEFAULT ''`,
+}
+
+// openHistory opens or creates the history database at path. Runs left
+// running by a previous process are marked aborted.
+func openHistory(path string) (*history, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("error opening run history %s: %v", path, err)
+	}
+	// SQLite allows a single writer, queue writes in the pool instead of
+	// failing on a busy database.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating run history %s: %v", path, err)
+	}
+	for _, m := range historyMigrations {
+		if _, err := db.Exec(m); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, fmt.Errorf("error updating run history %s: %v", path, err)
+		}
+	}
+	if _, err := db.Exec(`UPDATE runs SET outcome = ? WHERE outcome = ?`, outcomeAborted, outcomeRunning); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error updating run history %s: %v", path, err)
+	}
+	return &history{db: db}, nil
+}
+
+func (h *history) Close() error {
+	return h.db.Close()
+}
+
+// start records the beginning of a run, without its API key.
+func (h *history) start(r *runRecord) error {
+	spec, err := json.Marshal(withoutAPIKey(r.Spec))
+	if err != nil {
+		return err
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO runs (batch_id, name, started_at, outcome, target_host, target_user, workers, seed, spec)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		r.BatchId, r.Name, r.Started.UTC().Format(timeFormat), outcomeRunning,
+		r.TargetHost, r.TargetUser, r.Workers, r.Seed, string(spec))
+	if err != nil {
+		return fmt.Errorf("error recording run %s: %v", r.BatchId, err)
+	}
+	for _, tag := range r.Tags {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO run_tags (batch_id, tag) VALUES (?, ?)`, r.BatchId, tag); err != nil {
+			return fmt.Errorf("error recording run %s: %v", r.BatchId, err)
+		}
+	}
+	for i, m := range r.Spec.Models {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO run_models (batch_id, model_id, model_name) VALUES (?, ?, ?)`,
+			r.BatchId, r.Spec.ModelID(i), m.Model); err != nil {
+			return fmt.Errorf("error recording run %s: %v", r.BatchId, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// addPoints appends to a run's time series.
+func (h *history) addPoints(batchId string, points []point) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range points {
+		_, err := tx.Exec(`INSERT INTO run_points (batch_id, ts, model_id, sent, done, failed, rate, p50, p95, p99, users, iterations)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			batchId, p.Time.UTC().Format(timeFormat), p.ModelID, p.Sent, p.Done, p.Failed, p.Rate, p.P50, p.P95, p.P99, p.Users, p.Iterations)
+		if err != nil {
+			return fmt.Errorf("error recording points of run %s: %v", batchId, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// addServerPoints appends to the series scraped from a run's servers.
+func (h *history) addServerPoints(batchId string, points []serverPoint) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range points {
+		_, err := tx.Exec(`INSERT INTO run_server_points (batch_id, ts, target, series, value) VALUES (?, ?, ?, ?, ?)`,
+			batchId, p.Time.UTC().Format(timeFormat), p.Target, p.Series, p.Value)
+		if err != nil {
+			return fmt.Errorf("error recording server points of run %s: %v", batchId, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// finish records the end of a run and its summary.
+func (h *history) finish(batchId string, ended time.Time, outcome string, s *runSummary) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE runs SET ended_at = ?, outcome = ?, summary = ? WHERE batch_id = ?`,
+		ended.UTC().Format(timeFormat), outcome, string(b), batchId)
+	if err != nil {
+		return fmt.Errorf("error recording end of run %s: %v", batchId, err)
+	}
+	for _, m := range s.Models {
+		l := m.Latency
+		var latency []byte
+		if h := s.latencies[m.ID]; h != nil {
+			if latency, err = json.Marshal(h); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT OR REPLACE INTO run_models
+			(batch_id, model_id, model_name, sent, done, failed, error_rate, rate, mean, p50, p90, p95, p99, max, latency)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			batchId, m.ID, m.Model, m.Sent, m.Done, m.Failed, m.ErrorRate, m.Rate,
+			l.Mean, l.P50, l.P90, l.P95, l.P99, l.Max, string(latency))
+		if err != nil {
+			return fmt.Errorf("error recording end of run %s: %v", batchId, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// runFilter selects runs from the history. Empty fields match every run.
+type runFilter struct {
+	From, To time.Time
+	Host     string
+	Model    string
+	Tag      string
+	Outcome  string
+	Limit    int
+}
+
+// runs returns the runs matching f, most recent first, without their
+// specs.
+func (h *history) runs(f runFilter) ([]*runRecord, error) {
+	var where []string
+	var args []interface{}
+	if !f.From.IsZero() {
+		where = append(where, "started_at >= ?")
+		args = append(args, f.From.UTC().Format(timeFormat))
+	}
+	if !f.To.IsZero() {
+		where = append(where, "started_at < ?")
+		args = append(args, f.To.UTC().Format(timeFormat))
+	}
+	if f.Host != "" {
+		where = append(where, "target_host = ?")
+		args = append(args, f.Host)
+	}
+	if f.Model != "" {
+		where = append(where, "batch_id IN (SELECT batch_id FROM run_models WHERE model_name = ? OR model_id = ?)")
+		args = append(args, f.Model, f.Model)
+	}
+	if f.Tag != "" {
+		where = append(where, "batch_id IN (SELECT batch_id FROM run_tags WHERE tag = ?)")
+		args = append(args, f.Tag)
+	}
+	if f.Outcome != "" {
+		where = append(where, "outcome = ?")
+		args = append(args, f.Outcome)
+	}
+	q := `SELECT batch_id, name, started_at, ended_at, outcome, target_host, target_user, workers, seed, summary FROM runs`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY started_at DESC"
+	if f.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+
+	rows, err := h.db.Query(q, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying run history: %v", err)
+	}
+	defer rows.Close()
+	records := []*runRecord{}
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying run history: %v", err)
+	}
+	for _, r := range records {
+		if err := h.fill(r); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// withoutAPIKey returns a copy of spec with the target's API key blanked,
+// for whoever reads the history, reports or searches it is kept in.
+func withoutAPIKey(spec *workload.Spec) *workload.Spec {
+	if spec == nil {
+		return nil
+	}
+	s := *spec
+	s.Target.APIKey = ""
+	return &s
+}
+
+// run returns a run with its spec, or nil if there is none with the batch
+// id.
+func (h *history) run(batchId string) (*runRecord, error) {
+	row := h.db.QueryRow(`SELECT batch_id, name, started_at, ended_at, outcome, target_host, target_user, workers, seed, summary
+		FROM runs WHERE batch_id = ?`, batchId)
+	r, err := scanRun(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var spec string
+	if err := h.db.QueryRow(`SELECT spec FROM runs WHERE batch_id = ?`, batchId).Scan(&spec); err != nil {
+		return nil, fmt.Errorf("error reading run %s: %v", batchId, err)
+	}
+	r.Spec = &workload.Spec{}
+	if err := json.Unmarshal([]byte(spec), r.Spec); err != nil {
+		return nil, fmt.Errorf("error reading spec of run %s: %v", batchId, err)
+	}
+	return r, h.fill(r)
+}
+
+// latencies returns the latency distributions of a run's models by model
+// id, leaving out those of runs recorded before they were kept.
+func (h *history) latencies(batchId string) (map[string]*histogram, error) {
+	rows, err := h.db.Query(`SELECT model_id, latency FROM run_models WHERE batch_id = ? AND latency != ''`, batchId)
+	if err != nil {
+		return nil, fmt.Errorf("error reading latencies of run %s: %v", batchId, err)
+	}
+	defer rows.Close()
+	latencies := make(map[string]*histogram)
+	for rows.Next() {
+		var id, latency string
+		if err := rows.Scan(&id, &latency); err != nil {
+			return nil, fmt.Errorf("error reading latencies of run %s: %v", batchId, err)
+		}
+		h := newHistogram()
+		if err := json.Unmarshal([]byte(latency), h); err != nil {
+			return nil, fmt.Errorf("error reading latencies of run %s: %v", batchId, err)
+		}
+		latencies[id] = h
+	}
+	return latencies, rows.Err()
+}
+
+// points returns a run's time series, of one model if modelId is set.
+func (h *history) points(batchId, modelId string) ([]point, error) {
+	q := `SELECT ts, model_id, sent, done, failed, rate, p50, p95, p99, users, iterations FROM run_points WHERE batch_id = ?`
+	args := []interface{}{batchId}
+	if modelId != "" {
+		q += " AND model_id = ?"
+		args = append(args, modelId)
+	}
+	rows, err := h.db.Query(q+" ORDER BY ts, model_id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading points of run %s: %v", batchId, err)
+	}
+	defer rows.Close()
+	points := []point{}
+	for rows.Next() {
+		var p point
+		var ts string
+		if err := rows.Scan(&ts, &p.ModelID, &p.Sent, &p.Done, &p.Failed, &p.Rate, &p.P50, &p.P95, &p.P99, &p.Users, &p.Iterations); err != nil {
+			return nil, fmt.Errorf("error reading points of run %s: %v", batchId, err)
+		}
+		p.Time, _ = time.Parse(timeFormat, ts)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// serverPoints returns the series scraped from a run's servers.
+func (h *history) serverPoints(batchId string) ([]serverPoint, error) {
+	rows, err := h.db.Query(`SELECT ts, target, series, value FROM run_server_points
+		WHERE batch_id = ? ORDER BY ts, target, series`, batchId)
+	if err != nil {
+		return nil, fmt.Errorf("error reading server points of run %s: %v", batchId, err)
+	}
+	defer rows.Close()
+	points := []serverPoint{}
+	for rows.Next() {
+		var p serverPoint
+		var ts string
+		if err := rows.Scan(&ts, &p.Target, &p.Series, &p.Value); err != nil {
+			return nil, fmt.Errorf("error reading server points of run %s: %v", batchId, err)
+		}
+		p.Time, _ = time.Parse(timeFormat, ts)
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRun(row scanner) (*runRecord, error) {
+	r := &runRecord{}
+	var started string
+	var ended, summary sql.NullString
+	err := row.Scan(&r.BatchId, &r.Name, &started, &ended, &r.Outcome,
+		&r.TargetHost, &r.TargetUser, &r.Workers, &r.Seed, &summary)
+	if err == sql.ErrNoRows {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading run history: %v", err)
+	}
+	r.Started, _ = time.Parse(timeFormat, started)
+	if ended.Valid {
+		t, _ := time.Parse(timeFormat, ended.String)
+		r.Ended = &t
+	}
+	if summary.Valid {
+		r.Summary = &runSummary{}
+		if err := json.Unmarshal([]byte(summary.String), r.Summary); err != nil {
+			return nil, fmt.Errorf("error reading summary of run %s: %v", r.BatchId, err)
+		}
+	}
+	return r, nil
+}
+
+// fill reads a run's tags and model names.
+func (h *history) fill(r *runRecord) error {
+	r.Tags = []string{}
+	r.Models = []string{}
+	rows, err := h.db.Query(`SELECT tag FROM run_tags WHERE batch_id = ? ORDER BY tag`, r.BatchId)
+	if err != nil {
+		return fmt.Errorf("error reading tags of run %s: %v", r.BatchId, err)
+	}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return err
+		}
+		r.Tags = append(r.Tags, tag)
+	}
+	rows.Close()
+
+	rows, err = h.db.Query(`SELECT DISTINCT model_name FROM run_models WHERE batch_id = ? ORDER BY model_name`, r.BatchId)
+	if err != nil {
+		return fmt.Errorf("error reading models of run %s: %v", r.BatchId, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		r.Models = append(r.Models, name)
+	}
+	return rows.Err()
+}
+
+// baseline is a run pinned under a name to compare later runs against.
+type baseline struct {
+	Name    string    `json:"name"`
+	BatchId string    `json:"batch_id"`
+	Pinned  time.Time `json:"pinned"`
+}
+
+// pin makes the run the baseline called name, replacing any other run
+// pinned under it.
+func (h *history) pin(name, batchId string, at time.Time) error {
+	_, err := h.db.Exec(`INSERT OR REPLACE INTO baselines (name, batch_id, pinned_at) VALUES (?, ?, ?)`,
+		name, batchId, at.UTC().Format(timeFormat))
+	if err != nil {
+		return fmt.Errorf("error pinning baseline %s: %v", name, err)
+	}
+	return nil
+}
+
+// unpin removes a baseline. It reports whether there was one.
+func (h *history) unpin(name string) (bool, error) {
+	res, err := h.db.Exec(`DELETE FROM baselines WHERE name = ?`, name)
+	if err != nil {
+		return false, fmt.Errorf("error removing baseline %s: %v", name, err)
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// baseline returns the batch id pinned under name, empty if there is
+// none.
+func (h *history) baseline(name string) (string, error) {
+	var batchId string
+	err := h.db.QueryRow(`SELECT batch_id FROM baselines WHERE name = ?`, name).Scan(&batchId)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading baseline %s: %v", name, err)
+	}
+	return batchId, nil
+}
+
+func (h *history) baselines() ([]baseline, error) {
+	rows, err := h.db.Query(`SELECT name, batch_id, pinned_at FROM baselines ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading baselines: %v", err)
+	}
+	defer rows.Close()
+	baselines := []baseline{}
+	for rows.Next() {
+		var b baseline
+		var pinned string
+		if err := rows.Scan(&b.Name, &b.BatchId, &pinned); err != nil {
+			return nil, fmt.Errorf("error reading baselines: %v", err)
+		}
+		b.Pinned, _ = time.Parse(timeFormat, pinned)
+		baselines = append(baselines, b)
+	}
+	return baselines, rows.Err()
+}
+
+// saveSchedule adds a schedule, or replaces the one of the same name.
+func (h *history) saveSchedule(s *schedule) error {
+	_, err := h.db.Exec(`INSERT OR REPLACE INTO schedules (name, workload, version, cron, overlap, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.Name, s.Workload, s.Version, s.Cron, s.Overlap, s.Created.UTC().Format(timeFormat))
+	if err != nil {
+		return fmt.Errorf("error saving schedule %s: %v", s.Name, err)
+	}
+	return nil
+}
+
+// deleteSchedule removes a schedule.
+func (h *history) deleteSchedule(name string) error {
+	if _, err := h.db.Exec(`DELETE FROM schedules WHERE name = ?`, name); err != nil {
+		return fmt.Errorf("error deleting schedule %s: %v", name, err)
+	}
+	return nil
+}
+
+// schedules returns the saved schedules by name.
+func (h *history) schedules() ([]*schedule, error) {
+	rows, err := h.db.Query(`SELECT name, workload, version, cron, overlap, created_at FROM schedules ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schedules: %v", err)
+	}
+	defer rows.Close()
+	var schedules []*schedule
+	for rows.Next() {
+		s := &schedule{}
+		var created string
+		if err := rows.Scan(&s.Name, &s.Workload, &s.Version, &s.Cron, &s.Overlap, &created); err != nil {
+			return nil, fmt.Errorf("error reading schedules: %v", err)
+		}
+		s.Created, _ = time.Parse(timeFormat, created)
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
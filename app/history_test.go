@@ -0,0 +1,217 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+func runSpec(t *testing.T, app *App, spec string) *run {
+	w := do(app, "POST", "/workload", url.Values{"spec": {spec}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	waitRecorded(t, r)
+	return r
+}
+
+func getRuns(t *testing.T, app *App, query string) []runRecord {
+	w := do(app, "GET", "/runs?"+query, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: expected 200, got %d: %s", query, w.Code, w.Body.String())
+	}
+	var resp struct{ Runs []runRecord }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Runs
+}
+
+func TestRunHistory(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Models: map[string]mockops.ModelConfig{"flaky": {ErrorRate: 1}},
+	})
+	app := newTestApp(t)
+
+	first := runSpec(t, app, `
+version: 1
+metadata: {name: steady, tags: [nightly, rent]}
+target: {host: "`+ts.URL+`", user: demo}
+run: {workers: 2, seed: 1}
+models:
+    - {model: m1, requests: 10}
+`)
+	second := runSpec(t, app, `
+version: 1
+metadata: {tags: [adhoc]}
+target: {host: "`+ts.URL+`", user: demo}
+run: {workers: 1, seed: 2}
+models:
+    - {id: f, model: flaky, requests: 4}
+`)
+
+	runs := getRuns(t, app, "")
+	if len(runs) != 2 || runs[0].BatchId != second.batchId || runs[1].BatchId != first.batchId {
+		t.Fatalf("expected both runs, newest first, got %+v", runs)
+	}
+	r := runs[1]
+	if r.Name != "steady" || r.Outcome != outcomeCompleted || r.Ended == nil || r.Seed != 1 || r.Workers != 2 {
+		t.Errorf("unexpected run record %+v", r)
+	}
+	if s := r.Summary; s == nil || s.Sent != 20 || s.Done != 20 || s.Failed != 0 || s.Latency.Max <= 0 {
+		t.Errorf("unexpected summary %+v", r.Summary)
+	}
+	if s := runs[0].Summary; s == nil || s.Failed != 4 || s.ErrorRate != 1 {
+		t.Errorf("expected the flaky run to fail, got %+v", runs[0].Summary)
+	}
+	latencies, err := app.history.latencies(first.batchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := latencies[first.plan.spec.ModelID(0)]; h == nil || h.count() != 20 {
+		t.Errorf("expected the history to keep the latency of every request, got %+v", latencies)
+	}
+
+	queries := map[string]string{
+		"model=m1":        first.batchId,
+		"model=f":         second.batchId,
+		"tag=nightly":     first.batchId,
+		"host=" + ts.URL:  "",
+		"limit=1":         second.batchId,
+		"outcome=stopped": "none",
+		"from=2000-01-01": "",
+		"to=2000-01-01":   "none",
+		"from=" + time.Now().Add(time.Hour).Format(time.RFC3339): "none",
+	}
+	for q, want := range queries {
+		runs := getRuns(t, app, q)
+		switch want {
+		case "":
+			if len(runs) != 2 {
+				t.Errorf("%s: expected both runs, got %d", q, len(runs))
+			}
+		case "none":
+			if len(runs) != 0 {
+				t.Errorf("%s: expected no runs, got %d", q, len(runs))
+			}
+		default:
+			if len(runs) != 1 || runs[0].BatchId != want {
+				t.Errorf("%s: expected run %s, got %+v", q, want, runs)
+			}
+		}
+	}
+	if w := do(app, "GET", "/runs?from=yesterday", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad date, got %d", w.Code)
+	}
+
+	w := do(app, "GET", "/runs/"+first.batchId, nil)
+	var rec runRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Spec == nil || rec.Spec.Models[0].Requests != 10 || len(rec.Tags) != 2 || rec.Models[0] != "m1" {
+		t.Errorf("expected the run's workload, got %+v", rec)
+	}
+	if w := do(app, "GET", "/runs/nope", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown run, got %d", w.Code)
+	}
+
+	w = do(app, "GET", "/runs/"+first.batchId+"/series", nil)
+	var series struct{ Points []point }
+	if err := json.Unmarshal(w.Body.Bytes(), &series); err != nil {
+		t.Fatal(err)
+	}
+	done := 0
+	for _, p := range series.Points {
+		done += p.Done
+	}
+	if done != 20 {
+		t.Errorf("expected the series to account for all 20 requests, got %d in %+v", done, series.Points)
+	}
+}
+
+func TestRunHistoryRecordsStopsAndAborts(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+
+	// Runs until stopped.
+	w := do(app, "POST", "/workload", url.Values{"spec": {`
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+run: {workers: 2}
+models:
+    - {model: m1, rate: 100}
+stages:
+    - {duration: 1h}
+`}})
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	do(app, "POST", "/pause", nil)
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	waitRecorded(t, r)
+	runs := getRuns(t, app, "")
+	if len(runs) != 1 || runs[0].Outcome != outcomeStopped {
+		t.Errorf("expected the paused run to be stopped, got %+v", runs)
+	}
+
+	// Runs a previous process didn't finish are marked aborted.
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := openHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.start(&runRecord{BatchId: "b1", Started: time.Now(), Spec: r.plan.spec}); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if h, err = openHistory(path); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	rec, err := h.run("b1")
+	if err != nil || rec.Outcome != outcomeAborted {
+		t.Errorf("expected run to be aborted, got %+v, %v", rec, err)
+	}
+}
+
+func TestHistoryMigrates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run_points as it was before virtual users.
+	if _, err := db.Exec(`CREATE TABLE run_points (batch_id TEXT NOT NULL, ts TEXT NOT NULL, model_id TEXT NOT NULL,
+		sent INTEGER NOT NULL, done INTEGER NOT NULL, failed INTEGER NOT NULL,
+		rate REAL NOT NULL, p50 REAL NOT NULL, p95 REAL NOT NULL, p99 REAL NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		h, err := openHistory(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.addPoints("b1", []point{{Time: time.Now(), ModelID: "0", Users: 4}}); err != nil {
+			t.Fatal(err)
+		}
+		points, err := h.points("b1", "")
+		if err != nil || len(points) != i+1 || points[i].Users != 4 {
+			t.Errorf("expected the points to keep their users, got %+v, %v", points, err)
+		}
+		h.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	// kneeLevels is how many equal bands of offered load a model's points
+	// are grouped in to find its knee.
+	kneeLevels = 20
+
+	// kneeMinLevels is how many bands need points for the load to have
+	// varied enough to look for a knee, as it does in ramps.
+	kneeMinLevels = 4
+
+	// kneeLatency is how many times its p95 at the lowest loads latency
+	// has to rise to for the load to be past the knee.
+	kneeLatency = 2
+
+	// kneeAchieved is the share of the offered load below which the
+	// target's throughput no longer keeps up, saturating it.
+	kneeAchieved = 0.9
+
+	// kneeEvery is how many intervals of a running run pass between
+	// looking for its knees, which goes over all of its points again.
+	kneeEvery = 10
+)
+
+// loadMark is a level of offered load of a run, and how the target did at
+// it.
+type loadMark struct {
+	// Offered and achieved rate in requests per second, and the p95
+	// latency in seconds.
+	Offered float64 `json:"offered"`
+	Rate    float64 `json:"rate"`
+	P95     float64 `json:"p95"`
+
+	// Time is when the run first reached the load.
+	Time time.Time `json:"time"`
+}
+
+// modelKnee is where a model's latency rose sharply with offered load, the
+// knee, and where its throughput stopped scaling with it, the saturation
+// point. Either is nil if the run didn't reach it.
+type modelKnee struct {
+	Knee       *loadMark `json:"knee,omitempty"`
+	Saturation *loadMark `json:"saturation,omitempty"`
+}
+
+// loadLevel is the points of a model in one band of offered load.
+type loadLevel struct {
+	loadMark
+	secs float64
+	done int
+}
+
+// detectKnee finds the knee and saturation point of a model in its points
+// of a run started at started. Points are grouped into bands of offered
+// load, each point's load being the requests it sent since the model's
+// previous point. The knee is the lowest band from which on p95 latency
+// stays above kneeLatency times that of the lowest loads, and the
+// saturation point the lowest from which on the achieved rate stays below
+// kneeAchieved of the offered. It returns nil if the load didn't vary
+// enough to tell.
+func detectKnee(started time.Time, points []point) *modelKnee {
+	var max float64
+	offered := make([]float64, len(points))
+	secs := make([]float64, len(points))
+	prev := started
+	for i, p := range points {
+		secs[i] = p.Time.Sub(prev).Seconds()
+		prev = p.Time
+		if secs[i] > 0 {
+			offered[i] = float64(p.Sent) / secs[i]
+		}
+		max = math.Max(max, offered[i])
+	}
+	if max == 0 {
+		return nil
+	}
+
+	var bands [kneeLevels]*loadLevel
+	for i, p := range points {
+		if secs[i] <= 0 || offered[i] == 0 {
+			continue
+		}
+		b := int(offered[i] / max * kneeLevels)
+		if b == kneeLevels {
+			b--
+		}
+		l := bands[b]
+		if l == nil {
+			l = &loadLevel{loadMark: loadMark{Time: p.Time}}
+			bands[b] = l
+		}
+		// Rates are averaged over the band's time and latencies over its
+		// requests.
+		l.Offered += offered[i] * secs[i]
+		l.Rate += p.Rate * secs[i]
+		l.P95 += p.P95 * float64(p.Done)
+		l.secs += secs[i]
+		l.done += p.Done
+		if p.Time.Before(l.Time) {
+			l.Time = p.Time
+		}
+	}
+	var levels []*loadLevel
+	for _, l := range bands {
+		if l == nil {
+			continue
+		}
+		l.Offered /= l.secs
+		l.Rate /= l.secs
+		if l.done > 0 {
+			l.P95 /= float64(l.done)
+		}
+		levels = append(levels, l)
+	}
+	if len(levels) < kneeMinLevels {
+		return nil
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i].Offered < levels[j].Offered })
+
+	// The baseline is the best latency of the lowest few loads.
+	baseline := math.Inf(1)
+	for _, l := range levels[:kneeMinLevels-1] {
+		if l.done > 0 {
+			baseline = math.Min(baseline, l.P95)
+		}
+	}
+
+	k := &modelKnee{}
+	k.Knee = firstFrom(levels, func(l *loadLevel) bool {
+		// Bands with no requests done count as slow.
+		return l.done == 0 || l.P95 > kneeLatency*baseline
+	})
+	k.Saturation = firstFrom(levels, func(l *loadLevel) bool {
+		return l.Rate < kneeAchieved*l.Offered
+	})
+	return k
+}
+
+// firstFrom returns the lowest of levels from which on past holds for
+// every level, or nil if it doesn't hold for the highest.
+func firstFrom(levels []*loadLevel, past func(*loadLevel) bool) *loadMark {
+	first := -1
+	for i := len(levels) - 1; i >= 0 && past(levels[i]); i-- {
+		first = i
+	}
+	if first < 0 {
+		return nil
+	}
+	m := levels[first].loadMark
+	return &m
+}
+
+// detectKnees finds the knee of each model of a run in its points, leaving
+// out the models whose load didn't vary enough.
+func detectKnees(started time.Time, points []point) map[string]*modelKnee {
+	byModel := make(map[string][]point)
+	for _, p := range points {
+		byModel[p.ModelID] = append(byModel[p.ModelID], p)
+	}
+	knees := make(map[string]*modelKnee)
+	for id, ps := range byModel {
+		if k := detectKnee(started, ps); k != nil {
+			knees[id] = k
+		}
+	}
+	return knees
+}
+
+// annotateKnees adds the knees found in a run's points to its summary.
+func annotateKnees(s *runSummary, knees map[string]*modelKnee) {
+	for i, m := range s.Models {
+		if k := knees[m.ID]; k != nil {
+			s.Models[i].Knee, s.Models[i].Saturation = k.Knee, k.Saturation
+		}
+	}
+}
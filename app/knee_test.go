@@ -0,0 +1,102 @@
+package app
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rampPoints are the points of a ramp from 5 to 200 requests a second
+// against a target that does at most 100 a second, and whose p95 latency
+// starts rising from 10ms past 80 a second.
+func rampPoints(started time.Time) []point {
+	var points []point
+	for i := 1; i <= 40; i++ {
+		offered := 5 * float64(i)
+		p95 := 0.01
+		if offered > 80 {
+			p95 *= math.Exp((offered - 80) / 20)
+		}
+		rate := math.Min(offered, 100)
+		points = append(points, point{
+			Time:    started.Add(time.Duration(i) * time.Second),
+			ModelID: "0",
+			Sent:    int(offered),
+			Done:    int(rate),
+			Rate:    rate,
+			P95:     p95,
+		})
+	}
+	return points
+}
+
+func TestDetectKnee(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	k := detectKnee(t0, rampPoints(t0))
+	if k == nil || k.Knee == nil || k.Saturation == nil {
+		t.Fatalf("expected a knee and saturation point, got %+v", k)
+	}
+	// p95 doubles at 94/s offered, and throughput falls below 90% of the
+	// offered load past 111/s.
+	if k.Knee.Offered < 90 || k.Knee.Offered > 105 {
+		t.Errorf("expected the knee at about 95/s, got %+v", k.Knee)
+	}
+	if k.Saturation.Offered < 105 || k.Saturation.Offered > 125 {
+		t.Errorf("expected saturation at about 115/s, got %+v", k.Saturation)
+	}
+	if !k.Knee.Time.Before(k.Saturation.Time) {
+		t.Errorf("expected the knee before saturation, got %v and %v", k.Knee.Time, k.Saturation.Time)
+	}
+
+	// A steady load has no knee to find.
+	var steady []point
+	for i := 1; i <= 40; i++ {
+		steady = append(steady, point{Time: t0.Add(time.Duration(i) * time.Second), ModelID: "0", Sent: 50, Done: 50, Rate: 50, P95: 0.01})
+	}
+	if k := detectKnee(t0, steady); k != nil {
+		t.Errorf("expected no knee in a steady run, got %+v", k)
+	}
+
+	// A ramp the target keeps up with has neither.
+	easy := rampPoints(t0)[:14]
+	if k := detectKnee(t0, easy); k == nil || k.Knee != nil || k.Saturation != nil {
+		t.Errorf("expected neither knee nor saturation below 80/s, got %+v", k)
+	}
+}
+
+func TestRunLooksForKneesEveryFewIntervals(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	r := &run{started: t0}
+	for i, p := range rampPoints(t0) {
+		r.addPoints([]point{p})
+		if n := i + 1; n < kneeEvery && r.knees != nil {
+			t.Fatalf("expected no knees looked for after %d intervals, got %v", n, r.knees)
+		} else if n == kneeEvery && r.knees["0"] == nil {
+			t.Fatalf("expected knees looked for after %d intervals", n)
+		}
+	}
+	if k := r.knees["0"]; k == nil || k.Knee == nil || k.Saturation == nil {
+		t.Errorf("expected the ramp's knee and saturation, got %+v", k)
+	}
+}
+
+func TestReportShowsKnee(t *testing.T) {
+	app := newTestApp(t)
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	points := rampPoints(t0)
+	summary := &runSummary{Models: []modelSummary{{ID: "0", Model: "m1"}}}
+	annotateKnees(summary, detectKnees(t0, points))
+	rec := &runRecord{BatchId: "ramp", Started: t0, Outcome: outcomeCompleted, Summary: summary}
+
+	var b bytes.Buffer
+	if err := app.renderReport(&b, rec, points, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Latency knee at", "Saturated at", `class="mark"`} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("expected the report to contain %q", s)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Reasons a run stopped.
+const (
+	// stopRequests is a run whose workers all sent their requests.
+	stopRequests = "requests"
+	stopStages   = "stages"
+	stopDuration = "duration"
+	stopTime     = "stop_at"
+	// stopBudget is a run that sent its max_requests, and stopModelBudget
+	// one whose workers stopped at the max_requests of their models.
+	stopBudget      = "max_requests"
+	stopModelBudget = "model_max_requests"
+	// stopRampDown is a run whose virtual users all left over its ramp
+	// down.
+	stopRampDown = "ramp_down"
+	stopPaused   = "paused"
+	stopKilled   = "killed"
+)
+
+// stopReasons describe the reasons in reports.
+var stopReasons = map[string]string{
+	stopRequests:    "every worker sent its requests",
+	stopStages:      "the last stage ended",
+	stopDuration:    "the run's duration ran out",
+	stopTime:        "the run's stop_at time came",
+	stopBudget:      "the run sent its max_requests",
+	stopModelBudget: "the models sent their max_requests",
+	stopRampDown:    "the virtual users left over the ramp down",
+	stopPaused:      "paused from the UI",
+	stopKilled:      "killed",
+}
+
+// errBudgetAgents is returned when starting a run with request limits with
+// agents registered, which can't share a budget.
+var errBudgetAgents = errors.New("runs with max_requests can't be split across agents")
+
+// budget is a number of requests workers share.
+type budget struct {
+	left int64
+}
+
+// newBudget returns a budget of n requests, or nil, which is unlimited, if
+// n isn't positive.
+func newBudget(n int) *budget {
+	if n <= 0 {
+		return nil
+	}
+	return &budget{left: int64(n)}
+}
+
+// take spends a request of b, reporting false if none was left.
+func (b *budget) take() bool {
+	return b == nil || atomic.AddInt64(&b.left, -1) >= 0
+}
+
+// give hands back a request taken from b that wasn't sent.
+func (b *budget) give() {
+	if b != nil {
+		atomic.AddInt64(&b.left, 1)
+	}
+}
+
+// spent reports whether b has no requests left.
+func (b *budget) spent() bool {
+	return b != nil && atomic.LoadInt64(&b.left) <= 0
+}
+
+// runBudgets are the request budgets of a run and of each of its models by
+// index.
+type runBudgets struct {
+	run    *budget
+	models []*budget
+}
+
+// newRunBudgets returns the budgets of spec, or nil if it has none.
+func newRunBudgets(spec *workload.Spec) *runBudgets {
+	b := &runBudgets{run: newBudget(spec.Run.MaxRequests), models: make([]*budget, len(spec.Models))}
+	limited := b.run != nil
+	for i, m := range spec.Models {
+		b.models[i] = newBudget(m.MaxRequests)
+		limited = limited || b.models[i] != nil
+	}
+	if !limited {
+		return nil
+	}
+	return b
+}
+
+// model returns the budgets a worker of the model idx spends from.
+func (b *runBudgets) model(idx int) []*budget {
+	if b == nil {
+		return nil
+	}
+	return []*budget{b.models[idx], b.run}
+}
+
+// takeAll spends a request of each of bs in turn, reporting false as soon
+// as one had none left. The request isn't sent then, so it's given back to
+// those it was already taken from.
+func takeAll(bs []*budget) bool {
+	for i, b := range bs {
+		if !b.take() {
+			for _, taken := range bs[:i+1] {
+				taken.give()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// reason returns why a run whose workers stopped by themselves stopped.
+func (b *runBudgets) reason() string {
+	if b == nil {
+		return stopRequests
+	}
+	if b.run.spent() {
+		return stopBudget
+	}
+	for _, m := range b.models {
+		if m.spent() {
+			return stopModelBudget
+		}
+	}
+	return stopRequests
+}
+
+// limitRun stops the run r after d, recording reason, unless it ends
+// first.
+func (app *App) limitRun(r *run, d time.Duration, reason string) {
+	select {
+	case <-app.clock.After(d):
+	case <-r.recorded:
+		return
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.killc == r.killc {
+		log.Printf("run %s: stopping, %s", r.batchId, stopReasons[reason])
+		app.stopWorkers(outcomeCompleted, reason)
+	}
+}
@@ -0,0 +1,118 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+func TestRunLimits(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	target := `
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+`
+	tests := []struct {
+		name   string
+		spec   string
+		sent   int
+		reason string
+	}{
+		{"requests", `
+run: {workers: 2, seed: 1}
+models:
+    - {model: m1, requests: 5}
+`, 10, stopRequests},
+		{"max requests", `
+run: {workers: 4, max_requests: 25}
+models:
+    - {model: m1}
+`, 25, stopBudget},
+		{"model max requests", `
+run: {workers: 3}
+models:
+    - {model: m1, max_requests: 7}
+`, 7, stopModelBudget},
+		{"adaptive max requests", `
+run: {workers: 3, adaptive: true}
+models:
+    - {model: m1, rate: 200, max_requests: 9}
+`, 9, stopModelBudget},
+		{"duration", `
+run: {workers: 2, duration: 300ms}
+models:
+    - {model: m1, rate: 20}
+`, -1, stopDuration},
+		{"stop at", `
+run: {workers: 2, stop_at: "` + time.Now().Add(2*time.Second).Format(time.RFC3339Nano) + `"}
+models:
+    - {model: m1, rate: 20}
+`, -1, stopTime},
+	}
+	for _, test := range tests {
+		r := runSpec(t, app, target+test.spec)
+		if r.outcome != outcomeCompleted || r.summary.StopReason != test.reason {
+			t.Errorf("%s: expected to complete by %s, got %s by %s", test.name, test.reason, r.outcome, r.summary.StopReason)
+		}
+		if test.sent >= 0 && r.summary.Sent != test.sent {
+			t.Errorf("%s: expected %d requests sent, got %d", test.name, test.sent, r.summary.Sent)
+		}
+	}
+
+	b, err := ioutil.ReadFile(reportPath(app.config.ReportDir, app.run.batchId))
+	if err != nil {
+		t.Fatalf("expected a report file: %v", err)
+	}
+	if !strings.Contains(string(b), "stop_at time came") {
+		t.Errorf("expected the report to say why the run stopped")
+	}
+}
+
+func TestRunLimitsRejected(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	target := `
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+`
+	w := do(app, "POST", "/workload", url.Values{"spec": {target + `
+run: {workers: 2, stop_at: "2015-06-01T18:00:00Z"}
+models:
+    - {model: m1}
+`}})
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), "has passed") {
+		t.Errorf("expected a stop_at in the past to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+
+	app.agents.register(agentRegistration{Name: "a1", URL: "http://agent"})
+	w = do(app, "POST", "/workload", url.Values{"spec": {target + `
+run: {workers: 2, max_requests: 10}
+models:
+    - {model: m1}
+`}})
+	if w.Code == http.StatusOK || !strings.Contains(w.Body.String(), errBudgetAgents.Error()) {
+		t.Errorf("expected a budget across agents to be refused, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTakeAllGivesBackUnsentRequests(t *testing.T) {
+	b := &runBudgets{run: newBudget(1), models: []*budget{nil, newBudget(2)}}
+	if !takeAll(b.model(0)) {
+		t.Fatal("expected the first request to be taken")
+	}
+	if takeAll(b.model(1)) {
+		t.Fatal("expected no request past the run's max_requests")
+	}
+	if b.models[1].left != 2 || b.run.left != 0 {
+		t.Errorf("expected the unsent request to be given back, got %d left of the model and %d of the run", b.models[1].left, b.run.left)
+	}
+	if reason := b.reason(); reason != stopBudget {
+		t.Errorf("expected the run's max_requests to stop it, got %s", reason)
+	}
+}
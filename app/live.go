@@ -0,0 +1,336 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// LiveConfig configures live mode, which polls the status of an Ops
+// instance without sending it any predictions.
+type LiveConfig struct {
+	// StatusPath is polled on the Ops host for its status document.
+	// Defaults to /status.
+	StatusPath string `yaml:"status_path,omitempty"`
+
+	// Interval between polls. Defaults to 1s.
+	Interval workload.Duration `yaml:"interval,omitempty"`
+
+	// Window is how much of the time series is kept. Defaults to 10m.
+	Window workload.Duration `yaml:"window,omitempty"`
+}
+
+// liveIdle is how long the monitor keeps polling after the last read of
+// its time series, so a closed live page doesn't poll forever.
+const liveIdle = time.Minute
+
+// liveStatus is the status document an Ops instance answers with. Models
+// carry a request counter, their rate is derived from it between polls
+// unless the instance reports one. Resources may nest, they are
+// flattened to dotted names.
+type liveStatus struct {
+	Models    map[string]liveModel   `json:"models"`
+	Resources map[string]interface{} `json:"resources"`
+}
+
+type liveModel struct {
+	Status   string   `json:"status"`
+	Requests int64    `json:"requests"`
+	Rate     *float64 `json:"rate,omitempty"`
+}
+
+// liveSample is a poll of the instance's status.
+type liveSample struct {
+	Time      time.Time                  `json:"time"`
+	Models    map[string]liveModelSample `json:"models"`
+	Resources map[string]float64         `json:"resources"`
+}
+
+type liveModelSample struct {
+	Status   string  `json:"status"`
+	Requests int64   `json:"requests"`
+	Rate     float64 `json:"rate"`
+}
+
+// liveTarget is the Ops instance being monitored.
+type liveTarget struct {
+	Host   string `json:"ops_host"`
+	User   string `json:"ops_user"`
+	ApiKey string `json:"ops_apikey"`
+}
+
+// liveMonitor polls one target at a time and keeps a rolling time series
+// of its status. It starts polling when its series is read and stops once
+// nobody has read it for liveIdle.
+type liveMonitor struct {
+	cfg   LiveConfig
+	clock Clock
+
+	// starting serializes switching targets and restarting the poller.
+	starting sync.Mutex
+
+	mu       sync.Mutex
+	target   liveTarget
+	samples  []liveSample
+	err      error
+	lastRead time.Time
+
+	// quit stops the poller, nil when it isn't running.
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newLiveMonitor(clock Clock, cfg LiveConfig) *liveMonitor {
+	if cfg.StatusPath == "" {
+		cfg.StatusPath = "/status"
+	}
+	if !strings.HasPrefix(cfg.StatusPath, "/") {
+		cfg.StatusPath = "/" + cfg.StatusPath
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = workload.Duration(time.Second)
+	}
+	if cfg.Window <= 0 {
+		cfg.Window = workload.Duration(10 * time.Minute)
+	}
+	return &liveMonitor{cfg: cfg, clock: clock}
+}
+
+// watch points the monitor at t, polling it right away if it is a new
+// target or the poller had stopped, and returns the time series.
+func (m *liveMonitor) watch(t liveTarget) ([]liveSample, error) {
+	m.mu.Lock()
+	m.lastRead = m.clock.Now()
+	if t == m.target && m.quit != nil {
+		defer m.mu.Unlock()
+		return m.series(), m.err
+	}
+	m.mu.Unlock()
+
+	m.starting.Lock()
+	defer m.starting.Unlock()
+	m.mu.Lock()
+	if t == m.target && m.quit != nil {
+		// Another request started it meanwhile.
+		defer m.mu.Unlock()
+		return m.series(), m.err
+	}
+	m.mu.Unlock()
+
+	m.stop()
+	m.mu.Lock()
+	if t != m.target {
+		m.target = t
+		m.samples = nil
+	}
+	m.mu.Unlock()
+
+	m.poll()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ticker := m.clock.NewTicker(time.Duration(m.cfg.Interval))
+	m.quit = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.loop(ticker, m.quit, m.done)
+	return m.series(), m.err
+}
+
+func (m *liveMonitor) loop(ticker Ticker, quit, done chan struct{}) {
+	defer close(done)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			m.mu.Lock()
+			idle := m.clock.Now().Sub(m.lastRead) > liveIdle
+			if idle {
+				m.quit = nil
+			}
+			m.mu.Unlock()
+			if idle {
+				return
+			}
+			m.poll()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// stop stops the poller if it is running.
+func (m *liveMonitor) stop() {
+	m.mu.Lock()
+	quit, done := m.quit, m.done
+	m.quit = nil
+	m.mu.Unlock()
+	if quit != nil {
+		close(quit)
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+// poll fetches the target's status and adds it to the time series.
+func (m *liveMonitor) poll() {
+	m.mu.Lock()
+	t := m.target
+	m.mu.Unlock()
+
+	status, err := fetchLiveStatus(t, m.cfg.StatusPath)
+	now := m.clock.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t != m.target {
+		return
+	}
+	m.err = err
+	if err != nil {
+		return
+	}
+	var prev *liveSample
+	if len(m.samples) > 0 {
+		prev = &m.samples[len(m.samples)-1]
+	}
+	m.samples = append(m.samples, newLiveSample(now, status, prev))
+	cutoff := now.Add(-time.Duration(m.cfg.Window))
+	i := 0
+	for i < len(m.samples) && m.samples[i].Time.Before(cutoff) {
+		i++
+	}
+	m.samples = m.samples[i:]
+}
+
+// series returns a copy of the time series. m.mu must be held.
+func (m *liveMonitor) series() []liveSample {
+	return append([]liveSample(nil), m.samples...)
+}
+
+// newLiveSample turns a status into a sample, deriving request rates from
+// the previous sample where the status has none. A counter that went
+// backwards, say after a restart, has no rate until the next poll.
+func newLiveSample(now time.Time, status *liveStatus, prev *liveSample) liveSample {
+	s := liveSample{
+		Time:      now,
+		Models:    make(map[string]liveModelSample, len(status.Models)),
+		Resources: make(map[string]float64),
+	}
+	for name, m := range status.Models {
+		ms := liveModelSample{Status: m.Status, Requests: m.Requests}
+		switch {
+		case m.Rate != nil:
+			ms.Rate = *m.Rate
+		case prev != nil:
+			p, ok := prev.Models[name]
+			dt := now.Sub(prev.Time).Seconds()
+			if ok && dt > 0 && m.Requests >= p.Requests {
+				ms.Rate = float64(m.Requests-p.Requests) / dt
+			}
+		}
+		s.Models[name] = ms
+	}
+	flattenResources("", status.Resources, s.Resources)
+	return s
+}
+
+// flattenResources adds the numbers in v to out under dotted names,
+// skipping anything else.
+func flattenResources(prefix string, v map[string]interface{}, out map[string]float64) {
+	for k, x := range v {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch x := x.(type) {
+		case float64:
+			out[name] = x
+		case map[string]interface{}:
+			flattenResources(name, x, out)
+		}
+	}
+}
+
+var liveClient = &http.Client{Timeout: 5 * time.Second}
+
+func fetchLiveStatus(t liveTarget, path string) (*liveStatus, error) {
+	if t.Host == "" {
+		return nil, fmt.Errorf("no ops host set")
+	}
+	url := strings.TrimRight(t.Host, "/") + path
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create status request: %v", err)
+	}
+	if t.User != "" {
+		req.SetBasicAuth(t.User, t.ApiKey)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := liveClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("status request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	var status liveStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("could not parse status from %s: %v", url, err)
+	}
+	return &status, nil
+}
+
+// liveStats is the /live/stats response. Metrics and Plancache are JSON
+// strings the live page parses: the latest resource usage, and request
+// rates keyed by model. Models has the latest status of each model and
+// Series the whole time series.
+type liveStats struct {
+	Running   bool              `json:"running"`
+	Error     string            `json:"error,omitempty"`
+	Metrics   string            `json:"metrics"`
+	Plancache string            `json:"plancache"`
+	Models    map[string]string `json:"models"`
+	Series    []liveSample      `json:"series"`
+}
+
+func newLiveStats(series []liveSample, err error) *liveStats {
+	stats := &liveStats{
+		Running:   err == nil && len(series) > 0,
+		Metrics:   "{}",
+		Plancache: "{}",
+		Models:    make(map[string]string),
+		Series:    series,
+	}
+	if stats.Series == nil {
+		stats.Series = []liveSample{}
+	}
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	if len(series) == 0 {
+		return stats
+	}
+	last := series[len(series)-1]
+	rates := make(map[string]float64, len(last.Models))
+	for name, m := range last.Models {
+		rates[name] = m.Rate
+		stats.Models[name] = m.Status
+	}
+	if b, err := json.Marshal(last.Resources); err == nil {
+		stats.Metrics = string(b)
+	}
+	if b, err := json.Marshal(rates); err == nil {
+		stats.Plancache = string(b)
+	}
+	return stats
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func TestNewLiveSample(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	rate := 7.5
+	status := &liveStatus{
+		Models: map[string]liveModel{
+			"beer":  {Status: "online", Requests: 30},
+			"iris":  {Status: "online", Requests: 5, Rate: &rate},
+			"wine":  {Status: "restarting", Requests: 2},
+			"fresh": {Status: "online", Requests: 9},
+		},
+		Resources: map[string]interface{}{
+			"cpu":    0.25,
+			"memory": map[string]interface{}{"used_mb": 512.0, "note": "skipped"},
+			"host":   "ops-1",
+		},
+	}
+	prev := &liveSample{
+		Time: t0,
+		Models: map[string]liveModelSample{
+			"beer": {Requests: 10},
+			"wine": {Requests: 40},
+		},
+	}
+	s := newLiveSample(t0.Add(2*time.Second), status, prev)
+
+	want := map[string]float64{"beer": 10, "iris": 7.5, "wine": 0, "fresh": 0}
+	for name, r := range want {
+		if got := s.Models[name].Rate; got != r {
+			t.Errorf("%s rate = %v, want %v", name, got, r)
+		}
+	}
+	if s.Models["wine"].Status != "restarting" {
+		t.Errorf("wine status = %q", s.Models["wine"].Status)
+	}
+	wantRes := map[string]float64{"cpu": 0.25, "memory.used_mb": 512}
+	if len(s.Resources) != len(wantRes) {
+		t.Errorf("resources = %v, want %v", s.Resources, wantRes)
+	}
+	for k, v := range wantRes {
+		if s.Resources[k] != v {
+			t.Errorf("resource %s = %v, want %v", k, s.Resources[k], v)
+		}
+	}
+}
+
+func TestLiveMonitorPolls(t *testing.T) {
+	cfg := &mockops.Config{
+		Users:  map[string]string{"demo": "key"},
+		Models: map[string]mockops.ModelConfig{"beer": {}, "iris": {}},
+	}
+	_, ts := newMockOps(t, cfg)
+	clock := newFakeClock()
+	m := newLiveMonitor(clock, LiveConfig{Window: workload.Duration(2 * time.Second)})
+	defer m.stop()
+
+	target := liveTarget{Host: ts.URL, User: "demo", ApiKey: "key"}
+	series, err := m.watch(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || series[0].Models["beer"].Status != "online" {
+		t.Fatalf("first poll = %+v", series)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := opsPredictHTTP("demo", "beer", "key", ts.URL, map[string]interface{}{"x": i}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	polled := func(n int) func() bool {
+		return func() bool {
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			return len(m.samples) == n
+		}
+	}
+	clock.Advance(time.Second)
+	waitFor(t, polled(2))
+
+	series, err = m.watch(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := series[len(series)-1]
+	if last.Models["beer"].Requests != 3 || last.Models["beer"].Rate != 3 {
+		t.Errorf("beer = %+v, want 3 requests at 3/s", last.Models["beer"])
+	}
+	if last.Models["iris"].Rate != 0 {
+		t.Errorf("iris = %+v, want no requests", last.Models["iris"])
+	}
+	if _, ok := last.Resources["memory.alloc_mb"]; !ok {
+		t.Errorf("resources = %v, want memory.alloc_mb", last.Resources)
+	}
+
+	// Samples older than the window are dropped.
+	clock.Advance(time.Second)
+	waitFor(t, polled(3))
+	clock.Advance(time.Second)
+	waitFor(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.samples[len(m.samples)-1].Time.Equal(clock.Now())
+	})
+	series, _ = m.watch(target)
+	if len(series) != 3 || !series[0].Time.Equal(clock.Now().Add(-2*time.Second)) {
+		t.Errorf("series has %d samples from %v, want the last 2s", len(series), series[0].Time)
+	}
+}
+
+func TestLiveMonitorStopsWhenIdle(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	clock := newFakeClock()
+	m := newLiveMonitor(clock, LiveConfig{})
+	defer m.stop()
+
+	if _, err := m.watch(liveTarget{Host: ts.URL}); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	done := m.done
+	m.mu.Unlock()
+	clock.Advance(liveIdle + time.Second)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor still polling after going idle")
+	}
+
+	// Reading again starts it again.
+	series, err := m.watch(liveTarget{Host: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 {
+		t.Errorf("got %d samples, want 2", len(series))
+	}
+}
+
+func TestHandleLiveStats(t *testing.T) {
+	app := newTestApp(t)
+	_, ts := newMockOps(t, &mockops.Config{Models: map[string]mockops.ModelConfig{"beer": {}}})
+
+	settings := testSettings(ts.URL, "1")
+	w := do(app, "GET", "/live/stats?"+url.Values{"settings": {settings}}.Encode(), nil)
+	if w.Code != 200 {
+		t.Fatalf("got %d: %s", w.Code, w.Body.String())
+	}
+	data := decodeJSON(t, w)
+	if data["running"] != true {
+		t.Fatalf("running = %v: %s", data["running"], w.Body.String())
+	}
+	var plancache map[string]float64
+	if err := json.Unmarshal([]byte(data["plancache"].(string)), &plancache); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := plancache["beer"]; !ok {
+		t.Errorf("plancache = %v, want beer", plancache)
+	}
+	var metrics map[string]float64
+	if err := json.Unmarshal([]byte(data["metrics"].(string)), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := metrics["goroutines"]; !ok {
+		t.Errorf("metrics = %v, want goroutines", metrics)
+	}
+	if models := data["models"].(map[string]interface{}); models["beer"] != "online" {
+		t.Errorf("models = %v", models)
+	}
+
+	// An unreachable target isn't running and says why.
+	ts.Close()
+	w = do(app, "GET", "/live/stats?"+url.Values{"settings": {testSettings("http://127.0.0.1:1", "1")}}.Encode(), nil)
+	data = decodeJSON(t, w)
+	if data["running"] != false || data["error"] == nil {
+		t.Errorf("unreachable target = %s", w.Body.String())
+	}
+
+	w = do(app, "GET", "/live", nil)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "live.js") {
+		t.Errorf("live page got %d", w.Code)
+	}
+
+	w = do(app, "GET", "/live/stats?settings=nope", nil)
+	if w.Code != 400 {
+		t.Errorf("bad settings got %d, want 400", w.Code)
+	}
+}
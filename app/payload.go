@@ -0,0 +1,78 @@
+package app
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// Placeholders in model input that are replaced with random values on every
+// request, like the @ and ^ of the original simulator's queries.
+const (
+	randomIntPlaceholder    = "@"
+	randomStringPlaceholder = "^"
+)
+
+const randomStringChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// hasPlaceholders reports whether v contains any random value placeholders.
+func hasPlaceholders(v interface{}) bool {
+	switch t := v.(type) {
+	case string:
+		return t == randomIntPlaceholder || t == randomStringPlaceholder
+	case map[string]interface{}:
+		for _, e := range t {
+			if hasPlaceholders(e) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, e := range t {
+			if hasPlaceholders(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// generate returns a copy of v with placeholders replaced by values drawn
+// from rnd. Maps are walked in sorted key order so the same rnd always
+// produces the same payload.
+func generate(v interface{}, rnd *rand.Rand) interface{} {
+	switch t := v.(type) {
+	case string:
+		switch t {
+		case randomIntPlaceholder:
+			return rnd.Int31()
+		case randomStringPlaceholder:
+			b := make([]byte, 16)
+			for i := range b {
+				b[i] = randomStringChars[rnd.Intn(len(randomStringChars))]
+			}
+			return string(b)
+		}
+		return t
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for _, k := range sortedKeys(t) {
+			out[k] = generate(t[k], rnd)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = generate(e, rnd)
+		}
+		return out
+	}
+	return v
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -19,6 +19,10 @@ function getWorkload()
             'query' : query,
             'qps'  :  qps
         };
+        if (query_widget_map[i].rate)
+        {
+            ret[i]['rate'] = query_widget_map[i].rate;
+        }
     }
     return ret;
 }
@@ -37,6 +41,10 @@ function cacheWorkload()
             'query' : query,
             'qps'  :  qps
         };
+        if (query_widget_map[i].rate)
+        {
+            all[i]['rate'] = query_widget_map[i].rate;
+        }
     }
 
     workload_s = JSON.stringify(all);
@@ -57,6 +65,9 @@ function loadWorkload(workload) {
             q = new QueryWidget();
             q.codemirror.setValue(workload[i]['query']);
             q.dialValue = workload[i]['qps'];
+            // The UI has no control for rates, but keeps them so they
+            // are run and saved.
+            q.rate = workload[i]['rate'];
             q.unfreeze();
         }
     }
@@ -16,7 +16,7 @@ function signatureToQueryWidget(signature)
         return null;
     }
 
-    setLoadingStatus("Loading queries from MemSQL plancache.");
+    setLoadingStatus("Loading models from ScienceOps.");
 
     widget = new QueryWidget();
     CURRENT_QUERIES++;
@@ -104,11 +104,14 @@ function onWorkloadReceive(data, textStatus, jqXHR) {
 
 var haventLoadedMetricsYet = true;
 
+// updateMetrics keeps the latest resource usage, keyed by the dotted
+// resource names of the instance's status.
 function updateMetrics(mets) {
-    for (var key in metricsNames) {
-        var val = parseFloat(mets[metricsNames[key]]);
+    metricsValues = {};
+    for (var key in mets) {
+        var val = parseFloat(mets[key]);
         if (isNaN(val)) val = 0;
-        metricsValues[key] = val; 
+        metricsValues[key] = val;
     }
     if (haventLoadedMetricsYet) {
         reloadMetricsChart();
@@ -117,31 +120,16 @@ function updateMetrics(mets) {
 }
 
 function reloadMetricsChart() {
-    mets_graph.series[0].data[0].update(metricsValues['array'], false);
-    mets_graph.series[0].data[1].update(metricsValues['hash'], false);
-    mets_graph.series[0].data[2].update(metricsValues['buffer'], false);
-
-    mets_graph.series[1].data[0].update(metricsValues['array'], false);
-    mets_graph.series[1].data[1].update(metricsValues['hash'], false);
-    mets_graph.series[1].data[2].update(metricsValues['cached'], false);
-    mets_graph.series[1].data[3].update(metricsValues['table'], false);
-    var other = metricsValues['buffer'] - (metricsValues['cached'] + metricsValues['table']);
-    if (other < 0) {
-        other = 0;
-        mets_graph.series[0].data[2].update(metricsValues['cached'] + metricsValues['table'], false);
+    var names = Object.keys(metricsValues).sort();
+    var values = [];
+    for (var i = 0; i < names.length; i++) {
+        values.push(metricsValues[names[i]]);
     }
-    mets_graph.series[1].data[4].update(other, false);
+    mets_graph.xAxis[0].setCategories(names, false);
+    mets_graph.series[0].setData(values, false);
     mets_graph.redraw();
 }
 
-var metricsNames = {
-    'array': 'Alloc_large_array',
-    'hash': 'Alloc_hash_buckets',
-    'buffer': 'Buffer_manager_memory',
-    'cached': 'Buffer_manager_cached_memory',
-    'table': 'Alloc_table_memory',
-};
-
 var metricsValues = {};
 
 $(document).ready(function() {
@@ -36,7 +36,11 @@ function onWorkloadReceive(data, textStatus, jqXHR) {
         {
             var qps_number = parseFloat(stats[i]);
             total_qps += qps_number;
-            query_widget_map[i].setDialValue(qps_number);
+            // Workloads run from the library may have no widgets.
+            if (query_widget_map[i])
+            {
+                query_widget_map[i].setDialValue(qps_number);
+            }
         }
 
 	for (var j in rdone)
@@ -72,16 +76,23 @@ var playButton = new function PlayButton() {
         {
              query_widget_map[i].dom.click();
         }
+        _this.start(async, {
+            'workload' : JSON.stringify(getWorkload()),
+            'settings' : JSON.stringify(getSettings())
+        });
+    };
+    // playNamed runs a workload from the library as it was saved.
+    _this.playNamed = function(name) {
+        _this.start(true, {'name' : name});
+    };
+    _this.start = function(async, form) {
         setLoadingStatus("Validating Workload");
         $.ajax({
             'type' : 'POST',
             'url'  : '/workload',
             'dataType' : 'JSON',
             'async' : async,
-            'data' : {
-                'workload' : JSON.stringify(getWorkload()),
-                'settings' : JSON.stringify(getSettings())
-            },
+            'data' : form,
             'success' : function(data, textStatus, jqXHR) {
                 console.log('successfully submitted workload');
                 console.log(data);
@@ -106,7 +117,22 @@ var playButton = new function PlayButton() {
                     createError(data['error']);
                 }
             },
-            'error' : function() { clearLoadingStatus(); genericError(); }
+            'error' : function(jqXHR, textStatus, errorThrown) {
+                clearLoadingStatus();
+                // Rejected workloads come back as JSON with an error.
+                var data = null;
+                try {
+                    data = JSON.parse(jqXHR.responseText);
+                } catch (e) {}
+                if (data && data['error'])
+                {
+                    createError(data['error']);
+                }
+                else
+                {
+                    genericError(jqXHR, textStatus, errorThrown);
+                }
+            }
         });
     };
     _this.pause = function(async) {
@@ -158,15 +184,84 @@ function clearWorkload()
     localStorage.removeItem('workload_cache');
 }
 
-function readSessionFile(contents)
+// loadInfo fills the editor with a workload converted by the server.
+function loadInfo(info)
 {
-    var ret = JSON.parse(contents);
-    if (!(ret.settings && ret.workload))
+    loadSettings(info.settings);
+    loadWorkload(info.workload);
+    cacheSettings();
+    cacheWorkload();
+    for (var i in info.warnings)
     {
-        throw SyntaxError;
+        createError({'errno' : ER_JS, 'message' : info.warnings[i]});
     }
+}
 
-    return ret;
+function loadError(prefix)
+{
+    return function(jqXHR, textStatus, errorThrown) {
+        var message = prefix;
+        try {
+            message += ": " + JSON.parse(jqXHR.responseText)['error']['message'];
+        } catch (e) {
+            if (jqXHR.responseText)
+            {
+                message += ": " + jqXHR.responseText;
+            }
+        }
+        createError({'errno' : ER_JS, 'message' : message});
+    };
+}
+
+// refreshLibrary lists the server's saved workloads, hiding the library if
+// the server has none configured.
+function refreshLibrary()
+{
+    $.ajax({
+        'type' : 'GET',
+        'url'  : '/workloads',
+        'dataType' : 'JSON',
+        'success' : function(data, textStatus, jqXHR) {
+            var select = $("#library-select");
+            select.empty();
+            for (var i in data.workloads)
+            {
+                var entry = data.workloads[i];
+                var label = entry.name + " (v" + entry.version + ")";
+                if (entry.error)
+                {
+                    continue;
+                }
+                select.append($("<option></option>").attr("value", entry.name).text(label));
+            }
+            $("#library").show();
+        },
+        'error' : function() { $("#library").hide(); }
+    });
+}
+
+// refreshSessions lists the saved sessions, newest first, selecting name.
+function refreshSessions(name)
+{
+    $.ajax({
+        'type' : 'GET',
+        'url'  : '/sessions',
+        'dataType' : 'JSON',
+        'success' : function(data, textStatus, jqXHR) {
+            var select = $("#session-select");
+            select.empty();
+            for (var i in data.sessions)
+            {
+                var s = data.sessions[i];
+                select.append($("<option></option>").attr("value", s.name).text(s.name));
+            }
+            if (name)
+            {
+                select.val(name);
+            }
+            $("#sessions").toggle(data.sessions.length > 0);
+        }
+    });
 }
 
 function handleUpload(files)
@@ -178,17 +273,16 @@ function handleUpload(files)
 
     f = files[0];
     var reader = new FileReader();
-    reader.onload = function(val) { 
-        var info = null;
-        try {
-            info = readSessionFile(reader.result);
-        } catch (SyntaxError) {
-            createError({'errno' : ER_JS, 'message' : "Invalid workload file"});
-        }
-        loadSettings(info.settings);
-        loadWorkload(info.workload);
-        cacheSettings();
-        cacheWorkload();
+    reader.onload = function(val) {
+        // The server reads every workload format and version.
+        $.ajax({
+            'type' : 'POST',
+            'url'  : '/workload/load',
+            'dataType' : 'JSON',
+            'data' : { 'spec' : reader.result },
+            'success' : loadInfo,
+            'error' : loadError("Invalid workload file")
+        });
     };
 
     reader.readAsText(f);
@@ -205,10 +299,39 @@ $(document).ready(function() {
     playButton.initialize();
 
     $("#save-workload").click(function() {
-        settings = encodeURIComponent(JSON.stringify(getSettings()));
-        workload = encodeURIComponent(JSON.stringify(getWorkload()));
-        args = 'settings=' + settings + '&workload=' + workload;
-        window.open('/save?' + args);
+        var name = prompt("Save session as:", $("#session-select").val() || "");
+        if (!name)
+        {
+            return;
+        }
+        $.ajax({
+            'type' : 'POST',
+            'url'  : '/save',
+            'dataType' : 'JSON',
+            'data' : {
+                'name' : name,
+                'workload' : JSON.stringify(getWorkload()),
+                'settings' : JSON.stringify(getSettings())
+            },
+            'success' : function(data, textStatus, jqXHR) {
+                refreshSessions(data.name);
+            },
+            'error' : loadError("Could not save session")
+        });
+    });
+
+    $("#session-restore").click(function() {
+        var name = $("#session-select").val();
+        if (name && playButton.running == 0)
+        {
+            $.ajax({
+                'type' : 'GET',
+                'url'  : '/sessions/' + encodeURIComponent(name),
+                'dataType' : 'JSON',
+                'success' : loadInfo,
+                'error' : loadError("Could not restore " + name)
+            });
+        }
     });
 
     $("#clear-button").click(function() {
@@ -217,6 +340,31 @@ $(document).ready(function() {
 
     $('#ok-clear-button').click(clearWorkload);
 
+    $("#library-open").click(function() {
+        var name = $("#library-select").val();
+        if (name && playButton.running == 0)
+        {
+            $.ajax({
+                'type' : 'GET',
+                'url'  : '/workloads/' + encodeURIComponent(name) + '?format=legacy',
+                'dataType' : 'JSON',
+                'success' : loadInfo,
+                'error' : loadError("Could not open " + name)
+            });
+        }
+    });
+
+    $("#library-run").click(function() {
+        var name = $("#library-select").val();
+        if (name && playButton.running == 0)
+        {
+            playButton.playNamed(name);
+        }
+    });
+
+    refreshLibrary();
+    refreshSessions();
+
     var workload_s = localStorage.getItem('workload_cache');
     if (workload_s)
     {
@@ -0,0 +1,442 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// reportPath is where the HTML report of a run is written.
+func reportPath(dir, batchId string) string {
+	return filepath.Join(dir, "workload_report_"+batchId+".html")
+}
+
+// report is the data of a run's HTML report.
+type report struct {
+	Run       *runRecord
+	Workload  string
+	Generated time.Time
+	Env       [][2]string
+
+	Thresholds []thresholdResult
+	Passed     bool
+
+	// Adaptive is set if the run sized each model's workers to its rate.
+	Adaptive bool
+
+	// Users paced the run's workers as virtual users, if set.
+	Users *workload.Users
+
+	// Charts by model.
+	Models []modelReport
+
+	// Server series scraped during the run, by target.
+	Servers []serverReport
+}
+
+type serverReport struct {
+	Target string
+	Series []serverSeries
+}
+
+// serverSeries is a series scraped from a server and its correlation with
+// the run's total rate and worst p95 latency at the same times.
+type serverSeries struct {
+	Name              string
+	Chart             template.HTML
+	RateCorr, P95Corr float64
+	HasRate, HasP95   bool
+	Samples           int
+}
+
+type modelReport struct {
+	Summary modelSummary
+	Charts  []template.HTML
+}
+
+// writeReport writes the HTML report of a finished run to the report
+// directory.
+func (app *App) writeReport(rec *runRecord, points []point, server []serverPoint) error {
+	var buf bytes.Buffer
+	if err := app.renderReport(&buf, rec, points, server); err != nil {
+		return err
+	}
+	path := reportPath(app.config.ReportDir, rec.BatchId)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing report %s: %v", path, err)
+	}
+	return nil
+}
+
+// renderReport renders the report of a finished run. The report has no
+// external assets, so it can be viewed offline and sent on.
+func (app *App) renderReport(w io.Writer, rec *runRecord, points []point, server []serverPoint) error {
+	rep := &report{
+		Run:       rec,
+		Generated: app.clock.Now(),
+		Env:       app.environment(),
+	}
+	if rec.Spec != nil {
+		// Don't give the API key to whoever gets the report.
+		b, err := workload.Marshal(withoutAPIKey(rec.Spec), "yaml")
+		if err != nil {
+			return fmt.Errorf("error encoding workload of run %s: %v", rec.BatchId, err)
+		}
+		rep.Workload = string(b)
+		rep.Adaptive = rec.Spec.Run.Adaptive
+		rep.Users = rec.Spec.Run.Users
+		if rec.Summary != nil {
+			rep.Thresholds = checkThresholds(rec.Spec, rec.Summary)
+			rep.Passed = thresholdsPassed(rep.Thresholds)
+		}
+	}
+
+	if rec.Summary != nil {
+		byModel := make(map[string][]point)
+		for _, p := range points {
+			byModel[p.ModelID] = append(byModel[p.ModelID], p)
+		}
+		for _, m := range rec.Summary.Models {
+			rep.Models = append(rep.Models, modelReport{
+				Summary: m,
+				Charts:  modelCharts(rec.Started, byModel[m.ID], m),
+			})
+		}
+	}
+	rep.Servers = serverReports(rec.Started, points, server)
+
+	if err := reportTemplate.Execute(w, rep); err != nil {
+		return fmt.Errorf("error rendering report of run %s: %v", rec.BatchId, err)
+	}
+	return nil
+}
+
+func (app *App) environment() [][2]string {
+	host, _ := os.Hostname()
+	return [][2]string{
+		{"Simulator host", host},
+		{"OS", runtime.GOOS + "/" + runtime.GOARCH},
+		{"Go", runtime.Version()},
+		{"CPUs", fmt.Sprint(runtime.NumCPU())},
+		{"GOMAXPROCS", fmt.Sprint(runtime.GOMAXPROCS(0))},
+		{"Max workers", fmt.Sprint(app.config.MaxWorkers)},
+	}
+}
+
+// series is one line of a chart.
+type series struct {
+	name  string
+	color string
+	x, y  []float64
+}
+
+// chartMark is a labelled time of a chart.
+type chartMark struct {
+	x     float64
+	label string
+}
+
+func modelCharts(started time.Time, points []point, m modelSummary) []template.HTML {
+	rate := series{name: "done/s", color: "#2f7ed8"}
+	failed := series{name: "failed", color: "#d9534f"}
+	p50 := series{name: "p50", color: "#8bbc21"}
+	p95 := series{name: "p95", color: "#f28f43"}
+	p99 := series{name: "p99", color: "#910000"}
+	for _, p := range points {
+		x := p.Time.Sub(started).Seconds()
+		rate.x, rate.y = append(rate.x, x), append(rate.y, p.Rate)
+		failed.x, failed.y = append(failed.x, x), append(failed.y, float64(p.Failed))
+		if p.Done > 0 {
+			for _, s := range []struct {
+				s *series
+				v float64
+			}{{&p50, p.P50}, {&p95, p.P95}, {&p99, p.P99}} {
+				s.s.x, s.s.y = append(s.s.x, x), append(s.s.y, s.v*1000)
+			}
+		}
+	}
+	charts := []template.HTML{}
+	if m.Users > 0 {
+		charts = append(charts, userCharts(started, points)...)
+	}
+	var marks []chartMark
+	if m.Knee != nil {
+		marks = append(marks, chartMark{m.Knee.Time.Sub(started).Seconds(), "knee"})
+	}
+	if m.Saturation != nil {
+		marks = append(marks, chartMark{m.Saturation.Time.Sub(started).Seconds(), "saturated"})
+	}
+	return append(charts,
+		lineChart("Rate", "requests per second", []series{rate}, marks...),
+		lineChart("Latency", "milliseconds", []series{p50, p95, p99}, marks...),
+		lineChart("Errors", "failed requests per interval", []series{failed}),
+	)
+}
+
+// userCharts charts a model's active virtual users and the iterations they
+// finished per second.
+func userCharts(started time.Time, points []point) []template.HTML {
+	users := series{name: "active users", color: "#492970"}
+	iterations := series{name: "iterations/s", color: "#2f7ed8"}
+	prev := started
+	for _, p := range points {
+		x := p.Time.Sub(started).Seconds()
+		users.x, users.y = append(users.x, x), append(users.y, float64(p.Users))
+		if dt := p.Time.Sub(prev).Seconds(); dt > 0 {
+			iterations.x, iterations.y = append(iterations.x, x), append(iterations.y, float64(p.Iterations)/dt)
+		}
+		prev = p.Time
+	}
+	return []template.HTML{
+		lineChart("Active users", "virtual users", []series{users}),
+		lineChart("Iterations", "iterations per second", []series{iterations}),
+	}
+}
+
+// serverReports charts each scraped series and correlates it with the
+// client's points of the same time.
+func serverReports(started time.Time, points []point, server []serverPoint) []serverReport {
+	// The client's total rate and worst p95 at each time.
+	rate := make(map[time.Time]float64)
+	p95 := make(map[time.Time]float64)
+	for _, p := range points {
+		rate[p.Time] += p.Rate
+		if p.Done > 0 {
+			p95[p.Time] = math.Max(p95[p.Time], p.P95)
+		}
+	}
+
+	type key struct{ target, series string }
+	bySeries := make(map[key][]serverPoint)
+	var keys []key
+	for _, p := range server {
+		k := key{p.Target, p.Series}
+		if _, ok := bySeries[k]; !ok {
+			keys = append(keys, k)
+		}
+		bySeries[k] = append(bySeries[k], p)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].target != keys[j].target {
+			return keys[i].target < keys[j].target
+		}
+		return keys[i].series < keys[j].series
+	})
+
+	var reports []serverReport
+	for _, k := range keys {
+		if len(reports) == 0 || reports[len(reports)-1].Target != k.target {
+			reports = append(reports, serverReport{Target: k.target})
+		}
+		ps := bySeries[k]
+		s := series{name: "value", color: "#2f7ed8"}
+		var v1, r, v2, l []float64
+		for _, p := range ps {
+			s.x = append(s.x, p.Time.Sub(started).Seconds())
+			s.y = append(s.y, p.Value)
+			if x, ok := rate[p.Time]; ok {
+				v1, r = append(v1, p.Value), append(r, x)
+			}
+			if x, ok := p95[p.Time]; ok {
+				v2, l = append(v2, p.Value), append(l, x)
+			}
+		}
+		ss := serverSeries{Name: k.series, Chart: lineChart(k.series, "", []series{s}), Samples: len(ps)}
+		ss.RateCorr, ss.HasRate = pearson(v1, r)
+		ss.P95Corr, ss.HasP95 = pearson(v2, l)
+		sr := &reports[len(reports)-1]
+		sr.Series = append(sr.Series, ss)
+	}
+	return reports
+}
+
+// lineChart draws the series as an inline SVG chart against seconds
+// since the start of the run, with a line at each of marks.
+func lineChart(title, unit string, ss []series, marks ...chartMark) template.HTML {
+	const (
+		width, height = 600, 220
+		left, right   = 60, 20
+		top, bottom   = 30, 40
+		ticks         = 4
+	)
+	var xmax, ymax float64
+	for _, s := range ss {
+		for i := range s.x {
+			xmax = math.Max(xmax, s.x[i])
+			ymax = math.Max(ymax, s.y[i])
+		}
+	}
+	if xmax == 0 {
+		xmax = 1
+	}
+	if ymax == 0 {
+		ymax = 1
+	}
+	ymax *= 1.1
+	pw, ph := float64(width-left-right), float64(height-top-bottom)
+	px := func(x float64) float64 { return float64(left) + x/xmax*pw }
+	py := func(y float64) float64 { return float64(top) + ph - y/ymax*ph }
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" class="chart">`, width, height)
+	fmt.Fprintf(&b, `<text x="%d" y="18" class="title">%s</text>`, left, template.HTMLEscapeString(title))
+	for i := 0; i <= ticks; i++ {
+		y := ymax * float64(i) / ticks
+		fmt.Fprintf(&b, `<line x1="%d" x2="%d" y1="%.1f" y2="%.1f" class="grid"/>`, left, width-right, py(y), py(y))
+		fmt.Fprintf(&b, `<text x="%d" y="%.1f" class="tick" text-anchor="end">%.3g</text>`, left-6, py(y)+4, y)
+		x := xmax * float64(i) / ticks
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="tick" text-anchor="middle">%.0fs</text>`, px(x), height-bottom+16, x)
+	}
+	fmt.Fprintf(&b, `<text x="%d" y="%d" class="tick">%s</text>`, left, height-6, template.HTMLEscapeString(unit))
+	for _, m := range marks {
+		x := px(math.Min(m.x, xmax))
+		fmt.Fprintf(&b, `<line x1="%.1f" x2="%.1f" y1="%d" y2="%d" class="mark"/>`, x, x, top, height-bottom)
+		fmt.Fprintf(&b, `<text x="%.1f" y="%d" class="tick">%s</text>`, x+3, top+10, template.HTMLEscapeString(m.label))
+	}
+	for i, s := range ss {
+		if len(s.x) > 0 {
+			fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="1.5" points="`, s.color)
+			for j := range s.x {
+				fmt.Fprintf(&b, "%.1f,%.1f ", px(s.x[j]), py(s.y[j]))
+			}
+			b.WriteString(`"/>`)
+		}
+		lx := width - right - 70*(len(ss)-i)
+		fmt.Fprintf(&b, `<rect x="%d" y="10" width="10" height="10" fill="%s"/>`, lx, s.color)
+		fmt.Fprintf(&b, `<text x="%d" y="19" class="tick">%s</text>`, lx+14, template.HTMLEscapeString(s.name))
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"ms":   func(s float64) string { return fmt.Sprintf("%.1f ms", s*1000) },
+	"pct":  func(f float64) string { return fmt.Sprintf("%.2f%%", f*100) },
+	"time": func(t time.Time) string { return t.UTC().Format(time.RFC3339) },
+	"reason": func(r string) string {
+		if d, ok := stopReasons[r]; ok {
+			return d
+		}
+		return r
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Workload report {{.Run.Name}} {{.Run.BatchId}}</title>
+<style>
+body { font-family: "Helvetica Neue", Helvetica, Arial, sans-serif; color: #333; margin: 2em auto; max-width: 1240px; }
+h1 { font-size: 24px; } h2 { font-size: 18px; margin-top: 2em; border-bottom: 1px solid #ddd; }
+table { border-collapse: collapse; margin: 1em 0; }
+th, td { padding: 4px 12px; border-bottom: 1px solid #eee; text-align: left; }
+td.num { text-align: right; font-family: Menlo, Monaco, monospace; }
+.passed { color: #468847; } .failed { color: #b94a48; font-weight: bold; }
+pre { background: #f5f5f5; border: 1px solid #ccc; padding: 1em; overflow: auto; }
+svg.chart { margin: 0 1em 1em 0; }
+svg .title { font-size: 14px; font-weight: bold; }
+svg .tick { font-size: 11px; fill: #666; }
+svg .grid { stroke: #e5e5e5; }
+svg .mark { stroke: #b94a48; stroke-dasharray: 4 3; }
+</style>
+</head>
+<body>
+<h1>{{if .Run.Name}}{{.Run.Name}}{{else}}Workload{{end}} <small>{{.Run.BatchId}}</small></h1>
+<table>
+<tr><th>Outcome</th><td>{{.Run.Outcome}}</td></tr>
+{{with .Run.Summary}}{{with .StopReason}}<tr><th>Stopped</th><td>{{reason .}}</td></tr>{{end}}{{end}}
+<tr><th>Thresholds</th><td>{{if not .Thresholds}}none{{else if .Passed}}<span class="passed">passed</span>{{else}}<span class="failed">failed</span>{{end}}</td></tr>
+<tr><th>Started</th><td>{{time .Run.Started}}</td></tr>
+{{with .Run.Ended}}<tr><th>Ended</th><td>{{time .}}</td></tr>{{end}}
+<tr><th>Target</th><td>{{.Run.TargetUser}} @ {{.Run.TargetHost}}</td></tr>
+<tr><th>Workers</th><td>{{.Run.Workers}}{{if .Adaptive}} per model, adaptive{{end}}{{if .Users}} virtual users{{end}}</td></tr>
+<tr><th>Seed</th><td>{{.Run.Seed}}</td></tr>
+{{with .Run.Tags}}<tr><th>Tags</th><td>{{range .}}{{.}} {{end}}</td></tr>{{end}}
+</table>
+
+{{with .Run.Summary}}
+<h2>Summary</h2>
+<table>
+<tr><th>Model</th><th>Id</th><th>Sent</th><th>Done</th><th>Failed</th><th>Error rate</th><th>Rate</th><th>Mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>Max</th></tr>
+{{range .Models}}<tr><td>{{.Model}}</td><td>{{.ID}}</td><td class="num">{{.Sent}}</td><td class="num">{{.Done}}</td><td class="num">{{.Failed}}</td><td class="num">{{pct .ErrorRate}}</td><td class="num">{{printf "%.1f/s" .Rate}}</td>{{with .Latency}}<td class="num">{{ms .Mean}}</td><td class="num">{{ms .P50}}</td><td class="num">{{ms .P90}}</td><td class="num">{{ms .P95}}</td><td class="num">{{ms .P99}}</td><td class="num">{{ms .Max}}</td>{{end}}</tr>
+{{end}}<tr><th colspan="2">Total</th><td class="num">{{.Sent}}</td><td class="num">{{.Done}}</td><td class="num">{{.Failed}}</td><td class="num">{{pct .ErrorRate}}</td><td class="num">{{printf "%.1f/s" .Rate}}</td>{{with .Latency}}<td class="num">{{ms .Mean}}</td><td class="num">{{ms .P50}}</td><td class="num">{{ms .P90}}</td><td class="num">{{ms .P95}}</td><td class="num">{{ms .P99}}</td><td class="num">{{ms .Max}}</td>{{end}}</tr>
+</table>
+<p>Ran for {{printf "%.1f" .Duration}}s. Latencies only count successful requests.</p>
+{{end}}
+
+{{if .Adaptive}}{{with .Run.Summary}}
+<h2>Worker pools</h2>
+<table>
+<tr><th>Model</th><th>Id</th><th>Most workers</th><th>Sent late</th><th>Ceiling</th></tr>
+{{range .Models}}<tr><td>{{.Model}}</td><td>{{.ID}}</td><td class="num">{{.Workers}}</td><td class="num">{{.Late}}</td><td>{{if .CeilingLimited}}<span class="failed">limited the rate</span>{{else}}not reached{{end}}</td></tr>
+{{end}}</table>
+<p>Requests are sent late when every worker of the model is busy and its pool is at the ceiling of {{$.Run.Workers}} workers.</p>
+{{end}}{{end}}
+
+{{with .Users}}{{with $.Run.Summary}}
+<h2>Virtual users</h2>
+<table>
+<tr><th>Model</th><th>Id</th><th>Most active</th><th>Iterations</th><th>Iterations/s</th><th>Failed</th></tr>
+{{range .Models}}<tr><td>{{.Model}}</td><td>{{.ID}}</td><td class="num">{{.Users}}</td><td class="num">{{.Sent}}</td><td class="num">{{printf "%.2f/s" .IterationRate}}</td><td class="num">{{.Failed}}</td></tr>
+{{end}}</table>
+{{end}}<p>Each user sends a request, or runs its scenario, and then thinks for {{.ThinkMin}}{{if gt .ThinkMax .ThinkMin}} to {{.ThinkMax}}{{end}} before the next.
+{{if .RampUp}}Users joined over {{.RampUp}}.{{end}} {{if .RampDown}}They left over the last {{.RampDown}} of the run.{{end}}</p>
+{{end}}
+
+{{with .Thresholds}}
+<h2>Thresholds</h2>
+<table>
+<tr><th>Model</th><th>Metric</th><th>Min</th><th>Max</th><th>Value</th><th></th></tr>
+{{range .}}<tr><td>{{.Model}}</td><td>{{.Metric}}</td><td>{{.Min}}</td><td>{{.Max}}</td><td class="num">{{printf "%.4g" .Value}}</td><td>{{if .Passed}}<span class="passed">passed</span>{{else}}<span class="failed">failed</span>{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{range .Models}}
+<h2>{{.Summary.Model}} <small>{{.Summary.ID}}</small></h2>
+{{with .Summary.Knee}}<p>Latency knee at {{printf "%.1f/s" .Offered}} offered, {{printf "%.1f/s" .Rate}} done with a p95 of {{ms .P95}}, first reached {{time .Time}}.</p>
+{{end}}{{with .Summary.Saturation}}<p>Saturated at {{printf "%.1f/s" .Offered}} offered, only {{printf "%.1f/s" .Rate}} done with a p95 of {{ms .P95}}, first reached {{time .Time}}.</p>
+{{end}}{{with .Summary.Steps}}<p>A scenario of {{len .}} steps. Its latency above is end to end, of the scenarios whose every step succeeded; a
+scenario stops at the first step that fails.</p>
+<table>
+<tr><th>Step</th><th>Model</th><th>Sent</th><th>Done</th><th>Failed</th><th>Error rate</th><th>Mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>Max</th></tr>
+{{range .}}<tr><td class="num">{{.Step}}</td><td>{{.Model}}</td><td class="num">{{.Sent}}</td><td class="num">{{.Done}}</td><td class="num">{{.Failed}}</td><td class="num">{{pct .ErrorRate}}</td>{{with .Latency}}<td class="num">{{ms .Mean}}</td><td class="num">{{ms .P50}}</td><td class="num">{{ms .P90}}</td><td class="num">{{ms .P95}}</td><td class="num">{{ms .P99}}</td><td class="num">{{ms .Max}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}{{range .Charts}}{{.}}{{end}}
+{{end}}
+
+{{with .Servers}}
+<h2>Servers</h2>
+<p>Series scraped from the target's servers, with their correlation to the total request rate and the worst p95 latency of
+the same seconds. A correlation near 1 or -1 means the series moved with the client's numbers.</p>
+<table>
+<tr><th>Target</th><th>Series</th><th>Samples</th><th>Corr. with rate</th><th>Corr. with p95</th></tr>
+{{range .}}{{$target := .Target}}{{range .Series}}<tr><td>{{$target}}</td><td>{{.Name}}</td><td class="num">{{.Samples}}</td><td class="num">{{if .HasRate}}{{printf "%.2f" .RateCorr}}{{else}}n/a{{end}}</td><td class="num">{{if .HasP95}}{{printf "%.2f" .P95Corr}}{{else}}n/a{{end}}</td></tr>
+{{end}}{{end}}</table>
+{{range .}}<h3>{{.Target}}</h3>
+{{range .Series}}{{.Chart}}{{end}}
+{{end}}
+{{end}}
+
+{{with .Workload}}
+<h2>Workload</h2>
+<pre>{{.}}</pre>
+{{end}}
+
+<h2>Environment</h2>
+<table>
+{{range .Env}}<tr><th>{{index . 0}}</th><td>{{index . 1}}</td></tr>
+{{end}}<tr><th>Generated</th><td>{{time .Generated}}</td></tr>
+</table>
+</body>
+</html>
+`))
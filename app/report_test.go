@@ -0,0 +1,111 @@
+package app
+
+import (
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func TestCheckThresholds(t *testing.T) {
+	spec := &workload.Spec{Thresholds: []workload.Threshold{
+		{Metric: "p99", Max: "200ms"},
+		{Model: "b", Metric: "error_rate", Max: "1%"},
+		{Model: "m1", Metric: "rate", Min: "10", Max: "100"},
+	}}
+	s := &runSummary{Models: []modelSummary{
+		{ID: "a", Model: "m1", Rate: 50, ErrorRate: 0.5, Latency: latencySummary{P99: 0.1}},
+		{ID: "b", Model: "m2", Rate: 5, ErrorRate: 0.02, Latency: latencySummary{P99: 0.3}},
+	}}
+	results := checkThresholds(spec, s)
+	expected := []thresholdResult{
+		{Metric: "p99", Model: "a", Max: "200ms", Value: 0.1, Passed: true},
+		{Metric: "p99", Model: "b", Max: "200ms", Value: 0.3, Passed: false},
+		{Metric: "error_rate", Model: "b", Max: "1%", Value: 0.02, Passed: false},
+		{Metric: "rate", Model: "a", Min: "10", Max: "100", Value: 50, Passed: true},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), results)
+	}
+	for i, r := range results {
+		e := expected[i]
+		if r.Metric != e.Metric || r.Model != e.Model || r.Passed != e.Passed || math.Abs(r.Value-e.Value) > 1e-9 {
+			t.Errorf("result %d: expected %+v, got %+v", i, e, r)
+		}
+	}
+	if thresholdsPassed(results) || !thresholdsPassed(results[:1]) {
+		t.Error("expected thresholdsPassed to fail on any failed threshold")
+	}
+}
+
+func TestReport(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Models: map[string]mockops.ModelConfig{"flaky": {ErrorRate: 1}},
+	})
+	app := newTestApp(t)
+	r := runSpec(t, app, `
+version: 1
+metadata: {name: nightly}
+target: {host: "`+ts.URL+`", user: demo, apikey: secret-key}
+run: {workers: 2, seed: 3}
+models:
+    - {id: ok, model: m1, requests: 5}
+    - {id: bad, model: flaky, requests: 5}
+thresholds:
+    - {metric: error_rate, max: 10%}
+`)
+
+	path := reportPath(app.config.ReportDir, r.batchId)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected a report file: %v", err)
+	}
+	for _, s := range []string{"nightly", r.batchId, "<svg", "error_rate", "failed", "Environment"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("expected the report to contain %q", s)
+		}
+	}
+	if strings.Contains(string(b), "secret-key") {
+		t.Error("expected the report not to contain the API key")
+	}
+	var spec string
+	if err := app.history.db.QueryRow(`SELECT spec FROM runs WHERE batch_id = ?`, r.batchId).Scan(&spec); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(spec, "secret-key") || r.plan.spec.Target.APIKey != "secret-key" {
+		t.Errorf("expected the history to leave out the API key the run used, got %s", spec)
+	}
+	if _, err := app.history.db.Exec(`UPDATE runs SET spec = ? WHERE batch_id = ?`,
+		strings.Replace(spec, `"user":"demo"`, `"user":"demo","apikey":"secret-key"`, 1), r.batchId); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(app, "GET", "/runs/"+r.batchId, nil); w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret-key") ||
+		!strings.Contains(w.Body.String(), `"user":"demo"`) {
+		t.Errorf("expected the run to be served without its API key, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := do(app, "GET", "/reports/"+r.batchId, nil)
+	if w.Code != http.StatusOK || w.Body.String() != string(b) {
+		t.Errorf("expected the report to be served, got %d", w.Code)
+	}
+
+	// Runs in the history without a report file are rendered on demand.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w = do(app, "GET", "/reports/"+r.batchId, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "<svg") {
+		t.Errorf("expected the report to be rendered from the history, got %d", w.Code)
+	}
+
+	for _, id := range []string{"nope", ".hidden", ""} {
+		if w := do(app, "GET", "/reports/"+id, nil); w.Code != http.StatusNotFound {
+			t.Errorf("%q: expected 404, got %d", id, w.Code)
+		}
+	}
+}
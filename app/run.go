@@ -0,0 +1,465 @@
+package app
+
+import (
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// errRunning is returned when starting a workload while another one runs.
+var errRunning = errors.New("a workload is already running")
+
+// errAdaptiveAgents is returned when starting an adaptive run with agents
+// registered, which only run fixed workers.
+var errAdaptiveAgents = errors.New("adaptive runs can't be split across agents")
+
+// errStopped is returned when a run is stopped before it has started.
+var errStopped = errors.New("the workload was stopped before it started")
+
+// run is a started workload.
+type run struct {
+	batchId string
+	plan    *plan
+	started time.Time
+
+	// killc is closed to stop the run's workers.
+	killc chan int
+
+	// outcome and reason are set by whoever stops the run, and to
+	// completed if the workers finish by themselves. Guarded by app.mu.
+	outcome string
+	reason  string
+
+	// budgets, if set, are the run's request limits.
+	budgets *runBudgets
+
+	// collector has the run's complete statistics.
+	collector *collector
+
+	// record of the run for the history and report, and its points. The
+	// points are appended by the collector until it finishes.
+	record *runRecord
+	points []point
+
+	// intervals the collector has added points of.
+	intervals int
+
+	// knees found in the points so far by model id, guarded by mu.
+	mu    sync.Mutex
+	knees map[string]*modelKnee
+
+	// scraper, if set, scrapes the target's servers during the run, and
+	// serverPoints are what it scraped.
+	scraper      *scraper
+	serverPoints []serverPoint
+
+	// summary of the run once it is recorded.
+	summary *runSummary
+
+	// totals are the requests sent and done so far by model id, and
+	// pointed the time of each model's last point, for the rows written to
+	// the report sinks. Only the collector touches them.
+	totals  map[string]Metric
+	pointed map[string]time.Time
+
+	// remote, if set, is the run split across agents, which run its
+	// workers instead.
+	remote *remoteRun
+
+	// recorded is closed once the run has ended and is in the history.
+	recorded chan struct{}
+}
+
+// startRun spawns the workers for p and returns the batch id of the run.
+func (app *App) startRun(p *plan) (string, error) {
+	// Open the report sinks on a per workload basis.
+	// The pause button event should close them.
+	batchId, err := uuid()
+	if err != nil {
+		log.Printf("error generating uuid: %v", err)
+	}
+
+	// With agents registered, they run the workers. The run is reserved
+	// while they are asked to start it, which is done without app.mu so
+	// that a slow agent doesn't hold up the server.
+	killc, agents, err := app.reserveRun(p)
+	if err != nil {
+		return "", err
+	}
+	var remote *remoteRun
+	if len(agents) > 0 {
+		remote, err = app.startRemote(p, batchId, agents)
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.killc != killc {
+		// The run was stopped while the agents started it.
+		if remote != nil {
+			go stopShares(remote.shares, batchId, app.config.AgentToken)
+		}
+		return "", errStopped
+	}
+	if err != nil {
+		app.killc = nil
+		return "", err
+	}
+
+	// A run stopped without pausing may not have finished yet.
+	closeSinks(app.sinks)
+	app.sinks = openSinks(app.config.ReportSinks, app.config.ReportDir, batchId)
+
+	spec := p.spec
+	nw := spec.Run.Workers
+	app.config.currentWorkers = nw
+	scale := newRateScale(1)
+
+	started, lag := app.clock.Now(), time.Duration(0)
+	if remote != nil {
+		// The run starts with the agents, and their Stats arrive late.
+		started, lag = remote.startAt, agentStatsLag
+	}
+	r := &run{
+		batchId:  batchId,
+		plan:     p,
+		started:  started,
+		killc:    app.killc,
+		remote:   remote,
+		budgets:  newRunBudgets(spec),
+		totals:   make(map[string]Metric),
+		pointed:  make(map[string]time.Time),
+		recorded: make(chan struct{}),
+	}
+	app.run = r
+	r.record = &runRecord{
+		BatchId:    batchId,
+		Name:       p.name,
+		Started:    r.started,
+		Outcome:    outcomeRunning,
+		TargetHost: spec.Target.Host,
+		TargetUser: spec.Target.User,
+		Workers:    nw,
+		Seed:       p.seed,
+		Tags:       spec.Metadata.Tags,
+		Spec:       spec,
+	}
+	h := app.history
+	if h != nil {
+		if err := h.start(r.record); err != nil {
+			log.Printf("failed to record run: %v", err)
+		}
+	}
+	if len(app.config.Scrape.Targets) > 0 {
+		r.scraper = newScraper(app.clock, app.config.Scrape)
+	}
+	onPoints := func(points []point) {
+		r.addPoints(points)
+		app.writeSinks(r, r.rows(points))
+		if h != nil {
+			if err := h.addPoints(batchId, points); err != nil {
+				log.Println(err)
+			}
+		}
+		if r.scraper == nil || len(points) == 0 {
+			return
+		}
+		server := r.scraper.take(points[0].Time)
+		r.serverPoints = append(r.serverPoints, server...)
+		if h != nil && len(server) > 0 {
+			if err := h.addServerPoints(batchId, server); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+	r.collector = newCollector(app.clock, time.Second, lag, app.Statc, onPoints)
+	if d := time.Duration(spec.Run.Duration); d > 0 {
+		go app.limitRun(r, r.started.Add(d).Sub(app.clock.Now()), stopDuration)
+	}
+	if t, _ := spec.Run.StopTime(); !t.IsZero() {
+		go app.limitRun(r, t.Sub(app.clock.Now()), stopTime)
+	}
+
+	if remote != nil {
+		go app.waitRemote(r, app.clock.NewTicker(agentFlushInterval))
+		return batchId, nil
+	}
+	var done []<-chan struct{}
+	if spec.Run.Adaptive {
+		done = spawnPools(p, batchId, app.clock, r.collector.stats, app.killc, scale, app.statsd, r.budgets)
+	} else {
+		done = spawnWorkers(p, batchId, 0, nw, app.clock, r.collector.stats, app.killc, scale, app.statsd, r.budgets)
+	}
+	go app.waitWorkers(r, done)
+	if len(spec.Stages) > 0 {
+		go app.runStages(app.killc, scale, spec.Stages)
+	}
+	return batchId, nil
+}
+
+// reserveRun takes the slot of the current run for p, returning the kill
+// channel that stands for it and the agents to split it across, if any.
+// Stopping workers while the run is reserved gives the slot back.
+func (app *App) reserveRun(p *plan) (chan int, []agentInfo, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.killc != nil {
+		return nil, nil, errRunning
+	}
+	agents := app.agents.live()
+	if len(agents) > 0 {
+		if p.spec.Run.Adaptive {
+			return nil, nil, errAdaptiveAgents
+		}
+		if newRunBudgets(p.spec) != nil {
+			return nil, nil, errBudgetAgents
+		}
+	}
+	app.killc = make(chan int)
+	return app.killc, agents, nil
+}
+
+// addPoints adds the points of an interval to the run's, and looks for
+// its knees again every kneeEvery intervals.
+func (r *run) addPoints(points []point) {
+	r.points = append(r.points, points...)
+	r.intervals++
+	if r.intervals%kneeEvery != 0 {
+		return
+	}
+	knees := detectKnees(r.started, r.points)
+	r.mu.Lock()
+	r.knees = knees
+	r.mu.Unlock()
+}
+
+// rows turns points of the run into rows for its report sinks, which count
+// requests since the start of the run and give the rate of iterations over
+// each point.
+func (r *run) rows(points []point) []*CsvMetric {
+	spec := r.plan.spec
+	names := make(map[string]string, len(spec.Models))
+	for i, m := range spec.Models {
+		names[spec.ModelID(i)] = m.Model
+	}
+	rows := make([]*CsvMetric, 0, len(points))
+	for _, p := range points {
+		m := r.totals[p.ModelID]
+		m.reqSent += p.Sent
+		m.reqComplete += p.Done
+		m.reqPerSec = int(p.Rate)
+		r.totals[p.ModelID] = m
+		prev, ok := r.pointed[p.ModelID]
+		if !ok {
+			prev = r.started
+		}
+		r.pointed[p.ModelID] = p.Time
+		var iterPerSec float64
+		if dt := p.Time.Sub(prev).Seconds(); dt > 0 {
+			iterPerSec = float64(p.Iterations) / dt
+		}
+		rows = append(rows, &CsvMetric{
+			ts:           p.Time,
+			batchId:      r.batchId,
+			seed:         r.plan.seed,
+			opsHost:      spec.Target.Host,
+			opsUser:      spec.Target.User,
+			opsModelName: names[p.ModelID],
+			nWorkers:     spec.Run.Workers,
+			reqSent:      m.reqSent,
+			reqComplete:  m.reqComplete,
+			reqPerSec:    m.reqPerSec,
+			users:        p.Users,
+			iterPerSec:   iterPerSec,
+		})
+	}
+	return rows
+}
+
+// writeSinks writes rows of the run r to its report sinks, unless they
+// were closed when it was paused or killed.
+func (app *App) writeSinks(r *run, rows []*CsvMetric) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.run != r {
+		return
+	}
+	for _, sink := range app.sinks {
+		if err := sink.Write(rows); err != nil {
+			log.Printf("failed to write stats of run %s: %v", r.batchId, err)
+		}
+	}
+}
+
+// spawnWorkers starts workers first to first+n-1 of p's run, which sends
+// their Stats to stats and stops them when killc is closed. All randomness
+// in the run is drawn from the seed, so the same seed gives the same
+// assignment, arrivals and payloads, whichever of the workers are started.
+// That lets agents each start a share of a run's workers. Workers spend
+// their requests from budgets, if set.
+func spawnWorkers(p *plan, batchId string, first, n int, clock Clock, stats chan *Stat, killc chan int, scale *rateScale, statsd *statsdClient, budgets *runBudgets) []<-chan struct{} {
+	spec := p.spec
+	rnd := rand.New(rand.NewSource(p.seed))
+	done := make([]<-chan struct{}, 0, n)
+	for i := 0; i < first+n; i++ {
+		// Choose a model from the workload at random.
+		idx := rnd.Intn(len(spec.Models))
+		seed := rnd.Int63()
+		if i < first {
+			continue
+		}
+		model := spec.Models[idx]
+		nrequests := model.Requests
+		if nrequests == 0 {
+			// Unlimited, the stages or limits end the run.
+			nrequests = math.MaxInt32
+		}
+		work := &Workload{
+			dt:         500 * time.Millisecond,
+			batchId:    batchId,
+			workerId:   i,
+			seed:       p.seed,
+			opsHost:    spec.Target.Host,
+			apiKey:     spec.Target.APIKey,
+			user:       spec.Target.User,
+			nrequests:  nrequests,
+			modelId:    spec.ModelID(idx),
+			modelName:  model.Model,
+			modelInput: model.Input,
+			payloads:   model.Payloads,
+			steps:      newScenario(model),
+			clock:      clock,
+			rnd:        rand.New(rand.NewSource(seed)),
+			arrival:    spec.Run.Arrival,
+			rate:       model.Rate,
+			scale:      scale,
+			statsd:     statsd,
+			budgets:    budgets.model(idx),
+			session:    newUserSession(spec.Run, i),
+		}
+		done = append(done, Worker(stats, killc, work))
+	}
+	return done
+}
+
+// runStages steps the run identified by killc through its stages and stops
+// it after the last one.
+func (app *App) runStages(killc chan int, scale *rateScale, stages []workload.Stage) {
+	if !stepStages(app.clock, killc, scale, stages) {
+		return
+	}
+	app.mu.Lock()
+	if app.killc == killc {
+		app.stopWorkers(outcomeCompleted, stopStages)
+	}
+	app.mu.Unlock()
+}
+
+// stepStages scales the rates of a run through its stages. It returns
+// false if killc was closed first.
+func stepStages(clock Clock, killc chan int, scale *rateScale, stages []workload.Stage) bool {
+	for i, stage := range stages {
+		s := stage.Factor()
+		scale.Store(s)
+		log.Printf("stage %d: scaling rates by %v for %v", i, s, stage.Duration)
+		select {
+		case <-clock.After(time.Duration(stage.Duration)):
+		case <-killc:
+			return false
+		}
+	}
+	return true
+}
+
+// stopWorkers signals every worker of the current workload to exit,
+// recording outcome and the reason it stopped. It is safe to call when no
+// workload is running. The caller must hold app.mu.
+func (app *App) stopWorkers(outcome, reason string) {
+	if app.killc != nil {
+		close(app.killc)
+		app.killc = nil
+		if app.run != nil && app.run.outcome == "" {
+			app.run.outcome, app.run.reason = outcome, reason
+		}
+	}
+	app.config.currentWorkers = 0
+}
+
+// waitWorkers marks the run r as finished once all of its workers have
+// exited, and records its outcome and summary.
+func (app *App) waitWorkers(r *run, done []<-chan struct{}) {
+	for _, d := range done {
+		<-d
+	}
+	app.finishRun(r)
+}
+
+// finishRun marks the run r as finished once its workers have exited, and
+// records its outcome and summary.
+func (app *App) finishRun(r *run) {
+	ended := app.clock.Now()
+	summary := r.collector.finish(ended.Sub(r.started))
+	knees := detectKnees(r.started, r.points)
+	r.mu.Lock()
+	r.knees = knees
+	r.mu.Unlock()
+	annotateKnees(summary, knees)
+	if r.scraper != nil {
+		r.scraper.stop()
+	}
+
+	app.mu.Lock()
+	if app.killc == r.killc {
+		app.killc = nil
+		app.config.currentWorkers = 0
+	}
+	if app.run == r {
+		// Every point has been written, unless the run was stopped.
+		closeSinks(app.sinks)
+		app.sinks = nil
+	}
+	if r.outcome == "" {
+		r.outcome, r.reason = outcomeCompleted, r.budgets.reason()
+		if r.reason == stopRequests && rampedDown(r.plan.spec.Run, ended.Sub(r.started)) {
+			r.reason = stopRampDown
+		}
+		if r.remote != nil && len(r.plan.spec.Stages) > 0 {
+			// The agents ran the stages.
+			r.reason = stopStages
+		}
+	}
+	outcome := r.outcome
+	summary.StopReason = r.reason
+	app.mu.Unlock()
+
+	if app.history != nil {
+		if err := app.history.finish(r.batchId, ended, outcome, summary); err != nil {
+			log.Printf("failed to record end of run: %v", err)
+		}
+	}
+	if app.config.ReportDir != "" {
+		rec := *r.record
+		rec.Ended, rec.Outcome, rec.Summary = &ended, outcome, summary
+		if err := app.writeReport(&rec, r.points, r.serverPoints); err != nil {
+			log.Printf("failed to write report: %v", err)
+		}
+	}
+	log.Printf("run %s %s, %s: %d of %d requests done, %d failed", r.batchId, outcome, stopReasons[summary.StopReason], summary.Done, summary.Sent, summary.Failed)
+	for _, m := range summary.Models {
+		if m.CeilingLimited {
+			log.Printf("run %s: model %s was held back by its ceiling of %d workers, %d requests sent late", r.batchId, m.ID, r.plan.spec.Run.Workers, m.Late)
+		}
+		if m.Knee != nil {
+			log.Printf("run %s: model %s latency knee at %.1f/s offered, p95 %.1fms", r.batchId, m.ID, m.Knee.Offered, m.Knee.P95*1000)
+		}
+		if m.Saturation != nil {
+			log.Printf("run %s: model %s saturated at %.1f/s offered, %.1f/s done", r.batchId, m.ID, m.Saturation.Offered, m.Saturation.Rate)
+		}
+	}
+	r.summary = summary
+	close(r.recorded)
+}
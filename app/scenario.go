@@ -0,0 +1,222 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// scenarioStep is a step of a scenario, ready to send.
+type scenarioStep struct {
+	model string
+	input map[string]interface{}
+
+	// generated is set when input has random value placeholders, and
+	// filled when it references extracted values.
+	generated bool
+	filled    bool
+
+	extract []extraction
+}
+
+// extraction names the value at a path of a step's response.
+type extraction struct {
+	name string
+	path workload.Path
+}
+
+// newScenario returns the steps of the model m, nil if it isn't a
+// scenario. m must be valid.
+func newScenario(m workload.Model) []scenarioStep {
+	var steps []scenarioStep
+	for _, st := range m.Steps {
+		s := scenarioStep{
+			model:     st.Model,
+			input:     st.Input,
+			generated: hasPlaceholders(st.Input),
+			filled:    len(workload.References(st.Input)) > 0,
+		}
+		names := make([]string, 0, len(st.Extract))
+		for name := range st.Extract {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			path, err := workload.ParsePath(st.Extract[name])
+			if err != nil {
+				continue
+			}
+			s.extract = append(s.extract, extraction{name: name, path: path})
+		}
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// stepResult is the outcome of a step's request.
+type stepResult struct {
+	took time.Duration
+	err  error
+}
+
+// stepCounts are the requests of one step of a scenario. They are sent by
+// agents, so they have json tags.
+type stepCounts struct {
+	Sent    int        `json:"sent"`
+	Done    int        `json:"done"`
+	Failed  int        `json:"failed"`
+	Latency *histogram `json:"latency"`
+}
+
+// newStepCounts returns counts for n steps, nil if n is 0.
+func newStepCounts(n int) []*stepCounts {
+	if n == 0 {
+		return nil
+	}
+	counts := make([]*stepCounts, n)
+	for i := range counts {
+		counts[i] = &stepCounts{Latency: newHistogram()}
+	}
+	return counts
+}
+
+// recordSteps counts the results of a scenario's steps. Like requests, only
+// successful steps count towards latency.
+func recordSteps(counts []*stepCounts, results []stepResult) {
+	for i, r := range results {
+		c := counts[i]
+		c.Sent++
+		if r.err != nil {
+			c.Failed++
+			continue
+		}
+		c.Done++
+		c.Latency.record(r.took)
+	}
+}
+
+// mergeSteps adds the counts from to the counts to, which are made if nil.
+func mergeSteps(to, from []*stepCounts) []*stepCounts {
+	if len(from) == 0 {
+		return to
+	}
+	if to == nil {
+		to = newStepCounts(len(from))
+	}
+	for i, c := range from {
+		if i >= len(to) {
+			break
+		}
+		to[i].Sent += c.Sent
+		to[i].Done += c.Done
+		to[i].Failed += c.Failed
+		if c.Latency != nil {
+			to[i].Latency.merge(c.Latency)
+		}
+	}
+	return to
+}
+
+// stepSummary is a scenario step's statistics over a whole run.
+type stepSummary struct {
+	Step      int            `json:"step"`
+	Model     string         `json:"model"`
+	Sent      int            `json:"sent"`
+	Done      int            `json:"done"`
+	Failed    int            `json:"failed"`
+	ErrorRate float64        `json:"error_rate"`
+	Latency   latencySummary `json:"latency"`
+}
+
+// summarizeSteps summarizes the counts of the steps of a scenario whose
+// models are named by models.
+func summarizeSteps(counts []*stepCounts, models []string) []stepSummary {
+	var steps []stepSummary
+	for i, c := range counts {
+		s := stepSummary{
+			Step:    i + 1,
+			Sent:    c.Sent,
+			Done:    c.Done,
+			Failed:  c.Failed,
+			Latency: c.Latency.summary(),
+		}
+		if i < len(models) {
+			s.Model = models[i]
+		}
+		if n := c.Done + c.Failed; n > 0 {
+			s.ErrorRate = float64(c.Failed) / float64(n)
+		}
+		steps = append(steps, s)
+	}
+	return steps
+}
+
+// send sends a request of the worker's model, or runs its scenario, and
+// returns the status Ops last answered with and the results of the
+// scenario's steps.
+func (w *Workload) send() (int, []stepResult, error) {
+	if len(w.steps) == 0 {
+		status, err := w.predict()
+		return status, nil, err
+	}
+	return w.scenario()
+}
+
+// scenario sends the requests of the worker's scenario in turn, until one
+// fails.
+func (w *Workload) scenario() (int, []stepResult, error) {
+	clock := w.clock
+	if clock == nil {
+		clock = WallClock
+	}
+	vars := make(map[string]interface{})
+	results := make([]stepResult, 0, len(w.steps))
+	for i, st := range w.steps {
+		var data interface{} = st.input
+		if st.generated {
+			data = generate(data, w.rnd)
+		}
+		if st.filled {
+			data = workload.Fill(data, vars)
+		}
+		var resp, out interface{}
+		if len(st.extract) > 0 {
+			out = &resp
+		}
+		start := clock.Now()
+		r, err := opsPredictHTTP(w.user, st.model, w.apiKey, w.opsHost, data, out)
+		took := clock.Now().Sub(start)
+		status := 0
+		if r != nil {
+			status = r.StatusCode
+		}
+		for _, e := range st.extract {
+			if err != nil {
+				break
+			}
+			v, ok := e.path.Lookup(resp)
+			if !ok {
+				err = fmt.Errorf("no %s at %s in the response", e.name, e.path)
+				break
+			}
+			vars[e.name] = v
+		}
+		results = append(results, stepResult{took: took, err: err})
+		if err != nil {
+			return status, results, fmt.Errorf("step %d, %s: %v", i+1, st.model, err)
+		}
+	}
+	return http.StatusOK, results, nil
+}
+
+// stepModels returns the names of the models of the worker's scenario.
+func (w *Workload) stepModels() []string {
+	var models []string
+	for _, st := range w.steps {
+		models = append(models, st.model)
+	}
+	return models
+}
@@ -0,0 +1,90 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newScenarioOps returns a server whose model lookup answers with an id and
+// whose model score fails unless it is sent that id.
+func newScenarioOps(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&input)
+		switch r.URL.Path {
+		case "/demo/models/lookup/":
+			w.Write([]byte(`{"result": {"ids": [42, 7], "name": "chelsea"}}`))
+		case "/demo/models/score/":
+			want := map[string]interface{}{"Id": 42.0, "Label": "chelsea-1br"}
+			if !reflect.DeepEqual(input, want) {
+				http.Error(w, "unexpected input", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"result": {"score": 0.5}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestScenarioRun(t *testing.T) {
+	ts := newScenarioOps(t)
+	app := newTestApp(t)
+	spec := func(path string) string {
+		return `
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+run: {workers: 2, seed: 1}
+models:
+    - model: lookup-and-score
+      requests: 3
+      steps:
+          - model: lookup
+            input: {Name: "^"}
+            extract: {id: "` + path + `", name: "$.result.name"}
+          - model: score
+            input: {Id: "${id}", Label: "${name}-1br"}
+`
+	}
+
+	r := runSpec(t, app, spec("$.result.ids[0]"))
+	m := r.summary.Models[0]
+	if m.Sent != 6 || m.Done != 6 || len(m.Steps) != 2 {
+		t.Fatalf("expected 6 scenarios done in 2 steps, got %+v", m)
+	}
+	for _, s := range m.Steps {
+		if s.Sent != 6 || s.Done != 6 || s.Failed != 0 {
+			t.Errorf("expected step %d to be done 6 times, got %+v", s.Step, s)
+		}
+	}
+	if m.Steps[0].Model != "lookup" || m.Steps[1].Model != "score" {
+		t.Errorf("expected the steps' models, got %+v", m.Steps)
+	}
+	if m.Latency.Max < m.Steps[1].Latency.Max {
+		t.Errorf("expected end to end latency of at least the last step's, got %v and %v", m.Latency.Max, m.Steps[1].Latency.Max)
+	}
+	b, err := ioutil.ReadFile(reportPath(app.config.ReportDir, r.batchId))
+	if err != nil {
+		t.Fatalf("expected a report file: %v", err)
+	}
+	if !strings.Contains(string(b), "A scenario of 2 steps") {
+		t.Errorf("expected the report to show the scenario's steps")
+	}
+
+	// A scenario stops at the first step that fails.
+	r = runSpec(t, app, spec("$.result.ids[5]"))
+	m = r.summary.Models[0]
+	if m.Sent != 6 || m.Failed != 6 {
+		t.Fatalf("expected 6 scenarios to fail, got %+v", m)
+	}
+	if m.Steps[0].Failed != 6 || m.Steps[1].Sent != 0 {
+		t.Errorf("expected the first step to fail and the second not to be sent, got %+v", m.Steps)
+	}
+}
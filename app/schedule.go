@@ -0,0 +1,460 @@
+package app
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Overlap policies of a schedule, for when it fires while another run or
+// search goes on. The server runs one workload at a time, so a firing can
+// only start once the other run ends.
+const (
+	// overlapSkip drops the firing.
+	overlapSkip = "skip"
+	// overlapQueue starts the firing once the other run ends, keeping at
+	// most one firing of the schedule waiting.
+	overlapQueue = "queue"
+	// overlapAllow keeps every firing, starting them in turn.
+	overlapAllow = "allow"
+)
+
+// What a schedule did when it fired.
+const (
+	fireStarted = "started"
+	fireSkipped = "skipped"
+	fireQueued  = "queued"
+	fireFailed  = "failed"
+)
+
+const (
+	// scheduleFirings is how many of its latest firings a schedule keeps.
+	scheduleFirings = 20
+
+	// scheduleRetry is how often queued firings try to start while
+	// another run goes on.
+	scheduleRetry = time.Second
+)
+
+// schedule runs a saved workload whenever its cron expression matches.
+type schedule struct {
+	Name     string `json:"name"`
+	Workload string `json:"workload"`
+	// Version of the workload to run, the latest if zero.
+	Version int       `json:"version,omitempty"`
+	Cron    string    `json:"cron"`
+	Overlap string    `json:"overlap"`
+	Created time.Time `json:"created"`
+
+	// Next is when the schedule fires next, Pending how many of its
+	// firings wait for another run to end, and Firings its latest
+	// firings, the newest last.
+	Next    time.Time `json:"next"`
+	Pending int       `json:"pending"`
+	Firings []firing  `json:"firings"`
+
+	expr *cronExpr
+}
+
+// firing is what a schedule did at a time it fired, and the run or search
+// it started.
+type firing struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	BatchId  string    `json:"batch_id,omitempty"`
+	SearchId string    `json:"search_id,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// view returns a copy of s safe to use without the scheduler's lock.
+func (s *schedule) view() schedule {
+	v := *s
+	v.Firings = append([]firing{}, s.Firings...)
+	return v
+}
+
+// record adds a firing of s, forgetting the oldest past scheduleFirings.
+func (s *schedule) record(f firing) {
+	s.Firings = append(s.Firings, f)
+	if n := len(s.Firings); n > scheduleFirings {
+		s.Firings = append([]firing{}, s.Firings[n-scheduleFirings:]...)
+	}
+	switch f.Action {
+	case fireFailed:
+		log.Printf("schedule %s: failed to start %s: %s", s.Name, s.Workload, f.Error)
+	case fireStarted:
+		log.Printf("schedule %s: started %s, run %s%s", s.Name, s.Workload, f.BatchId, f.SearchId)
+	default:
+		log.Printf("schedule %s: %s %s, another run is going on", s.Name, f.Action, s.Workload)
+	}
+}
+
+// scheduler fires schedules on its clock. start starts a run or search of
+// a schedule's workload, returning errRunning while another one goes on.
+type scheduler struct {
+	clock Clock
+	start func(s *schedule) (batchId, searchId string, err error)
+
+	mu        sync.Mutex
+	schedules map[string]*schedule
+	// queue has the names of the schedules of waiting firings, in the
+	// order they fired.
+	queue []string
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newScheduler starts firing schedules.
+func newScheduler(clock Clock, start func(*schedule) (string, string, error), schedules []*schedule) *scheduler {
+	sc := &scheduler{
+		clock:     clock,
+		start:     start,
+		schedules: make(map[string]*schedule),
+		wake:      make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	now := clock.Now()
+	for _, s := range schedules {
+		expr, err := parseCron(s.Cron)
+		if err != nil {
+			log.Printf("schedule %s: %v, not firing it", s.Name, err)
+			continue
+		}
+		s.expr, s.Next = expr, expr.next(now)
+		sc.schedules[s.Name] = s
+	}
+	go sc.loop()
+	return sc
+}
+
+func (sc *scheduler) stop() {
+	close(sc.quit)
+	<-sc.done
+}
+
+func (sc *scheduler) loop() {
+	defer close(sc.done)
+	for {
+		sc.mu.Lock()
+		now := sc.clock.Now()
+		sc.startQueued(now)
+		var wait time.Duration = -1
+		for _, name := range sortedScheduleNames(sc.schedules) {
+			s := sc.schedules[name]
+			if s.Next.IsZero() {
+				continue
+			}
+			if !s.Next.After(now) {
+				sc.fire(s, now)
+				s.Next = s.expr.next(now)
+			}
+			if d := s.Next.Sub(now); !s.Next.IsZero() && (wait < 0 || d < wait) {
+				wait = d
+			}
+		}
+		if len(sc.queue) > 0 && (wait < 0 || scheduleRetry < wait) {
+			wait = scheduleRetry
+		}
+		sc.mu.Unlock()
+
+		var timer <-chan time.Time
+		if wait >= 0 {
+			timer = sc.clock.After(wait)
+		}
+		select {
+		case <-timer:
+		case <-sc.wake:
+		case <-sc.quit:
+			return
+		}
+	}
+}
+
+// fire starts a run of s, or deals with another going on by its overlap
+// policy. sc.mu must be held.
+func (sc *scheduler) fire(s *schedule, now time.Time) {
+	if len(sc.queue) == 0 {
+		f := sc.startNow(s, now)
+		if f.Action != fireSkipped {
+			s.record(f)
+			return
+		}
+	}
+	switch {
+	case s.Overlap == overlapAllow, s.Overlap == overlapQueue && s.Pending == 0:
+		s.Pending++
+		sc.queue = append(sc.queue, s.Name)
+		s.record(firing{Time: now, Action: fireQueued})
+	default:
+		s.record(firing{Time: now, Action: fireSkipped})
+	}
+}
+
+// startNow starts a run of s, returning a skipped firing if another run
+// goes on. sc.mu must be held.
+func (sc *scheduler) startNow(s *schedule, now time.Time) firing {
+	batchId, searchId, err := sc.start(s)
+	switch {
+	case err == errRunning:
+		return firing{Time: now, Action: fireSkipped}
+	case err != nil:
+		return firing{Time: now, Action: fireFailed, Error: err.Error()}
+	}
+	return firing{Time: now, Action: fireStarted, BatchId: batchId, SearchId: searchId}
+}
+
+// startQueued starts the waiting firings in turn until one has to wait
+// for another run. sc.mu must be held.
+func (sc *scheduler) startQueued(now time.Time) {
+	for len(sc.queue) > 0 {
+		s := sc.schedules[sc.queue[0]]
+		f := sc.startNow(s, now)
+		if f.Action == fireSkipped {
+			return
+		}
+		sc.queue = sc.queue[1:]
+		s.Pending--
+		s.record(f)
+	}
+}
+
+// put adds s, or replaces the schedule of the same name. Replacing a
+// schedule drops its waiting firings.
+func (sc *scheduler) put(s *schedule, expr *cronExpr) schedule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if old, ok := sc.schedules[s.Name]; ok {
+		s.Firings = old.Firings
+		sc.dequeue(s.Name)
+	}
+	s.expr, s.Next, s.Pending = expr, expr.next(sc.clock.Now()), 0
+	sc.schedules[s.Name] = s
+	sc.poke()
+	return s.view()
+}
+
+// remove deletes a schedule and its waiting firings. It reports whether
+// there was one.
+func (sc *scheduler) remove(name string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.schedules[name]; !ok {
+		return false
+	}
+	delete(sc.schedules, name)
+	sc.dequeue(name)
+	sc.poke()
+	return true
+}
+
+// dequeue drops the waiting firings of the schedule name. sc.mu must be
+// held.
+func (sc *scheduler) dequeue(name string) {
+	queue := sc.queue[:0]
+	for _, n := range sc.queue {
+		if n != name {
+			queue = append(queue, n)
+		}
+	}
+	sc.queue = queue
+}
+
+func (sc *scheduler) poke() {
+	select {
+	case sc.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *scheduler) get(name string) (schedule, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	s, ok := sc.schedules[name]
+	if !ok {
+		return schedule{}, false
+	}
+	return s.view(), true
+}
+
+// list returns the schedules by name.
+func (sc *scheduler) list() []schedule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	schedules := []schedule{}
+	for _, name := range sortedScheduleNames(sc.schedules) {
+		schedules = append(schedules, sc.schedules[name].view())
+	}
+	return schedules
+}
+
+func sortedScheduleNames(m map[string]*schedule) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startScheduled starts a run, or a search, of the schedule's workload
+// tagged schedule:<name>. It returns errRunning while another goes on.
+func (app *App) startScheduled(s *schedule) (string, string, error) {
+	version := ""
+	if s.Version > 0 {
+		version = strconv.Itoa(s.Version)
+	}
+	p, problems := app.parseNamed(s.Workload, version)
+	if problems != nil {
+		return "", "", problems
+	}
+	spec := *p.spec
+	spec.Metadata.Tags = append(append([]string{}, spec.Metadata.Tags...), "schedule:"+s.Name)
+	p.spec = &spec
+	if spec.Search != nil {
+		id, err := app.startSearch(p)
+		return "", id, err
+	}
+	app.mu.Lock()
+	searching := app.search != nil
+	app.mu.Unlock()
+	if searching {
+		return "", "", errRunning
+	}
+	batchId, err := app.startRun(p)
+	return batchId, "", err
+}
+
+// parseSchedule reads the schedule called name from the form values
+// workload, version, cron and overlap. The workload must be in the
+// library and valid.
+func (app *App) parseSchedule(r *http.Request, name string) (*schedule, *cronExpr, error) {
+	if err := workload.CheckName(name); err != nil {
+		return nil, nil, err
+	}
+	s := &schedule{
+		Name:     name,
+		Workload: r.FormValue("workload"),
+		Cron:     r.FormValue("cron"),
+		Overlap:  r.FormValue("overlap"),
+		Created:  app.clock.Now(),
+	}
+	if s.Workload == "" {
+		return nil, nil, fmt.Errorf("workload is required")
+	}
+	if v := r.FormValue("version"); v != "" {
+		var err error
+		if s.Version, err = strconv.Atoi(v); err != nil || s.Version < 0 {
+			return nil, nil, fmt.Errorf("version %q is not a positive integer", v)
+		}
+	}
+	expr, err := parseCron(s.Cron)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch s.Overlap {
+	case "":
+		s.Overlap = overlapSkip
+	case overlapSkip, overlapQueue, overlapAllow:
+	default:
+		return nil, nil, fmt.Errorf("unknown overlap policy %q, use skip, queue or allow", s.Overlap)
+	}
+	version := ""
+	if s.Version > 0 {
+		version = strconv.Itoa(s.Version)
+	}
+	if _, problems := app.parseNamed(s.Workload, version); problems != nil {
+		return nil, nil, problems
+	}
+	return s, expr, nil
+}
+
+// putSchedule saves the schedule in the form values and starts firing it.
+func (app *App) putSchedule(w http.ResponseWriter, r *http.Request, name string, status int) {
+	s, expr, err := app.parseSchedule(r, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if old, ok := app.scheduler.get(name); ok {
+		s.Created = old.Created
+	}
+	if app.history != nil {
+		if err := app.history.saveSchedule(s); err != nil {
+			log.Println(err)
+			http.Error(w, "failed to save schedule", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, status, app.scheduler.put(s, expr))
+}
+
+// handleSchedules lists the schedules on GET and adds one on POST.
+func (app *App) handleSchedules(w http.ResponseWriter, r *http.Request) {
+	if app.library == nil {
+		http.Error(w, "no workload library configured", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedules": app.scheduler.list()})
+	case "POST":
+		name := r.FormValue("name")
+		if _, ok := app.scheduler.get(name); ok {
+			http.Error(w, fmt.Sprintf("schedule %s already exists", name), http.StatusConflict)
+			return
+		}
+		app.putSchedule(w, r, name, http.StatusCreated)
+	default:
+		http.Error(w, "I only respond to GETs and POSTs.", http.StatusNotImplemented)
+	}
+}
+
+// handleSchedule serves the schedule at /schedules/{name} on GET, replaces
+// it on PUT and deletes it on DELETE.
+func (app *App) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	if app.library == nil {
+		http.Error(w, "no workload library configured", http.StatusNotFound)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/schedules/")
+	switch r.Method {
+	case "GET":
+		s, ok := app.scheduler.get(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, s)
+	case "PUT":
+		if _, ok := app.scheduler.get(name); !ok {
+			http.NotFound(w, r)
+			return
+		}
+		app.putSchedule(w, r, name, http.StatusOK)
+	case "DELETE":
+		if !app.scheduler.remove(name) {
+			http.NotFound(w, r)
+			return
+		}
+		if app.history != nil {
+			if err := app.history.deleteSchedule(name); err != nil {
+				log.Println(err)
+				http.Error(w, "failed to delete schedule", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "I only respond to GETs, PUTs and DELETEs.", http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,179 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// busyStarter starts runs of schedules until it's busy.
+type busyStarter struct {
+	mu      sync.Mutex
+	busy    bool
+	started []string
+}
+
+func (b *busyStarter) start(s *schedule) (string, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.busy {
+		return "", "", errRunning
+	}
+	b.started = append(b.started, s.Name)
+	return "batch", "", nil
+}
+
+func (b *busyStarter) setBusy(busy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.busy = busy
+}
+
+func (b *busyStarter) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.started)
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	tests := []struct {
+		overlap string
+		actions []string
+		started int
+	}{
+		{overlapSkip, []string{fireSkipped, fireSkipped}, 0},
+		{overlapQueue, []string{fireQueued, fireSkipped, fireStarted}, 1},
+		{overlapAllow, []string{fireQueued, fireQueued, fireStarted, fireStarted}, 2},
+	}
+	for _, test := range tests {
+		clock := newFakeClock()
+		b := &busyStarter{busy: true}
+		sc := newScheduler(clock, b.start, nil)
+		expr, _ := parseCron("* * * * *")
+		sc.put(&schedule{Name: "s", Workload: "w", Cron: "* * * * *", Overlap: test.overlap}, expr)
+		firings := func() []firing {
+			s, _ := sc.get("s")
+			return s.Firings
+		}
+
+		// Fires twice while another run goes on, then once it ends.
+		for i := 1; i <= 2; i++ {
+			waitFor(t, func() bool { return clock.Waiters() > 0 })
+			clock.Advance(time.Minute)
+			waitFor(t, func() bool { return len(firings()) == i })
+		}
+		b.setBusy(false)
+		clock.Advance(scheduleRetry)
+		waitFor(t, func() bool { return len(firings()) == len(test.actions) })
+		time.Sleep(10 * time.Millisecond)
+		sc.stop()
+
+		var actions []string
+		for _, f := range firings() {
+			actions = append(actions, f.Action)
+		}
+		if len(actions) != len(test.actions) || b.count() != test.started {
+			t.Errorf("%s: expected firings %v starting %d runs, got %v starting %d", test.overlap, test.actions, test.started, actions, b.count())
+			continue
+		}
+		for i := range actions {
+			if actions[i] != test.actions[i] {
+				t.Errorf("%s: expected firings %v, got %v", test.overlap, test.actions, actions)
+				break
+			}
+		}
+		if s, _ := sc.get("s"); s.Pending != 0 || !s.Next.Equal(clock.Now().Truncate(time.Minute).Add(time.Minute)) {
+			t.Errorf("%s: expected nothing pending and the next minute next, got %d and %v", test.overlap, s.Pending, s.Next)
+		}
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	app.library = workload.NewLibrary(t.TempDir())
+	w := do(app, "POST", "/workloads", url.Values{"name": {"nightly"}, "spec": {`
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+run: {workers: 2}
+models:
+    - {model: m1, requests: 3}
+`}})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, form := range []url.Values{
+		{"name": {"bad name"}, "workload": {"nightly"}, "cron": {"@daily"}},
+		{"name": {"s"}, "workload": {"missing"}, "cron": {"@daily"}},
+		{"name": {"s"}, "workload": {"nightly"}, "cron": {"every night"}},
+		{"name": {"s"}, "workload": {"nightly"}, "cron": {"@daily"}, "overlap": {"sometimes"}},
+	} {
+		if w := do(app, "POST", "/schedules", form); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, got %d: %s", form, w.Code, w.Body.String())
+		}
+	}
+	form := url.Values{"name": {"every-minute"}, "workload": {"nightly"}, "cron": {"* * * * *"}, "overlap": {overlapQueue}}
+	if w := do(app, "POST", "/schedules", form); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := do(app, "POST", "/schedules", form); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 adding a schedule twice, got %d", w.Code)
+	}
+	form.Set("cron", "@hourly")
+	if w := do(app, "PUT", "/schedules/every-hour", form); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 replacing a missing schedule, got %d", w.Code)
+	}
+	form.Set("cron", "* * * * *")
+	if w := do(app, "PUT", "/schedules/every-minute", form); w.Code != http.StatusOK {
+		t.Errorf("expected 200 replacing a schedule, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Fire the saved schedules on a fake clock.
+	saved, err := app.history.schedules()
+	if err != nil || len(saved) != 1 || saved[0].Overlap != overlapQueue {
+		t.Fatalf("expected the schedule saved, got %v, %v", saved, err)
+	}
+	clock := newFakeClock()
+	app.scheduler.stop()
+	app.scheduler = newScheduler(clock, app.startScheduled, saved)
+	waitFor(t, func() bool { return clock.Waiters() > 0 })
+	clock.Advance(time.Minute)
+
+	var s schedule
+	waitFor(t, func() bool {
+		w := do(app, "GET", "/schedules/every-minute", nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return len(s.Firings) == 1
+	})
+	if f := s.Firings[0]; f.Action != fireStarted || f.BatchId == "" {
+		t.Fatalf("expected the schedule to start a run, got %+v", f)
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	waitRecorded(t, r)
+	runs := getRuns(t, app, "tag=schedule:every-minute")
+	if len(runs) != 1 || runs[0].BatchId != s.Firings[0].BatchId || runs[0].Name != "nightly" {
+		t.Errorf("expected the scheduled run in the history, got %+v", runs)
+	}
+
+	if w := do(app, "DELETE", "/schedules/every-minute", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200 deleting a schedule, got %d", w.Code)
+	}
+	w = do(app, "GET", "/schedules", nil)
+	if data := decodeJSON(t, w); len(data["schedules"].([]interface{})) != 0 {
+		t.Errorf("expected no schedules left, got %v", data)
+	}
+	if saved, _ := app.history.schedules(); len(saved) != 0 {
+		t.Errorf("expected the schedule deleted from the history, got %v", saved)
+	}
+}
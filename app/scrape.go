@@ -0,0 +1,416 @@
+package app
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// ScrapeConfig configures scraping the Prometheus metrics of the target's
+// servers while a run goes on.
+type ScrapeConfig struct {
+	// Targets are the metrics endpoints scraped during every run.
+	Targets []ScrapeTarget `yaml:"targets,omitempty"`
+
+	// Interval between scrapes. Defaults to 1s, the interval of the
+	// run's own points.
+	Interval workload.Duration `yaml:"interval,omitempty"`
+}
+
+// ScrapeTarget is a Prometheus metrics endpoint and the series to keep
+// from it.
+type ScrapeTarget struct {
+	// Name the target's series are stored under, the URL's host if empty.
+	Name string `yaml:"name,omitempty"`
+	URL  string `yaml:"url"`
+
+	// Series to keep: metric names, optionally with label matchers like
+	// model_workers{model="beer"}. Every series matching a selector is
+	// kept. Counters are stored as their per second rate.
+	Series []string `yaml:"series"`
+}
+
+// check validates c and fills in its defaults.
+func (c *ScrapeConfig) check() error {
+	if c.Interval <= 0 {
+		c.Interval = workload.Duration(time.Second)
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		u, err := url.Parse(t.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("scrape target %q: invalid url", t.URL)
+		}
+		if t.Name == "" {
+			t.Name = u.Host
+		}
+		if len(t.Series) == 0 {
+			return fmt.Errorf("scrape target %s: no series to keep", t.Name)
+		}
+		for _, s := range t.Series {
+			if _, err := parseSelector(s); err != nil {
+				return fmt.Errorf("scrape target %s: %v", t.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// serverPoint is the value of a series scraped from a target, stamped
+// with the time of the run's points it goes with.
+type serverPoint struct {
+	Time   time.Time `json:"time"`
+	Target string    `json:"target"`
+	Series string    `json:"series"`
+	Value  float64   `json:"value"`
+}
+
+// selector picks series by metric name and exact label values.
+type selector struct {
+	name   string
+	labels map[string]string
+}
+
+func parseSelector(s string) (selector, error) {
+	sel := selector{labels: make(map[string]string)}
+	i := strings.IndexByte(s, '{')
+	if i < 0 {
+		sel.name = strings.TrimSpace(s)
+	} else {
+		sel.name = strings.TrimSpace(s[:i])
+		if !strings.HasSuffix(s, "}") {
+			return sel, fmt.Errorf("invalid series %q: missing }", s)
+		}
+		labels, rest, err := parseLabels(s[i+1:])
+		if err != nil || rest != "" {
+			return sel, fmt.Errorf("invalid series %q", s)
+		}
+		sel.labels = labels
+	}
+	if sel.name == "" {
+		return sel, fmt.Errorf("invalid series %q: no metric name", s)
+	}
+	return sel, nil
+}
+
+func (sel selector) matches(s sample) bool {
+	if s.name != sel.name {
+		return false
+	}
+	for k, v := range sel.labels {
+		if s.labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sample is a line of the Prometheus text format.
+type sample struct {
+	name   string
+	labels map[string]string
+	value  float64
+}
+
+// key is the sample's name with its labels in order, as Prometheus
+// writes it.
+func (s sample) key() string {
+	if len(s.labels) == 0 {
+		return s.name
+	}
+	names := make([]string, 0, len(s.labels))
+	for k := range s.labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(s.name + "{")
+	for i, k := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", k, s.labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// parseMetrics reads the Prometheus text exposition format, returning the
+// samples and the names of the counter metrics.
+func parseMetrics(r io.Reader) ([]sample, map[string]bool, error) {
+	var samples []sample
+	counters := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			f := strings.Fields(line)
+			if len(f) >= 4 && f[1] == "TYPE" && f[3] == "counter" {
+				counters[f[2]] = true
+			}
+			continue
+		}
+		s, err := parseSample(line)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		samples = append(samples, s)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, nil, err
+	}
+	return samples, counters, nil
+}
+
+func parseSample(line string) (sample, error) {
+	s := sample{labels: make(map[string]string)}
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.name = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		labels, r, err := parseLabels(rest[1:])
+		if err != nil {
+			return s, fmt.Errorf("invalid sample %q: %v", line, err)
+		}
+		s.labels, rest = labels, r
+	}
+	// The value may be followed by a timestamp, which is ignored.
+	f := strings.Fields(rest)
+	if len(f) == 0 {
+		return s, fmt.Errorf("invalid sample %q: no value", line)
+	}
+	v, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("invalid sample %q: %v", line, err)
+	}
+	s.value = v
+	return s, nil
+}
+
+// parseLabels reads label pairs up to and including the closing brace and
+// returns what follows it.
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return nil, "", fmt.Errorf("unterminated labels")
+		}
+		if s[0] == '}' {
+			return labels, s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid label")
+		}
+		name := strings.TrimSpace(s[:eq])
+		var v strings.Builder
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					v.WriteByte('\n')
+				default:
+					v.WriteByte(s[i])
+				}
+				continue
+			}
+			v.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated label value")
+		}
+		labels[name] = v.String()
+		s = s[i+1:]
+	}
+}
+
+// scraper scrapes the targets of a run on its own goroutines. The run's
+// collector takes the values scraped since its last points, so server
+// and client series share their timestamps.
+type scraper struct {
+	clock Clock
+
+	mu sync.Mutex
+	// fresh values by target and series, since the last take.
+	fresh map[string]map[string]float64
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// targetState is what a target's loop keeps between scrapes.
+type targetState struct {
+	target    ScrapeTarget
+	selectors []selector
+
+	// counters' last values and when they were scraped, for rates.
+	last     map[string]float64
+	lastTime time.Time
+
+	// failing is set while scrapes fail, so failures are logged once.
+	failing bool
+}
+
+func newScraper(clock Clock, cfg ScrapeConfig) *scraper {
+	s := &scraper{
+		clock: clock,
+		fresh: make(map[string]map[string]float64),
+		quit:  make(chan struct{}),
+	}
+	for _, t := range cfg.Targets {
+		ts := &targetState{target: t, last: make(map[string]float64)}
+		for _, sel := range t.Series {
+			p, _ := parseSelector(sel)
+			ts.selectors = append(ts.selectors, p)
+		}
+		ticker := clock.NewTicker(time.Duration(cfg.Interval))
+		s.wg.Add(1)
+		go s.loop(ts, ticker)
+	}
+	return s
+}
+
+func (s *scraper) loop(ts *targetState, ticker Ticker) {
+	defer s.wg.Done()
+	defer ticker.Stop()
+	s.scrape(ts)
+	for {
+		select {
+		case <-ticker.C():
+			s.scrape(ts)
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// stop stops scraping and waits for scrapes in flight.
+func (s *scraper) stop() {
+	close(s.quit)
+	s.wg.Wait()
+}
+
+var scrapeClient = &http.Client{Timeout: 5 * time.Second}
+
+// scrape fetches a target's metrics and keeps the selected series.
+// Failures are logged once until the target answers again.
+func (s *scraper) scrape(ts *targetState) {
+	values, err := fetchMetrics(ts.target.URL)
+	now := s.clock.Now()
+	if err != nil {
+		if !ts.failing {
+			log.Printf("scrape %s: %v", ts.target.Name, err)
+			ts.failing = true
+		}
+		return
+	}
+	if ts.failing {
+		log.Printf("scrape %s: answering again", ts.target.Name)
+		ts.failing = false
+	}
+	kept := make(map[string]float64)
+	samples, counters := values.samples, values.counters
+	dt := now.Sub(ts.lastTime).Seconds()
+	for _, smp := range samples {
+		if math.IsNaN(smp.value) || math.IsInf(smp.value, 0) {
+			continue
+		}
+		for _, sel := range ts.selectors {
+			if !sel.matches(smp) {
+				continue
+			}
+			key := smp.key()
+			if counters[smp.name] || counters[strings.TrimSuffix(smp.name, "_total")] {
+				prev, ok := ts.last[key]
+				ts.last[key] = smp.value
+				// A counter that went down was reset, it has no rate
+				// until the next scrape.
+				if ok && dt > 0 && smp.value >= prev {
+					kept["rate("+key+")"] = (smp.value - prev) / dt
+				}
+			} else {
+				kept[key] = smp.value
+			}
+			break
+		}
+	}
+	ts.lastTime = now
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fresh[ts.target.Name] == nil {
+		s.fresh[ts.target.Name] = make(map[string]float64)
+	}
+	for k, v := range kept {
+		s.fresh[ts.target.Name][k] = v
+	}
+}
+
+// take returns the values scraped since the last take as points at t.
+func (s *scraper) take(t time.Time) []serverPoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var points []serverPoint
+	for target, series := range s.fresh {
+		for name, v := range series {
+			points = append(points, serverPoint{Time: t, Target: target, Series: name, Value: v})
+		}
+	}
+	s.fresh = make(map[string]map[string]float64)
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].Target != points[j].Target {
+			return points[i].Target < points[j].Target
+		}
+		return points[i].Series < points[j].Series
+	})
+	return points
+}
+
+type metrics struct {
+	samples  []sample
+	counters map[string]bool
+}
+
+func fetchMetrics(u string) (*metrics, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	resp, err := scrapeClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, fmt.Errorf("returned status %d", resp.StatusCode)
+	}
+	samples, counters, err := parseMetrics(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &metrics{samples: samples, counters: counters}, nil
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+const testMetrics = `# HELP process_cpu_seconds_total Total user and system CPU time spent in seconds.
+# TYPE process_cpu_seconds_total counter
+process_cpu_seconds_total 12.5
+# TYPE model_workers gauge
+model_workers{model="beer",host="a"} 4
+model_workers{model="iris",host="a"} 2 1433160000000
+queue_depth{path="/say \"hi\"\\now"} 7
+process_resident_memory_bytes NaN
+`
+
+func TestParseMetrics(t *testing.T) {
+	samples, counters, err := parseMetrics(strings.NewReader(testMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !counters["process_cpu_seconds_total"] || counters["model_workers"] {
+		t.Errorf("unexpected counters %v", counters)
+	}
+	expected := []string{
+		"process_cpu_seconds_total",
+		`model_workers{host="a",model="beer"}`,
+		`model_workers{host="a",model="iris"}`,
+		`queue_depth{path="/say \"hi\"\\now"}`,
+		"process_resident_memory_bytes",
+	}
+	if len(samples) != len(expected) {
+		t.Fatalf("expected %d samples, got %d", len(expected), len(samples))
+	}
+	for i, s := range samples {
+		if s.key() != expected[i] {
+			t.Errorf("sample %d: expected %s, got %s", i, expected[i], s.key())
+		}
+	}
+	if samples[2].value != 2 {
+		t.Errorf("expected the timestamp to be ignored, got %v", samples[2].value)
+	}
+	if !math.IsNaN(samples[4].value) {
+		t.Errorf("expected NaN, got %v", samples[4].value)
+	}
+
+	if _, _, err := parseMetrics(strings.NewReader("broken{a=\"b\" 1\n")); err == nil {
+		t.Error("expected an error for unterminated labels")
+	}
+}
+
+func TestScrapeConfigCheck(t *testing.T) {
+	tests := []struct {
+		target ScrapeTarget
+		err    string
+	}{
+		{ScrapeTarget{URL: "http://ops:9100/metrics", Series: []string{"up"}}, ""},
+		{ScrapeTarget{URL: "ops:9100", Series: []string{"up"}}, "invalid url"},
+		{ScrapeTarget{URL: "http://ops/metrics"}, "no series"},
+		{ScrapeTarget{URL: "http://ops/metrics", Series: []string{`up{job="x"`}}, "missing }"},
+		{ScrapeTarget{URL: "http://ops/metrics", Series: []string{`{job="x"}`}}, "no metric name"},
+	}
+	for _, test := range tests {
+		c := ScrapeConfig{Targets: []ScrapeTarget{test.target}}
+		err := c.check()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: unexpected error %v", test.target, err)
+			} else if c.Targets[0].Name != "ops:9100" || c.Interval != workload.Duration(time.Second) {
+				t.Errorf("expected defaults, got %+v", c)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: expected error with %q, got %v", test.target, test.err, err)
+		}
+	}
+}
+
+func TestScraper(t *testing.T) {
+	var cpu int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE process_cpu_seconds_total counter\nprocess_cpu_seconds_total %d\n", atomic.LoadInt64(&cpu))
+		fmt.Fprintln(w, `model_workers{model="beer"} 4`)
+		fmt.Fprintln(w, `model_workers{model="iris"} 2`)
+		fmt.Fprintln(w, `go_goroutines 40`)
+	}))
+	defer srv.Close()
+
+	clock := newFakeClock()
+	cfg := ScrapeConfig{Targets: []ScrapeTarget{{
+		Name:   "ops",
+		URL:    srv.URL,
+		Series: []string{"process_cpu_seconds_total", `model_workers{model="beer"}`},
+	}}}
+	if err := cfg.check(); err != nil {
+		t.Fatal(err)
+	}
+	s := newScraper(clock, cfg)
+	defer s.stop()
+
+	take := func() map[string]float64 {
+		var values map[string]float64
+		waitFor(t, func() bool {
+			values = make(map[string]float64)
+			for _, p := range s.take(clock.Now()) {
+				if p.Target != "ops" || !p.Time.Equal(clock.Now()) {
+					t.Errorf("unexpected point %+v", p)
+				}
+				values[p.Series] = p.Value
+			}
+			return len(values) > 0
+		})
+		return values
+	}
+
+	// The first scrape has no counter rate yet.
+	values := take()
+	if len(values) != 1 || values[`model_workers{model="beer"}`] != 4 {
+		t.Errorf("expected only beer's workers, got %v", values)
+	}
+
+	atomic.StoreInt64(&cpu, 3)
+	clock.Advance(2 * time.Second)
+	values = take()
+	if values["rate(process_cpu_seconds_total)"] != 1.5 {
+		t.Errorf("expected a cpu rate of 1.5, got %v", values)
+	}
+	if len(s.take(clock.Now())) != 0 {
+		t.Error("expected nothing new to take")
+	}
+}
+
+func TestScrapeDuringRun(t *testing.T) {
+	var scrapes int64
+	metrics := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&scrapes, 1)
+		fmt.Fprintf(w, "queue_depth %d\n", n)
+	}))
+	defer metrics.Close()
+	_, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{Latency: mockops.Latency{Mean: 250 * time.Millisecond}},
+	})
+	app := newTestApp(t)
+	app.config.Scrape = ScrapeConfig{Targets: []ScrapeTarget{{Name: "ops", URL: metrics.URL, Series: []string{"queue_depth"}}}}
+	if err := app.config.Scrape.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := runSpec(t, app, `
+version: 1
+target: {host: "`+ts.URL+`", user: demo, apikey: key}
+run: {workers: 1}
+models:
+    - {model: m1, requests: 6}
+`)
+	w := do(app, "GET", "/runs/"+r.batchId+"/series", nil)
+	var resp struct {
+		Points []point
+		Server []serverPoint
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Server) == 0 {
+		t.Fatalf("expected server points, got %s", w.Body.String())
+	}
+	times := make(map[time.Time]bool)
+	for _, p := range resp.Points {
+		times[p.Time] = true
+	}
+	for _, p := range resp.Server {
+		if !times[p.Time] || p.Target != "ops" || p.Series != "queue_depth" {
+			t.Errorf("expected server points at the client's times, got %+v", p)
+		}
+	}
+
+	b, err := ioutil.ReadFile(reportPath(app.config.ReportDir, r.batchId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "<h2>Servers</h2>") || !strings.Contains(string(b), "queue_depth") {
+		t.Error("expected the report to chart the server series")
+	}
+}
+
+func TestServerReports(t *testing.T) {
+	t0 := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	var points []point
+	var server []serverPoint
+	for i := 1; i <= 5; i++ {
+		at := t0.Add(time.Duration(i) * time.Second)
+		// Latency climbs with the queue while the rate stays flat.
+		points = append(points,
+			point{Time: at, ModelID: "a", Done: 10, Rate: 10, P95: float64(i) / 10},
+			point{Time: at, ModelID: "b", Done: 10, Rate: 10, P95: 0.01},
+		)
+		server = append(server,
+			serverPoint{Time: at, Target: "ops", Series: "queue_depth", Value: float64(i * 3)},
+			serverPoint{Time: at, Target: "db", Series: "cpu", Value: float64(i % 2)},
+		)
+	}
+	reports := serverReports(t0, points, server)
+	if len(reports) != 2 || reports[0].Target != "db" || reports[1].Target != "ops" {
+		t.Fatalf("expected db then ops, got %+v", reports)
+	}
+	q := reports[1].Series[0]
+	if q.Name != "queue_depth" || q.Samples != 5 || !q.HasP95 || math.Abs(q.P95Corr-1) > 1e-9 {
+		t.Errorf("expected queue_depth to correlate with p95, got %+v", q)
+	}
+	if q.HasRate {
+		t.Error("expected no correlation with a constant rate")
+	}
+}
@@ -0,0 +1,454 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// Defaults of capacity searches.
+const (
+	searchStepDuration = 10 * time.Second
+	searchFactor       = 2
+	searchPrecision    = 0.05
+	searchMaxSteps     = 20
+
+	// searchAchieved is the fraction of a step's rate a model must do for
+	// the step to pass. Below it, the model doesn't keep up.
+	searchAchieved = 0.9
+)
+
+// outcomeFailed is the outcome of a search that couldn't run a step.
+const outcomeFailed = "failed"
+
+// Why the search of a model stopped.
+const (
+	limitThresholds = "thresholds"
+	limitMax        = "max"
+	limitSteps      = "steps"
+)
+
+// searchStep is a step of a capacity search, a run of one model at a fixed
+// rate, and its outcome.
+type searchStep struct {
+	Rate      float64 `json:"rate"`
+	BatchId   string  `json:"batch_id"`
+	Achieved  float64 `json:"achieved"`
+	ErrorRate float64 `json:"error_rate"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+
+	// Passed is set if the model did the rate within the thresholds,
+	// otherwise Failures say how it didn't.
+	Passed   bool     `json:"passed"`
+	Failures []string `json:"failures,omitempty"`
+}
+
+// searchResult is the capacity found for one model.
+type searchResult struct {
+	Model string `json:"model"`
+	Name  string `json:"name"`
+
+	// MaxRate is the highest rate sustained, zero if none was. FailedAt is
+	// the lowest rate that wasn't, zero if every rate was.
+	MaxRate  float64 `json:"max_rate"`
+	FailedAt float64 `json:"failed_at,omitempty"`
+
+	// Limit is why the search stopped, empty while it goes on.
+	Limit string       `json:"limit,omitempty"`
+	Steps []searchStep `json:"steps"`
+}
+
+// search is a capacity search, running or done.
+type search struct {
+	Id      string         `json:"id"`
+	Name    string         `json:"name"`
+	Started time.Time      `json:"started"`
+	Ended   *time.Time     `json:"ended,omitempty"`
+	Outcome string         `json:"outcome"`
+	Error   string         `json:"error,omitempty"`
+	Spec    *workload.Spec `json:"spec"`
+	Models  []searchResult `json:"models"`
+
+	mu sync.Mutex
+	// stopped is set to end the search before its next step. Guarded by
+	// app.mu.
+	stopped bool
+}
+
+// view returns a copy of s safe to read while the search goes on.
+func (s *search) view() *search {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := &search{
+		Id:      s.Id,
+		Name:    s.Name,
+		Started: s.Started,
+		Ended:   s.Ended,
+		Outcome: s.Outcome,
+		Error:   s.Error,
+		Spec:    s.Spec,
+		Models:  make([]searchResult, len(s.Models)),
+	}
+	for i, m := range s.Models {
+		v.Models[i] = m
+		v.Models[i].Steps = append([]searchStep{}, m.Steps...)
+	}
+	return v
+}
+
+// searchConfig returns the spec's search with its defaults filled in.
+func searchConfig(spec *workload.Spec) workload.Search {
+	cfg := *spec.Search
+	if cfg.Step == 0 {
+		cfg.Step = workload.Duration(searchStepDuration)
+	}
+	if cfg.Factor == 0 {
+		cfg.Factor = searchFactor
+	}
+	if cfg.Precision == 0 {
+		cfg.Precision = searchPrecision
+	}
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = searchMaxSteps
+	}
+	return cfg
+}
+
+// nextRate returns the rate of the next step of a model's search after
+// steps, from start. When the search is over it returns false and why.
+//
+// The rate grows by the factor until a step fails, or shrinks by it until
+// one passes if the first fails. It is then bisected between the highest
+// rate that passed and the lowest that failed, until they are within the
+// precision.
+func nextRate(cfg workload.Search, start float64, steps []searchStep) (float64, string, bool) {
+	if len(steps) == 0 {
+		return start, "", true
+	}
+	var passed, failed float64
+	for _, s := range steps {
+		if s.Passed && s.Rate > passed {
+			passed = s.Rate
+		}
+		if !s.Passed && (failed == 0 || s.Rate < failed) {
+			failed = s.Rate
+		}
+	}
+	switch {
+	case failed == 0 && cfg.Max > 0 && passed >= cfg.Max:
+		return 0, limitMax, false
+	case failed > 0 && failed-passed <= cfg.Precision*failed:
+		return 0, limitThresholds, false
+	case len(steps) >= cfg.MaxSteps:
+		return 0, limitSteps, false
+	case failed == 0:
+		rate := passed * cfg.Factor
+		if cfg.Max > 0 && rate > cfg.Max {
+			rate = cfg.Max
+		}
+		return rate, "", true
+	case passed == 0:
+		return failed / cfg.Factor, "", true
+	}
+	return (passed + failed) / 2, "", true
+}
+
+// evalStep checks the summary s of a step run at rate against the spec's
+// thresholds for the model.
+func evalStep(spec *workload.Spec, rate float64, s *runSummary) searchStep {
+	step := searchStep{Rate: rate}
+	if len(s.Models) == 0 {
+		step.Failures = []string{"no requests were done"}
+		return step
+	}
+	m := s.Models[0]
+	step.Achieved, step.ErrorRate = m.Rate, m.ErrorRate
+	step.P50, step.P95, step.P99 = m.Latency.P50, m.Latency.P95, m.Latency.P99
+	if m.Rate < searchAchieved*rate {
+		step.Failures = append(step.Failures, fmt.Sprintf("did %.4g/s of %.4g/s", m.Rate, rate))
+	}
+	for _, r := range checkThresholds(spec, s) {
+		if r.Passed {
+			continue
+		}
+		limits := []string{}
+		if r.Min != "" {
+			limits = append(limits, "min "+r.Min)
+		}
+		if r.Max != "" {
+			limits = append(limits, "max "+r.Max)
+		}
+		step.Failures = append(step.Failures, fmt.Sprintf("%s of %s outside %s", r.Metric, formatMetric(r.Metric, r.Value), strings.Join(limits, ", ")))
+	}
+	step.Passed = len(step.Failures) == 0
+	return step
+}
+
+// formatMetric formats a threshold metric's value in its units.
+func formatMetric(metric string, v float64) string {
+	switch metric {
+	case workload.MetricErrorRate:
+		return fmt.Sprintf("%.2f%%", v*100)
+	case workload.MetricRate:
+		return fmt.Sprintf("%.4g/s", v)
+	}
+	return time.Duration(v * float64(time.Second)).Round(time.Microsecond).String()
+}
+
+// stepPlan returns the plan of a step of the search of p running the
+// model idx alone at rate.
+func stepPlan(p *plan, searchId string, idx int, rate float64, step time.Duration) *plan {
+	spec := *p.spec
+	m := spec.Models[idx]
+	m.ID = p.spec.ModelID(idx)
+	m.Requests = 0
+	m.Rate = rate
+	if !spec.Run.Adaptive {
+		m.Rate /= float64(spec.Run.Workers)
+	}
+	spec.Models = []workload.Model{m}
+	spec.Stages = []workload.Stage{{Duration: workload.Duration(step)}}
+	spec.Search = nil
+	spec.Metadata.Tags = append(append([]string{}, spec.Metadata.Tags...), "search:"+searchId)
+	name := fmt.Sprintf("%s at %.4g/s", m.Model, rate)
+	if p.name != "" {
+		name = p.name + " search " + name
+	}
+	return &plan{spec: &spec, seed: p.seed, name: name}
+}
+
+// startSearch starts the capacity search of p and returns its id.
+func (app *App) startSearch(p *plan) (string, error) {
+	id, err := uuid()
+	if err != nil {
+		return "", err
+	}
+	s := &search{
+		Id:      id,
+		Name:    p.name,
+		Started: app.clock.Now(),
+		Outcome: outcomeRunning,
+		// The search is served and written to the report directory,
+		// without the API key.
+		Spec: withoutAPIKey(p.spec),
+	}
+	for i, m := range p.spec.Models {
+		s.Models = append(s.Models, searchResult{Model: p.spec.ModelID(i), Name: m.Model, Steps: []searchStep{}})
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if app.killc != nil || app.search != nil {
+		return "", errRunning
+	}
+	if app.searches == nil {
+		app.searches = make(map[string]*search)
+	}
+	app.searches[id] = s
+	app.search = s
+	go app.runSearch(s, p)
+	return id, nil
+}
+
+// runSearch runs the steps of the search s of p, one model at a time.
+func (app *App) runSearch(s *search, p *plan) {
+	cfg := searchConfig(p.spec)
+	outcome, err := outcomeCompleted, error(nil)
+models:
+	for i, m := range p.spec.Models {
+		start := cfg.Start
+		if start == 0 {
+			start = math.Max(m.Rate*float64(p.spec.Run.Workers), 1)
+		}
+		for {
+			s.mu.Lock()
+			rate, limit, ok := nextRate(cfg, start, s.Models[i].Steps)
+			if !ok {
+				s.Models[i].Limit = limit
+			}
+			s.mu.Unlock()
+			if !ok {
+				break
+			}
+			var step *searchStep
+			step, outcome, err = app.runStep(s, stepPlan(p, s.Id, i, rate, time.Duration(cfg.Step)), rate)
+			if err != nil || outcome != outcomeCompleted {
+				break models
+			}
+			s.mu.Lock()
+			r := &s.Models[i]
+			r.Steps = append(r.Steps, *step)
+			if step.Passed && step.Rate > r.MaxRate {
+				r.MaxRate = step.Rate
+			}
+			if !step.Passed && (r.FailedAt == 0 || step.Rate < r.FailedAt) {
+				r.FailedAt = step.Rate
+			}
+			s.mu.Unlock()
+			log.Printf("search %s: %s at %.4g/s passed: %v %s", s.Id, m.Model, rate, step.Passed, strings.Join(step.Failures, "; "))
+		}
+	}
+
+	app.mu.Lock()
+	if app.search == s {
+		app.search = nil
+	}
+	app.mu.Unlock()
+	ended := app.clock.Now()
+	s.mu.Lock()
+	s.Ended, s.Outcome = &ended, outcome
+	if err != nil {
+		s.Outcome, s.Error = outcomeFailed, err.Error()
+	}
+	s.mu.Unlock()
+	log.Printf("search %s %s", s.Id, outcome)
+	if app.config.ReportDir != "" {
+		if err := writeSearch(app.config.ReportDir, s.view()); err != nil {
+			log.Printf("failed to write search: %v", err)
+		}
+	}
+}
+
+// runStep runs the step p of the search s at rate and waits for it to end.
+// Steps run unless the search was stopped, and a step stopped early has no
+// result.
+func (app *App) runStep(s *search, p *plan, rate float64) (*searchStep, string, error) {
+	app.mu.Lock()
+	stopped := s.stopped
+	app.mu.Unlock()
+	if stopped {
+		return nil, outcomeStopped, nil
+	}
+	batchId, err := app.startRun(p)
+	if err != nil {
+		return nil, "", err
+	}
+	app.mu.Lock()
+	r := app.run
+	app.mu.Unlock()
+	if r == nil || r.batchId != batchId {
+		return nil, "", errors.New("lost the step's run")
+	}
+	<-r.recorded
+
+	app.mu.Lock()
+	outcome := r.outcome
+	app.mu.Unlock()
+	if outcome != outcomeCompleted {
+		return nil, outcome, nil
+	}
+	step := evalStep(p.spec, rate, r.summary)
+	step.BatchId = batchId
+	return &step, outcome, nil
+}
+
+// stopSearch ends the running search, if any, before its next step. The
+// caller must hold app.mu.
+func (app *App) stopSearch() {
+	if app.search != nil {
+		app.search.stopped = true
+	}
+}
+
+func searchPath(dir, id string) string {
+	return filepath.Join(dir, "search_"+id+".json")
+}
+
+func writeSearch(dir string, s *search) error {
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(searchPath(dir, s.Id), b, 0644)
+}
+
+// handleSearch starts the capacity search of the workload in the request,
+// which is read like handleWorkload's and must have a search section.
+func (app *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusNotImplemented)
+		return
+	}
+	p, problems := app.parseForm(r)
+	if problems == nil && p.spec.Search == nil {
+		problems = workload.Problems{{Field: "search", Message: "the workload has no search section"}}
+	}
+	if problems != nil {
+		writeWorkloadError(w, problems)
+		return
+	}
+	id, err := app.startSearch(p)
+	if err != nil {
+		writeWorkloadError(w, workload.Problems{{Field: "workload", Message: err.Error()}})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"search_id": id})
+}
+
+// handleSearches lists the searches run since the simulator started, most
+// recent first.
+func (app *App) handleSearches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	app.mu.Lock()
+	searches := make([]*search, 0, len(app.searches))
+	for _, s := range app.searches {
+		searches = append(searches, s)
+	}
+	app.mu.Unlock()
+	views := make([]*search, len(searches))
+	for i, s := range searches {
+		views[i] = s.view()
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Started.After(views[j].Started) })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"searches": views})
+}
+
+// handleSearchResult serves the search at /searches/{id}, from the report
+// directory if it ran before the simulator started.
+func (app *App) handleSearchResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/searches/")
+	app.mu.Lock()
+	s := app.searches[id]
+	app.mu.Unlock()
+	if s != nil {
+		writeJSON(w, http.StatusOK, s.view())
+		return
+	}
+	if app.config.ReportDir == "" || strings.ContainsAny(id, `/\.`) {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := ioutil.ReadFile(searchPath(app.config.ReportDir, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+			return
+		}
+		log.Println(err)
+		http.Error(w, "failed to read search", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,339 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func TestNextRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      workload.Search
+		capacity float64
+		rates    []float64
+		limit    string
+	}{
+		{"step up then bisect", workload.Search{Factor: 2, Precision: 0.1, MaxSteps: 20}, 37,
+			[]float64{5, 10, 20, 40, 30, 35, 37.5}, limitThresholds},
+		{"step down", workload.Search{Factor: 2, Precision: 0.3, MaxSteps: 20}, 3,
+			[]float64{5, 2.5, 3.75, 3.125}, limitThresholds},
+		{"max", workload.Search{Factor: 2, Precision: 0.1, Max: 50, MaxSteps: 20}, 100,
+			[]float64{5, 10, 20, 40, 50}, limitMax},
+		{"steps", workload.Search{Factor: 2, Precision: 0.01, MaxSteps: 3}, 100,
+			[]float64{5, 10, 20}, limitSteps},
+	}
+	for _, test := range tests {
+		var steps []searchStep
+		var rates []float64
+		limit := ""
+		for {
+			rate, l, ok := nextRate(test.cfg, 5, steps)
+			if !ok {
+				limit = l
+				break
+			}
+			if len(rates) > 20 {
+				t.Fatalf("%s: search doesn't end: %v", test.name, rates)
+			}
+			rates = append(rates, rate)
+			steps = append(steps, searchStep{Rate: rate, Passed: rate <= test.capacity})
+		}
+		if limit != test.limit || len(rates) != len(test.rates) {
+			t.Errorf("%s: expected %v then %s, got %v then %s", test.name, test.rates, test.limit, rates, limit)
+			continue
+		}
+		for i := range rates {
+			if rates[i] != test.rates[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.rates, rates)
+				break
+			}
+		}
+	}
+}
+
+func TestEvalStep(t *testing.T) {
+	spec := &workload.Spec{
+		Models: []workload.Model{{Model: "m1"}},
+		Thresholds: []workload.Threshold{
+			{Metric: workload.MetricP99, Max: "200ms"},
+			{Model: "other", Metric: workload.MetricErrorRate, Max: "1%"},
+		},
+	}
+	s := &runSummary{Models: []modelSummary{{
+		ID: "0", Model: "m1", Done: 80, Rate: 8,
+		Latency: latencySummary{P99: 0.25},
+	}}}
+	step := evalStep(spec, 10, s)
+	expected := []string{"did 8/s of 10/s", "p99 of 250ms outside max 200ms"}
+	if step.Passed || strings.Join(step.Failures, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("expected %q, got %+v", expected, step)
+	}
+
+	s.Models[0].Rate, s.Models[0].Latency.P99 = 9.5, 0.15
+	if step := evalStep(spec, 10, s); !step.Passed || step.Achieved != 9.5 || step.P99 != 0.15 {
+		t.Errorf("expected the step to pass, got %+v", step)
+	}
+}
+
+// simTarget is an Ops stand-in for runs on a fake clock, which it moves
+// through the requests of a single worker paced in steps of length step.
+// Requests take latency, which it advances the clock by, and it advances
+// the clock to the worker's arrivals itself once the worker waits for
+// them, so runs take the same simulated time however slowly the test
+// runs.
+type simTarget struct {
+	t       *testing.T
+	app     *App
+	clock   *fakeClock
+	latency time.Duration
+	step    time.Duration
+
+	mu sync.Mutex
+	// run is the run whose first request came in, once the timers left
+	// by the previous run were dropped.
+	run *run
+}
+
+func (st *simTarget) current() *run {
+	st.app.mu.Lock()
+	defer st.app.mu.Unlock()
+	return st.app.run
+}
+
+// stopped waits for the run r to be stopped.
+func (st *simTarget) stopped(r *run) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st.app.mu.Lock()
+		stopped := st.app.killc != r.killc
+		st.app.mu.Unlock()
+		if stopped {
+			return true
+		}
+		if time.Now().After(deadline) {
+			st.t.Errorf("timed out waiting for run %s to stop", r.batchId)
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (st *simTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r := st.current()
+	end := r.started.Add(st.step)
+	st.mu.Lock()
+	if st.run != r {
+		// The step's timer must be set before time moves, and the
+		// arrivals the previous run's worker left waiting never come.
+		deadline := time.Now().Add(5 * time.Second)
+		for !st.pending(end) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		st.dropArrivals(end)
+		st.run = r
+	}
+	st.mu.Unlock()
+
+	st.clock.Advance(st.latency)
+	if !st.clock.Now().Before(end) && !st.stopped(r) {
+		http.Error(w, "step didn't stop", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte(`{"result": 1}`))
+}
+
+// dropArrivals drops every timer but the one ending the step at end.
+func (st *simTarget) dropArrivals(end time.Time) {
+	step := false
+	st.clock.Drop(func(at time.Time) bool {
+		if at.Equal(end) && !step {
+			step = true
+			return false
+		}
+		return true
+	})
+}
+
+func (st *simTarget) pending(at time.Time) bool {
+	for _, d := range st.clock.Deadlines() {
+		if d.Equal(at) {
+			return true
+		}
+	}
+	return false
+}
+
+// drive advances the clock to the worker's next arrival whenever it waits
+// for one, and to the end of the step if that comes first, until stop is
+// closed.
+func (st *simTarget) drive(stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		r := st.current()
+		st.mu.Lock()
+		ready := r != nil && st.run == r
+		st.mu.Unlock()
+		st.app.mu.Lock()
+		ready = ready && st.app.killc == r.killc
+		st.app.mu.Unlock()
+		var next time.Time
+		if ready {
+			end := r.started.Add(st.step)
+			step := false
+			for _, at := range st.clock.Deadlines() {
+				if at.Equal(end) && !step {
+					step = true
+					continue
+				}
+				if next.IsZero() || at.Before(next) {
+					next = at
+				}
+			}
+			if !next.IsZero() && !next.Before(end) {
+				// The step ends first, or at the same time.
+				st.dropArrivals(end)
+				next = end
+			}
+		}
+		if next.IsZero() {
+			time.Sleep(100 * time.Microsecond)
+			continue
+		}
+		st.clock.Advance(next.Sub(st.clock.Now()))
+		if next.Equal(r.started.Add(st.step)) {
+			st.stopped(r)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	app := newTestApp(t)
+	clock := newFakeClock()
+	app.clock = clock
+	// A single worker waiting 40ms on every request can't do more than
+	// 25 requests a second.
+	// Steps don't end on a tick of the worker, which could then send
+	// another request before it is stopped.
+	st := &simTarget{t: t, app: app, clock: clock, latency: 40 * time.Millisecond, step: 600 * time.Millisecond}
+	ops := httptest.NewServer(st)
+	defer ops.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go st.drive(stop)
+
+	spec := `
+version: 1
+metadata: {name: capacity}
+target: {host: "` + ops.URL + `", user: demo, apikey: secret-key}
+run: {workers: 1, seed: 1}
+models:
+    - {model: m1}
+thresholds:
+    - {metric: error_rate, max: 1%}
+search: {step: 600ms, start: 20, precision: 0.2, max_steps: 6}
+`
+	if w := do(app, "POST", "/workload", map[string][]string{"spec": {spec}}); w.Code == http.StatusOK {
+		t.Error("expected /workload to refuse a search")
+	}
+	w := do(app, "POST", "/search", map[string][]string{"spec": {spec}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	id := decodeJSON(t, w)["search_id"].(string)
+
+	var s search
+	deadline := time.Now().Add(10 * time.Second)
+	for s.Outcome != outcomeCompleted {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the search, got %s", w.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+		w = do(app, "GET", "/searches/"+id, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The worker does 25/s at every rate from 25/s, and the search ends
+	// once 25/s passed and 30/s failed, within the precision.
+	m := s.Models[0]
+	var got []string
+	for _, step := range m.Steps {
+		got = append(got, fmt.Sprintf("%g:%.4g:%v", step.Rate, step.Achieved, step.Passed))
+	}
+	expected := "20:20:true 40:25:false 30:25:false 25:25:true"
+	if strings.Join(got, " ") != expected {
+		t.Errorf("expected steps %s, got %s", expected, strings.Join(got, " "))
+	}
+	if m.MaxRate != 25 || m.FailedAt != 30 || m.Limit != limitThresholds {
+		t.Errorf("expected a capacity of 25/s, got %+v", m)
+	}
+
+	// Every step is a run in the history.
+	runs := getRuns(t, app, "tag=search:"+id)
+	if len(runs) != len(m.Steps) || runs[len(runs)-1].BatchId != m.Steps[0].BatchId || runs[len(runs)-1].Name != "capacity search m1 at 20/s" {
+		t.Errorf("expected a run for each of %d steps, got %+v", len(m.Steps), runs)
+	}
+	b, err := ioutil.ReadFile(searchPath(app.config.ReportDir, id))
+	if err != nil {
+		t.Errorf("expected the search to be written: %v", err)
+	}
+	// The search's spec is served and written without the API key.
+	if s.Spec == nil || s.Spec.Target.User != "demo" || strings.Contains(string(b), "secret-key") ||
+		strings.Contains(w.Body.String(), "secret-key") || strings.Contains(do(app, "GET", "/searches", nil).Body.String(), "secret-key") {
+		t.Errorf("expected the search's spec without its API key, got %+v", s.Spec)
+	}
+}
+
+func TestSearchKilled(t *testing.T) {
+	_, ops := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	w := do(app, "POST", "/search", map[string][]string{"spec": {`
+version: 1
+target: {host: "` + ops.URL + `", user: demo, apikey: key}
+run: {workers: 1}
+models:
+    - {model: m1}
+search: {step: 1m, start: 5}
+`}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	id := decodeJSON(t, w)["search_id"].(string)
+	if w := do(app, "POST", "/workload", map[string][]string{"spec": {`
+version: 1
+target: {host: "` + ops.URL + `", user: demo, apikey: key}
+run: {workers: 1}
+models:
+    - {model: m1, requests: 1}
+`}}); w.Code == http.StatusOK {
+		t.Error("expected runs to be refused during a search")
+	}
+
+	do(app, "POST", "/kill", nil)
+	waitFor(t, func() bool {
+		app.mu.Lock()
+		defer app.mu.Unlock()
+		return app.search == nil
+	})
+	var s struct{ Outcome string }
+	if err := json.Unmarshal(do(app, "GET", "/searches/"+id, nil).Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Outcome != outcomeStopped {
+		t.Errorf("expected the search stopped, got %s", s.Outcome)
+	}
+}
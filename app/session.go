@@ -0,0 +1,133 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// session is the state of the UI saved under a name: its windows, with
+// their queries, request counts and rates, and its settings. Both are kept
+// exactly as the UI sent them so unfinished sessions can be saved too.
+//
+// Saved sessions are also workload files in the original format, so they
+// can be loaded, migrated and run like any other workload.
+type session struct {
+	Name     string                 `json:"name"`
+	Saved    time.Time              `json:"saved"`
+	Settings map[string]interface{} `json:"settings"`
+	Workload map[string]interface{} `json:"workload"`
+}
+
+// sessionInfo describes a saved session without its contents.
+type sessionInfo struct {
+	Name    string    `json:"name"`
+	Saved   time.Time `json:"saved"`
+	Windows int       `json:"windows"`
+}
+
+// saveSession writes the UI's json-encoded workload and settings under
+// name, replacing any session saved with that name before.
+func (app *App) saveSession(name, wl, settings string) (*session, error) {
+	if err := workload.CheckName(name); err != nil {
+		return nil, err
+	}
+	s := &session{Name: name, Saved: app.clock.Now().UTC()}
+	if err := json.Unmarshal([]byte(wl), &s.Workload); err != nil || s.Workload == nil {
+		return nil, fmt.Errorf("workload must be a json object")
+	}
+	if err := json.Unmarshal([]byte(settings), &s.Settings); err != nil || s.Settings == nil {
+		return nil, fmt.Errorf("settings must be a json object")
+	}
+	b, err := json.MarshalIndent(s, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+
+	dir := app.config.SessionDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating session directory: %v", err)
+	}
+	// Write to a temporary file first so a failed save doesn't clobber
+	// the previous one.
+	tmp, err := ioutil.TempFile(dir, ".session")
+	if err != nil {
+		return nil, fmt.Errorf("error saving session %s: %v", name, err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644)
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("error saving session %s: %v", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("error saving session %s: %v", name, err)
+	}
+	if err := os.Rename(tmp.Name(), app.sessionPath(name)); err != nil {
+		return nil, fmt.Errorf("error saving session %s: %v", name, err)
+	}
+	return s, nil
+}
+
+// loadSession reads a saved session. It returns workload.ErrNotFound if
+// there is none by that name.
+func (app *App) loadSession(name string) (*session, error) {
+	if err := workload.CheckName(name); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(app.sessionPath(name))
+	if os.IsNotExist(err) {
+		return nil, workload.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening session %s: %v", name, err)
+	}
+	s := &session{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("error reading session %s: %v", name, err)
+	}
+	s.Name = name
+	return s, nil
+}
+
+// listSessions returns the saved sessions, most recently saved first.
+func (app *App) listSessions() ([]sessionInfo, error) {
+	files, err := filepath.Glob(filepath.Join(app.config.SessionDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	infos := []sessionInfo{}
+	for _, f := range files {
+		name := strings.TrimSuffix(filepath.Base(f), ".json")
+		s, err := app.loadSession(name)
+		if err != nil {
+			continue
+		}
+		infos = append(infos, sessionInfo{Name: name, Saved: s.Saved, Windows: len(s.Workload)})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Saved.After(infos[j].Saved) })
+	return infos, nil
+}
+
+// deleteSession removes a saved session.
+func (app *App) deleteSession(name string) error {
+	if err := workload.CheckName(name); err != nil {
+		return err
+	}
+	err := os.Remove(app.sessionPath(name))
+	if os.IsNotExist(err) {
+		return workload.ErrNotFound
+	}
+	return err
+}
+
+func (app *App) sessionPath(name string) string {
+	return filepath.Join(app.config.SessionDir, name+".json")
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func saveForm(name, wl, settings string) url.Values {
+	form := workloadForm(wl, settings)
+	form.Set("name", name)
+	return form
+}
+
+func TestSaveAndRestoreSession(t *testing.T) {
+	app := newTestApp(t)
+	clock := newFakeClock()
+	app.clock = clock
+
+	wl := `{
+		"0": {"query": "{\"model\":\"m1\", \"input\":{\"x\":1}}", "qps": "5", "rate": "2.5"},
+		"3": {"query": "{\"model\":\"m2\"", "qps": "7"}
+	}`
+	settings := testSettings("http://ops.example.com", "4")
+
+	// Unfinished sessions, like one with a broken query, can be saved.
+	w := do(app, "POST", "/save", saveForm("nightly", wl, settings))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	clock.Advance(time.Hour)
+	do(app, "POST", "/save", saveForm("other", `{}`, settings))
+
+	w = do(app, "GET", "/sessions", nil)
+	var list struct{ Sessions []sessionInfo }
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Sessions) != 2 || list.Sessions[0].Name != "other" || list.Sessions[1].Windows != 2 {
+		t.Errorf("expected newest session first, got %+v", list.Sessions)
+	}
+
+	w = do(app, "GET", "/sessions/nightly", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var got, want struct {
+		Workload map[string]interface{}
+		Settings map[string]interface{}
+	}
+	json.Unmarshal(w.Body.Bytes(), &got)
+	json.Unmarshal([]byte(wl), &want.Workload)
+	json.Unmarshal([]byte(settings), &want.Settings)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected session to be restored exactly\nwant %v\ngot  %v", want, got)
+	}
+
+	if w := do(app, "DELETE", "/sessions/other", nil); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", w.Code)
+	}
+	if w := do(app, "GET", "/sessions/other", nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestSavedSessionIsAWorkload(t *testing.T) {
+	app := newTestApp(t)
+	settings := testSettings("http://ops.example.com", "4")
+	do(app, "POST", "/save", saveForm("s", twoWindows, settings))
+
+	b, err := ioutil.ReadFile(app.sessionPath("s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := workload.Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Run.Workers != 4 || len(spec.Models) != 2 || spec.Target.Host != "http://ops.example.com" {
+		t.Errorf("unexpected workload from session: %+v", spec)
+	}
+}
+
+func TestSaveSessionRejectsBadInput(t *testing.T) {
+	app := newTestApp(t)
+	settings := testSettings("http://ops.example.com", "4")
+	tests := []struct {
+		name string
+		form url.Values
+	}{
+		{"no name", saveForm("", twoWindows, settings)},
+		{"path name", saveForm("../escape", twoWindows, settings)},
+		{"bad workload", saveForm("s", `[`, settings)},
+		{"bad settings", saveForm("s", twoWindows, `null`)},
+	}
+	for _, tt := range tests {
+		if w := do(app, "POST", "/save", tt.form); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", tt.name, w.Code)
+		}
+	}
+	if w := do(app, "GET", "/save", nil); w.Code != http.StatusNotImplemented {
+		t.Errorf("expected GET /save to be refused, got %d", w.Code)
+	}
+	if w := do(app, "GET", "/sessions", nil); w.Body.String() != `{"sessions":[]}` {
+		t.Errorf("expected no sessions, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,151 @@
+package app
+
+import "math"
+
+// welchTest returns the two-sided p-value of Welch's t-test that samples a
+// and b have the same mean. ok is false if either sample has fewer than two
+// values.
+func welchTest(a, b []float64) (p float64, ok bool) {
+	if len(a) < 2 || len(b) < 2 {
+		return 0, false
+	}
+	ma, va := meanVariance(a)
+	mb, vb := meanVariance(b)
+	na, nb := float64(len(a)), float64(len(b))
+	sa, sb := va/na, vb/nb
+	if sa+sb == 0 {
+		// Both samples are constant.
+		if ma == mb {
+			return 1, true
+		}
+		return 0, true
+	}
+	t := (ma - mb) / math.Sqrt(sa+sb)
+	df := (sa + sb) * (sa + sb) / (sa*sa/(na-1) + sb*sb/(nb-1))
+	return studentTwoSided(t, df), true
+}
+
+// proportionTest returns the two-sided p-value of the z-test that x1 of n1
+// and x2 of n2 are drawn from the same proportion.
+func proportionTest(x1, n1, x2, n2 int) (p float64, ok bool) {
+	if n1 == 0 || n2 == 0 {
+		return 0, false
+	}
+	p1, p2 := float64(x1)/float64(n1), float64(x2)/float64(n2)
+	pooled := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(n1) + 1/float64(n2)))
+	if se == 0 {
+		if p1 == p2 {
+			return 1, true
+		}
+		return 0, true
+	}
+	z := math.Abs(p1-p2) / se
+	return math.Erfc(z / math.Sqrt2), true
+}
+
+func meanVariance(xs []float64) (mean, variance float64) {
+	for _, x := range xs {
+		mean += x
+	}
+	mean /= float64(len(xs))
+	for _, x := range xs {
+		variance += (x - mean) * (x - mean)
+	}
+	return mean, variance / float64(len(xs)-1)
+}
+
+// pearson returns the correlation coefficient of the paired samples x and
+// y. ok is false if there are fewer than three pairs or either sample is
+// constant.
+func pearson(x, y []float64) (r float64, ok bool) {
+	if len(x) != len(y) || len(x) < 3 {
+		return 0, false
+	}
+	mx, vx := meanVariance(x)
+	my, vy := meanVariance(y)
+	if vx == 0 || vy == 0 {
+		return 0, false
+	}
+	var cov float64
+	for i := range x {
+		cov += (x[i] - mx) * (y[i] - my)
+	}
+	cov /= float64(len(x) - 1)
+	return cov / math.Sqrt(vx*vy), true
+}
+
+// studentTwoSided returns P(|T| > |t|) for Student's t distribution with df
+// degrees of freedom.
+func studentTwoSided(t, df float64) float64 {
+	return regIncBeta(df/2, 0.5, df/(df+t*t))
+}
+
+// regIncBeta is the regularized incomplete beta function I_x(a, b).
+func regIncBeta(a, b, x float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log(1-x))
+	// The continued fraction converges quickly below the mean, use the
+	// symmetry I_x(a, b) = 1 - I_{1-x}(b, a) above it.
+	if x < (a+1)/(a+b+2) {
+		return front * betaFraction(a, b, x) / a
+	}
+	return 1 - front*betaFraction(b, a, 1-x)/b
+}
+
+// betaFraction evaluates the continued fraction of the incomplete beta
+// function by the modified Lentz method.
+func betaFraction(a, b, x float64) float64 {
+	const (
+		maxIter = 300
+		eps     = 1e-14
+		tiny    = 1e-300
+	)
+	c := 1.0
+	d := 1 - (a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= maxIter; m++ {
+		fm := float64(m)
+		// Even step.
+		num := fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		h *= d * c
+		// Odd step.
+		num = -(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1))
+		d = 1 + num*d
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = 1 + num/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < eps {
+			break
+		}
+	}
+	return h
+}
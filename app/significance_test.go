@@ -0,0 +1,78 @@
+package app
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStudentTwoSided(t *testing.T) {
+	tests := []struct {
+		t, df, p float64
+	}{
+		{0, 5, 1},
+		// Cauchy: P(|T| > 1) = 1/2.
+		{1, 1, 0.5},
+		{-1, 1, 0.5},
+		// P(|T| > t) = 1 - t/sqrt(2+t^2) with two degrees of freedom.
+		{2, 2, 1 - 2/math.Sqrt(6)},
+		// Tabulated critical values.
+		{2.228, 10, 0.05},
+		{2.763, 28, 0.01},
+	}
+	for _, tt := range tests {
+		if p := studentTwoSided(tt.t, tt.df); math.Abs(p-tt.p) > 1e-4 {
+			t.Errorf("t=%g df=%g: expected p=%g, got %g", tt.t, tt.df, tt.p, p)
+		}
+	}
+}
+
+func TestWelchTest(t *testing.T) {
+	a := []float64{10, 11, 9, 10, 12, 8, 10, 11}
+	if p, ok := welchTest(a, a); !ok || math.Abs(p-1) > 1e-9 {
+		t.Errorf("expected identical samples to have p=1, got %g, %v", p, ok)
+	}
+	b := []float64{20, 21, 19, 20, 22, 18, 20, 21}
+	if p, ok := welchTest(a, b); !ok || p > 1e-6 {
+		t.Errorf("expected separated samples to differ, got %g, %v", p, ok)
+	}
+	c := []float64{10.5, 9.5, 11, 9, 10, 10, 12, 9}
+	if p, ok := welchTest(a, c); !ok || p < 0.5 {
+		t.Errorf("expected overlapping samples not to differ, got %g, %v", p, ok)
+	}
+	if p, ok := welchTest([]float64{1, 1}, []float64{2, 2}); !ok || p != 0 {
+		t.Errorf("expected different constants to differ, got %g, %v", p, ok)
+	}
+	if _, ok := welchTest([]float64{1}, b); ok {
+		t.Error("expected a single value to be untestable")
+	}
+}
+
+func TestProportionTest(t *testing.T) {
+	// z = 0.1/sqrt(0.15*0.85*0.02) = 1.980.
+	p, ok := proportionTest(10, 100, 20, 100)
+	if !ok || math.Abs(p-0.0477) > 1e-3 {
+		t.Errorf("expected p=0.0477, got %g, %v", p, ok)
+	}
+	if p, ok := proportionTest(0, 100, 0, 50); !ok || p != 1 {
+		t.Errorf("expected no errors in both to have p=1, got %g, %v", p, ok)
+	}
+	if _, ok := proportionTest(0, 0, 1, 10); ok {
+		t.Error("expected an empty sample to be untestable")
+	}
+}
+
+func TestPearson(t *testing.T) {
+	x := []float64{1, 2, 3, 4}
+	if r, ok := pearson(x, []float64{2, 4, 6, 8}); !ok || math.Abs(r-1) > 1e-12 {
+		t.Errorf("expected 1, got %v %v", r, ok)
+	}
+	if r, ok := pearson(x, []float64{8, 6, 4, 2}); !ok || math.Abs(r+1) > 1e-12 {
+		t.Errorf("expected -1, got %v %v", r, ok)
+	}
+	if _, ok := pearson(x, []float64{1, 1, 1, 1}); ok {
+		t.Error("expected no correlation with a constant sample")
+	}
+	if _, ok := pearson(x[:2], x[:2]); ok {
+		t.Error("expected no correlation with two pairs")
+	}
+}
@@ -0,0 +1,194 @@
+package app
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Sink is a destination for the stats rows of a run. The stats pipeline
+// writes each batch of rows to every sink of the running workload and
+// closes the sinks when the workload stops.
+type Sink interface {
+	Write(records []*CsvMetric) error
+	Close() error
+}
+
+// Sink formats.
+const (
+	FormatCsv       = "csv"
+	FormatJSONLines = "jsonl"
+)
+
+// SinkConfig configures a sink writing a file per run to the report
+// directory.
+type SinkConfig struct {
+	// Format is "csv" (the default) or "jsonl".
+	Format string `yaml:"format,omitempty"`
+
+	// Gzip compresses the file.
+	Gzip bool `yaml:"gzip,omitempty"`
+}
+
+// defaultSinks write a CSV file per run.
+var defaultSinks = []SinkConfig{{Format: FormatCsv}}
+
+func (c SinkConfig) check() error {
+	switch c.Format {
+	case "", FormatCsv, FormatJSONLines:
+		return nil
+	}
+	return fmt.Errorf("unknown report format %q", c.Format)
+}
+
+// filename is the name of the file of the run with the batch id.
+func (c SinkConfig) filename(batchId string) string {
+	ext := c.Format
+	if ext == "" {
+		ext = FormatCsv
+	}
+	name := "workload_data_" + batchId + "." + ext
+	if c.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+// open creates the sink's file for the run with the batch id in dir.
+func (c SinkConfig) open(dir, batchId string) (Sink, error) {
+	path := filepath.Join(dir, c.filename(batchId))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("error creating report file: %v", err)
+	}
+	fs := &fileSink{f: f}
+	var w io.Writer = f
+	if c.Gzip {
+		fs.gz = gzip.NewWriter(f)
+		w = fs.gz
+	}
+	switch c.Format {
+	case FormatJSONLines:
+		fs.Sink = NewJSONLinesSink(w)
+	default:
+		fs.Sink, err = NewCsvSink(w)
+	}
+	if err == nil {
+		err = fs.flush()
+	}
+	if err != nil {
+		fs.Close()
+		return nil, fmt.Errorf("error writing report file %s: %v", path, err)
+	}
+	return fs, nil
+}
+
+// openSinks opens a sink of each config for a run. Sinks that fail to open
+// are logged and skipped, a run doesn't fail for want of a report.
+func openSinks(configs []SinkConfig, dir, batchId string) []Sink {
+	var sinks []Sink
+	for _, c := range configs {
+		s, err := c.open(dir, batchId)
+		if err != nil {
+			log.Printf("failed to open report: %v", err)
+			continue
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// closeSinks closes every sink, logging failures.
+func closeSinks(sinks []Sink) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			log.Printf("failed to close report: %v", err)
+		}
+	}
+}
+
+// fileSink writes a sink's output to a file, through gzip if gz is set.
+// Compressed output is flushed after each write, so the file can be read
+// while the run goes on.
+type fileSink struct {
+	Sink
+	gz *gzip.Writer
+	f  *os.File
+}
+
+func (s *fileSink) Write(records []*CsvMetric) error {
+	if err := s.Sink.Write(records); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *fileSink) flush() error {
+	if s.gz != nil {
+		return s.gz.Flush()
+	}
+	return nil
+}
+
+func (s *fileSink) Close() error {
+	var err error
+	if s.Sink != nil {
+		err = s.Sink.Close()
+	}
+	if s.gz != nil {
+		if gerr := s.gz.Close(); err == nil {
+			err = gerr
+		}
+	}
+	if ferr := s.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+type csvSink struct {
+	w io.Writer
+}
+
+// NewCsvSink returns a Sink writing CSV rows to w after a header.
+func NewCsvSink(w io.Writer) (Sink, error) {
+	if err := WriteHeader(w); err != nil {
+		return nil, err
+	}
+	return &csvSink{w: w}, nil
+}
+
+func (s *csvSink) Write(records []*CsvMetric) error {
+	return WriteCsv(s.w, records)
+}
+
+func (s *csvSink) Close() error {
+	return nil
+}
+
+type jsonLinesSink struct {
+	enc *json.Encoder
+}
+
+// NewJSONLinesSink returns a Sink writing each row to w as a JSON object
+// on its own line, with the CSV header's column names as keys.
+func NewJSONLinesSink(w io.Writer) Sink {
+	return &jsonLinesSink{enc: json.NewEncoder(w)}
+}
+
+func (s *jsonLinesSink) Write(records []*CsvMetric) error {
+	for _, r := range records {
+		if err := s.enc.Encode(r.jsonRow()); err != nil {
+			return fmt.Errorf("error writing json: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *jsonLinesSink) Close() error {
+	return nil
+}
@@ -0,0 +1,155 @@
+package app
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+func testRecords() []*CsvMetric {
+	ts := time.Date(2015, 6, 1, 12, 0, 0, 500000000, time.UTC)
+	return []*CsvMetric{
+		{ts, "b1", 42, "http://ops", "demo", "m1", 4, 10, 9, 3, 4, 2.5},
+		{ts.Add(time.Second), "b1", 42, "http://ops", "demo", "m2", 4, 2, 1, 0, 0, 0},
+	}
+}
+
+func TestSinkFormats(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []SinkConfig{
+		{},
+		{Format: FormatJSONLines},
+		{Format: FormatCsv, Gzip: true},
+		{Format: FormatJSONLines, Gzip: true},
+	} {
+		s, err := c.open(dir, "b1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write(testRecords()); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, c.filename("b1"))
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var r io.Reader = f
+		if c.Gzip {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+		}
+
+		if c.Format == FormatJSONLines {
+			var rows []jsonRow
+			sc := bufio.NewScanner(r)
+			for sc.Scan() {
+				var row jsonRow
+				if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+					t.Fatalf("%s: line is not json: %v", path, err)
+				}
+				rows = append(rows, row)
+			}
+			if len(rows) != 2 || rows[0].ModelName != "m1" || rows[0].Seed != 42 || rows[1].RequestsSent != 2 ||
+				rows[0].Users != 4 || rows[0].IterationsPerSec != 2.5 || !rows[0].Timestamp.Equal(testRecords()[0].ts) {
+				t.Errorf("%s: unexpected rows %+v", path, rows)
+			}
+			continue
+		}
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			t.Fatalf("%s: not csv: %v", path, err)
+		}
+		if len(rows) != 3 || rows[0][0] != "timestamp" || rows[2][5] != "m2" {
+			t.Fatalf("%s: unexpected rows %v", path, rows)
+		}
+		ts, err := time.Parse(time.RFC3339, rows[1][0])
+		if err != nil || !ts.Equal(testRecords()[0].ts) {
+			t.Errorf("%s: expected an RFC 3339 timestamp, got %q", path, rows[1][0])
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != 4 {
+		t.Errorf("expected a file per sink, got %v", names)
+	}
+}
+
+func TestUnknownSinkFormat(t *testing.T) {
+	cfg := &Config{}
+	cfg.Web.ReportDir = t.TempDir()
+	cfg.Web.ReportSinks = []SinkConfig{{Format: "xml"}}
+	if _, err := New(cfg); err == nil || !strings.Contains(err.Error(), "xml") {
+		t.Errorf("expected an unknown format to fail, got %v", err)
+	}
+}
+
+func TestRunWritesConfiguredSinks(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	app.config.ReportSinks = []SinkConfig{{Format: FormatCsv}, {Format: FormatJSONLines, Gzip: true}}
+	// Nobody polls /stats, the run's own stats fill the sinks.
+	r := runSpec(t, app, `
+version: 1
+target: {host: "`+ts.URL+`", user: demo}
+run: {workers: 2, seed: 7}
+models:
+    - {model: m1, requests: 5}
+`)
+	app.mu.Lock()
+	if app.sinks != nil {
+		t.Error("expected the sinks to be closed once the run finished")
+	}
+	app.mu.Unlock()
+
+	dir := app.config.ReportDir
+	f, err := os.Open(filepath.Join(dir, "workload_data_"+r.batchId+".csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 2 || rows[0][0] != "timestamp" {
+		t.Fatalf("expected a header and rows, got %v", rows)
+	}
+	want := []string{r.batchId, "7", ts.URL, "demo", "m1", "2", "10", "10"}
+	if last := rows[len(rows)-1]; strings.Join(last[1:9], ",") != strings.Join(want, ",") {
+		t.Errorf("expected the last row to count every request %v, got %v", want, last)
+	}
+
+	gf, err := os.Open(filepath.Join(dir, "workload_data_"+r.batchId+".jsonl.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gf.Close()
+	gz, err := gzip.NewReader(gf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last jsonRow
+	n := 0
+	for sc := bufio.NewScanner(gz); sc.Scan(); n++ {
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n != len(rows)-1 || last.BatchId != r.batchId || last.ModelName != "m1" || last.RequestsSent != 10 || last.RequestsCompleted != 10 {
+		t.Errorf("expected %d json rows ending with every request counted, got %d ending with %+v", len(rows)-1, n, last)
+	}
+}
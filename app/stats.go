@@ -6,7 +6,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"time"
 )
@@ -30,9 +29,16 @@ type Report struct {
 	requestPerS    string
 	requestLagDone string
 
+	// seed the batch's randomness was drawn from.
+	seed int64
+
 	// cumulative stats
 	requestSent int
 	requestDone int
+
+	// per model stats and names keyed by modelId
+	metrics    map[string]Metric
+	modelNames map[string]string
 }
 
 // Stat represents request statistics
@@ -40,14 +46,44 @@ type Stat struct {
 	// Contains metadata about work being done by the worker.
 	workload *Workload
 
-	// Variable statistics.
-	nreqSent int
-	nreqDone int
+	// Variable statistics collected since the worker's last Stat.
+	nreqSent   int
+	nreqDone   int
+	nreqFailed int
+
+	// Latencies of the requests done since the last Stat.
+	latency *histogram
+
+	// steps are the counts of each step of a scenario since the last Stat,
+	// nil for models that aren't scenarios.
+	steps []*stepCounts
+
+	// Length of the window the statistics were collected over, and when
+	// it ended.
+	dt time.Duration
+	at time.Time
+
+	// Set on the last Stat a worker sends before exiting.
+	final bool
+
+	// Pools of adaptive runs report the most workers they had over the
+	// window, and how many requests were sent late because every worker
+	// was busy at the ceiling.
+	workers int
+	late    int
+
+	// Virtual users report joining the run and leaving it.
+	joined int
+	left   int
 }
 
-func StatsMonitor(report chan<- *Report, dt time.Duration) chan *Stat {
+// StatsMonitor aggregates Stats sent by workers on the returned channel and
+// sends a Report every dt of clock to report and to each of taps. Reports
+// are dropped if nobody is receiving, so workers are never held up by a
+// slow consumer.
+func StatsMonitor(clock Clock, report chan<- *Report, dt time.Duration, taps ...chan<- *Report) chan *Stat {
 	stats := make(chan *Stat)
-	ticker := time.NewTicker(dt)
+	ticker := clock.NewTicker(dt)
 
 	var isent int
 	var idone int
@@ -59,6 +95,7 @@ func StatsMonitor(report chan<- *Report, dt time.Duration) chan *Stat {
 
 	var host string
 	var user string
+	var seed int64
 
 	// maps modelId to req/s for the front end.
 	requestPerSec := make(map[string]int)
@@ -66,11 +103,15 @@ func StatsMonitor(report chan<- *Report, dt time.Duration) chan *Stat {
 
 	// other stats not used in the front end.
 	requestMetrics := make(map[string]Metric)
+	modelNames := make(map[string]string)
+
+	// latest request rate of each worker by modelId.
+	workerRates := make(map[string]map[int]float64)
 
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-ticker.C():
 				// send report of stats.
 				r, err := json.Marshal(requestPerSec)
 				if err != nil {
@@ -85,21 +126,50 @@ func StatsMonitor(report chan<- *Report, dt time.Duration) chan *Stat {
 					return
 				}
 				bd := bytes.NewBuffer(rd)
-				report <- &Report{
+
+				metrics := make(map[string]Metric, len(requestMetrics))
+				for k, v := range requestMetrics {
+					metrics[k] = v
+				}
+				names := make(map[string]string, len(modelNames))
+				for k, v := range modelNames {
+					names[k] = v
+				}
+				rep := &Report{
 					batchId:        bid,
 					modelName:      mn,
 					modelId:        mid,
 					opsHost:        host,
 					user:           user,
+					seed:           seed,
 					requestPerS:    b.String(),
 					requestLagDone: bd.String(),
 					requestSent:    isent,
 					requestDone:    idone,
+					metrics:        metrics,
+					modelNames:     names,
+				}
+				select {
+				case report <- rep:
+				default:
+				}
+				for _, tap := range taps {
+					select {
+					case tap <- rep:
+					default:
+					}
 				}
 			case s := <-stats:
-				// increment state counters
-				tt := s.workload.dt
-				reqPerS := float64(s.nreqDone) / tt.Seconds()
+				// start over when a new batch begins.
+				if s.workload.batchId != bid {
+					isent = 0
+					idone = 0
+					requestPerSec = make(map[string]int)
+					requestLagDone = make(map[string]int)
+					requestMetrics = make(map[string]Metric)
+					modelNames = make(map[string]string)
+					workerRates = make(map[string]map[int]float64)
+				}
 
 				bid = s.workload.batchId
 				mn = s.workload.modelName
@@ -107,14 +177,35 @@ func StatsMonitor(report chan<- *Report, dt time.Duration) chan *Stat {
 
 				host = s.workload.opsHost
 				user = s.workload.user
+				seed = s.workload.seed
 
+				// increment state counters
 				isent += s.nreqSent
 				idone += s.nreqDone
 
-				newStat := Metric{isent, idone, int(reqPerS)}
-				requestMetrics[mid] = newStat
-				requestPerSec[mid] = int(reqPerS)
-				requestLagDone[mid] = idone
+				rates, ok := workerRates[mid]
+				if !ok {
+					rates = make(map[int]float64)
+					workerRates[mid] = rates
+				}
+				if s.final {
+					delete(rates, s.workload.workerId)
+				} else if s.dt > 0 {
+					rates[s.workload.workerId] = float64(s.nreqDone) / s.dt.Seconds()
+				}
+				var reqPerS float64
+				for _, r := range rates {
+					reqPerS += r
+				}
+
+				m := requestMetrics[mid]
+				m.reqSent += s.nreqSent
+				m.reqComplete += s.nreqDone
+				m.reqPerSec = int(reqPerS)
+				requestMetrics[mid] = m
+				modelNames[mid] = mn
+				requestPerSec[mid] = m.reqPerSec
+				requestLagDone[mid] = m.reqComplete
 			}
 		}
 	}()
@@ -126,6 +217,7 @@ type CsvMetric struct {
 	// timestamp and unique batchId
 	ts      time.Time
 	batchId string
+	seed    int64
 
 	// ops related data
 	opsHost      string
@@ -139,12 +231,36 @@ type CsvMetric struct {
 	reqSent     int
 	reqComplete int
 	reqPerSec   int
+
+	// virtual user data, zero unless the run has users.
+	users      int
+	iterPerSec float64
+}
+
+// csvColumns are the names of a CsvMetric's fields, in the order of
+// ConvertCsvMetric.
+var csvColumns = []string{
+	"timestamp",
+	"batch_id",
+	"seed",
+	"ops_host",
+	"ops_user",
+	"model_name",
+	"workers",
+	"requests_sent",
+	"requests_completed",
+	"requests_per_second",
+	"users",
+	"iterations_per_second",
 }
 
+// ConvertCsvMetric returns the row's fields as strings, with the timestamp
+// in RFC 3339 format.
 func (c *CsvMetric) ConvertCsvMetric() []string {
 	s := []string{
-		c.ts.String(),
+		c.ts.UTC().Format(time.RFC3339Nano),
 		c.batchId,
+		strconv.FormatInt(c.seed, 10),
 		c.opsHost,
 		c.opsUser,
 		c.opsModelName,
@@ -152,25 +268,50 @@ func (c *CsvMetric) ConvertCsvMetric() []string {
 		strconv.Itoa(c.reqSent),
 		strconv.Itoa(c.reqComplete),
 		strconv.Itoa(c.reqPerSec),
+		strconv.Itoa(c.users),
+		strconv.FormatFloat(c.iterPerSec, 'f', -1, 64),
 	}
 	return s
 }
 
+// jsonRow is the row as a JSON lines object.
+type jsonRow struct {
+	Timestamp         time.Time `json:"timestamp"`
+	BatchId           string    `json:"batch_id"`
+	Seed              int64     `json:"seed,string"`
+	OpsHost           string    `json:"ops_host"`
+	OpsUser           string    `json:"ops_user"`
+	ModelName         string    `json:"model_name"`
+	Workers           int       `json:"workers"`
+	RequestsSent      int       `json:"requests_sent"`
+	RequestsCompleted int       `json:"requests_completed"`
+	RequestsPerSecond int       `json:"requests_per_second"`
+	Users             int       `json:"users"`
+	IterationsPerSec  float64   `json:"iterations_per_second"`
+}
+
+func (c *CsvMetric) jsonRow() *jsonRow {
+	return &jsonRow{
+		Timestamp:         c.ts.UTC(),
+		BatchId:           c.batchId,
+		Seed:              c.seed,
+		OpsHost:           c.opsHost,
+		OpsUser:           c.opsUser,
+		ModelName:         c.opsModelName,
+		Workers:           c.nWorkers,
+		RequestsSent:      c.reqSent,
+		RequestsCompleted: c.reqComplete,
+		RequestsPerSecond: c.reqPerSec,
+		Users:             c.users,
+		IterationsPerSec:  c.iterPerSec,
+	}
+}
+
+// WriteHeader writes the CSV header row to w.
 func WriteHeader(w io.Writer) error {
 	wcsv := csv.NewWriter(w)
-	header := []string{
-		"timestamp",
-		"batch_id",
-		"ops_host",
-		"ops_user",
-		"model_name",
-		"workers",
-		"requests_sent",
-		"requests_completed",
-		"requests_per_second",
-	}
-	if err := wcsv.Write(header); err != nil {
-		log.Fatalln("error writing record to csv:", err)
+	if err := wcsv.Write(csvColumns); err != nil {
+		return fmt.Errorf("error writing csv: %v", err)
 	}
 	wcsv.Flush()
 	if err := wcsv.Error(); err != nil {
@@ -186,11 +327,11 @@ func WriteCsv(w io.Writer, records []*CsvMetric) error {
 	for _, record := range records {
 		s := record.ConvertCsvMetric()
 		if err := wcsv.Write(s); err != nil {
-			log.Fatalln("error writing record to csv:", err)
+			return fmt.Errorf("error writing csv: %v", err)
 		}
 	}
 
-	// Write any buffered data to the underlying writer (standard output).
+	// Write any buffered data to the underlying writer.
 	wcsv.Flush()
 
 	if err := wcsv.Error(); err != nil {
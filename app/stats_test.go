@@ -0,0 +1,173 @@
+package app
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitReport receives reports until ok returns true for one of them.
+func waitReport(t *testing.T, reports chan *Report, ok func(*Report) bool) *Report {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-reports:
+			if ok(r) {
+				return r
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for report")
+		}
+	}
+}
+
+func TestStatsMonitorAggregatesConcurrentWorkers(t *testing.T) {
+	reports := make(chan *Report)
+	stats := StatsMonitor(WallClock, reports, 10*time.Millisecond)
+
+	const (
+		workersPerModel = 4
+		statsPerWorker  = 50
+	)
+	models := []string{"0", "1"}
+
+	var wg sync.WaitGroup
+	for _, mid := range models {
+		for i := 0; i < workersPerModel; i++ {
+			wl := &Workload{batchId: "b1", workerId: i, modelId: mid, modelName: "model" + mid}
+			// model "1" workers complete twice as many requests.
+			done, _ := strconv.Atoi(mid)
+			done++
+			wg.Add(1)
+			go func(wl *Workload, done int) {
+				defer wg.Done()
+				for j := 0; j < statsPerWorker; j++ {
+					stats <- &Stat{workload: wl, nreqSent: done + 1, nreqDone: done, dt: time.Second}
+				}
+			}(wl, done)
+		}
+	}
+	wg.Wait()
+
+	total := len(models) * workersPerModel * statsPerWorker
+	r := waitReport(t, reports, func(r *Report) bool { return r.requestDone == total*3/2 })
+
+	if r.batchId != "b1" {
+		t.Errorf("expected batch b1, got %s", r.batchId)
+	}
+	if r.requestSent != total*5/2 {
+		t.Errorf("expected %d sent, got %d", total*5/2, r.requestSent)
+	}
+	for i, mid := range models {
+		m := r.metrics[mid]
+		perWorker := i + 1
+		if want := workersPerModel * statsPerWorker * perWorker; m.reqComplete != want {
+			t.Errorf("model %s: expected %d complete, got %d", mid, want, m.reqComplete)
+		}
+		if want := workersPerModel * statsPerWorker * (perWorker + 1); m.reqSent != want {
+			t.Errorf("model %s: expected %d sent, got %d", mid, want, m.reqSent)
+		}
+		// Each worker's latest rate is summed, not overwritten.
+		if want := workersPerModel * perWorker; m.reqPerSec != want {
+			t.Errorf("model %s: expected %d req/s, got %d", mid, want, m.reqPerSec)
+		}
+		if r.modelNames[mid] != "model"+mid {
+			t.Errorf("model %s: expected name model%s, got %q", mid, mid, r.modelNames[mid])
+		}
+	}
+	if r.requestPerS != `{"0":4,"1":8}` {
+		t.Errorf("unexpected requestPerS %s", r.requestPerS)
+	}
+}
+
+func TestStatsMonitorDropsFinishedWorkers(t *testing.T) {
+	reports := make(chan *Report)
+	stats := StatsMonitor(WallClock, reports, 10*time.Millisecond)
+
+	a := &Workload{batchId: "b1", workerId: 0, modelId: "0"}
+	b := &Workload{batchId: "b1", workerId: 1, modelId: "0"}
+	stats <- &Stat{workload: a, nreqSent: 10, nreqDone: 10, dt: time.Second}
+	stats <- &Stat{workload: b, nreqSent: 20, nreqDone: 20, dt: 2 * time.Second}
+	r := waitReport(t, reports, func(r *Report) bool { return r.requestDone == 30 })
+	if got := r.metrics["0"].reqPerSec; got != 20 {
+		t.Errorf("expected 20 req/s, got %d", got)
+	}
+
+	stats <- &Stat{workload: a, nreqSent: 1, nreqDone: 1, dt: 100 * time.Millisecond, final: true}
+	r = waitReport(t, reports, func(r *Report) bool { return r.requestDone == 31 })
+	if got := r.metrics["0"].reqPerSec; got != 10 {
+		t.Errorf("expected 10 req/s after worker finished, got %d", got)
+	}
+}
+
+func TestStatsMonitorResetsOnNewBatch(t *testing.T) {
+	reports := make(chan *Report)
+	stats := StatsMonitor(WallClock, reports, 10*time.Millisecond)
+
+	stats <- &Stat{workload: &Workload{batchId: "b1", modelId: "0"}, nreqSent: 5, nreqDone: 5, dt: time.Second}
+	waitReport(t, reports, func(r *Report) bool { return r.batchId == "b1" && r.requestDone == 5 })
+
+	stats <- &Stat{workload: &Workload{batchId: "b2", modelId: "1"}, nreqSent: 2, nreqDone: 2, dt: time.Second}
+	r := waitReport(t, reports, func(r *Report) bool { return r.batchId == "b2" })
+	if r.requestDone != 2 || r.requestSent != 2 {
+		t.Errorf("expected counts to restart for new batch, got %d sent %d done", r.requestSent, r.requestDone)
+	}
+	if _, ok := r.metrics["0"]; ok {
+		t.Error("expected models from the previous batch to be dropped")
+	}
+}
+
+func TestWriteCsv(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteHeader(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	records := []*CsvMetric{
+		{ts, "b1", 42, "http://ops", "demo", "m1", 4, 10, 9, 3, 4, 2.5},
+		{ts, "b1", 42, "http://ops", "demo", "m, \"quoted\"", 4, 2, 1, 0, 0, 0},
+	}
+	if err := WriteCsv(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatalf("output is not valid csv: %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected header and 2 rows, got %d rows", len(rows))
+	}
+	header := []string{"timestamp", "batch_id", "seed", "ops_host", "ops_user", "model_name",
+		"workers", "requests_sent", "requests_completed", "requests_per_second", "users", "iterations_per_second"}
+	if len(rows[0]) != len(header) {
+		t.Errorf("expected %d columns, got %v", len(header), rows[0])
+	}
+	for i, h := range header {
+		if rows[0][i] != h {
+			t.Errorf("header column %d: expected %s, got %s", i, h, rows[0][i])
+		}
+	}
+	want := []string{"2015-06-01T12:00:00Z", "b1", "42", "http://ops", "demo", "m1", "4", "10", "9", "3", "4", "2.5"}
+	for i, v := range want {
+		if rows[1][i] != v {
+			t.Errorf("row 1 column %d: expected %s, got %s", i, v, rows[1][i])
+		}
+	}
+	if rows[2][5] != `m, "quoted"` {
+		t.Errorf("expected model name to survive quoting, got %s", rows[2][5])
+	}
+}
+
+func TestStatsMonitorTaps(t *testing.T) {
+	reports := make(chan *Report)
+	tap := make(chan *Report, 1)
+	stats := StatsMonitor(WallClock, reports, 10*time.Millisecond, tap)
+	stats <- &Stat{workload: &Workload{batchId: "b1", modelId: "0"}, nreqSent: 2, nreqDone: 1}
+
+	// The tap gets Reports though nobody receives on reports.
+	waitReport(t, tap, func(r *Report) bool { return r.batchId == "b1" && r.requestSent == 2 })
+}
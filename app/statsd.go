@@ -0,0 +1,209 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsD tag dialects.
+const (
+	DialectStatsd    = "statsd"
+	DialectDogStatsd = "dogstatsd"
+)
+
+// StatsdConfig configures the StatsD client workers report every request
+// to.
+type StatsdConfig struct {
+	// Address is the StatsD server's UDP host:port.
+	Address string `yaml:"address"`
+
+	// Prefix of every metric name. Defaults to sim.
+	Prefix string `yaml:"prefix,omitempty"`
+
+	// SampleRate is the fraction of requests reported, 1 by default.
+	SampleRate float64 `yaml:"sample_rate,omitempty"`
+
+	// Dialect is "statsd" (the default), which has no tags, or
+	// "dogstatsd", which tags metrics with the batch id, model id and
+	// target host and Tags.
+	Dialect string `yaml:"dialect,omitempty"`
+
+	// Tags are added to every metric in the dogstatsd dialect.
+	Tags map[string]string `yaml:"tags,omitempty"`
+}
+
+// statsdClient sends metrics to StatsD over UDP. Metrics are queued and
+// packed into datagrams by a goroutine, so workers never wait on the
+// network. Metrics are dropped when the queue is full.
+type statsdClient struct {
+	cfg  StatsdConfig
+	tags string
+	conn net.Conn
+
+	// mu guards closed against metrics queued while closing.
+	mu      sync.RWMutex
+	closed  bool
+	lines   chan string
+	dropped int64
+
+	done chan struct{}
+}
+
+// statsdFlushInterval bounds how long a metric waits for its datagram to
+// fill up.
+const statsdFlushInterval = 100 * time.Millisecond
+
+func newStatsd(cfg StatsdConfig) (*statsdClient, error) {
+	if cfg.Address == "" {
+		return nil, fmt.Errorf("statsd: address is required")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "sim"
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("statsd: sample_rate must be between 0 and 1, got %v", cfg.SampleRate)
+	}
+	switch cfg.Dialect {
+	case "":
+		cfg.Dialect = DialectStatsd
+	case DialectStatsd, DialectDogStatsd:
+	default:
+		return nil, fmt.Errorf("statsd: unknown dialect %q", cfg.Dialect)
+	}
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+
+	c := &statsdClient{
+		cfg:   cfg,
+		conn:  conn,
+		lines: make(chan string, 10000),
+		done:  make(chan struct{}),
+	}
+	var tags []string
+	for k, v := range cfg.Tags {
+		tags = append(tags, statsdName(k)+":"+statsdName(v))
+	}
+	sort.Strings(tags)
+	c.tags = strings.Join(tags, ",")
+	go c.loop()
+	return c, nil
+}
+
+// request reports a request of w's model: its latency and success, or
+// an error with the status code, "network" if there was no response.
+func (c *statsdClient) request(w *Workload, latency time.Duration, code string) {
+	if c.cfg.SampleRate < 1 && rand.Float64() >= c.cfg.SampleRate {
+		return
+	}
+	if code == "" {
+		c.send(w, "latency", strconv.FormatFloat(latency.Seconds()*1000, 'f', 3, 64), "ms")
+		c.send(w, "success", "1", "c")
+		return
+	}
+	c.send(w, "error."+statsdName(code), "1", "c")
+}
+
+func (c *statsdClient) send(w *Workload, metric, value, kind string) {
+	line := c.line(w, metric, value, kind)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.lines <- line:
+	default:
+		atomic.AddInt64(&c.dropped, 1)
+	}
+}
+
+// line formats a metric as prefix.model.metric:value|kind, with the
+// sample rate and dogstatsd tags if set.
+func (c *statsdClient) line(w *Workload, metric, value, kind string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s.%s.%s:%s|%s", c.cfg.Prefix, statsdName(w.modelName), metric, value, kind)
+	if c.cfg.SampleRate < 1 {
+		fmt.Fprintf(&b, "|@%g", c.cfg.SampleRate)
+	}
+	if c.cfg.Dialect == DialectDogStatsd {
+		fmt.Fprintf(&b, "|#batch_id:%s,model_id:%s,target_host:%s",
+			statsdName(w.batchId), statsdName(w.modelId), statsdName(w.opsHost))
+		if c.tags != "" {
+			b.WriteString("," + c.tags)
+		}
+	}
+	return b.String()
+}
+
+// statsdEscaper replaces the characters that delimit StatsD lines and
+// tags.
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_", "\n", "_")
+
+func statsdName(s string) string {
+	return statsdEscaper.Replace(s)
+}
+
+func (c *statsdClient) loop() {
+	defer close(c.done)
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet.Bytes()); err != nil {
+			log.Printf("statsd: %v", err)
+		}
+		packet.Reset()
+	}
+	for {
+		select {
+		case l, ok := <-c.lines:
+			if !ok {
+				flush()
+				return
+			}
+			if packet.Len() > 0 && packet.Len()+len(l)+1 > maxDatagram {
+				flush()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(l)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Close sends the queued metrics and closes the connection.
+func (c *statsdClient) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	close(c.lines)
+	c.mu.Unlock()
+	<-c.done
+	if dropped := atomic.LoadInt64(&c.dropped); dropped > 0 {
+		log.Printf("statsd: dropped %d metrics", dropped)
+	}
+	return c.conn.Close()
+}
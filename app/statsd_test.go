@@ -0,0 +1,114 @@
+package app
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+func TestStatsdLine(t *testing.T) {
+	w := testWorkload("http://ops:80", 1, nil)
+	w.modelName = "rent viz"
+	tests := []struct {
+		cfg  StatsdConfig
+		want string
+	}{
+		{StatsdConfig{}, "sim.rent_viz.latency:1.500|ms"},
+		{StatsdConfig{Prefix: "lt", SampleRate: 0.25}, "lt.rent_viz.latency:1.500|ms|@0.25"},
+		{
+			StatsdConfig{Dialect: DialectDogStatsd, Tags: map[string]string{"env": "ci", "dc": "us:east"}},
+			"sim.rent_viz.latency:1.500|ms|#batch_id:batch,model_id:0,target_host:http_//ops_80,dc:us_east,env:ci",
+		},
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	for _, tt := range tests {
+		tt.cfg.Address = pc.LocalAddr().String()
+		c, err := newStatsd(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.line(w, "latency", "1.500", "ms"); got != tt.want {
+			t.Errorf("expected %s, got %s", tt.want, got)
+		}
+		c.Close()
+	}
+
+	for _, cfg := range []StatsdConfig{
+		{},
+		{Address: "localhost:8125", SampleRate: 2},
+		{Address: "localhost:8125", Dialect: "influx"},
+	} {
+		if _, err := newStatsd(cfg); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
+
+func TestWorkerSendsStatsd(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{
+		Models: map[string]mockops.ModelConfig{"flaky": {ErrorRate: 1}},
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c, err := newStatsd(StatsdConfig{Address: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok := testWorkload(ts.URL, 3, nil)
+	flaky := testWorkload(ts.URL, 2, nil)
+	flaky.modelName = "flaky"
+	down := testWorkload("http://127.0.0.1:1", 1, nil)
+	down.modelName = "down"
+	stats := make(chan *Stat, 100)
+	for _, w := range []*Workload{ok, flaky, down} {
+		w.statsd = c
+		waitDone(t, Worker(stats, nil, w))
+	}
+	c.Close()
+
+	var lines []string
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for len(lines) < 9 {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %q before %v", lines, err)
+		}
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+	counts := make(map[string]int)
+	for _, l := range lines {
+		name := l[:strings.Index(l, ":")]
+		counts[name]++
+		if name == "sim.m1.latency" && !strings.HasSuffix(l, "|ms") {
+			t.Errorf("expected a timing, got %s", l)
+		}
+		if name != "sim.m1.latency" && !strings.HasSuffix(l, ":1|c") {
+			t.Errorf("expected a count, got %s", l)
+		}
+	}
+	want := map[string]int{
+		"sim.m1.latency":         3,
+		"sim.m1.success":         3,
+		"sim.flaky.error.500":    2,
+		"sim.down.error.network": 1,
+	}
+	for name, n := range want {
+		if counts[name] != n {
+			sort.Strings(lines)
+			t.Errorf("expected %d of %s, got lines %q", n, name, lines)
+		}
+	}
+}
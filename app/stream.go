@@ -0,0 +1,185 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// streamEvent is a StatsMonitor tick as sent to stream subscribers. Stats
+// and RDone are the same maps /stats returns.
+type streamEvent struct {
+	Time         time.Time              `json:"time"`
+	BatchId      string                 `json:"batch_id"`
+	RequestsSent int                    `json:"requests_sent"`
+	RequestsDone int                    `json:"requests_done"`
+	Models       map[string]streamModel `json:"models"`
+	Stats        map[string]int         `json:"stats"`
+	RDone        map[string]int         `json:"rdone"`
+}
+
+type streamModel struct {
+	Name string `json:"name"`
+	Sent int    `json:"sent"`
+	Done int    `json:"done"`
+	Rate int    `json:"rate"`
+}
+
+// statsHub broadcasts every StatsMonitor Report to the subscribers of the
+// stats stream. Unlike Reportc, which hands each Report to one reader,
+// every subscriber gets every tick.
+type statsHub struct {
+	clock Clock
+
+	// reports is tapped into the StatsMonitor.
+	reports chan *Report
+
+	mu   sync.Mutex
+	subs map[*subscriber]bool
+}
+
+// subscriber receives the events of one batch, or of every batch if
+// batchId is empty. Events are dropped for subscribers that fall behind.
+type subscriber struct {
+	batchId string
+	events  chan *streamEvent
+}
+
+func newStatsHub(clock Clock) *statsHub {
+	h := &statsHub{
+		clock:   clock,
+		reports: make(chan *Report, 1),
+		subs:    make(map[*subscriber]bool),
+	}
+	go h.loop()
+	return h
+}
+
+func (h *statsHub) loop() {
+	for r := range h.reports {
+		h.mu.Lock()
+		if len(h.subs) == 0 {
+			h.mu.Unlock()
+			continue
+		}
+		ev := newStreamEvent(h.clock.Now(), r)
+		for s := range h.subs {
+			if s.batchId != "" && s.batchId != ev.BatchId {
+				continue
+			}
+			select {
+			case s.events <- ev:
+			default:
+			}
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *statsHub) subscribe(batchId string) *subscriber {
+	s := &subscriber{batchId: batchId, events: make(chan *streamEvent, 16)}
+	h.mu.Lock()
+	h.subs[s] = true
+	h.mu.Unlock()
+	return s
+}
+
+func (h *statsHub) unsubscribe(s *subscriber) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+func newStreamEvent(now time.Time, r *Report) *streamEvent {
+	ev := &streamEvent{
+		Time:         now,
+		BatchId:      r.batchId,
+		RequestsSent: r.requestSent,
+		RequestsDone: r.requestDone,
+		Models:       make(map[string]streamModel, len(r.metrics)),
+		Stats:        make(map[string]int, len(r.metrics)),
+		RDone:        make(map[string]int, len(r.metrics)),
+	}
+	for id, m := range r.metrics {
+		ev.Models[id] = streamModel{
+			Name: r.modelNames[id],
+			Sent: m.reqSent,
+			Done: m.reqComplete,
+			Rate: m.reqPerSec,
+		}
+		ev.Stats[id] = m.reqPerSec
+		ev.RDone[id] = m.reqComplete
+	}
+	return ev
+}
+
+// handleStatsStream streams every StatsMonitor tick as Server-Sent Events
+// named stats. The batch_id form value limits the stream to one run.
+func (app *App) handleStatsStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusNotImplemented)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	s := app.hub.subscribe(r.FormValue("batch_id"))
+	defer app.hub.unsubscribe(s)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case ev := <-s.events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("error marshalling stats event: %v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: stats\ndata: %s\n\n", b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleStatsSocket streams the same events as handleStatsStream as
+// WebSocket text messages.
+func (app *App) handleStatsSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	s := app.hub.subscribe(ws.Request().FormValue("batch_id"))
+	defer app.hub.unsubscribe(s)
+
+	// The stream is one way, reading only notices the client leaving.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+	for {
+		select {
+		case ev := <-s.events:
+			if err := websocket.JSON.Send(ws, ev); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
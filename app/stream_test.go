@@ -0,0 +1,127 @@
+package app
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"golang.org/x/net/websocket"
+)
+
+// startLongRun starts a run that lasts until stopped and returns its batch
+// id.
+func startLongRun(t *testing.T, app *App) string {
+	_, ts := newMockOps(t, &mockops.Config{})
+	w := do(app, "POST", "/workload", url.Values{"spec": {`
+version: 1
+target: {host: "` + ts.URL + `", user: demo}
+run: {workers: 2}
+models:
+    - {model: m1, rate: 200}
+stages:
+    - {duration: 1h}
+`}})
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	return app.run.batchId
+}
+
+func readEvent(t *testing.T, sc *bufio.Scanner) *streamEvent {
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev streamEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatal(err)
+		}
+		return &ev
+	}
+	t.Fatalf("stream ended: %v", sc.Err())
+	return nil
+}
+
+func TestStatsStream(t *testing.T) {
+	app := newTestApp(t)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+	batchId := startLongRun(t, app)
+
+	resp, err := http.Get(srv.URL + "/stats/stream?batch_id=" + batchId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %s", ct)
+	}
+
+	// Stream the socket alongside, both get every tick.
+	origin := srv.URL
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stats/ws?batch_id="+batchId, "", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	sc := bufio.NewScanner(resp.Body)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ev := readEvent(t, sc)
+		if ev.BatchId != batchId {
+			t.Fatalf("expected events of %s only, got %s", batchId, ev.BatchId)
+		}
+		if m, ok := ev.Models["0"]; ok && m.Done > 0 {
+			if m.Name != "m1" || ev.RDone["0"] != m.Done || ev.RequestsDone < m.Done {
+				t.Errorf("inconsistent event %+v", ev)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for requests in the stream")
+		}
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ev streamEvent
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.BatchId != batchId {
+		t.Errorf("expected a socket event of %s, got %+v", batchId, ev)
+	}
+
+	// Polling /stats doesn't take ticks from the streams.
+	do(app, "GET", "/stats", nil)
+	readEvent(t, sc)
+}
+
+func TestStatsStreamFiltersRuns(t *testing.T) {
+	app := newTestApp(t)
+	startLongRun(t, app)
+	s := app.hub.subscribe("other")
+	defer app.hub.unsubscribe(s)
+	all := app.hub.subscribe("")
+	defer app.hub.unsubscribe(all)
+
+	select {
+	case <-all.events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	select {
+	case ev := <-s.events:
+		t.Errorf("expected no events of other runs, got %+v", ev)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"math"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// thresholdResult is a threshold of the workload checked against one
+// model of a finished run.
+type thresholdResult struct {
+	Metric string `json:"metric"`
+	Model  string `json:"model"`
+	Min    string `json:"min,omitempty"`
+	Max    string `json:"max,omitempty"`
+
+	// Value of the metric, in the units of workload.Threshold.Bounds.
+	Value  float64 `json:"value"`
+	Passed bool    `json:"passed"`
+}
+
+// checkThresholds checks the spec's thresholds against the run summary s.
+// A threshold without a model is checked against every model.
+func checkThresholds(spec *workload.Spec, s *runSummary) []thresholdResult {
+	results := []thresholdResult{}
+	for _, t := range spec.Thresholds {
+		min, max, err := t.Bounds()
+		if err != nil {
+			// Validation rejects these before the run starts.
+			continue
+		}
+		for _, m := range s.Models {
+			if t.Model != "" && t.Model != m.ID && t.Model != m.Model {
+				continue
+			}
+			v := metricValue(t.Metric, m)
+			results = append(results, thresholdResult{
+				Metric: t.Metric,
+				Model:  m.ID,
+				Min:    t.Min,
+				Max:    t.Max,
+				Value:  v,
+				Passed: (math.IsNaN(min) || v >= min) && (math.IsNaN(max) || v <= max),
+			})
+		}
+	}
+	return results
+}
+
+// thresholdsPassed reports whether every threshold result passed.
+func thresholdsPassed(results []thresholdResult) bool {
+	for _, r := range results {
+		if !r.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func metricValue(metric string, m modelSummary) float64 {
+	switch metric {
+	case workload.MetricMean:
+		return m.Latency.Mean
+	case workload.MetricP50:
+		return m.Latency.P50
+	case workload.MetricP90:
+		return m.Latency.P90
+	case workload.MetricP95:
+		return m.Latency.P95
+	case workload.MetricP99:
+		return m.Latency.P99
+	case workload.MetricMax:
+		return m.Latency.Max
+	case workload.MetricErrorRate:
+		return m.ErrorRate
+	case workload.MetricRate:
+		return m.Rate
+	}
+	return math.NaN()
+}
@@ -0,0 +1,49 @@
+package app
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// userSession paces a worker as a virtual user. The user joins join after
+// the worker starts and leaves leave after, if set, and thinks between a
+// response and its next request.
+type userSession struct {
+	join, leave        time.Duration
+	thinkMin, thinkMax time.Duration
+}
+
+// newUserSession returns the session of worker i of run, nil if the run
+// has no virtual users. Users join at even intervals over the ramp up and
+// leave at even intervals over the ramp down, the last to join first.
+func newUserSession(run workload.Run, i int) *userSession {
+	u := run.Users
+	if u == nil {
+		return nil
+	}
+	n := time.Duration(run.Workers)
+	s := &userSession{join: time.Duration(u.RampUp) * time.Duration(i) / n}
+	s.thinkMin, s.thinkMax = u.Think()
+	if u.RampDown > 0 {
+		down := time.Duration(u.RampDown)
+		s.leave = time.Duration(run.Duration) - down + down*(n-1-time.Duration(i))/n
+	}
+	return s
+}
+
+// think returns how long the user thinks before its next request.
+func (s *userSession) think(rnd *rand.Rand) time.Duration {
+	if s.thinkMax <= s.thinkMin {
+		return s.thinkMin
+	}
+	return s.thinkMin + time.Duration(rnd.Int63n(int64(s.thinkMax-s.thinkMin)+1))
+}
+
+// rampedDown reports whether a run with virtual users that lasted d ended
+// in its ramp down, the users having left.
+func rampedDown(run workload.Run, d time.Duration) bool {
+	u := run.Users
+	return u != nil && u.RampDown > 0 && d >= time.Duration(run.Duration-u.RampDown)
+}
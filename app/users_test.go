@@ -0,0 +1,134 @@
+package app
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func TestUserSession(t *testing.T) {
+	run := workload.Run{
+		Workers:  4,
+		Duration: workload.Duration(20 * time.Second),
+		Users: &workload.Users{
+			ThinkMin: workload.Duration(time.Second),
+			ThinkMax: workload.Duration(3 * time.Second),
+			RampUp:   workload.Duration(4 * time.Second),
+			RampDown: workload.Duration(4 * time.Second),
+		},
+	}
+	for i := 0; i < 4; i++ {
+		s := newUserSession(run, i)
+		join, leave := time.Duration(i)*time.Second, time.Duration(19-i)*time.Second
+		if s.join != join || s.leave != leave {
+			t.Errorf("user %d: expected to join at %v and leave at %v, got %v and %v", i, join, leave, s.join, s.leave)
+		}
+	}
+	s, rnd := newUserSession(run, 0), rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if d := s.think(rnd); d < time.Second || d > 3*time.Second {
+			t.Fatalf("expected think times from 1s to 3s, got %v", d)
+		}
+	}
+	run.Users = nil
+	if s := newUserSession(run, 0); s != nil {
+		t.Errorf("expected no session without users, got %+v", s)
+	}
+}
+
+func TestVirtualUsers(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	app.config.ReportSinks = []SinkConfig{{Format: FormatCsv}}
+	r := runSpec(t, app, `
+version: 1
+target: {host: "`+ts.URL+`", user: demo}
+run:
+    workers: 3
+    seed: 1
+    duration: 1500ms
+    users: {think_min: 50ms, think_max: 100ms, ramp_up: 300ms, ramp_down: 300ms}
+models:
+    - {model: m1}
+`)
+	if r.outcome != outcomeCompleted || r.summary.StopReason != stopRampDown {
+		t.Errorf("expected the users to leave over the ramp down, got %s by %s", r.outcome, r.summary.StopReason)
+	}
+	m := r.summary.Models[0]
+	// Each user thinks at least 50ms between requests, for at most 1.4s.
+	if m.Users != 3 || m.Sent == 0 || m.Sent > 3*28+3 || m.IterationRate <= 0 {
+		t.Errorf("expected 3 users pacing their requests, got %+v", m)
+	}
+	peak, last := 0, -1
+	for _, p := range r.points {
+		if p.Users > peak {
+			peak = p.Users
+		}
+		last = p.Users
+	}
+	if peak != 3 || last != 0 {
+		t.Errorf("expected up to 3 active users and none at the end, got %d and %d", peak, last)
+	}
+
+	b, err := ioutil.ReadFile(reportPath(app.config.ReportDir, r.batchId))
+	if err != nil {
+		t.Fatalf("expected a report file: %v", err)
+	}
+	for _, s := range []string{"Virtual users", "Active users", "thinks for 50ms to 100ms"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("expected the report to contain %q", s)
+		}
+	}
+	points, err := app.history.points(r.batchId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, iterations := 0, 0
+	for _, p := range points {
+		if p.Users > stored {
+			stored = p.Users
+		}
+		iterations += p.Iterations
+	}
+	if stored != 3 || iterations != m.Done+m.Failed {
+		t.Errorf("expected the history to keep the active users and their %d iterations, got at most %d and %d",
+			m.Done+m.Failed, stored, iterations)
+	}
+
+	f, err := os.Open(filepath.Join(app.config.ReportDir, "workload_data_"+r.batchId+".csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The collector has a point every second the users are active, even
+	// the ones they all spend thinking.
+	if len(rows) != len(points)+1 {
+		t.Errorf("expected a row per point, got %d rows for %d points", len(rows)-1, len(points))
+	}
+	peak, rate := 0, 0.0
+	for _, row := range rows[1:] {
+		users, _ := strconv.Atoi(row[10])
+		iterPerSec, _ := strconv.ParseFloat(row[11], 64)
+		if users > peak {
+			peak = users
+		}
+		rate = math.Max(rate, iterPerSec)
+	}
+	if peak != 3 || rate <= 0 {
+		t.Errorf("expected rows of up to 3 users finishing iterations, got %d users and %g/s", peak, rate)
+	}
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// plan is a validated workload, ready to be run.
+type plan struct {
+	spec *workload.Spec
+
+	// Seed the run's randomness is drawn from, the spec's or a new one.
+	seed int64
+
+	// name of the run, the workload's name or its name in the library.
+	name string
+}
+
+// parseWorkload converts the UI's json-encoded workload and settings form
+// values and checks them. It returns every problem found, and a nil plan if
+// there were any.
+func (app *App) parseWorkload(wl, s string) (*plan, workload.Problems) {
+	spec, problems := workload.FromLegacy(wl, s)
+	if problems != nil {
+		return nil, problems
+	}
+	return app.checkSpec(spec)
+}
+
+// parseSpec decodes and checks a workload file.
+func (app *App) parseSpec(content string) (*plan, workload.Problems) {
+	spec, err := workload.Parse([]byte(content))
+	if err != nil {
+		if problems, ok := err.(workload.Problems); ok {
+			return nil, problems
+		}
+		return nil, workload.Problems{{Field: "spec", Message: err.Error()}}
+	}
+	return app.checkSpec(spec)
+}
+
+// parseNamed reads and checks a workload from the library, its latest
+// version if version is empty.
+func (app *App) parseNamed(name, version string) (*plan, workload.Problems) {
+	if app.library == nil {
+		return nil, workload.Problems{{Field: "name", Message: "no workload library configured"}}
+	}
+	v := 0
+	if version != "" {
+		var err error
+		if v, err = strconv.Atoi(version); err != nil {
+			return nil, workload.Problems{{Field: "version", Message: fmt.Sprintf("%q is not an integer", version)}}
+		}
+	}
+	spec, _, err := app.library.GetVersion(name, v)
+	if err != nil {
+		if problems, ok := err.(workload.Problems); ok {
+			return nil, problems
+		}
+		return nil, workload.Problems{{Field: "name", Message: fmt.Sprintf("%s: %v", name, err)}}
+	}
+	p, problems := app.checkSpec(spec)
+	if p != nil && p.name == "" {
+		p.name = name
+	}
+	return p, problems
+}
+
+// checkSpec validates spec against the workload rules and this app's
+// limits.
+func (app *App) checkSpec(spec *workload.Spec) (*plan, workload.Problems) {
+	problems := spec.Validate()
+	if max := app.config.MaxWorkers; max > 0 && spec.Run.Workers > max {
+		problems = append(problems, workload.Problem{
+			Field:   "run.workers",
+			Message: fmt.Sprintf("can't be more than %d, got %d", max, spec.Run.Workers),
+		})
+	} else if n := spec.Run.Workers * len(spec.Models); max > 0 && spec.Run.Adaptive && spec.Search == nil && n > max {
+		problems = append(problems, workload.Problem{
+			Field:   "run.workers",
+			Message: fmt.Sprintf("the %d models can grow to %d workers, more than %d", len(spec.Models), n, max),
+		})
+	}
+	if t, err := spec.Run.StopTime(); err == nil && !t.IsZero() && !t.After(app.clock.Now()) {
+		problems = append(problems, workload.Problem{
+			Field:   "run.stop_at",
+			Message: fmt.Sprintf("%s has passed", spec.Run.StopAt),
+		})
+	}
+	if problems != nil {
+		return nil, problems
+	}
+
+	seed := spec.Run.Seed
+	if seed == 0 {
+		var err error
+		if seed, err = newSeed(); err != nil {
+			return nil, workload.Problems{{Field: "run.seed", Message: err.Error()}}
+		}
+	}
+	return &plan{spec: spec, seed: seed, name: spec.Metadata.Name}, nil
+}
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+func validate(t *testing.T, app *App, wl, settings string) (bool, []workload.Problem) {
+	w := do(app, "POST", "/workload/validate", workloadForm(wl, settings))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Valid    bool
+		Problems []workload.Problem
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Valid, resp.Problems
+}
+
+// fields reduces problems to window/field pairs for comparison.
+func fields(problems []workload.Problem) [][2]string {
+	out := make([][2]string, len(problems))
+	for i, p := range problems {
+		out[i] = [2]string{p.Window, p.Field}
+		if p.Message == "" {
+			out[i][1] += " (no message)"
+		}
+	}
+	return out
+}
+
+func TestValidateWorkload(t *testing.T) {
+	good := testSettings("http://ops.example.com", "4")
+	tests := []struct {
+		name     string
+		workload string
+		settings string
+		want     [][2]string
+	}{
+		{"valid", twoWindows, good, [][2]string{}},
+		{"bad workload json", `[1, 2]`, good, [][2]string{{"", "workload"}}},
+		{"bad workload and settings json", `{`, `{`, [][2]string{{"", "workload"}, {"", "settings"}}},
+		{"empty workload", `{}`, good, [][2]string{{"", "models"}}},
+		{
+			"unparseable window fields",
+			`{
+				"0": {"query": "", "qps": "5"},
+				"1": {"query": "{\"model\": \"m\"}", "qps": "5"},
+				"2": {"query": "{\"model\": \"m\"", "qps": "12.5", "rate": "fast"},
+				"10": "not a window"
+			}`,
+			good,
+			[][2]string{{"0", "query"}, {"2", "query"}, {"2", "qps"}, {"2", "rate"}, {"10", "window"}},
+		},
+		{
+			"invalid window fields",
+			`{
+				"1": {"query": "{\"input\": {}}", "qps": "0"},
+				"3": {"query": "{\"model\": \"m\"}", "qps": "5", "rate": "-2"},
+				"4": {"query": "{\"model\": \"m\"}", "qps": "5", "rate": "2.5"}
+			}`,
+			good,
+			[][2]string{{"1", "model"}, {"1", "requests"}, {"3", "rate"}},
+		},
+		{
+			"unparseable settings",
+			twoWindows,
+			`{"ops_host": "http://ops.example.com", "workers": "x", "seed": "y"}`,
+			[][2]string{{"", "workers"}, {"", "seed"}},
+		},
+		{
+			"invalid settings",
+			twoWindows,
+			`{"ops_host": "ops.example.com", "workers": "500", "arrival": "bursty"}`,
+			[][2]string{{"", "target.host"}, {"", "target.user"}, {"", "run.arrival"}, {"", "run.workers"}},
+		},
+		{"no workers", twoWindows, testSettings("http://ops.example.com", "0"), [][2]string{{"", "run.workers"}}},
+		{"missing host", twoWindows, testSettings("", "2"), [][2]string{{"", "target.host"}}},
+	}
+	app := newTestApp(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, problems := validate(t, app, tt.workload, tt.settings)
+			if valid != (len(tt.want) == 0) {
+				t.Errorf("expected valid to be %v", len(tt.want) == 0)
+			}
+			if got := fields(problems); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected problems %v, got %v", tt.want, problems)
+			}
+		})
+	}
+}
+
+func TestValidateSpec(t *testing.T) {
+	app := newTestApp(t)
+	spec := `
+version: 1
+target: {host: "http://ops.example.com", user: demo}
+run: {workers: 2}
+models:
+    - {model: m1, requests: 5}
+    - {model: m2}
+thresholds:
+    - {metric: p42, max: 1s}
+`
+	w := do(app, "POST", "/workload/validate", url.Values{"spec": {spec}})
+	var resp struct {
+		Valid    bool
+		Problems []workload.Problem
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"1", "requests"}, {"", "thresholds[0].metric"}}
+	if resp.Valid || !reflect.DeepEqual(fields(resp.Problems), want) {
+		t.Errorf("expected problems %v, got %v", want, resp.Problems)
+	}
+}
+
+func TestHandleWorkloadReportsProblems(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	wl := `{
+		"0": {"query": "{\"model\": \"m1\"}", "qps": "5"},
+		"1": {"query": "{\"model\": \"m1\"}", "qps": "lots"}
+	}`
+	w := do(app, "POST", "/workload", workloadForm(wl, testSettings(ts.URL, "2")))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	var resp struct {
+		Running  bool
+		Problems []workload.Problem
+		Error    struct{ Message string }
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []workload.Problem{{Window: "1", Field: "qps", Message: `"lots" is not an integer`}}
+	if !reflect.DeepEqual(resp.Problems, want) {
+		t.Errorf("expected %v, got %v", want, resp.Problems)
+	}
+	if resp.Error.Message != `window 1: qps: "lots" is not an integer` {
+		t.Errorf("unexpected error message %q", resp.Error.Message)
+	}
+	// The valid window must not have been started either.
+	if running(app) || len(reportFiles(t, app)) != 0 {
+		t.Error("expected nothing to run when any window is invalid")
+	}
+}
+
+func TestHandleWorkloadRunsSpecStages(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{})
+	app := newTestApp(t)
+	spec := `
+version: 1
+target: {host: "` + ts.URL + `", user: demo, apikey: abc123}
+run: {workers: 2, seed: 7}
+models:
+    - {model: m1, rate: 200}
+stages:
+    - {duration: 50ms, scale: 0.5}
+    - {duration: 50ms}
+`
+	w := do(app, "POST", "/workload", url.Values{"spec": {spec}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if data := decodeJSON(t, w); data["seed"] != "7" {
+		t.Errorf("expected the spec's seed, got %v", data["seed"])
+	}
+	// Models without a request count run until the last stage ends.
+	waitFinished(t, app)
+	if got := m.Stats()["m1"].Received; got == 0 || got > 2*200/10 {
+		t.Errorf("expected a paced number of requests over 100ms, got %d", got)
+	}
+}
+
+func TestHandleLoad(t *testing.T) {
+	app := newTestApp(t)
+	spec := `
+version: 1
+target: {host: "http://ops.example.com", user: demo}
+run: {workers: 3, seed: 11}
+models:
+    - {id: "0", model: m1, requests: 5, input: {x: 1}}
+stages:
+    - {duration: 1m}
+`
+	w := do(app, "POST", "/workload/load", url.Values{"spec": {spec}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Workload map[string]map[string]string
+		Settings map[string]interface{}
+		Warnings []string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if q := resp.Workload["0"]; q["qps"] != "5" || q["query"] != `{"input":{"x":1},"model":"m1"}` {
+		t.Errorf("unexpected window %v", q)
+	}
+	if resp.Settings["workers"] != "3" || resp.Settings["seed"] != "11" {
+		t.Errorf("unexpected settings %v", resp.Settings)
+	}
+	if len(resp.Warnings) != 1 {
+		t.Errorf("expected a warning about stages, got %v", resp.Warnings)
+	}
+
+	// The loaded form runs as the same workload.
+	wl, _ := json.Marshal(resp.Workload)
+	settings, _ := json.Marshal(resp.Settings)
+	if ok, problems := validate(t, app, string(wl), string(settings)); !ok {
+		t.Errorf("expected loaded workload to be valid, got %v", problems)
+	}
+
+	w = do(app, "POST", "/workload/load", url.Values{"spec": {"version: 3"}})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an unsupported version, got %d", w.Code)
+	}
+}
@@ -1,13 +1,17 @@
 package app
 
 import (
-	"crypto/rand"
+	crand "crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -18,6 +22,9 @@ type Workload struct {
 	batchId  string
 	workerId int
 
+	// seed of the run this worker belongs to.
+	seed int64
+
 	// remote ops server info
 	opsHost string
 	apiKey  string
@@ -28,11 +35,61 @@ type Workload struct {
 	modelId    string
 	modelName  string
 	modelInput map[string]interface{}
+
+	// payloads, if set, are chosen from at random instead of modelInput.
+	payloads []map[string]interface{}
+
+	// steps, if set, are the model's scenario, sent instead of a request
+	// to the model.
+	steps []scenarioStep
+
+	// clock drives the reporting window and arrivals, nil uses the wall
+	// clock.
+	clock Clock
+
+	// rnd is the worker's source for arrival gaps and generated payloads.
+	// It is seeded from the run seed so runs can be replayed.
+	rnd *rand.Rand
+
+	// arrival process and per worker rate in requests per second. A zero
+	// rate sends requests back to back. scale, if set, is the run's rate
+	// multiplier.
+	arrival string
+	rate    float64
+	scale   *rateScale
+
+	// generated is set when modelInput has random value placeholders.
+	generated bool
+
+	// statsd, if set, is sent every request's outcome.
+	statsd *statsdClient
+
+	// budgets the worker spends a request of before each it sends, and
+	// stops when one runs out. They are shared with other workers.
+	budgets []*budget
+
+	// session, if set, paces the worker as a virtual user instead of by
+	// its rate.
+	session *userSession
 }
 
 // Predict sends a POST request to an ops model endpoint.
 func (w *Workload) Predict() error {
-	data := w.modelInput
+	_, err := w.predict()
+	return err
+}
+
+// predict sends a prediction request and returns the status Ops answered
+// with, zero if there was no response.
+func (w *Workload) predict() (int, error) {
+	input := w.modelInput
+	if len(w.payloads) > 0 {
+		input = w.payloads[w.rnd.Intn(len(w.payloads))]
+	}
+	var data interface{} = input
+	if w.generated {
+		data = generate(input, w.rnd)
+	}
 
 	// Make a prediciton to this remote host.
 	username := w.user
@@ -40,54 +97,180 @@ func (w *Workload) Predict() error {
 	apikey := w.apiKey
 	host := w.opsHost
 
-	_, err := opsPredictHTTP(username, modelname, apikey, host, data)
+	resp, err := opsPredictHTTP(username, modelname, apikey, host, data, nil)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
 	if err != nil {
-		return fmt.Errorf("yhat prediction failed: %v", err)
+		return status, fmt.Errorf("yhat prediction failed: %v", err)
 	}
-	return nil
+	return status, nil
 }
 
 // Worker func that spawns a goroutine that does work and emits statistics to a stats
-// channel every period duration seconds.
-func Worker(stats chan *Stat, kill <-chan int, w *Workload) {
-	// TODO add predicitons made vs pred completed.
+// channel every period duration seconds. The returned channel is closed when the
+// goroutine exits, either because the work is done or kill was signaled.
+func Worker(stats chan *Stat, kill <-chan int, w *Workload) <-chan struct{} {
 	id := w.workerId
 	batchId := w.batchId
 	dt := w.dt
+	clock := w.clock
+	if clock == nil {
+		clock = WallClock
+	}
+	if w.rnd == nil {
+		w.rnd = rand.New(rand.NewSource(clock.Now().UnixNano()))
+	}
+	w.generated = hasPlaceholders(w.modelInput)
+	for _, p := range w.payloads {
+		w.generated = w.generated || hasPlaceholders(p)
+	}
+	schedule, err := newArrivals(w.arrival, w.rate, w.rnd, w.scale)
+	if err != nil {
+		log.Printf("worker id: %d: %v, sending requests unpaced", id, err)
+	}
+	done := make(chan struct{})
 	go func(id int, batchId string, n int, dt time.Duration) {
-		predCount := 0
+		defer close(done)
 		predSent := 0
-		ticker := time.NewTicker(dt)
-		for i := 0; i < n; i++ {
-			predSent += 1
+		predCount := 0
+		predFailed := 0
+		latency := newHistogram()
+		steps := newStepCounts(len(w.steps))
+		last := clock.Now()
+		next := last
+		ticker := clock.NewTicker(dt)
+		defer ticker.Stop()
+
+		// Virtual users wait to join and think between requests, and
+		// leave at their session's end. active is set once the user has
+		// joined, and joined while it is to be reported.
+		paced := schedule != nil || w.session != nil
+		active, joined := false, 0
+		var leave time.Time
+		if s := w.session; s != nil {
+			next = next.Add(s.join)
+			if s.leave > 0 {
+				leave = last.Add(s.leave)
+			}
+		}
+
+		// flush sends the counts collected since the last report.
+		flush := func(final bool) {
+			now := clock.Now()
+			left := 0
+			if final && active {
+				left = 1
+			}
+			stats <- &Stat{
+				workload:   w,
+				nreqSent:   predSent,
+				nreqDone:   predCount,
+				nreqFailed: predFailed,
+				latency:    latency,
+				steps:      steps,
+				dt:         now.Sub(last),
+				at:         now,
+				final:      final,
+				joined:     joined,
+				left:       left,
+			}
+			joined = 0
+			predSent = 0
+			predCount = 0
+			predFailed = 0
+			latency = newHistogram()
+			steps = newStepCounts(len(w.steps))
+			last = now
+		}
+
+		for i := 0; i < n; {
+			if !leave.IsZero() && !clock.Now().Before(leave) {
+				log.Printf("worker id: %d: virtual user leaving after %d requests", id, i)
+				break
+			}
+			// Wait for the next scheduled arrival. Arrivals are scheduled
+			// from the previous one rather than from when a request
+			// returned, so a slow target doesn't lower the offered rate.
+			if paced {
+				if d := next.Sub(clock.Now()); d > 0 {
+					if !leave.IsZero() && leave.Sub(clock.Now()) < d {
+						d = leave.Sub(clock.Now())
+					}
+					select {
+					case <-ticker.C():
+						flush(false)
+					case <-kill:
+						flush(true)
+						log.Printf("worker id: %d: SIGKILL good-bye!!!", id)
+						return
+					case <-clock.After(d):
+					}
+					continue
+				}
+			}
+			if w.session != nil && !active {
+				active, joined = true, 1
+			}
 			select {
-			case <-ticker.C:
-				// send stats and reset request counter
-				// TODO: add predSent to Stat struct
-				s := &Stat{w, predSent, predCount}
-				stats <- s
-				predCount = 0
+			case <-ticker.C():
+				// send stats and reset request counters
+				flush(false)
 			case <-kill:
+				flush(true)
 				log.Printf("worker id: %d: SIGKILL good-bye!!!", id)
 				return
 			default:
-				// Do work and increment counter
-				err := w.Predict()
+				if !takeAll(w.budgets) {
+					flush(true)
+					log.Printf("worker id: %d: request budget spent after %d requests", id, i)
+					return
+				}
+				// Do work and increment counters
+				i++
+				predSent += 1
+				if schedule != nil {
+					next = next.Add(schedule.gap())
+				}
+				start := clock.Now()
+				status, results, err := w.send()
+				took := clock.Now().Sub(start)
+				recordSteps(steps, results)
+				if w.session != nil {
+					next = clock.Now().Add(w.session.think(w.rnd))
+				}
 				if err != nil {
 					log.Printf("Prediction error: %v\n", err)
-					return
+					predFailed += 1
+					if w.statsd != nil {
+						code := "network"
+						if status != 0 {
+							code = strconv.Itoa(status)
+						}
+						w.statsd.request(w, took, code)
+					}
+					continue
 				}
+				// Only successful requests count towards latency, so
+				// quick errors don't flatter the distribution.
+				latency.record(took)
 				predCount += 1
+				if w.statsd != nil {
+					w.statsd.request(w, took, "")
+				}
 			}
 		}
+		flush(true)
 		// exit goroutine when work is done.
 		log.Printf("worker id: %d: Done making %d requests dying!!!", id, n)
-		return
 	}(id, batchId, w.nrequests, dt)
-	return
+	return done
 }
 
-func opsPredictHTTP(username, model, apikey, host string, input interface{}) (*http.Response, error) {
+// opsPredictHTTP sends input to a model and, if out is set, decodes the
+// model's JSON response into it.
+func opsPredictHTTP(username, model, apikey, host string, input, out interface{}) (*http.Response, error) {
 	url := host + "/" + username + "/models/" + model + "/"
 	b, err := json.Marshal(input)
 	if err != nil {
@@ -97,7 +280,7 @@ func opsPredictHTTP(username, model, apikey, host string, input interface{}) (*h
 
 	req, err := http.NewRequest("POST", url, strings.NewReader(sinput))
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("could not create ops request: %v", err)
 	}
 	req.SetBasicAuth(username, apikey)
 	req.Header.Set("Content-Type", "application/json")
@@ -107,12 +290,31 @@ func opsPredictHTTP(username, model, apikey, host string, input interface{}) (*h
 		return nil, fmt.Errorf("ops prediction request failed: %v", err)
 	}
 	defer resp.Body.Close()
+	// Drain the body so the connection can be reused.
+	defer io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return resp, fmt.Errorf("ops returned status %d", resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, fmt.Errorf("ops returned invalid json: %v", err)
+		}
+	}
 	return resp, nil
 }
 
+// newSeed returns a random run seed.
+func newSeed() (int64, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b) >> 1), nil
+}
+
 func uuid() (string, error) {
 	b := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
 		return "", err
 	}
 	return hex.EncodeToString(b), nil
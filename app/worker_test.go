@@ -0,0 +1,321 @@
+package app
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/yhat/workload-simulator/mockops"
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// gatedTarget is an Ops stand-in that holds every request until the test
+// releases it.
+type gatedTarget struct {
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func newGatedTarget() (*gatedTarget, *httptest.Server) {
+	g := &gatedTarget{
+		arrived: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	return g, httptest.NewServer(g)
+}
+
+func (g *gatedTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.arrived <- struct{}{}
+	<-g.release
+	w.Write([]byte(`{"result": {}}`))
+}
+
+// serve lets n requests through.
+func (g *gatedTarget) serve(n int) {
+	for i := 0; i < n; i++ {
+		<-g.arrived
+		g.release <- struct{}{}
+	}
+}
+
+func newMockOps(t *testing.T, cfg *mockops.Config) (*mockops.Server, *httptest.Server) {
+	m := mockops.New(cfg)
+	ts := httptest.NewServer(m)
+	t.Cleanup(ts.Close)
+	return m, ts
+}
+
+func testWorkload(host string, n int, clock Clock) *Workload {
+	return &Workload{
+		dt:         time.Second,
+		batchId:    "batch",
+		workerId:   7,
+		opsHost:    host,
+		apiKey:     "abc123",
+		user:       "demo",
+		nrequests:  n,
+		modelId:    "0",
+		modelName:  "m1",
+		modelInput: map[string]interface{}{"x": 1},
+		clock:      clock,
+	}
+}
+
+func receiveStat(t *testing.T, stats chan *Stat) *Stat {
+	select {
+	case s := <-stats:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a stat")
+	}
+	return nil
+}
+
+func waitDone(t *testing.T, done <-chan struct{}) {
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for worker to exit")
+	}
+}
+
+func TestWorkerReportsEachWindow(t *testing.T) {
+	g, ts := newGatedTarget()
+	defer ts.Close()
+	clock := newFakeClock()
+	stats := make(chan *Stat)
+	kill := make(chan int)
+
+	done := Worker(stats, kill, testWorkload(ts.URL, 5, clock))
+
+	// Three requests complete, then the window closes while the fourth is
+	// in flight. The worker reports once the fourth returns.
+	g.serve(3)
+	<-g.arrived
+	clock.Advance(time.Second)
+	g.release <- struct{}{}
+
+	s := receiveStat(t, stats)
+	if s.nreqSent != 4 || s.nreqDone != 4 {
+		t.Errorf("expected 4 sent and 4 done, got %d sent and %d done", s.nreqSent, s.nreqDone)
+	}
+	if s.dt != time.Second {
+		t.Errorf("expected a 1s window, got %v", s.dt)
+	}
+	if s.final {
+		t.Error("first stat should not be final")
+	}
+
+	// The last request is flushed when the worker finishes.
+	g.serve(1)
+	s = receiveStat(t, stats)
+	if s.nreqSent != 1 || s.nreqDone != 1 || !s.final {
+		t.Errorf("expected final stat with 1 sent and 1 done, got %+v", s)
+	}
+	waitDone(t, done)
+}
+
+func TestWorkerMakesExactlyNRequests(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{})
+	clock := newFakeClock()
+	stats := make(chan *Stat)
+
+	done := Worker(stats, make(chan int), testWorkload(ts.URL, 25, clock))
+	s := receiveStat(t, stats)
+	waitDone(t, done)
+
+	if s.nreqSent != 25 || s.nreqDone != 25 || !s.final {
+		t.Errorf("expected final stat with 25 sent and 25 done, got %+v", s)
+	}
+	if got := m.Stats()["m1"].Received; got != 25 {
+		t.Errorf("expected target to receive 25 requests, got %d", got)
+	}
+}
+
+func TestWorkerKeepsGoingOnErrors(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{
+		Default: mockops.ModelConfig{ErrorRate: 1, ErrorCodes: []int{503}},
+	})
+	stats := make(chan *Stat)
+
+	done := Worker(stats, make(chan int), testWorkload(ts.URL, 10, newFakeClock()))
+	s := receiveStat(t, stats)
+	waitDone(t, done)
+
+	if s.nreqSent != 10 || s.nreqDone != 0 {
+		t.Errorf("expected 10 sent and 0 done, got %d sent and %d done", s.nreqSent, s.nreqDone)
+	}
+	if got := m.Stats()["m1"].Statuses[503]; got != 10 {
+		t.Errorf("expected 10 503s from target, got %d", got)
+	}
+}
+
+func TestWorkerStopsOnKill(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{})
+	stats := make(chan *Stat)
+	kill := make(chan int)
+
+	done := Worker(stats, kill, testWorkload(ts.URL, 1<<30, newFakeClock()))
+	time.Sleep(20 * time.Millisecond)
+	close(kill)
+
+	s := receiveStat(t, stats)
+	if !s.final {
+		t.Error("expected a final stat after kill")
+	}
+	waitDone(t, done)
+
+	received := m.Stats()["m1"].Received
+	if received == 0 || received != s.nreqSent {
+		t.Errorf("expected target to receive the %d requests sent, got %d", s.nreqSent, received)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := m.Stats()["m1"].Received; got != received {
+		t.Errorf("requests kept arriving after kill: %d then %d", received, got)
+	}
+}
+
+func TestOpsPredictHTTPAuth(t *testing.T) {
+	_, ts := newMockOps(t, &mockops.Config{Users: map[string]string{"demo": "abc123"}})
+
+	if _, err := opsPredictHTTP("demo", "m1", "abc123", ts.URL, map[string]int{"x": 1}, nil); err != nil {
+		t.Errorf("expected prediction to succeed: %v", err)
+	}
+	resp, err := opsPredictHTTP("demo", "m1", "wrong", ts.URL, map[string]int{"x": 1}, nil)
+	if err == nil {
+		t.Fatal("expected bad apikey to fail")
+	}
+	if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 response, got %v", resp)
+	}
+	if _, err := opsPredictHTTP("demo", "m1", "abc123", "::bad-host", nil, nil); err == nil {
+		t.Error("expected malformed host to fail")
+	}
+}
+
+func TestWorkerPacesArrivals(t *testing.T) {
+	m, ts := newMockOps(t, &mockops.Config{})
+	clock := newFakeClock()
+	stats := make(chan *Stat, 10)
+
+	wl := testWorkload(ts.URL, 3, clock)
+	wl.rate = 10
+	done := Worker(stats, make(chan int), wl)
+
+	// The first request goes out immediately and each following one waits
+	// for the next 100ms arrival.
+	for want := 1; want <= 2; want++ {
+		waitFor(t, func() bool { return clock.Waiters() == 1 })
+		if got := m.Stats()["m1"].Received; got != want {
+			t.Fatalf("expected %d requests before the next arrival, got %d", want, got)
+		}
+		clock.Advance(50 * time.Millisecond)
+		if clock.Waiters() != 1 {
+			t.Fatal("worker stopped waiting before its arrival time")
+		}
+		clock.Advance(50 * time.Millisecond)
+	}
+	waitDone(t, done)
+	if got := m.Stats()["m1"].Received; got != 3 {
+		t.Errorf("expected 3 requests, got %d", got)
+	}
+}
+
+func TestStepStagesScalesRates(t *testing.T) {
+	clock := newFakeClock()
+	scale := newRateScale(1)
+	zero := 0.0
+	stages := []workload.Stage{
+		{Duration: workload.Duration(time.Second), Scale: &zero},
+		{Duration: workload.Duration(time.Second)},
+	}
+	done := make(chan bool, 1)
+	go func() { done <- stepStages(clock, make(chan int), scale, stages) }()
+
+	// An explicit scale of 0 idles the paced models and an unset one runs
+	// them at their full rate.
+	waitFor(t, func() bool { return clock.Waiters() == 1 })
+	if got := scale.Load(); got != 0 {
+		t.Errorf("expected the first stage to scale rates by 0, got %v", got)
+	}
+	clock.Advance(time.Second)
+	waitFor(t, func() bool { return clock.Waiters() == 1 && scale.Load() == 1 })
+	clock.Advance(time.Second)
+	if !<-done {
+		t.Error("expected the stages to complete")
+	}
+}
+
+func TestArrivalsAreReproducible(t *testing.T) {
+	a, _ := newArrivals(arrivalPoisson, 50, rand.New(rand.NewSource(1)), nil)
+	b, _ := newArrivals(arrivalPoisson, 50, rand.New(rand.NewSource(1)), nil)
+	var total time.Duration
+	for i := 0; i < 1000; i++ {
+		ga, gb := a.gap(), b.gap()
+		if ga != gb {
+			t.Fatalf("gap %d differs for the same seed: %v and %v", i, ga, gb)
+		}
+		total += ga
+	}
+	// 1000 arrivals at 50/s should take about 20s.
+	if total < 18*time.Second || total > 22*time.Second {
+		t.Errorf("expected poisson arrivals to average 50/s, took %v for 1000", total)
+	}
+
+	c, _ := newArrivals(arrivalConstant, 4, nil, nil)
+	if g := c.gap(); g != 250*time.Millisecond {
+		t.Errorf("expected constant 250ms gaps, got %v", g)
+	}
+	if s, err := newArrivals("", 0, nil, nil); s != nil || err != nil {
+		t.Errorf("expected no schedule for unpaced workers, got %v, %v", s, err)
+	}
+	if _, err := newArrivals("bursty", 1, nil, nil); err == nil {
+		t.Error("expected unknown arrival process to fail")
+	}
+}
+
+func TestGeneratePayload(t *testing.T) {
+	input := map[string]interface{}{
+		"id":    "@",
+		"name":  "^",
+		"fixed": "Chelsea",
+		"tags":  []interface{}{"^", 3.0},
+	}
+	if !hasPlaceholders(input) {
+		t.Fatal("expected placeholders to be found")
+	}
+	if hasPlaceholders(map[string]interface{}{"fixed": "Chelsea"}) {
+		t.Error("expected no placeholders")
+	}
+
+	a := generate(input, rand.New(rand.NewSource(9))).(map[string]interface{})
+	b := generate(input, rand.New(rand.NewSource(9))).(map[string]interface{})
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("expected same payload for the same seed, got %v and %v", a, b)
+	}
+	if _, ok := a["id"].(int32); !ok {
+		t.Errorf("expected @ to become an int, got %T", a["id"])
+	}
+	if s, ok := a["name"].(string); !ok || len(s) != 16 {
+		t.Errorf("expected ^ to become a random string, got %v", a["name"])
+	}
+	if a["fixed"] != "Chelsea" || a["tags"].([]interface{})[1] != 3.0 {
+		t.Errorf("expected other values to be copied, got %v", a)
+	}
+	if input["id"] != "@" {
+		t.Error("generate modified its input")
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// comparison is the response of the simulator's /compare endpoint.
+type comparison struct {
+	Baseline   string `json:"baseline"`
+	Regression bool   `json:"regression"`
+	Runs       []struct {
+		BatchId    string `json:"batch_id"`
+		Name       string `json:"name"`
+		Regression bool   `json:"regression"`
+		Models     []struct {
+			Model   string `json:"model"`
+			Note    string `json:"note"`
+			Metrics []struct {
+				Metric      string   `json:"metric"`
+				Baseline    float64  `json:"baseline"`
+				Value       float64  `json:"value"`
+				Change      float64  `json:"change"`
+				PValue      *float64 `json:"p_value"`
+				Significant bool     `json:"significant"`
+				Regression  bool     `json:"regression"`
+			} `json:"metrics"`
+		} `json:"models"`
+	} `json:"runs"`
+}
+
+// compare asks a running simulator to compare runs from its history and
+// prints the result. It exits with status 1 if any run regressed.
+func compare(args []string) {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "address of the simulator")
+	baseline := fs.String("baseline", "", "name of a pinned baseline to compare the runs to")
+	throughput := fs.String("throughput", "", "largest relative drop in throughput allowed")
+	latency := fs.String("latency", "", "largest relative increase in latency allowed")
+	errorRate := fs.String("error_rate", "", "largest absolute increase in error rate allowed")
+	alpha := fs.String("alpha", "", "significance level")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: workload-simulator compare [flags] [baseline-run] run...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	q := url.Values{}
+	q.Set("runs", strings.Join(fs.Args(), ","))
+	params := map[string]string{
+		"baseline":   *baseline,
+		"throughput": *throughput,
+		"latency":    *latency,
+		"error_rate": *errorRate,
+		"alpha":      *alpha,
+	}
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	resp, err := http.Get(strings.TrimRight(*server, "/") + "/compare?" + q.Encode())
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println(err)
+		os.Exit(2)
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("compare failed: %s", strings.TrimSpace(string(body)))
+		os.Exit(2)
+	}
+	var c comparison
+	if err := json.Unmarshal(body, &c); err != nil {
+		log.Printf("error decoding comparison: %v", err)
+		os.Exit(2)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "baseline %s\n", c.Baseline)
+	for _, r := range c.Runs {
+		fmt.Fprintf(w, "\nrun %s %s\n", r.BatchId, r.Name)
+		fmt.Fprintln(w, "model\tmetric\tbaseline\tvalue\tchange\tp\t")
+		for _, m := range r.Models {
+			if m.Note != "" {
+				fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\n", m.Model, m.Note)
+				continue
+			}
+			for _, x := range m.Metrics {
+				p := "-"
+				if x.PValue != nil {
+					p = fmt.Sprintf("%.3g", *x.PValue)
+				}
+				change := fmt.Sprintf("%+.1f%%", x.Change*100)
+				if x.Metric == "error_rate" {
+					change = fmt.Sprintf("%+.4f", x.Change)
+				}
+				flag := ""
+				if x.Regression {
+					flag = "REGRESSION"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%.4g\t%.4g\t%s\t%s\t%s\n",
+					m.Model, x.Metric, x.Baseline, x.Value, change, p, flag)
+			}
+		}
+	}
+	w.Flush()
+	if c.Regression {
+		os.Exit(1)
+	}
+}
@@ -17,6 +17,27 @@ var c = flag.String("config", "", "file path for app configuration yaml")
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
+	// Subcommands other than serving the simulator.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mock-ops":
+			mockOps(os.Args[2:])
+			return
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "validate":
+			validate(os.Args[2:])
+			return
+		case "compare":
+			compare(os.Args[2:])
+			return
+		case "agent":
+			agent(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Parse()
 
 	cfgPath := *c
@@ -29,20 +50,19 @@ func main() {
 	a, err := app.New(cfg)
 	if err != nil {
 		log.Println(err)
+		os.Exit(1)
 	}
+	defer a.Close()
 
 	// Init communication channels for StatsMonitor and Workers
-	killc := make(chan int)
 	reportc := make(chan *app.Report)
-	defer close(killc)
 	defer close(reportc)
 
-	a.Killc = killc
 	a.Reportc = reportc
 
 	// Start a StatMonitor goroutine that maintains a map of models to stats.
 	fmt.Println("starting stats mointor")
-	stats := app.StatsMonitor(reportc, 100*time.Millisecond)
+	stats := app.StatsMonitor(app.WallClock, reportc, 100*time.Millisecond, a.StatsTaps()...)
 	a.Statc = stats
 
 	log.Printf("serving http on port: %d\n", cfg.Web.HttpPort)
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/yhat/workload-simulator/mockops"
+)
+
+// mockOps runs a mock ScienceOps server until it fails.
+func mockOps(args []string) {
+	fs := flag.NewFlagSet("mock-ops", flag.ExitOnError)
+	config := fs.String("config", "", "file path for mock ops configuration yaml")
+	addr := fs.String("addr", "", "address to listen on, overrides the config file")
+	fs.Parse(args)
+
+	cfg := &mockops.Config{}
+	if *config != "" {
+		var err error
+		cfg, err = mockops.ReadConfig(*config)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+	if *addr != "" {
+		cfg.Addr = *addr
+	}
+	if cfg.Addr == "" {
+		cfg.Addr = ":9090"
+	}
+
+	log.Printf("serving mock ops on %s\n", cfg.Addr)
+	if err := http.ListenAndServe(cfg.Addr, mockops.New(cfg)); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
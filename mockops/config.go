@@ -0,0 +1,140 @@
+package mockops
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config describes how the mock ScienceOps server behaves.
+type Config struct {
+	// Address to listen on, e.g. ":9090".
+	Addr string `yaml:"addr,omitempty"`
+
+	// Users maps usernames to api keys. Requests must carry matching basic
+	// auth credentials. An empty map disables the auth check.
+	Users map[string]string `yaml:"users,omitempty"`
+
+	// Seed for the random source used for latencies and errors. Zero seeds
+	// from the current time.
+	Seed int64 `yaml:"seed,omitempty"`
+
+	// Default behavior for models not listed in Models.
+	Default ModelConfig `yaml:"default,omitempty"`
+
+	// Per model overrides keyed by model name.
+	Models map[string]ModelConfig `yaml:"models,omitempty"`
+
+	// Strict rejects requests for models not listed in Models with a 404.
+	Strict bool `yaml:"strict,omitempty"`
+}
+
+// ModelConfig describes the behavior of a single model endpoint.
+type ModelConfig struct {
+	Latency Latency `yaml:"latency,omitempty"`
+
+	// Fraction of requests, between 0 and 1, answered with an error.
+	ErrorRate float64 `yaml:"error_rate,omitempty"`
+
+	// Status codes to pick from at random when returning an error.
+	// Defaults to 500.
+	ErrorCodes []int `yaml:"error_codes,omitempty"`
+
+	// Maximum number of requests served concurrently. Zero is unlimited.
+	MaxConcurrent int `yaml:"max_concurrent,omitempty"`
+
+	// Maximum requests per second accepted, in bursts of up to MaxRate
+	// requests or a single one for rates below 1. Zero is unlimited.
+	MaxRate float64 `yaml:"max_rate,omitempty"`
+
+	// Throttle is either "reject" (default) to answer requests over the
+	// concurrency limit with ThrottleStatus, or "queue" to make them wait
+	// for a free slot.
+	Throttle string `yaml:"throttle,omitempty"`
+
+	// Status code for throttled requests. Defaults to 429.
+	ThrottleStatus int `yaml:"throttle_status,omitempty"`
+
+	// Canned JSON response body. When empty the request input is echoed
+	// back as the prediction result.
+	Response string `yaml:"response,omitempty"`
+}
+
+// Latency describes the distribution response times are drawn from.
+type Latency struct {
+	// One of "constant" (default), "uniform", "normal" or "exponential".
+	Distribution string `yaml:"distribution,omitempty"`
+
+	// Mean is used by constant, normal and exponential distributions.
+	Mean time.Duration `yaml:"mean,omitempty"`
+
+	// Stddev is used by the normal distribution.
+	Stddev time.Duration `yaml:"stddev,omitempty"`
+
+	// Min and Max bound the uniform distribution and clamp the others
+	// when non-zero.
+	Min time.Duration `yaml:"min,omitempty"`
+	Max time.Duration `yaml:"max,omitempty"`
+}
+
+// ReadConfig reads in a YAML config file for the mock Ops server.
+func ReadConfig(configPath string) (*Config, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file %s: %v", configPath, err)
+	}
+	cfg := Config{}
+	if err = yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", configPath, err)
+	}
+	if err = cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", configPath, err)
+	}
+	return &cfg, nil
+}
+
+// Validate checks the config for values the server can't honor.
+func (c *Config) Validate() error {
+	if err := c.Default.validate(); err != nil {
+		return fmt.Errorf("default: %v", err)
+	}
+	for name, m := range c.Models {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("model %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (m *ModelConfig) validate() error {
+	if m.ErrorRate < 0 || m.ErrorRate > 1 {
+		return fmt.Errorf("error_rate must be between 0 and 1, got %v", m.ErrorRate)
+	}
+	for _, code := range m.ErrorCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid error code %d", code)
+		}
+	}
+	if m.MaxConcurrent < 0 {
+		return fmt.Errorf("max_concurrent can't be negative")
+	}
+	if m.MaxRate < 0 {
+		return fmt.Errorf("max_rate can't be negative")
+	}
+	switch m.Throttle {
+	case "", "reject", "queue":
+	default:
+		return fmt.Errorf("unknown throttle mode %q", m.Throttle)
+	}
+	switch m.Latency.Distribution {
+	case "", "constant", "uniform", "normal", "exponential":
+	default:
+		return fmt.Errorf("unknown latency distribution %q", m.Latency.Distribution)
+	}
+	if m.Latency.Max != 0 && m.Latency.Max < m.Latency.Min {
+		return fmt.Errorf("latency max is less than min")
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package mockops
+
+import (
+	"math/rand"
+	"time"
+)
+
+// sample draws a response time from the latency distribution.
+func (l Latency) sample(r *rand.Rand) time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case "uniform":
+		if l.Max <= l.Min {
+			return l.Min
+		}
+		return l.Min + time.Duration(r.Int63n(int64(l.Max-l.Min)))
+	case "normal":
+		d = l.Mean + time.Duration(r.NormFloat64()*float64(l.Stddev))
+	case "exponential":
+		d = time.Duration(r.ExpFloat64() * float64(l.Mean))
+	default:
+		d = l.Mean
+	}
+	return l.clamp(d)
+}
+
+// clamp bounds d to [Min, Max], ignoring a zero Max.
+func (l Latency) clamp(d time.Duration) time.Duration {
+	if d < l.Min {
+		d = l.Min
+	}
+	if l.Max > 0 && d > l.Max {
+		d = l.Max
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
@@ -0,0 +1,53 @@
+package mockops
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestLatencySample(t *testing.T) {
+	const n = 10000
+	tests := []struct {
+		name     string
+		latency  Latency
+		min, max time.Duration
+		// mean is checked to within 10% when set.
+		mean time.Duration
+	}{
+		{"constant", Latency{Mean: 20 * time.Millisecond}, 20 * time.Millisecond, 20 * time.Millisecond, 20 * time.Millisecond},
+		{"uniform", Latency{Distribution: "uniform", Min: 10 * time.Millisecond, Max: 30 * time.Millisecond},
+			10 * time.Millisecond, 30 * time.Millisecond, 20 * time.Millisecond},
+		{"normal", Latency{Distribution: "normal", Mean: 50 * time.Millisecond, Stddev: 5 * time.Millisecond},
+			0, time.Second, 50 * time.Millisecond},
+		{"normal clamped", Latency{Distribution: "normal", Mean: 50 * time.Millisecond, Stddev: 50 * time.Millisecond,
+			Min: 40 * time.Millisecond, Max: 60 * time.Millisecond}, 40 * time.Millisecond, 60 * time.Millisecond, 0},
+		{"exponential", Latency{Distribution: "exponential", Mean: 10 * time.Millisecond}, 0, time.Second, 10 * time.Millisecond},
+		{"never negative", Latency{Distribution: "normal", Mean: time.Millisecond, Stddev: 10 * time.Millisecond}, 0, time.Second, 0},
+	}
+	for _, tt := range tests {
+		rnd := rand.New(rand.NewSource(1))
+		var sum time.Duration
+		for i := 0; i < n; i++ {
+			d := tt.latency.sample(rnd)
+			if d < tt.min || d > tt.max {
+				t.Errorf("%s: sample %v outside [%v, %v]", tt.name, d, tt.min, tt.max)
+				break
+			}
+			sum += d
+		}
+		if tt.mean == 0 {
+			continue
+		}
+		if mean := sum / n; mean < tt.mean*9/10 || mean > tt.mean*11/10 {
+			t.Errorf("%s: expected a mean near %v, got %v", tt.name, tt.mean, mean)
+		}
+	}
+}
+
+func TestLatencyUniformWithoutRange(t *testing.T) {
+	l := Latency{Distribution: "uniform", Min: 5 * time.Millisecond}
+	if d := l.sample(rand.New(rand.NewSource(1))); d != 5*time.Millisecond {
+		t.Errorf("expected min when max is unset, got %v", d)
+	}
+}
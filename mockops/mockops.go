@@ -0,0 +1,381 @@
+// Package mockops implements a stand-in for a ScienceOps server. It serves
+// model prediction endpoints with configurable latency, errors and
+// throttling so the simulator can be exercised without a live Ops box.
+package mockops
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelStats counts what the mock server did for a single model.
+type ModelStats struct {
+	Received  int         `json:"received"`
+	Served    int         `json:"served"`
+	Errors    int         `json:"errors"`
+	Throttled int         `json:"throttled"`
+	Statuses  map[int]int `json:"statuses"`
+}
+
+// model holds the runtime state of a single model endpoint.
+type model struct {
+	config ModelConfig
+
+	// slots limits concurrent requests, nil when unlimited. They belong
+	// to the server, so requests in flight keep theirs across a reset.
+	slots chan struct{}
+
+	// token bucket state for MaxRate.
+	tokens float64
+	last   time.Time
+
+	stats ModelStats
+}
+
+// Server is a mock ScienceOps server.
+type Server struct {
+	config *Config
+	router *http.ServeMux
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	models map[string]*model
+
+	// slots are the models' concurrency slots by model name.
+	slots map[string]chan struct{}
+
+	// inFlight counts the requests being served.
+	inFlight int
+}
+
+// New returns a mock Ops server for config.
+func New(config *Config) *Server {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &Server{
+		config: config,
+		router: http.NewServeMux(),
+		rnd:    rand.New(rand.NewSource(seed)),
+		models: make(map[string]*model),
+		slots:  make(map[string]chan struct{}),
+	}
+	s.router.HandleFunc("/", s.handlePredict)
+	s.router.HandleFunc("/status", s.handleStatus)
+	s.router.HandleFunc("/_mock/stats", s.handleStats)
+	s.router.HandleFunc("/_mock/reset", s.handleReset)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// Stats returns a snapshot of the per model counters.
+func (s *Server) Stats() map[string]ModelStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]ModelStats, len(s.models))
+	for name, m := range s.models {
+		st := m.stats
+		st.Statuses = make(map[int]int, len(m.stats.Statuses))
+		for code, n := range m.stats.Statuses {
+			st.Statuses[code] = n
+		}
+		out[name] = st
+	}
+	return out
+}
+
+// Reset clears all counters and rate limiting state. Requests in flight
+// keep holding their concurrency slots until they are answered.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.models = make(map[string]*model)
+	s.mu.Unlock()
+}
+
+// lookup returns the state for a model, creating it on first use. The
+// second return value is false if the model is unknown in strict mode.
+func (s *Server) lookup(name string) (*model, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.models[name]; ok {
+		return m, true
+	}
+	cfg, ok := s.config.Models[name]
+	if !ok {
+		if s.config.Strict {
+			return nil, false
+		}
+		cfg = s.config.Default
+	}
+	m := &model{
+		config: cfg,
+		last:   time.Now(),
+	}
+	m.tokens = m.burst()
+	m.stats.Statuses = make(map[int]int)
+	if cfg.MaxConcurrent > 0 {
+		if m.slots = s.slots[name]; m.slots == nil {
+			m.slots = make(chan struct{}, cfg.MaxConcurrent)
+			s.slots[name] = m.slots
+		}
+	}
+	s.models[name] = m
+	return m, true
+}
+
+// allow takes a token from the model's rate limiter.
+func (s *Server) allow(m *model) bool {
+	if m.config.MaxRate <= 0 {
+		return true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	m.tokens += now.Sub(m.last).Seconds() * m.config.MaxRate
+	if burst := m.burst(); m.tokens > burst {
+		m.tokens = burst
+	}
+	m.last = now
+	if m.tokens < 1 {
+		return false
+	}
+	m.tokens--
+	return true
+}
+
+// burst is how many tokens the model's rate limiter holds when full. It
+// holds at least one, so rates below 1/s still let requests through.
+func (m *model) burst() float64 {
+	if m.config.MaxRate < 1 {
+		return 1
+	}
+	return m.config.MaxRate
+}
+
+// draw decides the latency and, if non-zero, the error status code for a
+// single request.
+func (s *Server) draw(m *model) (time.Duration, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := m.config.Latency.sample(s.rnd)
+	if m.config.ErrorRate > 0 && s.rnd.Float64() < m.config.ErrorRate {
+		codes := m.config.ErrorCodes
+		if len(codes) == 0 {
+			return d, http.StatusInternalServerError
+		}
+		return d, codes[s.rnd.Intn(len(codes))]
+	}
+	return d, 0
+}
+
+func (s *Server) record(m *model, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.stats.Statuses[status]++
+	switch {
+	case status == m.throttleStatus():
+		m.stats.Throttled++
+	case status >= 400:
+		m.stats.Errors++
+	default:
+		m.stats.Served++
+	}
+}
+
+func (m *model) throttleStatus() int {
+	if m.config.ThrottleStatus != 0 {
+		return m.config.ThrottleStatus
+	}
+	return http.StatusTooManyRequests
+}
+
+// handlePredict serves /{user}/models/{model}/ the way Ops does.
+func (s *Server) handlePredict(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 3 || parts[1] != "models" {
+		http.NotFound(w, r)
+		return
+	}
+	user, name := parts[0], parts[2]
+
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(s.config.Users) > 0 {
+		u, key, ok := r.BasicAuth()
+		if !ok || u != user || s.config.Users[u] != key {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ScienceOps"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "invalid username or apikey",
+			})
+			return
+		}
+	}
+
+	m, ok := s.lookup(name)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"error": "model " + name + " not found",
+		})
+		return
+	}
+
+	s.mu.Lock()
+	m.stats.Received++
+	s.inFlight++
+	s.mu.Unlock()
+
+	status := s.serve(w, r, user, name, m)
+	s.record(m, status)
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+}
+
+// serve answers a prediction request for m and returns the status code
+// written.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, user, name string, m *model) int {
+	throttled := func() int {
+		status := m.throttleStatus()
+		writeJSON(w, status, map[string]interface{}{"error": "too many requests"})
+		return status
+	}
+
+	if !s.allow(m) {
+		return throttled()
+	}
+
+	if m.slots != nil {
+		if m.config.Throttle == "queue" {
+			select {
+			case m.slots <- struct{}{}:
+			case <-r.Context().Done():
+				return throttled()
+			}
+		} else {
+			select {
+			case m.slots <- struct{}{}:
+			default:
+				return throttled()
+			}
+		}
+		defer func() { <-m.slots }()
+	}
+
+	var input interface{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &input)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": "could not parse input data",
+		})
+		return http.StatusBadRequest
+	}
+
+	latency, errStatus := s.draw(m)
+	time.Sleep(latency)
+
+	if errStatus != 0 {
+		writeJSON(w, errStatus, map[string]interface{}{"error": "mock prediction error"})
+		return errStatus
+	}
+
+	if m.config.Response != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(m.config.Response))
+		return http.StatusOK
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"result":     input,
+		"yhat_model": name,
+		"yhat_user":  user,
+	})
+	return http.StatusOK
+}
+
+// handleStats returns the per model counters as JSON.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Stats())
+}
+
+// handleStatus serves the status document live mode polls: each model's
+// status and request count, and the mock's resource usage.
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "I only respond to GETs.", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(s.config.Users) > 0 {
+		u, key, ok := r.BasicAuth()
+		if !ok || s.config.Users[u] != key {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ScienceOps"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+				"error": "invalid username or apikey",
+			})
+			return
+		}
+	}
+
+	models := make(map[string]interface{})
+	for name := range s.config.Models {
+		models[name] = map[string]interface{}{"status": "online", "requests": 0}
+	}
+	s.mu.Lock()
+	for name, m := range s.models {
+		models[name] = map[string]interface{}{"status": "online", "requests": m.stats.Received}
+	}
+	inFlight := s.inFlight
+	s.mu.Unlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"models": models,
+		"resources": map[string]interface{}{
+			"in_flight":  inFlight,
+			"goroutines": runtime.NumGoroutine(),
+			"memory": map[string]interface{}{
+				"alloc_mb": float64(mem.Alloc) / (1 << 20),
+				"sys_mb":   float64(mem.Sys) / (1 << 20),
+			},
+		},
+	})
+}
+
+// handleReset clears all counters.
+func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "I only respond to POSTs.", http.StatusMethodNotAllowed)
+		return
+	}
+	s.Reset()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "failed to marshal data", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
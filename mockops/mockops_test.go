@@ -0,0 +1,174 @@
+package mockops
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, cfg *Config) (*Server, *httptest.Server) {
+	s := New(cfg)
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// predict sends a prediction request for model m and returns the status.
+func predict(t *testing.T, ts *httptest.Server, m string) int {
+	resp, err := http.Post(ts.URL+"/demo/models/"+m+"/", "application/json", strings.NewReader(`{"x": 1}`))
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// waitSlots waits until n of model m's concurrency slots are taken.
+func waitSlots(t *testing.T, s *Server, m string, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		taken := len(s.slots[m])
+		s.mu.Unlock()
+		if taken == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d slots of %s, %d taken", n, m, taken)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestThrottleRejectsOverConcurrency(t *testing.T) {
+	s, ts := newTestServer(t, &Config{Default: ModelConfig{
+		MaxConcurrent:  1,
+		ThrottleStatus: http.StatusServiceUnavailable,
+		Latency:        Latency{Mean: 200 * time.Millisecond},
+	}})
+
+	first := make(chan int)
+	go func() { first <- predict(t, ts, "m1") }()
+	waitSlots(t, s, "m1", 1)
+
+	if got := predict(t, ts, "m1"); got != http.StatusServiceUnavailable {
+		t.Errorf("expected request over the limit to get 503, got %d", got)
+	}
+	if got := <-first; got != http.StatusOK {
+		t.Errorf("expected first request to be served, got %d", got)
+	}
+	st := s.Stats()["m1"]
+	if st.Received != 2 || st.Served != 1 || st.Throttled != 1 || st.Errors != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestThrottleQueuesOverConcurrency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	s, ts := newTestServer(t, &Config{Default: ModelConfig{
+		MaxConcurrent: 1,
+		Throttle:      "queue",
+		Latency:       Latency{Mean: latency},
+	}})
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	statuses := make([]int, 3)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = predict(t, ts, "m1")
+		}(i)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d: expected 200, got %d", i, status)
+		}
+	}
+	// Requests waited for each other rather than being served together.
+	if took := time.Since(start); took < 3*latency {
+		t.Errorf("expected queued requests to take at least %v, took %v", 3*latency, took)
+	}
+	if st := s.Stats()["m1"]; st.Served != 3 || st.Throttled != 0 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestMaxRate(t *testing.T) {
+	tests := []struct {
+		rate    float64
+		allowed int
+	}{
+		// A rate below 1/s still lets a first request through.
+		{0.5, 1},
+		{1, 1},
+		{3, 3},
+	}
+	for _, tt := range tests {
+		s, ts := newTestServer(t, &Config{Default: ModelConfig{MaxRate: tt.rate}})
+		for i := 0; i < tt.allowed+2; i++ {
+			predict(t, ts, "m1")
+		}
+		st := s.Stats()["m1"]
+		if st.Served != tt.allowed || st.Throttled != 2 {
+			t.Errorf("max_rate %v: expected %d served and 2 throttled, got %+v", tt.rate, tt.allowed, st)
+		}
+	}
+}
+
+func TestMaxRateRefills(t *testing.T) {
+	s, _ := newTestServer(t, &Config{Default: ModelConfig{MaxRate: 0.5}})
+	m, _ := s.lookup("m1")
+
+	if !s.allow(m) {
+		t.Fatal("expected the first request to be allowed")
+	}
+	if s.allow(m) {
+		t.Fatal("expected the bucket to be empty")
+	}
+	// Ten seconds at 0.5/s refill more than a token, but only one fits.
+	m.last = m.last.Add(-10 * time.Second)
+	if !s.allow(m) {
+		t.Error("expected a request to be allowed once the bucket refilled")
+	}
+	if s.allow(m) {
+		t.Error("expected the bucket to hold a single token")
+	}
+}
+
+func TestResetDuringRequests(t *testing.T) {
+	s, ts := newTestServer(t, &Config{Default: ModelConfig{
+		MaxConcurrent: 1,
+		Latency:       Latency{Mean: 200 * time.Millisecond},
+	}})
+
+	first := make(chan int)
+	go func() { first <- predict(t, ts, "m1") }()
+	waitSlots(t, s, "m1", 1)
+	s.Reset()
+
+	if n := len(s.Stats()); n != 0 {
+		t.Errorf("expected reset to clear the counters, got %d models", n)
+	}
+	// The request in flight still holds the only slot.
+	if got := predict(t, ts, "m1"); got != http.StatusTooManyRequests {
+		t.Errorf("expected request over the limit to get 429 after reset, got %d", got)
+	}
+	if got := <-first; got != http.StatusOK {
+		t.Errorf("expected request in flight to be served, got %d", got)
+	}
+	waitSlots(t, s, "m1", 0)
+	if got := predict(t, ts, "m1"); got != http.StatusOK {
+		t.Errorf("expected slot to be free once the request was served, got %d", got)
+	}
+	if st := s.Stats()["m1"]; st.Received != 2 || st.Served != 1 || st.Throttled != 1 {
+		t.Errorf("unexpected stats after reset %+v", st)
+	}
+}
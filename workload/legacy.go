@@ -0,0 +1,234 @@
+package workload
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// legacyWindow is a window of the original workload format. Query is the
+// json encoding of a legacyQuery and QPS the number of requests each worker
+// makes.
+type legacyWindow struct {
+	Query string
+	QPS   string
+	Rate  string
+}
+
+type legacyQuery struct {
+	Model string
+	Input map[string]interface{}
+}
+
+// legacySettings are the settings form values of the UI.
+type legacySettings struct {
+	OpsHost    string `json:"ops_host"`
+	ApiKey     string `json:"ops_apikey"`
+	User       string `json:"ops_user"`
+	MaxDialVal string `json:"dial_max_value"`
+	Workers    string `json:"workers"`
+	Seed       string `json:"seed"`
+	Arrival    string `json:"arrival"`
+}
+
+// FromLegacy converts the UI's json-encoded workload and settings form
+// values to a Spec. Problems name the form fields that couldn't be
+// converted.
+func FromLegacy(workload, settings string) (*Spec, Problems) {
+	var problems Problems
+	var w, s map[string]interface{}
+	if err := json.Unmarshal([]byte(workload), &w); err != nil {
+		problems = append(problems, Problem{Field: "workload", Message: fmt.Sprintf("could not parse workload json: %v", err)})
+	}
+	if err := json.Unmarshal([]byte(settings), &s); err != nil {
+		problems = append(problems, Problem{Field: "settings", Message: fmt.Sprintf("could not parse settings json: %v", err)})
+	}
+	if problems != nil {
+		return nil, problems
+	}
+	return fromLegacy(w, s)
+}
+
+// migrate converts a decoded file in the original format, either a bare
+// workload or a saved session of settings and workload.
+func migrate(raw map[string]interface{}) (*Spec, Problems) {
+	w, hasWorkload := raw["workload"].(map[string]interface{})
+	s, hasSettings := raw["settings"].(map[string]interface{})
+	if hasWorkload && hasSettings {
+		return fromLegacy(w, s)
+	}
+	return fromLegacy(raw, nil)
+}
+
+func fromLegacy(workload, settings map[string]interface{}) (*Spec, Problems) {
+	var problems Problems
+	add := func(window, field, format string, args ...interface{}) {
+		problems = append(problems, Problem{window, field, fmt.Sprintf(format, args...)})
+	}
+
+	spec := &Spec{Version: Version}
+	for _, k := range sortedIDs(workload) {
+		var v legacyWindow
+		if !decodeLegacy(workload[k], &v) {
+			add(k, "window", "expected an object with query and qps")
+			continue
+		}
+		q := legacyQuery{}
+		if strings.TrimSpace(v.Query) == "" {
+			add(k, "query", "query is empty")
+		} else if err := json.Unmarshal([]byte(v.Query), &q); err != nil {
+			add(k, "query", "could not parse query json: %v", err)
+		}
+		requests, err := strconv.Atoi(strings.TrimSpace(v.QPS))
+		if err != nil {
+			add(k, "qps", "%q is not an integer", v.QPS)
+		}
+		var rate float64
+		if v.Rate != "" {
+			if rate, err = strconv.ParseFloat(strings.TrimSpace(v.Rate), 64); err != nil {
+				add(k, "rate", "%q is not a number", v.Rate)
+			}
+		}
+		spec.Models = append(spec.Models, Model{
+			ID:       k,
+			Model:    q.Model,
+			Requests: requests,
+			Rate:     rate,
+			Input:    q.Input,
+		})
+	}
+
+	if settings != nil {
+		var s legacySettings
+		decodeLegacy(settings, &s)
+		spec.Target = Target{Host: s.OpsHost, User: s.User, APIKey: s.ApiKey}
+		spec.Run.Arrival = s.Arrival
+		var err error
+		if spec.Run.Workers, err = strconv.Atoi(strings.TrimSpace(s.Workers)); err != nil {
+			add("", "workers", "%q is not an integer", s.Workers)
+		}
+		if s.Seed != "" {
+			if spec.Run.Seed, err = strconv.ParseInt(strings.TrimSpace(s.Seed), 10, 64); err != nil {
+				add("", "seed", "could not parse seed %q into an int", s.Seed)
+			}
+		}
+		if s.MaxDialVal != "" {
+			if spec.Run.DialMax, err = strconv.Atoi(s.MaxDialVal); err != nil {
+				add("", "dial_max_value", "%q is not an integer", s.MaxDialVal)
+			}
+		}
+	}
+
+	if problems != nil {
+		return nil, problems
+	}
+	return spec, nil
+}
+
+// Legacy converts spec to the UI's workload and settings, the inverse of
+// FromLegacy. Features the UI has no place for, like stages, are dropped
+// and listed in the returned warnings.
+func (spec *Spec) Legacy() (workload map[string]map[string]string, settings map[string]interface{}, warnings []string) {
+	workload = make(map[string]map[string]string)
+	for i, m := range spec.Models {
+		id := m.ID
+		if id == "" {
+			id = strconv.Itoa(i)
+		}
+		input := m.Input
+		if len(m.Payloads) > 0 {
+			input = m.Payloads[0]
+			warnings = append(warnings, fmt.Sprintf("window %s: only the first of %d payloads is shown", id, len(m.Payloads)))
+		}
+		model := m.Model
+		if len(m.Steps) > 0 {
+			model, input = m.Steps[0].Model, m.Steps[0].Input
+			warnings = append(warnings, fmt.Sprintf("window %s: only the first of the scenario's %d steps is shown", id, len(m.Steps)))
+		}
+		b, _ := json.Marshal(map[string]interface{}{"model": model, "input": input})
+		w := map[string]string{
+			"query": string(b),
+			"qps":   strconv.Itoa(m.Requests),
+		}
+		if m.Rate != 0 {
+			w["rate"] = strconv.FormatFloat(m.Rate, 'f', -1, 64)
+		}
+		workload[id] = w
+	}
+	settings = map[string]interface{}{
+		"ops_host":       spec.Target.Host,
+		"ops_user":       spec.Target.User,
+		"ops_apikey":     spec.Target.APIKey,
+		"workers":        strconv.Itoa(spec.Run.Workers),
+		"arrival":        spec.Run.Arrival,
+		"dial_max_value": spec.Run.DialMax,
+	}
+	if spec.Run.Seed != 0 {
+		settings["seed"] = strconv.FormatInt(spec.Run.Seed, 10)
+	}
+	if len(spec.Stages) > 0 {
+		warnings = append(warnings, "stages can't be shown and will not be run from the UI")
+	}
+	if len(spec.Thresholds) > 0 {
+		warnings = append(warnings, "thresholds can't be shown and will not be checked from the UI")
+	}
+	if spec.Search != nil {
+		warnings = append(warnings, "searches can't be run from the UI")
+	}
+	if spec.Run.Limited() {
+		warnings = append(warnings, "run limits can't be shown and will not be applied from the UI")
+	}
+	if spec.Run.Adaptive {
+		warnings = append(warnings, "the UI runs a fixed number of workers, not an adaptive pool")
+	}
+	if spec.Run.Users != nil {
+		warnings = append(warnings, "the UI runs workers at their rates, not virtual users")
+	}
+	return workload, settings, warnings
+}
+
+// decodeLegacy decodes a generic value into v, accepting numbers where the
+// original format used strings.
+func decodeLegacy(in interface{}, v interface{}) bool {
+	m, ok := in.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	strs := make(map[string]string, len(m))
+	for k, e := range m {
+		switch t := e.(type) {
+		case string:
+			strs[k] = t
+		case float64:
+			strs[k] = strconv.FormatFloat(t, 'f', -1, 64)
+		case nil:
+		default:
+			strs[k] = fmt.Sprint(t)
+		}
+	}
+	b, _ := json.Marshal(strs)
+	return json.Unmarshal(b, v) == nil
+}
+
+// sortedIDs returns the keys of m in numeric order where they are numbers,
+// as the UI numbers its windows.
+func sortedIDs(m map[string]interface{}) []string {
+	ids := make([]string, 0, len(m))
+	for k := range m {
+		ids = append(ids, k)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		if (errA == nil) != (errB == nil) {
+			return errA == nil
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
@@ -0,0 +1,107 @@
+package workload
+
+import (
+	"reflect"
+	"testing"
+)
+
+const legacyWorkload = `{
+	"0": {
+	     "query": "{\"model\":\"NycRentViz01\", \"input\":{\"Bedrooms\":0,\"Neighborhood\":\"Chelsea\"}}",
+	     "qps":"12566"
+	},
+	"10": {"query": "{\"model\":\"Other\"}", "qps": 5, "rate": "2.5"},
+	"2": {"query": "{\"model\":\"Other\"}", "qps": "7"}
+}`
+
+func TestParseLegacyWorkload(t *testing.T) {
+	spec, err := Parse([]byte(legacyWorkload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Model{
+		{ID: "0", Model: "NycRentViz01", Requests: 12566,
+			Input: map[string]interface{}{"Bedrooms": 0.0, "Neighborhood": "Chelsea"}},
+		{ID: "2", Model: "Other", Requests: 7},
+		{ID: "10", Model: "Other", Requests: 5, Rate: 2.5},
+	}
+	if spec.Version != Version {
+		t.Errorf("expected version %d, got %d", Version, spec.Version)
+	}
+	if !reflect.DeepEqual(spec.Models, want) {
+		t.Errorf("expected models %+v, got %+v", want, spec.Models)
+	}
+}
+
+func TestParseLegacySession(t *testing.T) {
+	session := `{
+		"settings": {"ops_host": "http://ops", "ops_user": "demo", "ops_apikey": "k",
+		             "workers": "4", "dial_max_value": 20, "seed": "9", "arrival": "poisson"},
+		"workload": ` + legacyWorkload + `
+	}`
+	spec, err := Parse([]byte(session))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Target{Host: "http://ops", User: "demo", APIKey: "k"}); spec.Target != want {
+		t.Errorf("expected target %+v, got %+v", want, spec.Target)
+	}
+	if want := (Run{Workers: 4, Seed: 9, Arrival: "poisson", DialMax: 20}); spec.Run != want {
+		t.Errorf("expected run %+v, got %+v", want, spec.Run)
+	}
+	if len(spec.Models) != 3 {
+		t.Errorf("expected 3 models, got %d", len(spec.Models))
+	}
+	if problems := spec.Validate(); problems != nil {
+		t.Errorf("expected a valid spec, got %v", problems)
+	}
+}
+
+func TestFromLegacyProblems(t *testing.T) {
+	_, problems := FromLegacy(`{
+		"0": {"query": "{bad", "qps": "five"},
+		"1": [1]
+	}`, `{"workers": "x", "seed": "y", "dial_max_value": "z"}`)
+	want := Problems{
+		{"0", "query", "could not parse query json: invalid character 'b' looking for beginning of object key string"},
+		{"0", "qps", `"five" is not an integer`},
+		{"1", "window", "expected an object with query and qps"},
+		{"", "workers", `"x" is not an integer`},
+		{"", "seed", `could not parse seed "y" into an int`},
+		{"", "dial_max_value", `"z" is not an integer`},
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("expected %v\ngot %v", want, problems)
+	}
+}
+
+func TestLegacyRoundTrip(t *testing.T) {
+	spec, err := Parse([]byte(yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl, settings, warnings := spec.Legacy()
+	if len(warnings) != 3 {
+		t.Errorf("expected warnings for payloads, stages and thresholds, got %v", warnings)
+	}
+	if wl["a"]["qps"] != "100" || wl["a"]["rate"] != "2.5" || wl["1"]["qps"] != "0" {
+		t.Errorf("unexpected legacy workload %v", wl)
+	}
+	if settings["seed"] != "42" || settings["workers"] != "8" {
+		t.Errorf("unexpected legacy settings %v", settings)
+	}
+
+	b, _ := jsonString(wl)
+	s, _ := jsonString(settings)
+	again, problems := FromLegacy(b, s)
+	if problems != nil {
+		t.Fatal(problems)
+	}
+	if again.Target != spec.Target || again.Run != spec.Run {
+		t.Errorf("expected target and run to survive, got %+v %+v", again.Target, again.Run)
+	}
+	// Numeric ids sort first, so model "a" comes back second.
+	if !reflect.DeepEqual(again.Models[1], spec.Models[0]) {
+		t.Errorf("expected model a to survive, got %+v", again.Models[1])
+	}
+}
@@ -0,0 +1,314 @@
+package workload
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound = errors.New("workload not found")
+	ErrExists   = errors.New("workload already exists")
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// extensions are the workload file extensions a library reads, in order of
+// preference.
+var extensions = []string{".yaml", ".yml", ".json"}
+
+// Library stores named workloads in a directory laid out like the
+// simulator's workloads directory. Workload name lives in name/name.yaml
+// (or .yml or .json) next to any other files it needs, and replaced
+// versions are kept in name/versions/name.N.yaml.
+type Library struct {
+	dir string
+
+	// mu serializes changes so versions are numbered without gaps, and
+	// keeps reads from seeing a version number before its file is written.
+	mu sync.RWMutex
+}
+
+// Entry describes a workload in a library.
+type Entry struct {
+	Name     string    `json:"name"`
+	Version  int       `json:"version"`
+	Modified time.Time `json:"modified"`
+	Metadata Metadata  `json:"metadata"`
+	Models   int       `json:"models"`
+
+	// Error is set if the workload file can't be read.
+	Error string `json:"error,omitempty"`
+}
+
+// VersionInfo describes one saved version of a workload.
+type VersionInfo struct {
+	Version  int       `json:"version"`
+	Modified time.Time `json:"modified"`
+}
+
+// NewLibrary returns a library of the workloads in dir.
+func NewLibrary(dir string) *Library {
+	return &Library{dir: dir}
+}
+
+// List returns every workload in the library sorted by name. Directories
+// without a workload file are skipped.
+func (l *Library) List() ([]Entry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	infos, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading workload library %s: %v", l.dir, err)
+	}
+	entries := []Entry{}
+	for _, info := range infos {
+		if !info.IsDir() || !validName.MatchString(info.Name()) {
+			continue
+		}
+		name := info.Name()
+		path, ok := l.current(name)
+		if !ok {
+			continue
+		}
+		e := Entry{Name: name, Version: l.latest(name), Modified: modTime(path)}
+		if spec, err := Load(path); err != nil {
+			e.Error = err.Error()
+		} else {
+			e.Metadata = spec.Metadata
+			e.Models = len(spec.Models)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Get reads the latest version of a workload.
+func (l *Library) Get(name string) (*Spec, int, error) {
+	return l.GetVersion(name, 0)
+}
+
+// GetVersion reads a version of a workload, the latest if version is 0.
+func (l *Library) GetVersion(name string, version int) (*Spec, int, error) {
+	if err := CheckName(name); err != nil {
+		return nil, 0, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	path, ok := l.current(name)
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	latest := l.latest(name)
+	if version != 0 && version != latest {
+		if path, ok = l.archived(name, version); !ok {
+			return nil, 0, ErrNotFound
+		}
+	} else {
+		version = latest
+	}
+	spec, err := Load(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	return spec, version, nil
+}
+
+// Versions lists the saved versions of a workload, oldest first.
+func (l *Library) Versions(name string) ([]VersionInfo, error) {
+	if err := CheckName(name); err != nil {
+		return nil, err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	path, ok := l.current(name)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var versions []VersionInfo
+	for _, v := range l.archivedVersions(name) {
+		p, _ := l.archived(name, v)
+		versions = append(versions, VersionInfo{Version: v, Modified: modTime(p)})
+	}
+	return append(versions, VersionInfo{Version: l.latest(name), Modified: modTime(path)}), nil
+}
+
+// Create adds a new workload to the library as version 1.
+func (l *Library) Create(name string, spec *Spec) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.current(name); ok {
+		return ErrExists
+	}
+	if err := os.MkdirAll(filepath.Join(l.dir, name), 0755); err != nil {
+		return fmt.Errorf("error creating workload %s: %v", name, err)
+	}
+	return l.write(filepath.Join(l.dir, name, name+".yaml"), spec)
+}
+
+// Update replaces a workload with a new version, keeping the old one. It
+// returns the new version number.
+func (l *Library) Update(name string, spec *Spec) (int, error) {
+	if err := CheckName(name); err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path, ok := l.current(name)
+	if !ok {
+		return 0, ErrNotFound
+	}
+	version := l.latest(name)
+	versionsDir := filepath.Join(l.dir, name, "versions")
+	if err := os.MkdirAll(versionsDir, 0755); err != nil {
+		return 0, fmt.Errorf("error archiving workload %s: %v", name, err)
+	}
+	// Copy rather than move the current version so readers always find
+	// one.
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("error archiving workload %s: %v", name, err)
+	}
+	archive := filepath.Join(versionsDir, fmt.Sprintf("%s.%d%s", name, version, filepath.Ext(path)))
+	if err := ioutil.WriteFile(archive, old, 0644); err != nil {
+		return 0, fmt.Errorf("error archiving workload %s: %v", name, err)
+	}
+	if err := l.write(path, spec); err != nil {
+		os.Remove(archive)
+		return 0, err
+	}
+	return version + 1, nil
+}
+
+// Delete removes a workload and all of its versions. Other files in the
+// workload's directory, like sql schemas, are left alone.
+func (l *Library) Delete(name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	path, ok := l.current(name)
+	if !ok {
+		return ErrNotFound
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("error deleting workload %s: %v", name, err)
+	}
+	for _, v := range l.archivedVersions(name) {
+		p, _ := l.archived(name, v)
+		os.Remove(p)
+	}
+	// Only removed if nothing else is left in them.
+	os.Remove(filepath.Join(l.dir, name, "versions"))
+	os.Remove(filepath.Join(l.dir, name))
+	return nil
+}
+
+// write encodes spec in the format of path's extension, replacing path
+// atomically.
+func (l *Library) write(path string, spec *Spec) error {
+	b, err := Marshal(spec, FormatOf(path))
+	if err != nil {
+		return fmt.Errorf("error encoding workload: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".workload")
+	if err != nil {
+		return fmt.Errorf("error writing workload %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	tmp.Chmod(0644)
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing workload %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing workload %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing workload %s: %v", path, err)
+	}
+	return nil
+}
+
+// current returns the path of the latest version of a workload.
+func (l *Library) current(name string) (string, bool) {
+	for _, ext := range extensions {
+		path := filepath.Join(l.dir, name, name+ext)
+		if fi, err := os.Stat(path); err == nil && !fi.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// latest returns the version number of the current file, one more than the
+// newest archived version.
+func (l *Library) latest(name string) int {
+	versions := l.archivedVersions(name)
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1] + 1
+}
+
+// archived returns the path of an archived version of a workload.
+func (l *Library) archived(name string, version int) (string, bool) {
+	for _, ext := range extensions {
+		path := filepath.Join(l.dir, name, "versions", fmt.Sprintf("%s.%d%s", name, version, ext))
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// archivedVersions returns the version numbers in a workload's versions
+// directory in ascending order.
+func (l *Library) archivedVersions(name string) []int {
+	infos, err := ioutil.ReadDir(filepath.Join(l.dir, name, "versions"))
+	if err != nil {
+		return nil
+	}
+	var versions []int
+	for _, info := range infos {
+		base := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
+		if !strings.HasPrefix(base, name+".") {
+			continue
+		}
+		if v, err := strconv.Atoi(strings.TrimPrefix(base, name+".")); err == nil && v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// CheckName returns an error if name can't be used as a workload name,
+// which must be safe to use as a file name.
+func CheckName(name string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid workload name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+func modTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
@@ -0,0 +1,166 @@
+package workload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testSpec(requests int) *Spec {
+	return &Spec{
+		Version:  Version,
+		Metadata: Metadata{Name: "test", Tags: []string{"ci"}},
+		Target:   Target{Host: "http://ops", User: "demo"},
+		Run:      Run{Workers: 2},
+		Models:   []Model{{Model: "m1", Requests: requests}},
+	}
+}
+
+func TestLibraryVersions(t *testing.T) {
+	dir := t.TempDir()
+	lib := NewLibrary(dir)
+
+	if err := lib.Create("rent", testSpec(10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lib.Create("rent", testSpec(10)); err != ErrExists {
+		t.Errorf("expected ErrExists, got %v", err)
+	}
+	for want := 2; want <= 3; want++ {
+		v, err := lib.Update("rent", testSpec(10*want))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != want {
+			t.Errorf("expected version %d, got %d", want, v)
+		}
+	}
+
+	spec, v, err := lib.Get("rent")
+	if err != nil || v != 3 || spec.Models[0].Requests != 30 {
+		t.Errorf("expected version 3 with 30 requests, got %d, %+v, %v", v, spec, err)
+	}
+	spec, v, err = lib.GetVersion("rent", 1)
+	if err != nil || v != 1 || spec.Models[0].Requests != 10 {
+		t.Errorf("expected version 1 with 10 requests, got %d, %+v, %v", v, spec, err)
+	}
+	if _, _, err := lib.GetVersion("rent", 4); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound for a missing version, got %v", err)
+	}
+
+	versions, err := lib.Versions("rent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	if !reflect.DeepEqual(numbers, []int{1, 2, 3}) {
+		t.Errorf("expected versions 1-3, got %v", numbers)
+	}
+
+	if err := lib.Delete("rent"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := lib.Get("rent"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "rent")); !os.IsNotExist(err) {
+		t.Errorf("expected workload directory to be removed, got %v", err)
+	}
+}
+
+func TestLibraryReadsWhileUpdating(t *testing.T) {
+	lib := NewLibrary(t.TempDir())
+	if err := lib.Create("rent", testSpec(10)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		for v := 2; v <= 50; v++ {
+			if _, err := lib.Update("rent", testSpec(10*v)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	// Every read gets the version number of the file it read.
+	for {
+		spec, v, err := lib.Get("rent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if spec.Models[0].Requests != 10*v {
+			t.Fatalf("expected version %d to have %d requests, got %d", v, 10*v, spec.Models[0].Requests)
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func TestLibraryList(t *testing.T) {
+	dir := t.TempDir()
+	lib := NewLibrary(dir)
+	if err := lib.Create("b", testSpec(1)); err != nil {
+		t.Fatal(err)
+	}
+	// Workloads in the original format and files that can't be read are
+	// listed, other directories aren't.
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "a.json"), []byte(`{"0": {"query": "{\"model\": \"m\"}", "qps": "1"}}`), 0644)
+	os.MkdirAll(filepath.Join(dir, "c"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "c", "c.yaml"), []byte("version: 1\nrun: ["), 0644)
+	os.MkdirAll(filepath.Join(dir, "d"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "d", "d.sql"), []byte("select 1"), 0644)
+
+	entries, err := lib.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+	if e := entries[0]; e.Name != "a" || e.Models != 1 || e.Error != "" {
+		t.Errorf("unexpected entry for a: %+v", e)
+	}
+	if e := entries[1]; e.Name != "b" || e.Version != 1 || e.Metadata.Name != "test" || e.Modified.IsZero() {
+		t.Errorf("unexpected entry for b: %+v", e)
+	}
+	if e := entries[2]; e.Name != "c" || e.Error == "" {
+		t.Errorf("expected an error for c, got %+v", e)
+	}
+
+	// A workload in json stays json when updated.
+	if _, err := lib.Update("a", testSpec(5)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "versions", "a.1.json")); err != nil {
+		t.Errorf("expected the original to be archived: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "a", "a.json")); !isJSON(b) {
+		t.Errorf("expected json, got %s", b)
+	}
+}
+
+func TestLibraryRejectsBadNames(t *testing.T) {
+	lib := NewLibrary(t.TempDir())
+	for _, name := range []string{"", "..", "../x", "a/b", ".hidden"} {
+		if err := lib.Create(name, testSpec(1)); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+		if _, _, err := lib.Get(name); err == nil || err == ErrNotFound {
+			t.Errorf("expected %q to be rejected, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package workload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var nan = math.NaN()
+
+// Problem describes one thing wrong with a workload.
+type Problem struct {
+	// Window is the id of the model (a window in the UI) the problem is
+	// in, empty for problems with the workload as a whole.
+	Window string `json:"window,omitempty"`
+
+	// Field names the offending value, e.g. "requests" or "target.host".
+	Field string `json:"field"`
+
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Window != "" {
+		return fmt.Sprintf("window %s: %s: %s", p.Window, p.Field, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", p.Field, p.Message)
+}
+
+// Problems is an error made of one or more problems.
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	msgs := make([]string, len(ps))
+	for i, p := range ps {
+		msgs[i] = p.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Load reads a workload file. See Parse.
+func Load(path string) (*Spec, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening workload file %s: %v", path, err)
+	}
+	spec, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error reading workload file %s: %v", path, err)
+	}
+	return spec, nil
+}
+
+// Parse decodes a YAML or JSON workload, migrating the original unversioned
+// format to the current version. The returned error is a Problems if the
+// content was decoded but couldn't be migrated. Parse does not validate the
+// workload.
+func Parse(content []byte) (*Spec, error) {
+	raw := make(map[string]interface{})
+	if isJSON(content) {
+		if err := json.Unmarshal(content, &raw); err != nil {
+			return nil, fmt.Errorf("invalid json: %v", err)
+		}
+	} else {
+		var y map[interface{}]interface{}
+		if err := yaml.Unmarshal(content, &y); err != nil {
+			return nil, fmt.Errorf("invalid yaml: %v", err)
+		}
+		raw = normalize(y).(map[string]interface{})
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty workload")
+	}
+
+	if _, ok := raw["version"]; !ok {
+		spec, problems := migrate(raw)
+		if problems != nil {
+			return nil, problems
+		}
+		return spec, nil
+	}
+
+	// Round trip through json so YAML and JSON are decoded by the same
+	// rules.
+	b, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	spec := &Spec{}
+	if err := json.Unmarshal(b, spec); err != nil {
+		return nil, fmt.Errorf("invalid workload: %v", err)
+	}
+	if spec.Version != Version {
+		return nil, fmt.Errorf("unsupported workload version %d, expected %d", spec.Version, Version)
+	}
+	return spec, nil
+}
+
+// Marshal encodes spec as YAML, or as indented JSON if format is "json".
+func Marshal(spec *Spec, format string) ([]byte, error) {
+	if format == "json" {
+		return json.MarshalIndent(spec, "", "    ")
+	}
+	// Encode through json first so inputs are written with json's key
+	// names and numbers.
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	var v yaml.MapSlice
+	if err := yaml.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(v)
+}
+
+// FormatOf returns the format Marshal should use for a file name.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return "json"
+	}
+	return "yaml"
+}
+
+func isJSON(content []byte) bool {
+	trimmed := bytes.TrimSpace(content)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// normalize converts the map[interface{}]interface{} values the yaml
+// package produces into map[string]interface{} so they can be encoded as
+// json.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[fmt.Sprint(k)] = normalize(e)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = normalize(e)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,182 @@
+package workload
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const yamlSpec = `
+version: 1
+metadata:
+    name: nyc-rent
+    tags: [nightly, example]
+target:
+    host: https://ops.example.com
+    user: demo
+    apikey: abc123
+run:
+    workers: 8
+    seed: 42
+    arrival: poisson
+models:
+    - id: "a"
+      model: NycRentViz01
+      requests: 100
+      rate: 2.5
+      input: {Bedrooms: 0, Neighborhood: Chelsea, Nested: {List: [1, "^"]}}
+    - model: Other
+      payloads:
+          - {x: 1}
+          - {x: "@"}
+stages:
+    - {duration: 30s, scale: 0.5}
+    - {duration: 2m}
+    - {duration: 10s, scale: 0}
+thresholds:
+    - {metric: p99, max: 200ms}
+    - {model: a, metric: error_rate, max: 1%}
+`
+
+const jsonSpec = `{
+	"version": 1,
+	"metadata": {"name": "nyc-rent", "tags": ["nightly", "example"]},
+	"target": {"host": "https://ops.example.com", "user": "demo", "apikey": "abc123"},
+	"run": {"workers": 8, "seed": 42, "arrival": "poisson"},
+	"models": [
+		{"id": "a", "model": "NycRentViz01", "requests": 100, "rate": 2.5,
+		 "input": {"Bedrooms": 0, "Neighborhood": "Chelsea", "Nested": {"List": [1, "^"]}}},
+		{"model": "Other", "payloads": [{"x": 1}, {"x": "@"}]}
+	],
+	"stages": [{"duration": "30s", "scale": 0.5}, {"duration": "2m"}, {"duration": "10s", "scale": 0}],
+	"thresholds": [
+		{"metric": "p99", "max": "200ms"},
+		{"model": "a", "metric": "error_rate", "max": "1%"}
+	]
+}`
+
+func TestParseYAMLAndJSONAgree(t *testing.T) {
+	y, err := Parse([]byte(yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := Parse([]byte(jsonSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(y, j) {
+		t.Errorf("yaml and json specs differ\nyaml: %+v\njson: %+v", y, j)
+	}
+
+	if y.Run.Seed != 42 || y.Run.Workers != 8 || y.Target.APIKey != "abc123" {
+		t.Errorf("unexpected run or target: %+v %+v", y.Run, y.Target)
+	}
+	if got := time.Duration(y.Stages[1].Duration); got != 2*time.Minute {
+		t.Errorf("expected 2m stage, got %v", got)
+	}
+	if f0, f1, f2 := y.Stages[0].Factor(), y.Stages[1].Factor(), y.Stages[2].Factor(); f0 != 0.5 || f1 != 1 || f2 != 0 {
+		t.Errorf("expected stage scales 0.5, 1 and 0, got %v, %v and %v", f0, f1, f2)
+	}
+	nested := y.Models[0].Input["Nested"].(map[string]interface{})
+	if !reflect.DeepEqual(nested["List"], []interface{}{1.0, "^"}) {
+		t.Errorf("expected nested yaml input to decode like json, got %#v", nested)
+	}
+	if problems := y.Validate(); problems != nil {
+		t.Errorf("expected a valid spec, got %v", problems)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, content, want string
+	}{
+		{"bad json", `{"version": 1,`, "invalid json"},
+		{"bad yaml", "version: 1\nmodels: [", "invalid yaml"},
+		{"empty", "", "empty workload"},
+		{"future version", "version: 2", "unsupported workload version 2"},
+		{"bad duration", "version: 1\nstages: [{duration: soon}]", `"soon" is not a duration`},
+		{"wrong type", `{"version": 1, "run": {"workers": "many"}}`, "invalid workload"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	spec, err := Parse([]byte(yamlSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []string{"yaml", "json"} {
+		b, err := Marshal(spec, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := Parse(b)
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", format, err, b)
+		}
+		if !reflect.DeepEqual(spec, again) {
+			t.Errorf("%s: round trip changed the spec\n%s", format, b)
+		}
+	}
+	if !strings.HasPrefix(mustMarshal(t, spec, "yaml"), "version: 1\n") {
+		t.Error("expected yaml to keep version first")
+	}
+}
+
+func TestLoadExampleWorkloads(t *testing.T) {
+	files, _ := filepath.Glob("../workloads/*/*.yaml")
+	if len(files) == 0 {
+		t.Fatal("expected example workloads")
+	}
+	for _, f := range files {
+		spec, err := Load(f)
+		if err != nil {
+			t.Errorf("%s: %v", f, err)
+			continue
+		}
+		if problems := spec.Validate(); problems != nil {
+			t.Errorf("%s: %v", f, problems)
+		}
+	}
+}
+
+func TestThresholdBounds(t *testing.T) {
+	tests := []struct {
+		t        Threshold
+		min, max float64
+	}{
+		{Threshold{Metric: MetricP99, Max: "200ms"}, math.NaN(), 0.2},
+		{Threshold{Metric: MetricErrorRate, Max: "1.5%"}, math.NaN(), 0.015},
+		{Threshold{Metric: MetricErrorRate, Max: "0.02"}, math.NaN(), 0.02},
+		{Threshold{Metric: MetricRate, Min: "100", Max: "150"}, 100, 150},
+	}
+	same := func(a, b float64) bool { return a == b || math.IsNaN(a) && math.IsNaN(b) }
+	for _, tt := range tests {
+		min, max, err := tt.t.Bounds()
+		if err != nil {
+			t.Errorf("%+v: %v", tt.t, err)
+		}
+		if !same(min, tt.min) || !same(max, tt.max) {
+			t.Errorf("%+v: expected [%v, %v], got [%v, %v]", tt.t, tt.min, tt.max, min, max)
+		}
+	}
+	if _, _, err := (Threshold{Metric: MetricP50, Max: "fast"}).Bounds(); err == nil {
+		t.Error("expected bad latency to fail")
+	}
+}
+
+func mustMarshal(t *testing.T, spec *Spec, format string) string {
+	b, err := Marshal(spec, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
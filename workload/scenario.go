@@ -0,0 +1,164 @@
+package workload
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// varRef matches a reference to an extracted value in a step's input.
+var varRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// varName is what an extracted value may be called.
+var varName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Path is a JSON path picking a value out of a JSON document, like
+// "$.result.items[0].id". It supports the root "$", member names as ".name"
+// or "['name']" and array indexes as "[n]".
+type Path struct {
+	expr string
+	// elems are the member names, as strings, and indexes, as ints, from
+	// the root down.
+	elems []interface{}
+}
+
+// ParsePath parses a JSON path.
+func ParsePath(expr string) (Path, error) {
+	p := Path{expr: expr}
+	if !strings.HasPrefix(expr, "$") {
+		return p, fmt.Errorf("JSON path %q must start with $", expr)
+	}
+	s := expr[1:]
+	for s != "" {
+		switch {
+		case s[0] == '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			name := s[1 : end+1]
+			if name == "" {
+				return p, fmt.Errorf("JSON path %q has an empty member name", expr)
+			}
+			p.elems = append(p.elems, name)
+			s = s[end+1:]
+		case strings.HasPrefix(s, "['"):
+			end := strings.Index(s, "']")
+			if end < 0 {
+				return p, fmt.Errorf("JSON path %q has an unclosed [", expr)
+			}
+			p.elems = append(p.elems, s[2:end])
+			s = s[end+2:]
+		case s[0] == '[':
+			end := strings.Index(s, "]")
+			if end < 0 {
+				return p, fmt.Errorf("JSON path %q has an unclosed [", expr)
+			}
+			i, err := strconv.Atoi(s[1:end])
+			if err != nil || i < 0 {
+				return p, fmt.Errorf("JSON path %q: %q is not an array index", expr, s[1:end])
+			}
+			p.elems = append(p.elems, i)
+			s = s[end+1:]
+		default:
+			return p, fmt.Errorf("JSON path %q: unexpected %q", expr, s)
+		}
+	}
+	return p, nil
+}
+
+func (p Path) String() string { return p.expr }
+
+// Lookup returns the value at p in doc, a JSON document decoded into
+// interface{}, reporting false if there is none.
+func (p Path) Lookup(doc interface{}) (interface{}, bool) {
+	v := doc
+	for _, e := range p.elems {
+		switch e := e.(type) {
+		case string:
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[e]; !ok {
+				return nil, false
+			}
+		case int:
+			a, ok := v.([]interface{})
+			if !ok || e >= len(a) {
+				return nil, false
+			}
+			v = a[e]
+		}
+	}
+	return v, true
+}
+
+// References returns the names of the extracted values v references, in the
+// order they appear. Maps are walked in sorted key order.
+func References(v interface{}) []string {
+	var names []string
+	switch t := v.(type) {
+	case string:
+		for _, m := range varRef.FindAllStringSubmatch(t, -1) {
+			names = append(names, m[1])
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			names = append(names, References(t[k])...)
+		}
+	case []interface{}:
+		for _, e := range t {
+			names = append(names, References(e)...)
+		}
+	}
+	return names
+}
+
+// Fill returns a copy of v with references to extracted values replaced by
+// the values in vars. A string that is only a reference becomes the value,
+// whatever its type; references within longer strings are replaced by the
+// value's text. References to values not in vars are left as they are.
+func Fill(v interface{}, vars map[string]interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if m := varRef.FindStringSubmatch(t); m != nil && m[0] == t {
+			if value, ok := vars[m[1]]; ok {
+				return value
+			}
+			return t
+		}
+		return varRef.ReplaceAllStringFunc(t, func(ref string) string {
+			value, ok := vars[ref[2:len(ref)-1]]
+			if !ok {
+				return ref
+			}
+			if s, ok := value.(string); ok {
+				return s
+			}
+			b, _ := json.Marshal(value)
+			return string(b)
+		})
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			out[k] = Fill(e, vars)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = Fill(e, vars)
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,63 @@
+package workload
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPath(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"result": {"ids": [42, 7], "first name": "Ann", "nested": [{"x": true}]}}`), &doc)
+	tests := []struct {
+		path  string
+		value interface{}
+		ok    bool
+	}{
+		{"$", doc, true},
+		{"$.result.ids[1]", 7.0, true},
+		{"$.result['first name']", "Ann", true},
+		{"$.result.nested[0].x", true, true},
+		{"$.result.ids[2]", nil, false},
+		{"$.result.missing", nil, false},
+		{"$.result.ids.x", nil, false},
+	}
+	for _, test := range tests {
+		p, err := ParsePath(test.path)
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if v, ok := p.Lookup(doc); ok != test.ok || !reflect.DeepEqual(v, test.value) {
+			t.Errorf("%s: expected %v, %v, got %v, %v", test.path, test.value, test.ok, v, ok)
+		}
+	}
+	for _, path := range []string{"", "result.id", "$.", "$..id", "$[x]", "$[-1]", "$['id'", "$.ids[0"} {
+		if _, err := ParsePath(path); err == nil {
+			t.Errorf("expected %q to be refused", path)
+		}
+	}
+}
+
+func TestFill(t *testing.T) {
+	input := map[string]interface{}{
+		"Id":    "${id}",
+		"Label": "${name}-${id}",
+		"List":  []interface{}{"${tags}", "${missing}"},
+	}
+	if refs := References(input); !reflect.DeepEqual(refs, []string{"id", "name", "id", "tags", "missing"}) {
+		t.Errorf("unexpected references %v", refs)
+	}
+	vars := map[string]interface{}{"id": 42.0, "name": "ann", "tags": []interface{}{"a"}}
+	want := map[string]interface{}{
+		"Id":    42.0,
+		"Label": "ann-42",
+		"List":  []interface{}{[]interface{}{"a"}, "${missing}"},
+	}
+	if got := Fill(input, vars); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if input["Id"] != "${id}" {
+		t.Errorf("expected the input to be left alone")
+	}
+}
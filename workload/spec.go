@@ -0,0 +1,404 @@
+// Package workload defines the workload file format shared by the simulator's
+// UI, API and command line.
+//
+// A workload file is YAML or JSON. Version 1 looks like
+//
+//	version: 1
+//	metadata:
+//	    name: nyc-rent
+//	    description: rent predictions at a steady rate
+//	    tags: [nightly]
+//	target:
+//	    host: https://sandbox.yhathq.com
+//	    user: demo
+//	    apikey: abc123
+//	run:
+//	    workers: 8
+//	    seed: 42
+//	    arrival: poisson
+//	models:
+//	    - id: "0"
+//	      model: NycRentViz01
+//	      requests: 1000
+//	      rate: 10
+//	      input: {Bedrooms: 0, Baths: 1, Sqft: 1990, Neighborhood: Chelsea}
+//	stages:
+//	    - {duration: 30s, scale: 0.5}
+//	    - {duration: 2m, scale: 1}
+//	thresholds:
+//	    - {metric: p99, max: 200ms}
+//	    - {model: NycRentViz01, metric: error_rate, max: 1%}
+//
+// A workload with a search section is run as a capacity search instead,
+// finding the highest rate each model sustains within the thresholds:
+//
+//	search: {step: 10s, start: 10, max: 2000}
+//
+// An adaptive run sizes each model's worker pool to sustain its rate instead
+// of splitting a fixed number of workers between the models. Rate and
+// requests are then each model's totals, and workers is the most requests
+// each model has in flight:
+//
+//	run: {workers: 64, adaptive: true}
+//
+// A model with steps is a scenario: each of its requests calls the steps'
+// models in order, filling values extracted from earlier responses by JSON
+// path into later inputs where strings reference them as "${name}":
+//
+//	models:
+//	    - model: rent-by-address
+//	      rate: 5
+//	      steps:
+//	          - model: Geocoder
+//	            input: {Address: "^"}
+//	            extract: {lat: "$.result.lat", lon: "$.result.lon"}
+//	          - model: NycRentViz01
+//	            input: {Lat: "${lat}", Lon: "${lon}", Bedrooms: 1}
+//
+// A run with users runs each worker as a virtual user, which sends its
+// model's requests, or runs its scenario, in a loop, thinking for a random
+// time between iterations instead of keeping a rate. Users join over
+// ramp_up and leave over the ramp_down before the end of the run's
+// duration:
+//
+//	run:
+//	    workers: 50
+//	    duration: 10m
+//	    users: {think_min: 1s, think_max: 5s, ramp_up: 1m, ramp_down: 1m}
+//
+// A run ends once its workers have sent their requests, or earlier when it
+// reaches one of its limits:
+//
+//	run: {workers: 8, duration: 10m, stop_at: "2015-06-01T18:00:00Z", max_requests: 100000}
+//	models:
+//	    - {model: NycRentViz01, max_requests: 20000}
+//
+// Files without a version are read as the simulator's original format, a map
+// of window ids to {"query": "<json>", "qps": "<requests>"}, optionally
+// wrapped in a saved session's {"settings": ..., "workload": ...}.
+package workload
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Version is the current workload file version.
+const Version = 1
+
+// Spec is a workload file.
+type Spec struct {
+	Version    int         `yaml:"version" json:"version"`
+	Metadata   Metadata    `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	Target     Target      `yaml:"target" json:"target"`
+	Run        Run         `yaml:"run" json:"run"`
+	Models     []Model     `yaml:"models" json:"models"`
+	Stages     []Stage     `yaml:"stages,omitempty" json:"stages,omitempty"`
+	Thresholds []Threshold `yaml:"thresholds,omitempty" json:"thresholds,omitempty"`
+	Search     *Search     `yaml:"search,omitempty" json:"search,omitempty"`
+}
+
+// Metadata describes a workload for people and for finding it later.
+type Metadata struct {
+	Name        string            `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Tags        []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+}
+
+// Target is the ScienceOps instance a workload runs against.
+type Target struct {
+	Host   string `yaml:"host" json:"host"`
+	User   string `yaml:"user" json:"user"`
+	APIKey string `yaml:"apikey,omitempty" json:"apikey,omitempty"`
+}
+
+// Run holds settings for the run as a whole.
+type Run struct {
+	// Number of concurrent workers. Each is assigned one model at random.
+	// In adaptive runs it is the most workers each model grows to.
+	Workers int `yaml:"workers" json:"workers"`
+
+	// Adaptive grows and shrinks each model's workers to sustain its rate.
+	Adaptive bool `yaml:"adaptive,omitempty" json:"adaptive,omitempty"`
+
+	// Duration, if set, stops the run after it has run this long.
+	Duration Duration `yaml:"duration,omitempty" json:"duration,omitempty"`
+
+	// StopAt, if set, is an RFC 3339 time to stop the run at.
+	StopAt string `yaml:"stop_at,omitempty" json:"stop_at,omitempty"`
+
+	// MaxRequests, if set, stops the run once it has sent this many
+	// requests to all of its models together.
+	MaxRequests int `yaml:"max_requests,omitempty" json:"max_requests,omitempty"`
+
+	// Users, if set, runs each worker as a virtual user.
+	Users *Users `yaml:"users,omitempty" json:"users,omitempty"`
+
+	// Seed for all of the run's randomness. Zero picks a new seed.
+	Seed int64 `yaml:"seed,omitempty" json:"seed,omitempty"`
+
+	// Arrival process for paced models, "constant" (default) or "poisson".
+	Arrival string `yaml:"arrival,omitempty" json:"arrival,omitempty"`
+
+	// Maximum value of the UI's dials.
+	DialMax int `yaml:"dial_max,omitempty" json:"dial_max,omitempty"`
+}
+
+// StopTime returns the time to stop the run at, the zero time if it has
+// none.
+func (r Run) StopTime() (time.Time, error) {
+	if r.StopAt == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, r.StopAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time like \"2015-06-01T18:00:00Z\"", r.StopAt)
+	}
+	return t, nil
+}
+
+// Limited reports whether the run is stopped by a duration, time or
+// request limit, so its workers can make unlimited requests.
+func (r Run) Limited() bool {
+	return r.Duration > 0 || r.StopAt != "" || r.MaxRequests > 0
+}
+
+// Model is a model endpoint to send requests to. Each worker assigned to a
+// model sends it Requests requests.
+type Model struct {
+	// ID identifies the model within the workload. Defaults to its index.
+	ID string `yaml:"id,omitempty" json:"id,omitempty"`
+
+	// Name of the model on the Ops server, or of the scenario if it has
+	// steps.
+	Model string `yaml:"model" json:"model"`
+
+	// Requests each worker makes, or the model does in adaptive runs. Zero
+	// is unlimited, which requires stages to end the run.
+	Requests int `yaml:"requests,omitempty" json:"requests,omitempty"`
+
+	// Rate in requests per second for each worker, or of the model in
+	// adaptive runs. Zero sends requests back to back.
+	Rate float64 `yaml:"rate,omitempty" json:"rate,omitempty"`
+
+	// MaxRequests, if set, stops the model's workers once they have sent
+	// this many requests together.
+	MaxRequests int `yaml:"max_requests,omitempty" json:"max_requests,omitempty"`
+
+	// Input sent with every request. String values "@" and "^" are
+	// replaced with a random integer and string on each request.
+	Input map[string]interface{} `yaml:"input,omitempty" json:"input,omitempty"`
+
+	// Payloads, if set, are inputs chosen from at random for each request
+	// instead of Input.
+	Payloads []map[string]interface{} `yaml:"payloads,omitempty" json:"payloads,omitempty"`
+
+	// Steps, if set, make the model a scenario whose every request sends
+	// each step's request in turn. Its latency is end to end.
+	Steps []Step `yaml:"steps,omitempty" json:"steps,omitempty"`
+}
+
+// Step is a request of a scenario.
+type Step struct {
+	// Name of the model on the Ops server.
+	Model string `yaml:"model" json:"model"`
+
+	// Input sent with the step's request. Besides the "@" and "^"
+	// placeholders, strings may reference values extracted by earlier
+	// steps as "${name}".
+	Input map[string]interface{} `yaml:"input,omitempty" json:"input,omitempty"`
+
+	// Extract names values of the step's response by their JSON paths,
+	// like {id: "$.result.ids[0]"}, for later steps to reference.
+	Extract map[string]string `yaml:"extract,omitempty" json:"extract,omitempty"`
+}
+
+// Users paces the workers of a run as virtual users. Each user sends its
+// model's requests one after another, thinking between each response and
+// its next request.
+type Users struct {
+	// ThinkMin and ThinkMax bound the time a user thinks, drawn uniformly
+	// between them. ThinkMax defaults to ThinkMin.
+	ThinkMin Duration `yaml:"think_min,omitempty" json:"think_min,omitempty"`
+	ThinkMax Duration `yaml:"think_max,omitempty" json:"think_max,omitempty"`
+
+	// RampUp is how long the users take to join, one after another at
+	// even intervals from the start of the run.
+	RampUp Duration `yaml:"ramp_up,omitempty" json:"ramp_up,omitempty"`
+
+	// RampDown is how long before the end of the run's duration the users
+	// start to leave, one after another at even intervals, the last to
+	// join first.
+	RampDown Duration `yaml:"ramp_down,omitempty" json:"ramp_down,omitempty"`
+}
+
+// Think returns the bounds of a user's think time.
+func (u *Users) Think() (min, max time.Duration) {
+	min, max = time.Duration(u.ThinkMin), time.Duration(u.ThinkMax)
+	if max == 0 {
+		max = min
+	}
+	return min, max
+}
+
+// Stage is a period of the run. Stages run in order and the run ends after
+// the last one.
+type Stage struct {
+	Duration Duration `yaml:"duration" json:"duration"`
+
+	// Scale multiplies every paced model's rate during the stage.
+	// Defaults to 1 when unset; 0 idles the paced models.
+	Scale *float64 `yaml:"scale,omitempty" json:"scale,omitempty"`
+}
+
+// Factor returns the stage's scale, 1 if it is unset.
+func (s Stage) Factor() float64 {
+	if s.Scale == nil {
+		return 1
+	}
+	return *s.Scale
+}
+
+// Threshold is a pass/fail limit on a metric of the run.
+type Threshold struct {
+	// Model the threshold applies to, empty for every model.
+	Model string `yaml:"model,omitempty" json:"model,omitempty"`
+
+	// One of the latency metrics "mean", "p50", "p90", "p95", "p99" and
+	// "max", or "error_rate" or "rate".
+	Metric string `yaml:"metric" json:"metric"`
+
+	// Limits on the metric. Latencies are durations like "200ms", error
+	// rates a fraction or a percentage like "1%" and rates requests per
+	// second.
+	Min string `yaml:"min,omitempty" json:"min,omitempty"`
+	Max string `yaml:"max,omitempty" json:"max,omitempty"`
+}
+
+// Search configures a capacity search. Each model is searched on its own,
+// in steps at a fixed total rate for the model shared by the run's workers.
+// The rate is multiplied by Factor after every step that sustains it and
+// the thresholds, until one doesn't, then bisected until it is known to
+// within Precision.
+type Search struct {
+	// Step is how long each step runs. Defaults to 10s.
+	Step Duration `yaml:"step,omitempty" json:"step,omitempty"`
+
+	// Start is the rate of the first step in requests per second.
+	// Defaults to the model's rate for every worker, or 1.
+	Start float64 `yaml:"start,omitempty" json:"start,omitempty"`
+
+	// Max is the highest rate tried, unlimited if zero.
+	Max float64 `yaml:"max,omitempty" json:"max,omitempty"`
+
+	// Factor the rate grows by until a step fails. Defaults to 2.
+	Factor float64 `yaml:"factor,omitempty" json:"factor,omitempty"`
+
+	// Precision the search stops at, as a fraction of the rate. Defaults
+	// to 0.05.
+	Precision float64 `yaml:"precision,omitempty" json:"precision,omitempty"`
+
+	// MaxSteps is the most steps run for each model. Defaults to 20.
+	MaxSteps int `yaml:"max_steps,omitempty" json:"max_steps,omitempty"`
+}
+
+// Threshold metrics.
+const (
+	MetricMean      = "mean"
+	MetricP50       = "p50"
+	MetricP90       = "p90"
+	MetricP95       = "p95"
+	MetricP99       = "p99"
+	MetricMax       = "max"
+	MetricErrorRate = "error_rate"
+	MetricRate      = "rate"
+)
+
+// IsLatency reports whether the threshold's metric is a latency.
+func (t Threshold) IsLatency() bool {
+	switch t.Metric {
+	case MetricMean, MetricP50, MetricP90, MetricP95, MetricP99, MetricMax:
+		return true
+	}
+	return false
+}
+
+// Bounds returns the threshold's limits in seconds for latencies, as a
+// fraction for error rates and in requests per second for rates. A limit
+// that isn't set is returned as NaN.
+func (t Threshold) Bounds() (min, max float64, err error) {
+	if min, err = t.parse(t.Min); err != nil {
+		return 0, 0, fmt.Errorf("min: %v", err)
+	}
+	if max, err = t.parse(t.Max); err != nil {
+		return 0, 0, fmt.Errorf("max: %v", err)
+	}
+	return min, max, nil
+}
+
+func (t Threshold) parse(s string) (float64, error) {
+	if s == "" {
+		return nan, nil
+	}
+	if t.IsLatency() {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration", s)
+		}
+		return d.Seconds(), nil
+	}
+	if t.Metric == MetricErrorRate && s[len(s)-1] == '%' {
+		f, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a percentage", s)
+		}
+		return f / 100, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return f, nil
+}
+
+// Duration is a time.Duration written as a string like "30s" in YAML and
+// JSON.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	return d.set(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\"")
+	}
+	return d.set(s)
+}
+
+func (d *Duration) set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("%q is not a duration", s)
+	}
+	*d = Duration(v)
+	return nil
+}
@@ -0,0 +1,222 @@
+package workload
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// Arrival processes for paced models.
+const (
+	ArrivalConstant = "constant"
+	ArrivalPoisson  = "poisson"
+)
+
+// Validate checks spec for values that can't be run and returns every
+// problem found, or nil.
+func (spec *Spec) Validate() Problems {
+	var problems Problems
+	add := func(window, field, format string, args ...interface{}) {
+		problems = append(problems, Problem{window, field, fmt.Sprintf(format, args...)})
+	}
+
+	if spec.Target.Host == "" {
+		add("", "target.host", "Ops host is required")
+	} else if u, err := url.Parse(spec.Target.Host); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("", "target.host", "%q is not an http(s) url", spec.Target.Host)
+	}
+	if spec.Target.User == "" {
+		add("", "target.user", "Ops user is required")
+	}
+
+	if spec.Run.Workers <= 0 {
+		add("", "run.workers", "must be greater than 0, got %d", spec.Run.Workers)
+	}
+	switch spec.Run.Arrival {
+	case "", ArrivalConstant, ArrivalPoisson:
+	default:
+		add("", "run.arrival", "unknown arrival process %q", spec.Run.Arrival)
+	}
+
+	if spec.Run.Duration < 0 {
+		add("", "run.duration", "can't be negative, got %v", spec.Run.Duration)
+	}
+	if _, err := spec.Run.StopTime(); err != nil {
+		add("", "run.stop_at", "%v", err)
+	}
+	if spec.Run.MaxRequests < 0 {
+		add("", "run.max_requests", "can't be negative, got %d", spec.Run.MaxRequests)
+	}
+
+	if u := spec.Run.Users; u != nil {
+		for _, d := range []struct {
+			field string
+			d     Duration
+		}{{"think_min", u.ThinkMin}, {"think_max", u.ThinkMax}, {"ramp_up", u.RampUp}, {"ramp_down", u.RampDown}} {
+			if d.d < 0 {
+				add("", "run.users."+d.field, "can't be negative, got %v", d.d)
+			}
+		}
+		if u.ThinkMax != 0 && u.ThinkMax < u.ThinkMin {
+			add("", "run.users.think_max", "must be at least think_min %v, got %v", u.ThinkMin, u.ThinkMax)
+		}
+		if u.RampDown > 0 && spec.Run.Duration == 0 {
+			add("", "run.users.ramp_down", "needs the run's duration to end by")
+		} else if spec.Run.Duration > 0 && u.RampUp+u.RampDown > spec.Run.Duration {
+			add("", "run.users", "ramp_up and ramp_down take longer than the run's duration %v", spec.Run.Duration)
+		}
+		if spec.Run.Adaptive {
+			add("", "run.users", "virtual users can't be adaptive, remove one")
+		}
+		if len(spec.Stages) > 0 {
+			add("", "stages", "virtual users are paced by their think time, remove the stages")
+		}
+		if spec.Search != nil {
+			add("", "search", "a search runs at fixed rates, remove the users")
+		}
+	}
+
+	if len(spec.Models) == 0 {
+		add("", "models", "no work to be done")
+	}
+	ids := make(map[string]bool)
+	names := make(map[string]bool)
+	for i, m := range spec.Models {
+		id := spec.ModelID(i)
+		if ids[id] {
+			add(id, "id", "duplicate model id")
+		}
+		ids[id] = true
+		names[m.Model] = true
+
+		if m.Model == "" {
+			add(id, "model", "model name is required")
+		}
+		if len(spec.Stages) == 0 && spec.Search == nil && !spec.Run.Limited() && m.MaxRequests == 0 && m.Requests <= 0 {
+			add(id, "requests", "must be greater than 0 when there are no stages or limits, got %d", m.Requests)
+		} else if m.Requests < 0 {
+			add(id, "requests", "can't be negative, got %d", m.Requests)
+		}
+		if m.Rate < 0 || math.IsNaN(m.Rate) {
+			add(id, "rate", "can't be negative, got %v", m.Rate)
+		} else if spec.Run.Adaptive && spec.Search == nil && m.Rate == 0 {
+			add(id, "rate", "adaptive runs need a rate to sustain")
+		} else if spec.Run.Users != nil && m.Rate > 0 {
+			add(id, "rate", "virtual users are paced by their think time, remove the rate")
+		}
+		if m.MaxRequests < 0 {
+			add(id, "max_requests", "can't be negative, got %d", m.MaxRequests)
+		}
+		if m.Input != nil && len(m.Payloads) > 0 {
+			add(id, "payloads", "set either input or payloads, not both")
+		}
+		if len(m.Steps) > 0 && (m.Input != nil || len(m.Payloads) > 0) {
+			add(id, "steps", "a scenario's steps have their own inputs, remove the model's input and payloads")
+		}
+		// Steps may only reference values extracted by the steps before.
+		extracted := make(map[string]bool)
+		for j, st := range m.Steps {
+			field := "steps[" + strconv.Itoa(j) + "]"
+			if st.Model == "" {
+				add(id, field+".model", "model name is required")
+			}
+			for _, name := range References(st.Input) {
+				if !extracted[name] {
+					add(id, field+".input", "references ${%s} before a step extracts it", name)
+				}
+			}
+			for _, name := range sortedNames(st.Extract) {
+				if !varName.MatchString(name) {
+					add(id, field+".extract", "%q is not a name like lat or user_id", name)
+				}
+				if _, err := ParsePath(st.Extract[name]); err != nil {
+					add(id, field+".extract."+name, "%v", err)
+				}
+				extracted[name] = true
+			}
+		}
+	}
+
+	for i, s := range spec.Stages {
+		field := "stages[" + strconv.Itoa(i) + "]"
+		if s.Duration <= 0 {
+			add("", field+".duration", "must be greater than 0")
+		}
+		if s.Factor() < 0 {
+			add("", field+".scale", "can't be negative, got %v", s.Factor())
+		}
+	}
+
+	for i, t := range spec.Thresholds {
+		field := "thresholds[" + strconv.Itoa(i) + "]"
+		switch t.Metric {
+		case MetricMean, MetricP50, MetricP90, MetricP95, MetricP99, MetricMax, MetricErrorRate, MetricRate:
+		default:
+			add("", field+".metric", "unknown metric %q", t.Metric)
+			continue
+		}
+		if t.Model != "" && !ids[t.Model] && !names[t.Model] {
+			add("", field+".model", "no model with id or name %q", t.Model)
+		}
+		if t.Min == "" && t.Max == "" {
+			add("", field, "set min, max or both")
+		}
+		if _, _, err := t.Bounds(); err != nil {
+			add("", field, "%v", err)
+		}
+	}
+
+	if s := spec.Search; s != nil {
+		if s.Step < 0 {
+			add("", "search.step", "can't be negative, got %v", s.Step)
+		}
+		if s.Start < 0 || math.IsNaN(s.Start) {
+			add("", "search.start", "can't be negative, got %v", s.Start)
+		}
+		if s.Max < 0 || math.IsNaN(s.Max) {
+			add("", "search.max", "can't be negative, got %v", s.Max)
+		} else if s.Max > 0 && s.Start > s.Max {
+			add("", "search.max", "must be at least the start rate %v, got %v", s.Start, s.Max)
+		}
+		if s.Factor != 0 && !(s.Factor > 1) {
+			add("", "search.factor", "must be greater than 1, got %v", s.Factor)
+		}
+		if s.Precision != 0 && !(s.Precision > 0 && s.Precision < 1) {
+			add("", "search.precision", "must be between 0 and 1, got %v", s.Precision)
+		}
+		if s.MaxSteps < 0 {
+			add("", "search.max_steps", "can't be negative, got %d", s.MaxSteps)
+		}
+		if len(spec.Stages) > 0 {
+			add("", "stages", "a search runs its own steps, remove the stages")
+		}
+		limited := spec.Run.Limited()
+		for _, m := range spec.Models {
+			limited = limited || m.MaxRequests > 0
+		}
+		if limited {
+			add("", "run", "a search runs its own steps, remove the limits")
+		}
+	}
+
+	return problems
+}
+
+// ModelID returns the id of the i'th model, its index if it has none.
+func (spec *Spec) ModelID(i int) string {
+	if id := spec.Models[i].ID; id != "" {
+		return id
+	}
+	return strconv.Itoa(i)
+}
+
+func sortedNames(m map[string]string) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,129 @@
+package workload
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func jsonString(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Spec {
+		return &Spec{
+			Version: Version,
+			Target:  Target{Host: "http://ops", User: "demo"},
+			Run:     Run{Workers: 2},
+			Models:  []Model{{Model: "m1", Requests: 10}},
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(s *Spec)
+		want   [][2]string
+	}{
+		{"valid", func(s *Spec) {}, nil},
+		{"target", func(s *Spec) { s.Target = Target{Host: "ops:80"} }, [][2]string{{"", "target.host"}, {"", "target.user"}}},
+		{"run", func(s *Spec) { s.Run = Run{Workers: -1, Arrival: "burst"} }, [][2]string{{"", "run.workers"}, {"", "run.arrival"}}},
+		{"no models", func(s *Spec) { s.Models = nil }, [][2]string{{"", "models"}}},
+		{"models", func(s *Spec) {
+			s.Models = []Model{
+				{ID: "x", Requests: -1, Rate: -2},
+				{ID: "x", Model: "m", Requests: 1, Input: map[string]interface{}{}, Payloads: []map[string]interface{}{{}}},
+				{Model: "m"},
+			}
+		}, [][2]string{{"x", "model"}, {"x", "requests"}, {"x", "rate"}, {"x", "id"}, {"x", "payloads"}, {"2", "requests"}}},
+		{"unlimited requests with stages", func(s *Spec) {
+			s.Models[0].Requests = 0
+			s.Stages = []Stage{{Duration: Duration(1)}}
+		}, nil},
+		{"stages", func(s *Spec) {
+			scale := -1.0
+			s.Stages = []Stage{{Scale: &scale}}
+		}, [][2]string{{"", "stages[0].duration"}, {"", "stages[0].scale"}}},
+		{"unlimited requests with search", func(s *Spec) {
+			s.Models[0].Requests = 0
+			s.Search = &Search{Step: Duration(1), Start: 10, Max: 100}
+		}, nil},
+		{"search", func(s *Spec) {
+			s.Search = &Search{Step: -1, Start: 10, Max: 5, Factor: 1, Precision: 2, MaxSteps: -1}
+			s.Stages = []Stage{{Duration: Duration(1)}}
+		}, [][2]string{{"", "search.step"}, {"", "search.max"}, {"", "search.factor"}, {"", "search.precision"}, {"", "search.max_steps"}, {"", "stages"}}},
+		{"adaptive", func(s *Spec) {
+			s.Run.Adaptive = true
+			s.Models = append(s.Models, Model{Model: "m2", Requests: 10, Rate: 5})
+		}, [][2]string{{"0", "rate"}}},
+		{"adaptive search", func(s *Spec) {
+			s.Run.Adaptive = true
+			s.Search = &Search{}
+		}, nil},
+		{"unlimited requests with limits", func(s *Spec) {
+			s.Models[0].Requests = 0
+			s.Run.Duration = Duration(time.Minute)
+		}, nil},
+		{"unlimited requests with model limits", func(s *Spec) {
+			s.Models = []Model{{Model: "m1", MaxRequests: 10}, {Model: "m2"}}
+		}, [][2]string{{"1", "requests"}}},
+		{"limits", func(s *Spec) {
+			s.Run.Duration = -1
+			s.Run.StopAt = "6pm"
+			s.Run.MaxRequests = -1
+			s.Models[0].MaxRequests = -1
+		}, [][2]string{{"", "run.duration"}, {"", "run.stop_at"}, {"", "run.max_requests"}, {"0", "max_requests"}}},
+		{"limits with search", func(s *Spec) {
+			s.Run.StopAt = "2015-06-01T18:00:00Z"
+			s.Search = &Search{}
+		}, [][2]string{{"", "run"}}},
+		{"scenario", func(s *Spec) {
+			s.Models[0].Steps = []Step{
+				{Model: "lookup", Extract: map[string]string{"id": "$.result.id"}},
+				{Model: "score", Input: map[string]interface{}{"Id": "${id}"}},
+			}
+		}, nil},
+		{"scenario steps", func(s *Spec) {
+			s.Models[0].Input = map[string]interface{}{}
+			s.Models[0].Steps = []Step{
+				{Input: map[string]interface{}{"Id": "${id}"}, Extract: map[string]string{"id": "result.id", "bad-name": "$"}},
+				{Model: "score", Input: map[string]interface{}{"Id": "${id}", "Next": "${later}"}, Extract: map[string]string{"later": "$"}},
+			}
+		}, [][2]string{{"0", "steps"}, {"0", "steps[0].model"}, {"0", "steps[0].input"}, {"0", "steps[0].extract"}, {"0", "steps[0].extract.id"}, {"0", "steps[1].input"}}},
+		{"users", func(s *Spec) {
+			s.Run.Duration = Duration(time.Minute)
+			s.Run.Users = &Users{ThinkMin: Duration(time.Second), RampUp: Duration(10 * time.Second), RampDown: Duration(10 * time.Second)}
+		}, nil},
+		{"users settings", func(s *Spec) {
+			s.Run.Users = &Users{ThinkMin: Duration(time.Second), ThinkMax: Duration(time.Millisecond), RampUp: -1, RampDown: Duration(time.Second)}
+			s.Run.Adaptive = true
+			s.Models[0].Rate = 5
+		}, [][2]string{{"", "run.users.ramp_up"}, {"", "run.users.think_max"}, {"", "run.users.ramp_down"}, {"", "run.users"}, {"0", "rate"}}},
+		{"users ramps", func(s *Spec) {
+			s.Run.Duration = Duration(time.Minute)
+			s.Run.Users = &Users{RampUp: Duration(time.Minute), RampDown: Duration(time.Second)}
+			s.Stages = []Stage{{Duration: Duration(1)}}
+		}, [][2]string{{"", "run.users"}, {"", "stages"}}},
+		{"thresholds", func(s *Spec) {
+			s.Thresholds = []Threshold{
+				{Metric: "p42", Max: "1s"},
+				{Metric: MetricP99},
+				{Model: "nope", Metric: MetricRate, Min: "lots"},
+				{Model: "m1", Metric: MetricErrorRate, Max: "1%"},
+				{Model: "0", Metric: MetricMean, Max: "5ms"},
+			}
+		}, [][2]string{{"", "thresholds[0].metric"}, {"", "thresholds[1]"}, {"", "thresholds[2].model"}, {"", "thresholds[2]"}}},
+	}
+	for _, tt := range tests {
+		s := valid()
+		tt.modify(s)
+		var got [][2]string
+		for _, p := range s.Validate() {
+			got = append(got, [2]string{p.Window, p.Field})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, s.Validate())
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/yhat/workload-simulator/workload"
+)
+
+// migrate rewrites a workload file in the current version of the format.
+func migrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	out := fs.String("o", "", "file to write the migrated workload to, stdout if empty")
+	format := fs.String("format", "", "yaml or json, defaults to the output file's extension or yaml")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: workload-simulator migrate [-o file] [-format yaml|json] workload-file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	spec, err := workload.Load(fs.Arg(0))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if *format == "" {
+		*format = workload.FormatOf(*out)
+	}
+	b, err := workload.Marshal(spec, *format)
+	if err != nil {
+		log.Printf("error encoding workload: %v", err)
+		os.Exit(1)
+	}
+	if *out == "" {
+		os.Stdout.Write(b)
+		return
+	}
+	if err := ioutil.WriteFile(*out, b, 0644); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
+
+// validate checks workload files and lists their problems.
+func validate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: workload-simulator validate workload-file...")
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ok := true
+	for _, path := range fs.Args() {
+		spec, err := workload.Load(path)
+		if err == nil {
+			if problems := spec.Validate(); problems != nil {
+				err = problems
+			}
+		}
+		if problems, isProblems := err.(workload.Problems); isProblems {
+			ok = false
+			for _, p := range problems {
+				fmt.Printf("%s: %s\n", path, p)
+			}
+			continue
+		}
+		if err != nil {
+			ok = false
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("%s: ok\n", path)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}